@@ -0,0 +1,103 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/Cloud-Foundations/golib/pkg/auth/authinfo/x509util"
+	"github.com/Cloud-Foundations/golib/pkg/awsutil/presignauth/caller"
+	"github.com/Cloud-Foundations/golib/pkg/constants"
+	"github.com/Cloud-Foundations/golib/pkg/crypto/certmanager/http_proxy"
+	"github.com/Cloud-Foundations/golib/pkg/log"
+)
+
+type authenticator struct {
+	caller         caller.Caller
+	hmacKeys       map[string][]byte // Key: key ID.
+	permittedNames http_proxy.PermittedNames
+}
+
+// identity contains the principals of an authenticated caller. The first
+// principal identifies the caller.
+type identity struct {
+	principals []string
+}
+
+func newAuthenticator(permittedNamesFilename, hmacKeysFilename string,
+	logger log.DebugLogger) (*authenticator, error) {
+	permittedNames, err := http_proxy.ReadPermittedNamesFile(
+		permittedNamesFilename)
+	if err != nil {
+		return nil, err
+	}
+	a := &authenticator{
+		hmacKeys:       make(map[string][]byte),
+		permittedNames: permittedNames,
+	}
+	if hmacKeysFilename != "" {
+		keys, err := http_proxy.ReadHmacKeyFile(hmacKeysFilename)
+		if err != nil {
+			return nil, err
+		}
+		for _, key := range keys {
+			a.hmacKeys[key.Id] = key.Key
+		}
+	}
+	a.caller, err = caller.New(caller.Params{Logger: logger})
+	if err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+// authenticate will authenticate the caller using a verified client
+// certificate, a HMAC signature or a presigned AWS STS URL, in that order. If
+// no credentials are provided, nil is returned.
+func (a *authenticator) authenticate(req *http.Request,
+	body []byte) (*identity, error) {
+	if req.TLS != nil && len(req.TLS.VerifiedChains) > 0 {
+		authInfo, err := x509util.GetAuthInfo(req.TLS.VerifiedChains[0][0])
+		if err != nil {
+			return nil, err
+		}
+		if authInfo.AwsRole != nil {
+			return &identity{[]string{authInfo.AwsRole.ARN}}, nil
+		}
+		id := &identity{[]string{"user:" + authInfo.Username}}
+		for _, group := range authInfo.Groups {
+			id.principals = append(id.principals, "group:"+group)
+		}
+		return id, nil
+	}
+	if req.Header.Get("Authorization") != "" {
+		keyId, err := http_proxy.VerifyHmac(req, body, a.hmacKeys)
+		if err != nil {
+			return nil, err
+		}
+		return &identity{[]string{"hmac:" + keyId}}, nil
+	}
+	if url := req.Header.Get(constants.AcmeProxyPresignedUrlHeader); url != "" {
+		callerArn, err := a.caller.GetCallerIdentity(req.Context(),
+			req.Header.Get(constants.AcmeProxyPresignedMethodHeader), url)
+		if err != nil {
+			return nil, err
+		}
+		return &identity{[]string{callerArn.String()}}, nil
+	}
+	return nil, nil
+}
+
+// authorise will check if the caller is permitted to record responses for all
+// the names.
+func (a *authenticator) authorise(id *identity, names []string) error {
+	for _, name := range names {
+		if !a.permittedNames.IsPermitted(id.principals, name) {
+			return fmt.Errorf("%s not permitted for: %s", id, name)
+		}
+	}
+	return nil
+}
+
+func (id *identity) String() string {
+	return id.principals[0]
+}
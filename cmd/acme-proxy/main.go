@@ -2,19 +2,24 @@ package main
 
 import (
 	"bufio"
+	"crypto/tls"
+	"crypto/x509"
 	"flag"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"net"
 	"net/http"
 	"os"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/Cloud-Foundations/Dominator/lib/flags/loadflags"
 	"github.com/Cloud-Foundations/Dominator/lib/html"
 	"github.com/Cloud-Foundations/Dominator/lib/log/serverlogger"
 	"github.com/Cloud-Foundations/golib/pkg/constants"
+	cm_http "github.com/Cloud-Foundations/golib/pkg/crypto/certmanager/http"
 	"github.com/Cloud-Foundations/golib/pkg/log"
 	"github.com/Cloud-Foundations/tricorder/go/tricorder"
 )
@@ -24,14 +29,44 @@ var (
 		"Port number to allocate and listen on for ACME http-01 challenges")
 	adminPortNum = flag.Uint("adminPortNum", constants.AcmeProxyPortNumber,
 		"admin/dashboard port number to listen on")
+	allowUnauthenticated = flag.Bool("allowUnauthenticated", false,
+		"If true, accept unauthenticated responses (matched by source IP)")
+	clientCAFile = flag.String("clientCAFile", "",
+		"Optional file containing CA certificates to verify client certs (enables mutual TLS)")
 	fallbackPortNum = flag.Uint("fallbackPortNum", 0,
 		"Backend port number to connect to if port 80 yields 404: Not Found")
+	hmacKeysFile = flag.String("hmacKeysFile", "",
+		"Optional file containing shared HMAC keys for authentication")
+	permittedNamesFile = flag.String("permittedNamesFile", "",
+		"file containing the names each principal may record responses for")
+	responseTTL = flag.Duration("responseTTL", time.Hour,
+		"time after which recorded responses expire")
+	s3Bucket = flag.String("s3Bucket", "",
+		"Optional AWS S3 (or S3-compatible) bucket to share responses via")
+	s3Endpoint = flag.String("s3Endpoint", "",
+		"Optional endpoint URL for S3-compatible object storage")
+	s3Prefix = flag.String("s3Prefix", "",
+		"Optional prefix for object keys in s3Bucket")
+	s3Region = flag.String("s3Region", "",
+		"Optional region of s3Bucket (default: region of the instance)")
+	storageDirectory = flag.String("storageDirectory", "",
+		"Optional (shared) directory to persist responses to")
+	tlsCertFile = flag.String("tlsCertFile", "",
+		"Optional certificate file for HTTPS on the admin port")
+	tlsKeyFile = flag.String("tlsKeyFile", "",
+		"Optional key file for HTTPS on the admin port")
 )
 
 type acmeProxy struct {
-	logger  htmlWriterLogger
-	rwMutex sync.RWMutex              // Protect everything below.
-	ipMap   map[string]*responsesType // Key: IP.
+	authenticator   *authenticator
+	logger          htmlWriterLogger
+	store           cm_http.ChallengeStorer
+	rwMutex         sync.RWMutex // Protect everything below.
+	numStoreReads   uint         // Since readWindowStart.
+	readWindowStart time.Time
+	recording       map[string]string          // Key: path, value: owner.
+	responses       map[string]*responseType   // Key: path.
+	storeCache      map[string]storeCacheEntry // Key: path.
 }
 
 type htmlWriterLogger interface {
@@ -39,8 +74,35 @@ type htmlWriterLogger interface {
 	log.DebugLogger
 }
 
-type responsesType struct {
-	pathMap map[string][]byte // Key: path.
+// makeTlsConfig returns the TLS configuration for the admin port. If a client
+// CA file is specified, client certificates are verified if given, so that the
+// status page remains available. Otherwise client certificates are not
+// requested. If no certificate is specified, nil is returned.
+func makeTlsConfig() (*tls.Config, error) {
+	if *tlsCertFile == "" {
+		return nil, nil
+	}
+	cert, err := tls.LoadX509KeyPair(*tlsCertFile, *tlsKeyFile)
+	if err != nil {
+		return nil, err
+	}
+	tlsConfig := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		ClientAuth:   tls.NoClientCert,
+		MinVersion:   tls.VersionTLS12,
+	}
+	if *clientCAFile != "" {
+		pemData, err := ioutil.ReadFile(*clientCAFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.ClientCAs = x509.NewCertPool()
+		if !tlsConfig.ClientCAs.AppendCertsFromPEM(pemData) {
+			return nil, fmt.Errorf("no CA certificates in: %s", *clientCAFile)
+		}
+		tlsConfig.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+	return tlsConfig, nil
 }
 
 func printUsage() {
@@ -77,10 +139,17 @@ func (proxy *acmeProxy) setupAdmin() error {
 	if *adminPortNum < 1 {
 		return nil
 	}
+	tlsConfig, err := makeTlsConfig()
+	if err != nil {
+		return err
+	}
 	listener, err := net.Listen("tcp", fmt.Sprintf(":%d", *adminPortNum))
 	if err != nil {
 		return err
 	}
+	if tlsConfig != nil {
+		listener = tls.NewListener(listener, tlsConfig)
+	}
 	html.HandleFunc("/", proxy.statusHandler)
 	if err := proxy.setupPublisher(); err != nil {
 		return err
@@ -157,6 +226,9 @@ func (proxy *acmeProxy) statusHandler(w http.ResponseWriter,
 	proxy.logger.WriteHtml(writer)
 	fmt.Fprintln(writer, "</h3>")
 	fmt.Fprintln(writer, "<hr>")
+	fmt.Fprintln(writer, "<h3>Responses recorded by this instance</h3>")
+	proxy.writeResponses(writer)
+	fmt.Fprintln(writer, "<hr>")
 	html.WriteFooter(writer)
 	fmt.Fprintln(writer, "</body>")
 }
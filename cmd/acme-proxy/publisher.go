@@ -1,9 +1,12 @@
 package main
 
 import (
+	"io"
 	"io/ioutil"
 	"net"
 	"net/http"
+	"strings"
+	"time"
 
 	"github.com/Cloud-Foundations/Dominator/lib/html"
 	"github.com/Cloud-Foundations/golib/pkg/constants"
@@ -15,65 +18,221 @@ const (
 )
 
 func (proxy *acmeProxy) setupPublisher() error {
-	proxy.ipMap = make(map[string]*responsesType)
+	proxy.recording = make(map[string]string)
+	proxy.responses = make(map[string]*responseType)
+	proxy.storeCache = make(map[string]storeCacheEntry)
+	if *permittedNamesFile != "" {
+		authenticator, err := newAuthenticator(*permittedNamesFile,
+			*hmacKeysFile, proxy.logger)
+		if err != nil {
+			return err
+		}
+		proxy.authenticator = authenticator
+	} else if !*allowUnauthenticated {
+		proxy.logger.Println(
+			"no permittedNamesFile: recording responses is disabled")
+	}
+	store, err := makeStore(proxy.logger)
+	if err != nil {
+		return err
+	}
+	proxy.store = store
+	go proxy.gcLoop()
 	html.HandleFunc(constants.AcmeProxyCleanupResponses, proxy.cleanupHandler)
 	html.HandleFunc(constants.AcmeProxyRecordResponse, proxy.recordHandler)
 	return nil
 }
 
+// authenticate will authenticate the request. If the request is not
+// authenticated (and this is allowed), nil is returned. If the request is
+// rejected, an error response is written and false is returned.
+func (proxy *acmeProxy) authenticate(w http.ResponseWriter, req *http.Request,
+	body []byte) (*identity, bool) {
+	var id *identity
+	if proxy.authenticator != nil {
+		var err error
+		id, err = proxy.authenticator.authenticate(req, body)
+		if err != nil {
+			http.Error(w, "Authentication failed", http.StatusUnauthorized)
+			proxy.logger.Printf("%s: authentication failed: %s\n",
+				req.RemoteAddr, err)
+			return nil, false
+		}
+	}
+	if id == nil && !*allowUnauthenticated {
+		http.Error(w, "Authentication required", http.StatusUnauthorized)
+		return nil, false
+	}
+	return id, true
+}
+
 func (proxy *acmeProxy) getResponse(hostPort, path string) []byte {
 	host, _, err := net.SplitHostPort(hostPort)
 	if err != nil {
 		host = hostPort
 	}
+	response := proxy.lookupResponse(path)
+	if response == nil {
+		return nil
+	}
+	if len(response.Names) > 0 {
+		if response.matchesName(host) {
+			return response.Data
+		}
+		return nil
+	}
+	// Recorded without authentication: match the IP address of the server
+	// which recorded the response.
 	ips, err := net.LookupHost(host)
 	if err != nil {
 		proxy.logger.Println(err)
 		return nil
 	}
-	proxy.rwMutex.RLock()
-	defer proxy.rwMutex.RUnlock()
 	for _, ip := range ips {
-		if responses := proxy.ipMap[ip]; responses != nil {
-			if data := responses.pathMap[path]; len(data) > 0 {
-				return data
-			}
+		if ip == response.Owner {
+			return response.Data
 		}
 	}
 	return nil
 }
 
-func (proxy *acmeProxy) cleanupHandler(w http.ResponseWriter,
+func (proxy *acmeProxy) cleanupForIP(w http.ResponseWriter,
 	req *http.Request) {
-	if req.Method != "POST" {
-		http.Error(w, "Use POST", http.StatusMethodNotAllowed)
-		return
-	}
 	host, _, err := net.SplitHostPort(req.RemoteAddr)
 	if err != nil {
 		http.Error(w, "Cannot split host:port", http.StatusInternalServerError)
 		proxy.logger.Println(err)
 		return
 	}
-	proxy.rwMutex.Lock()
-	defer proxy.rwMutex.Unlock()
-	delete(proxy.ipMap, host)
+	var paths []string
+	proxy.rwMutex.RLock()
+	for path, response := range proxy.responses {
+		if response.Owner == host && len(response.Names) < 1 {
+			paths = append(paths, path)
+		}
+	}
+	proxy.rwMutex.RUnlock()
+	proxy.deleteResponses(host, paths)
 	proxy.logger.Debugf(0, "cleaned up for: %s\n", host)
 }
 
-func (proxy *acmeProxy) recordHandler(w http.ResponseWriter,
+func (proxy *acmeProxy) cleanupHandler(w http.ResponseWriter,
 	req *http.Request) {
 	if req.Method != "POST" {
 		http.Error(w, "Use POST", http.StatusMethodNotAllowed)
 		return
 	}
+	data, err := ioutil.ReadAll(io.LimitReader(req.Body, maxSize))
+	if err != nil {
+		http.Error(w, "Cannot read body", http.StatusBadRequest)
+		proxy.logger.Println(err)
+		return
+	}
+	id, ok := proxy.authenticate(w, req, data)
+	if !ok {
+		return
+	}
+	if id == nil {
+		proxy.cleanupForIP(w, req)
+		return
+	}
+	proxy.deleteResponses(id.String(), req.URL.Query()["path"])
+	proxy.logger.Debugf(0, "cleaned up for: %s\n", id)
+}
+
+// record will record the response for the path, locally and in the shared
+// store. If the response could not be recorded, an error response is written
+// and false is returned.
+func (proxy *acmeProxy) record(w http.ResponseWriter, path string,
+	response *responseType) bool {
+	if proxy.store != nil && proxy.readStoredResponse(path) != nil {
+		http.Error(w, "Duplicate path", http.StatusConflict)
+		return false
+	}
+	response.Recorded = time.Now()
+	response.Expires = response.Recorded.Add(*responseTTL)
+	if code := proxy.reserve(path, response.Owner); code != http.StatusOK {
+		if code == http.StatusConflict {
+			http.Error(w, "Duplicate path", code)
+		} else {
+			http.Error(w, "Too much data", code)
+		}
+		return false
+	}
+	// Write to the shared store first, so that the garbage collector does not
+	// forget the response.
+	if proxy.store != nil {
+		if err := proxy.writeStoredResponse(path, response); err != nil {
+			proxy.rwMutex.Lock()
+			delete(proxy.recording, path)
+			proxy.rwMutex.Unlock()
+			http.Error(w, "Error storing response",
+				http.StatusInternalServerError)
+			proxy.logger.Printf("error storing response: %s: %s\n", path, err)
+			return false
+		}
+	}
+	proxy.rwMutex.Lock()
+	delete(proxy.recording, path)
+	proxy.responses[path] = response
+	proxy.rwMutex.Unlock()
+	w.WriteHeader(http.StatusOK)
+	return true
+}
+
+func (proxy *acmeProxy) recordForIP(w http.ResponseWriter, req *http.Request,
+	data []byte) {
 	host, _, err := net.SplitHostPort(req.RemoteAddr)
 	if err != nil {
 		http.Error(w, "Cannot split host:port", http.StatusInternalServerError)
 		proxy.logger.Println(err)
 		return
 	}
-	data, err := ioutil.ReadAll(req.Body)
+	path := req.URL.RawQuery
+	if tokenFromPath(path) == "" {
+		http.Error(w, "Not an ACME challenge", http.StatusBadRequest)
+		return
+	}
+	if proxy.record(w, path, &responseType{Data: data, Owner: host}) {
+		proxy.logger.Printf("%s: recorded for path: %s\n", host, path)
+	}
+}
+
+func (proxy *acmeProxy) recordForNames(w http.ResponseWriter,
+	req *http.Request, id *identity, data []byte) {
+	query := req.URL.Query()
+	path := query.Get("path")
+	if tokenFromPath(path) == "" {
+		http.Error(w, "Not an ACME challenge", http.StatusBadRequest)
+		return
+	}
+	names := query["name"]
+	if len(names) < 1 {
+		http.Error(w, "No names", http.StatusBadRequest)
+		return
+	}
+	for index, name := range names {
+		names[index] = strings.ToLower(name)
+	}
+	if err := proxy.authenticator.authorise(id, names); err != nil {
+		http.Error(w, "Not permitted", http.StatusForbidden)
+		proxy.logger.Println(err)
+		return
+	}
+	response := &responseType{Data: data, Names: names, Owner: id.String()}
+	if proxy.record(w, path, response) {
+		proxy.logger.Printf("%s: recorded for path: %s, names: %s\n",
+			id, path, strings.Join(names, ","))
+	}
+}
+
+func (proxy *acmeProxy) recordHandler(w http.ResponseWriter,
+	req *http.Request) {
+	if req.Method != "POST" {
+		http.Error(w, "Use POST", http.StatusMethodNotAllowed)
+		return
+	}
+	data, err := ioutil.ReadAll(io.LimitReader(req.Body, maxSize+1))
 	if err != nil {
 		http.Error(w, "Cannot read body", http.StatusBadRequest)
 		proxy.logger.Println(err)
@@ -83,21 +242,45 @@ func (proxy *acmeProxy) recordHandler(w http.ResponseWriter,
 		http.Error(w, "Too much data", http.StatusNotAcceptable)
 		return
 	}
+	id, ok := proxy.authenticate(w, req, data)
+	if !ok {
+		return
+	}
+	if id == nil {
+		proxy.recordForIP(w, req, data)
+	} else {
+		proxy.recordForNames(w, req, id, data)
+	}
+}
+
+// reserve will reserve the path for a response being recorded by owner, so
+// that concurrent requests to record a response for the same path are
+// rejected. If the path cannot be reserved, the HTTP status code for the error
+// response is returned, otherwise http.StatusOK is returned.
+func (proxy *acmeProxy) reserve(path, owner string) int {
 	proxy.rwMutex.Lock()
 	defer proxy.rwMutex.Unlock()
-	responses := proxy.ipMap[host]
-	if responses == nil {
-		responses = &responsesType{make(map[string][]byte)}
-		proxy.ipMap[host] = responses
-	} else if len(responses.pathMap) >= maxResponses {
-		http.Error(w, "Too much data", http.StatusTooManyRequests)
-		return
+	if existing := proxy.responses[path]; existing != nil &&
+		!existing.expired() {
+		return http.StatusConflict
 	}
-	if len(responses.pathMap[req.URL.RawQuery]) > 0 {
-		http.Error(w, "Duplicate path", http.StatusConflict)
-		return
+	if _, ok := proxy.recording[path]; ok {
+		return http.StatusConflict
 	}
-	responses.pathMap[req.URL.RawQuery] = data
-	w.WriteHeader(http.StatusOK)
-	proxy.logger.Printf("%s: recorded for path: %s\n", host, req.URL.RawQuery)
+	var numResponses int
+	for _, existing := range proxy.responses {
+		if existing.Owner == owner {
+			numResponses++
+		}
+	}
+	for _, existingOwner := range proxy.recording {
+		if existingOwner == owner {
+			numResponses++
+		}
+	}
+	if numResponses >= maxResponses {
+		return http.StatusTooManyRequests
+	}
+	proxy.recording[path] = owner
+	return http.StatusOK
 }
@@ -0,0 +1,350 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"io"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/Cloud-Foundations/Dominator/lib/html"
+	"github.com/Cloud-Foundations/golib/pkg/constants"
+	cm_http "github.com/Cloud-Foundations/golib/pkg/crypto/certmanager/http"
+	"github.com/Cloud-Foundations/golib/pkg/crypto/certmanager/storage/filesystem"
+	"github.com/Cloud-Foundations/golib/pkg/crypto/certmanager/storage/s3"
+	"github.com/Cloud-Foundations/golib/pkg/log"
+)
+
+const (
+	gcInterval             = time.Minute
+	maxStoreCacheSize      = 1024
+	maxStoreReadsPerSecond = 50
+	storeCacheTime         = time.Second * 5
+)
+
+var tokenRegexp = regexp.MustCompile("^[A-Za-z0-9_-]+$")
+
+// responseType is a recorded challenge response. It is stored in JSON format
+// in the shared store.
+type responseType struct {
+	Data     []byte
+	Expires  time.Time
+	Names    []string `json:",omitempty"` // If empty, matched by IP address.
+	Owner    string   // The caller identity or IP address.
+	Recorded time.Time
+}
+
+// storeCacheEntry is a response read from the shared store. If response is nil,
+// there was no response in the store.
+type storeCacheEntry struct {
+	expires  time.Time
+	response *responseType
+}
+
+// makeStore will create the shared store specified by the command-line flags.
+// If no store is specified, nil is returned.
+func makeStore(logger log.DebugLogger) (cm_http.ChallengeStorer, error) {
+	if *storageDirectory != "" && *s3Bucket != "" {
+		return nil, errors.New(
+			"cannot specify both storageDirectory and s3Bucket")
+	}
+	if *storageDirectory != "" {
+		return filesystem.New(*storageDirectory, logger)
+	}
+	if *s3Bucket != "" {
+		return s3.NewWithConfig(
+			s3.Config{
+				Bucket:   *s3Bucket,
+				Endpoint: *s3Endpoint,
+				Prefix:   *s3Prefix,
+				Region:   *s3Region,
+			},
+			s3.Params{Logger: logger})
+	}
+	return nil, nil
+}
+
+// tokenFromPath returns the challenge token from the request path. If the path
+// is not for an ACME challenge, the empty string is returned.
+func tokenFromPath(path string) string {
+	if !strings.HasPrefix(path, constants.AcmePath+"/") {
+		return ""
+	}
+	token := path[len(constants.AcmePath)+1:]
+	if !tokenRegexp.MatchString(token) {
+		return ""
+	}
+	return token
+}
+
+// deleteResponses will delete the responses for the paths which were recorded
+// by owner, locally and in the shared store.
+func (proxy *acmeProxy) deleteResponses(owner string, paths []string) {
+	var localPaths, remotePaths []string
+	proxy.rwMutex.Lock()
+	for _, path := range paths {
+		if response := proxy.responses[path]; response == nil {
+			remotePaths = append(remotePaths, path)
+		} else if response.Owner == owner {
+			delete(proxy.responses, path)
+			localPaths = append(localPaths, path)
+		}
+	}
+	proxy.rwMutex.Unlock()
+	if proxy.store == nil {
+		return
+	}
+	for _, path := range localPaths {
+		proxy.deleteStoredResponse(path)
+	}
+	// Responses recorded by another instance.
+	for _, path := range remotePaths {
+		if response := proxy.readStoredResponse(path); response != nil &&
+			response.Owner == owner {
+			proxy.deleteStoredResponse(path)
+		}
+	}
+}
+
+// cacheStoredResponse will cache the response read from the shared store. If
+// the cache is full of unexpired entries, the response is not cached.
+func (proxy *acmeProxy) cacheStoredResponse(path string,
+	response *responseType) {
+	now := time.Now()
+	proxy.rwMutex.Lock()
+	defer proxy.rwMutex.Unlock()
+	if len(proxy.storeCache) >= maxStoreCacheSize {
+		for key, entry := range proxy.storeCache {
+			if now.After(entry.expires) {
+				delete(proxy.storeCache, key)
+			}
+		}
+		if len(proxy.storeCache) >= maxStoreCacheSize {
+			return
+		}
+	}
+	proxy.storeCache[path] = storeCacheEntry{
+		expires:  now.Add(storeCacheTime),
+		response: response,
+	}
+}
+
+// checkStoreRead returns true if the shared store may be read for a lookup.
+// It returns false if too many reads were made recently, so that requests for
+// random tokens (which are not cached once the cache is full) do not overload
+// the store.
+func (proxy *acmeProxy) checkStoreRead(path string) bool {
+	now := time.Now()
+	proxy.rwMutex.Lock()
+	defer proxy.rwMutex.Unlock()
+	if now.Sub(proxy.readWindowStart) >= time.Second {
+		proxy.numStoreReads = 0
+		proxy.readWindowStart = now
+	}
+	if proxy.numStoreReads >= maxStoreReadsPerSecond {
+		proxy.logger.Debugf(1,
+			"too many stored response reads, ignoring: %s\n", path)
+		return false
+	}
+	proxy.numStoreReads++
+	return true
+}
+
+func (proxy *acmeProxy) deleteStoredResponse(path string) {
+	proxy.forgetStoredResponse(path)
+	err := proxy.store.DeleteChallengeResponse(tokenFromPath(path))
+	if err != nil {
+		proxy.logger.Printf("error deleting stored response: %s: %s\n",
+			path, err)
+	}
+}
+
+// collectGarbage will delete expired responses and cached reads. Responses which
+// were deleted from the shared store (i.e. cleaned up by another instance) are
+// forgotten. This reads the shared store once for each live response recorded
+// by this instance, without holding the lock. These reads are not rate limited,
+// since they are bounded by the responses recorded by this instance (at most
+// maxResponses for each owner), which expire after responseTTL.
+func (proxy *acmeProxy) collectGarbage() {
+	var expiredPaths, livePaths []string
+	proxy.rwMutex.RLock()
+	for path, response := range proxy.responses {
+		if response.expired() {
+			expiredPaths = append(expiredPaths, path)
+		} else {
+			livePaths = append(livePaths, path)
+		}
+	}
+	proxy.rwMutex.RUnlock()
+	deletedPaths := expiredPaths
+	if proxy.store != nil {
+		for _, path := range livePaths {
+			if proxy.readStoredResponse(path) == nil {
+				deletedPaths = append(deletedPaths, path)
+			}
+		}
+	}
+	now := time.Now()
+	proxy.rwMutex.Lock()
+	for _, path := range deletedPaths {
+		delete(proxy.responses, path)
+	}
+	for path, entry := range proxy.storeCache {
+		if now.After(entry.expires) {
+			delete(proxy.storeCache, path)
+		}
+	}
+	proxy.rwMutex.Unlock()
+	for _, path := range expiredPaths {
+		proxy.logger.Debugf(0, "expired response for path: %s\n", path)
+		if proxy.store != nil {
+			proxy.deleteStoredResponse(path)
+		}
+	}
+}
+
+// forgetStoredResponse will remove the cached response for the path, which is
+// being written or deleted by this instance.
+func (proxy *acmeProxy) forgetStoredResponse(path string) {
+	proxy.rwMutex.Lock()
+	delete(proxy.storeCache, path)
+	proxy.rwMutex.Unlock()
+}
+
+// gcLoop will periodically delete expired responses.
+func (proxy *acmeProxy) gcLoop() {
+	ticker := time.NewTicker(gcInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		proxy.collectGarbage()
+	}
+}
+
+// lookupResponse returns the unexpired response for the path, or nil. Responses
+// recorded by this instance are used first. Otherwise, if there is a shared
+// store, the response may have been recorded by another instance, and is read
+// from the store. Reads from the store (including missing responses) are
+// cached briefly and are rate limited.
+func (proxy *acmeProxy) lookupResponse(path string) *responseType {
+	now := time.Now()
+	proxy.rwMutex.RLock()
+	response := proxy.responses[path]
+	entry, cached := proxy.storeCache[path]
+	proxy.rwMutex.RUnlock()
+	if response != nil && !response.expired() {
+		return response
+	}
+	if proxy.store == nil || tokenFromPath(path) == "" {
+		return nil
+	}
+	if cached && now.Before(entry.expires) {
+		if entry.response == nil || entry.response.expired() {
+			return nil
+		}
+		return entry.response
+	}
+	if !proxy.checkStoreRead(path) {
+		return nil
+	}
+	response = proxy.readStoredResponse(path)
+	proxy.cacheStoredResponse(path, response)
+	return response
+}
+
+// readStoredResponse will read the unexpired response for the path from the
+// shared store. If there is no response, nil is returned.
+func (proxy *acmeProxy) readStoredResponse(path string) *responseType {
+	token := tokenFromPath(path)
+	if token == "" {
+		return nil
+	}
+	value, err := proxy.store.ReadChallengeResponse(token)
+	if err != nil {
+		proxy.logger.Debugf(1, "error reading stored response: %s: %s\n",
+			path, err)
+		return nil
+	}
+	var response responseType
+	if err := json.Unmarshal([]byte(value), &response); err != nil {
+		proxy.logger.Printf("error decoding stored response: %s: %s\n",
+			path, err)
+		return nil
+	}
+	if response.expired() {
+		proxy.deleteStoredResponse(path)
+		return nil
+	}
+	return &response
+}
+
+// writeResponses will write the table of unexpired responses recorded by this
+// instance. Responses recorded by other instances in the shared store are not
+// listed.
+func (proxy *acmeProxy) writeResponses(writer io.Writer) {
+	type entry struct {
+		path     string
+		response *responseType
+	}
+	var entries []entry
+	proxy.rwMutex.RLock()
+	for path, response := range proxy.responses {
+		if !response.expired() {
+			entries = append(entries, entry{path, response})
+		}
+	}
+	proxy.rwMutex.RUnlock()
+	if len(entries) < 1 {
+		fmt.Fprintln(writer, "No responses recorded by this instance<br>")
+		return
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].response.Recorded.Before(entries[j].response.Recorded)
+	})
+	fmt.Fprintln(writer, `<table border="1" style="border-collapse: collapse">`)
+	tw, _ := html.NewTableWriter(writer, true, "Path", "Names", "Recorded By",
+		"Age", "Expires In")
+	for _, entry := range entries {
+		names := "(by IP)"
+		if len(entry.response.Names) > 0 {
+			names = strings.Join(entry.response.Names, " ")
+		}
+		tw.WriteRow("", "",
+			template.HTMLEscapeString(entry.path),
+			template.HTMLEscapeString(names),
+			template.HTMLEscapeString(entry.response.Owner),
+			time.Since(entry.response.Recorded).Round(time.Second).String(),
+			time.Until(entry.response.Expires).Round(time.Second).String())
+	}
+	tw.Close()
+}
+
+// writeStoredResponse will write the response to the shared store.
+func (proxy *acmeProxy) writeStoredResponse(path string,
+	response *responseType) error {
+	value, err := json.Marshal(response)
+	if err != nil {
+		return err
+	}
+	proxy.forgetStoredResponse(path)
+	return proxy.store.WriteChallengeResponse(tokenFromPath(path),
+		string(value))
+}
+
+func (response *responseType) expired() bool {
+	return time.Now().After(response.Expires)
+}
+
+// matchesName returns true if the response may be used for the host name.
+func (response *responseType) matchesName(host string) bool {
+	host = strings.ToLower(host)
+	for _, name := range response.Names {
+		if name == host {
+			return true
+		}
+	}
+	return false
+}
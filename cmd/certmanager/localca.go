@@ -0,0 +1,58 @@
+package main
+
+import (
+	"net/http"
+	"path/filepath"
+
+	"github.com/Cloud-Foundations/golib/pkg/crypto/certmanager"
+	acmecfg "github.com/Cloud-Foundations/golib/pkg/crypto/certmanager/config"
+	"github.com/Cloud-Foundations/golib/pkg/log"
+)
+
+// getLocalCAConfig returns the configuration for the local CA. The CA files
+// default to "local-ca.pem" and "local-ca-key.pem" next to the certificate.
+func getLocalCAConfig() *certmanager.LocalCAConfig {
+	caConfig := &certmanager.LocalCAConfig{
+		CertFilename:        *localCACert,
+		CertificateLifetime: *localCACertificateLifetime,
+		KeyFilename:         *localCAKey,
+	}
+	if caConfig.CertFilename == "" {
+		caConfig.CertFilename = filepath.Join(filepath.Dir(*cert),
+			"local-ca.pem")
+	}
+	if caConfig.KeyFilename == "" {
+		caConfig.KeyFilename = filepath.Join(filepath.Dir(*cert),
+			"local-ca-key.pem")
+	}
+	return caConfig
+}
+
+// getLocalCAStorer returns the Storer for sharing the local CA, which is kept
+// under "local-ca" in the storage specified by the command-line flags. If an
+// encryption key file is specified, the CA private key is encrypted.
+func getLocalCAStorer(logger log.DebugLogger) (certmanager.Storer, error) {
+	storageConfig, err := getStorageConfig()
+	if err != nil {
+		return nil, err
+	}
+	storer, err := acmecfg.NewLocalCAStorer(storageConfig, logger)
+	if err != nil {
+		return nil, err
+	}
+	return encryptStorer(storer, logger)
+}
+
+// makeLocalCAHandler returns a handler which serves the local CA certificate,
+// so that it may be installed in trust stores.
+func makeLocalCAHandler(cm *certmanager.CertificateManager) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		caPEM, err := cm.ExportLocalCA()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/x-pem-file")
+		w.Write(caPEM)
+	}
+}
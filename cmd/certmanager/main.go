@@ -5,27 +5,34 @@ import (
 	"errors"
 	"flag"
 	"fmt"
+	"io/ioutil"
 	"net"
 	"net/http"
 	"os"
-	"os/exec"
 	"strings"
+	"sync"
 
 	"github.com/Cloud-Foundations/Dominator/lib/flags/loadflags"
 	"github.com/Cloud-Foundations/Dominator/lib/html"
 	"github.com/Cloud-Foundations/Dominator/lib/log/serverlogger"
 	"github.com/Cloud-Foundations/golib/pkg/constants"
 	"github.com/Cloud-Foundations/golib/pkg/crypto/certmanager"
+	acmecfg "github.com/Cloud-Foundations/golib/pkg/crypto/certmanager/config"
+	"github.com/Cloud-Foundations/golib/pkg/crypto/certmanager/dns/acmedns"
 	"github.com/Cloud-Foundations/golib/pkg/crypto/certmanager/dns/route53"
 	cm_http "github.com/Cloud-Foundations/golib/pkg/crypto/certmanager/http"
 	"github.com/Cloud-Foundations/golib/pkg/crypto/certmanager/http_proxy"
-	"github.com/Cloud-Foundations/golib/pkg/crypto/certmanager/storage/awssecretsmanager"
+	"github.com/Cloud-Foundations/golib/pkg/crypto/certmanager/storage/encrypted"
+	"github.com/Cloud-Foundations/golib/pkg/crypto/certmanager/tls_alpn"
 	"github.com/Cloud-Foundations/golib/pkg/log"
 	"github.com/Cloud-Foundations/tricorder/go/tricorder"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
 type dashboardType struct {
 	htmlWriter html.HtmlWriter
+	mutex      sync.Mutex // Protect everything below.
+	certWriter html.HtmlWriter
 }
 
 type htmlWriterLogger interface {
@@ -34,42 +41,140 @@ type htmlWriterLogger interface {
 }
 
 var (
+	acmeDnsAccountsFile = flag.String("acmeDnsAccountsFile", "",
+		"JSON file containing acme-dns accounts (for acme-dns DNS provider)")
+	acmeDnsServerURL = flag.String("acmeDnsServerURL", "",
+		"URL of acme-dns server (for acme-dns DNS provider)")
 	adminPortNum = flag.Uint("adminPortNum", constants.CertmanagerPortNumber,
 		"admin/dashboard port number to listen on")
 	awsSecretId = flag.String("awsSecretId", "",
 		"Optional AWS Secrets Manager SecretId to read/write certs to")
 	cert = flag.String("cert", "",
 		"file to read/write certificate from/to")
-	challenge   = flag.String("challenge", "http-01", "ACME challenge type")
+	challenge = flag.String("challenge", "http-01",
+		"ACME challenge type")
+	challengeAliases = flag.String("challengeAliases", "",
+		"Optional space separated domain=FQDN dns-01 TXT record aliases")
+	contacts = flag.String("contacts", "",
+		"Optional space separated e-mail addresses for the ACME account")
 	dnsProvider = flag.String("dnsProvider", "route53",
 		"The DNS provider to use for the dns-01 challenge")
 	domains = flag.String("domains", "",
 		"Space separated list of domains to request a certificate for")
-	key     = flag.String("key", "", "file to read/write key from/to")
-	keyType = flag.String("keyType", "EC", "key type (EC/RSA)")
+	eabHmacKey = flag.String("eabHmacKey", "",
+		"Optional Base64url-encoded External Account Binding HMAC key")
+	eabHmacKeyFile = flag.String("eabHmacKeyFile", "",
+		"Optional file containing the External Account Binding HMAC key")
+	eabKeyId = flag.String("eabKeyId", "",
+		"Optional External Account Binding key ID")
+	encryptionKeyFile = flag.String("encryptionKeyFile", "",
+		"Optional file containing keys to encrypt private keys in remote store")
+	failoverThreshold = flag.Uint("failoverThreshold", 0,
+		"Optional number of failed requests before failing over to fallback CA")
+	fallbackCaDirectoryURL = flag.String("fallbackCaDirectoryURL", "",
+		"Optional ACME directory URL of the CA to fail over to")
+	fallbackEabHmacKey = flag.String("fallbackEabHmacKey", "",
+		"Optional Base64url-encoded EAB HMAC key for fallback CA")
+	fallbackEabHmacKeyFile = flag.String("fallbackEabHmacKeyFile", "",
+		"Optional file containing the EAB HMAC key for fallback CA")
+	fallbackEabKeyId = flag.String("fallbackEabKeyId", "",
+		"Optional EAB key ID for fallback CA")
+	followChallengeCNAME = flag.Bool("followChallengeCNAME", false,
+		"If true, follow _acme-challenge CNAME records for dns-01")
+	jwksFile = flag.String("jwksFile", "",
+		"Optional file to write certificate and key to in JWKS format")
+	key         = flag.String("key", "", "file to read/write key from/to")
+	keyRotation = flag.String("keyRotation", "",
+		"Optional key rotation policy (always/every/reuse)")
+	keyRotationInterval = flag.Uint("keyRotationInterval", 0,
+		"number of renewals between key rotations for keyRotation=every")
+	keyType = flag.String("keyType", "EC",
+		"key type (EC/EC-P384/RSA/RSA-3072/RSA-4096)")
+	localCA = flag.Bool("localCA", false,
+		"If true, issue certificates from a local development CA")
+	localCACert = flag.String("localCACert", "",
+		"Optional local CA cert file (default: local-ca.pem next to cert)")
+	localCACertificateLifetime = flag.Duration("localCACertificateLifetime",
+		0, "Optional lifetime of certificates issued by the local CA")
+	localCAKey = flag.String("localCAKey", "",
+		"Optional local CA key file (default: local-ca-key.pem next to cert)")
+	pemBundleFile = flag.String("pemBundleFile", "",
+		"Optional file to write certificate chain and key to (i.e. HAProxy)")
+	pkcs12File = flag.String("pkcs12File", "",
+		"Optional file to write certificate and key to in PKCS#12 format")
+	pkcs12Password = flag.String("pkcs12Password", "changeit",
+		"password for pkcs12File")
+	pkcs12PasswordFile = flag.String("pkcs12PasswordFile", "",
+		"Optional file containing the password for pkcs12File")
 	portNum = flag.Uint("portNum", 80,
 		"port number to listen on for http-01 challenge response")
+	preferredChain = flag.String("preferredChain", "",
+		"Optional preferred chain root issuer name or SHA-256 fingerprint")
+	propagationNameservers = flag.String("propagationNameservers", "",
+		"Optional space separated nameservers to check dns-01 propagation")
+	propagationTimeout = flag.Duration("propagationTimeout", 0,
+		"Optional maximum time to wait for dns-01 TXT record propagation")
 	production = flag.Bool("production", false,
 		"If true, use productionDirectoryURL")
 	productionDirectoryURL = flag.String("productionDirectoryURL",
 		certmanager.LetsEncryptProductionURL,
 		"The directory endpoint for the Certificate Authority Production URL")
+	proxyCAFile = flag.String("proxyCAFile", "",
+		"Optional file containing CA certificates to verify acme-proxy (HTTPS)")
+	proxyClientCertFile = flag.String("proxyClientCertFile", "",
+		"Optional client certificate file to authenticate to acme-proxy")
+	proxyClientKeyFile = flag.String("proxyClientKeyFile", "",
+		"key file for proxyClientCertFile")
+	proxyHmacKeyFile = flag.String("proxyHmacKeyFile", "",
+		"Optional file containing a HMAC key to authenticate to acme-proxy")
 	proxyHostname = flag.String("proxyHostname", "", "hostname of acme-proxy")
 	proxyPortNum  = flag.Uint("proxyPortNum", constants.AcmeProxyPortNumber,
 		"port number of acme-proxy")
+	proxyUseAwsIdentity = flag.Bool("proxyUseAwsIdentity", false,
+		"If true, authenticate to acme-proxy using the AWS IAM identity")
 	redirect = flag.Bool("redirect", false,
 		"If true, redirect non-ACME HTTP requests to HTTPS")
 	route53ZoneId = flag.String("route53ZoneId", "",
 		"Route 53 Hosted Zone ID for dns-01 challenge response")
+	s3Bucket = flag.String("s3Bucket", "",
+		"Optional AWS S3 (or S3-compatible) bucket to read/write certs to")
+	s3Endpoint = flag.String("s3Endpoint", "",
+		"Optional endpoint URL for S3-compatible object storage")
+	s3Prefix = flag.String("s3Prefix", "",
+		"Optional prefix for object keys in s3Bucket")
+	s3Region = flag.String("s3Region", "",
+		"Optional region of s3Bucket (default: region of the instance)")
+	shareHttpChallenges = flag.Bool("shareHttpChallenges", false,
+		"If true, share http-01 challenge responses via the (shared) storage")
+	shareLocalCA = flag.Bool("shareLocalCA", false,
+		"If true, share the local CA via the (shared) storage")
+	tlsPortNum = flag.Uint("tlsPortNum", 443,
+		"port number to listen on for tls-alpn-01 challenge response")
 	notifierCommand = flag.String("notifierCommand", "",
 		"Optional command and arguments to run when the certificate is written")
+	notifierEvents = flag.String("notifierEvents", "issued loadedFromStorer",
+		"Space separated list of events for which to run notifierCommand")
+	storageDirectory = flag.String("storageDirectory", "",
+		"Optional (shared) directory to read/write certs to")
 	stagingDirectoryURL = flag.String("stagingDirectoryURL",
 		certmanager.LetsEncryptStagingURL,
 		"The directory endpoint for the Certificate Authority staging URL")
+	vaultAddress = flag.String("vaultAddress", "",
+		"Optional Vault server address (default: $VAULT_ADDR)")
+	vaultAppRoleId = flag.String("vaultAppRoleId", "",
+		"Optional Vault AppRole role ID (default: use $VAULT_TOKEN)")
+	vaultAppRoleSecretIdFile = flag.String("vaultAppRoleSecretIdFile", "",
+		"file containing the Vault AppRole secret ID")
+	vaultMountPath = flag.String("vaultMountPath", "secret",
+		"mount path of the Vault KV secrets engine")
+	vaultPath = flag.String("vaultPath", "",
+		"Optional path in Vault KV secrets engine to read/write certs to")
 )
 
 func getDnsResponder(logger log.DebugLogger) (certmanager.Responder, error) {
 	switch *dnsProvider {
+	case "acme-dns":
+		return acmedns.New(*acmeDnsServerURL, *acmeDnsAccountsFile, logger)
 	case "manual":
 		return newManualDnsResponder(), nil
 	case "route53":
@@ -89,6 +194,20 @@ func doMain() int {
 	flag.Parse()
 	tricorder.RegisterFlags()
 	logger := serverlogger.New("")
+	if flag.NArg() > 0 && flag.Arg(0) == "revoke" {
+		if err := runRevoke(flag.Args()[1:], logger); err != nil {
+			logger.Println(err)
+			return 1
+		}
+		return 0
+	}
+	if flag.NArg() > 0 && flag.Arg(0) == "rewrap" {
+		if err := runRewrap(flag.Args()[1:], logger); err != nil {
+			logger.Println(err)
+			return 1
+		}
+		return 0
+	}
 	domainList := flag.Args()
 	domainList = append(domainList, strings.Fields(*domains)...)
 	if err := runCertmanager(domainList, logger); err != nil {
@@ -98,33 +217,77 @@ func doMain() int {
 	return 0
 }
 
-func main() {
-	os.Exit(doMain())
+// encryptStorer wraps storer so that private keys are encrypted, if an
+// encryption key file is specified.
+func encryptStorer(storer certmanager.Storer,
+	logger log.DebugLogger) (certmanager.Storer, error) {
+	if storer == nil || *encryptionKeyFile == "" {
+		return storer, nil
+	}
+	keyProvider, err := encrypted.NewKeyfileProvider(*encryptionKeyFile)
+	if err != nil {
+		return nil, err
+	}
+	return encrypted.New(storer, keyProvider, logger)
 }
 
-func printUsage() {
-	w := flag.CommandLine.Output()
-	fmt.Fprintln(w, "Usage: certmanager [flags...] [domain...]")
-	fmt.Fprintln(w, "Common flags:")
-	flag.PrintDefaults()
-	fmt.Fprintln(w, "ACME challenge types:")
-	fmt.Fprintln(w, "  dns-01:  respond via DNS TXT records")
-	fmt.Fprintln(w, "  http-01: respond via HTTP")
-	fmt.Fprintln(w, "DNS providers:")
-	fmt.Fprintln(w, "  manual:  manually update DNS during ACME challenge")
-	fmt.Fprintln(w, "  route53: AWS Route 53. Requires an instance role with zone write access")
+func getDirectoryURL() string {
+	if *production {
+		return *productionDirectoryURL
+	}
+	return *stagingDirectoryURL
 }
 
-func runCertmanager(domainList []string, logger htmlWriterLogger) error {
-	if err := setupDashboard(logger); err != nil {
-		return err
+// getLockingStorer returns the Locker and Storer specified by the command-line
+// flags. If an encryption key file is specified, the Storer encrypts private
+// keys. If no storage is specified, nil values are returned.
+func getLockingStorer(logger log.DebugLogger) (certmanager.Locker,
+	certmanager.Storer, error) {
+	locker, storer, err := getPlainLockingStorer(logger)
+	if err != nil {
+		return nil, nil, err
 	}
-	if *cert == "" {
-		return errors.New("no cert file specified")
+	if storer, err = encryptStorer(storer, logger); err != nil {
+		return nil, nil, err
 	}
-	if *key == "" {
-		return errors.New("no key file specified")
+	return locker, storer, nil
+}
+
+// getPlainLockingStorer returns the Locker and Storer specified by the
+// command-line flags, without encryption. If no storage is specified, nil
+// values are returned.
+func getPlainLockingStorer(logger log.DebugLogger) (certmanager.Locker,
+	certmanager.Storer, error) {
+	storageConfig, err := getStorageConfig()
+	if err != nil {
+		return nil, nil, err
+	}
+	return acmecfg.NewLockingStorer(storageConfig, logger)
+}
+
+// getProxyResponder returns the Responder for the acme-proxy. Authentication is
+// used if any credentials are specified.
+func getProxyResponder(domainList []string,
+	logger log.DebugLogger) (certmanager.Responder, error) {
+	config := http_proxy.Config{
+		Address:        fmt.Sprintf("%s:%d", *proxyHostname, *proxyPortNum),
+		CAFile:         *proxyCAFile,
+		ClientCertFile: *proxyClientCertFile,
+		ClientKeyFile:  *proxyClientKeyFile,
+		HmacKeyFile:    *proxyHmacKeyFile,
+		UseAwsIdentity: *proxyUseAwsIdentity,
 	}
+	if *proxyClientCertFile != "" || *proxyHmacKeyFile != "" ||
+		*proxyUseAwsIdentity {
+		config.Names = domainList
+	}
+	return http_proxy.NewWithConfig(config, http_proxy.Params{Logger: logger})
+}
+
+// getResponder returns the Responder for the challenge type. The (unencrypted)
+// storer is used to share http-01 challenge responses, if requested.
+func getResponder(domainList []string, storer certmanager.Storer,
+	logger log.DebugLogger) (certmanager.Responder, error) {
 	var responder certmanager.Responder
 	var err error
 	switch *challenge {
@@ -132,83 +295,267 @@ func runCertmanager(domainList []string, logger htmlWriterLogger) error {
 		responder, err = getDnsResponder(logger)
 	case "http-01":
 		if *proxyHostname == "" {
+			var fallbackHandler http.Handler
 			if *redirect {
+				fallbackHandler = &cm_http.RedirectHandler{}
+			}
+			if !*shareHttpChallenges {
 				responder, err = cm_http.NewServer(uint16(*portNum),
-					&cm_http.RedirectHandler{}, logger)
+					fallbackHandler, logger)
+			} else if store, ok := storer.(cm_http.ChallengeStorer); !ok {
+				return nil, errors.New(
+					"storage does not support sharing http-01 challenges")
 			} else {
-				responder, err = cm_http.NewServer(uint16(*portNum), nil,
-					logger)
+				responder, err = cm_http.NewSharedServer(uint16(*portNum),
+					fallbackHandler, store, logger)
 			}
 		} else {
 			if *redirect {
 				err = cm_http.CreateRedirectServer(uint16(*portNum),
 					logger)
 				if err != nil {
-					return err
+					return nil, err
 				}
 			}
-			responder, err = http_proxy.New(
-				fmt.Sprintf("%s:%d", *proxyHostname, *proxyPortNum), logger)
+			responder, err = getProxyResponder(domainList, logger)
+		}
+	case "tls-alpn-01":
+		if *redirect {
+			err = cm_http.CreateRedirectServer(uint16(*portNum), logger)
+			if err != nil {
+				return nil, err
+			}
 		}
+		responder, err = tls_alpn.NewServer(uint16(*tlsPortNum), logger)
 	default:
-		return fmt.Errorf("challenge: %s not supported", *challenge)
+		return nil, fmt.Errorf("challenge: %s not supported", *challenge)
+	}
+	return responder, err
+}
+
+// getStorageConfig returns the storage configuration specified by the
+// command-line flags.
+func getStorageConfig() (acmecfg.AcmeConfig, error) {
+	var secretId string
+	if *vaultAppRoleSecretIdFile != "" {
+		data, err := ioutil.ReadFile(*vaultAppRoleSecretIdFile)
+		if err != nil {
+			return acmecfg.AcmeConfig{}, err
+		}
+		secretId = strings.TrimSpace(string(data))
+	}
+	return acmecfg.AcmeConfig{
+		AwsSecretId:          *awsSecretId,
+		S3Bucket:             *s3Bucket,
+		S3Endpoint:           *s3Endpoint,
+		S3Prefix:             *s3Prefix,
+		S3Region:             *s3Region,
+		StorageDirectory:     *storageDirectory,
+		VaultAddress:         *vaultAddress,
+		VaultAppRoleId:       *vaultAppRoleId,
+		VaultAppRoleSecretId: secretId,
+		VaultMountPath:       *vaultMountPath,
+		VaultPath:            *vaultPath,
+	}, nil
+}
+
+func main() {
+	os.Exit(doMain())
+}
+
+// parseChallengeAliases will parse a space separated list of domain=FQDN
+// pairs.
+func parseChallengeAliases(value string) (map[string]string, error) {
+	aliases := make(map[string]string)
+	for _, field := range strings.Fields(value) {
+		splitField := strings.SplitN(field, "=", 2)
+		if len(splitField) != 2 || splitField[0] == "" || splitField[1] == "" {
+			return nil, fmt.Errorf("bad challenge alias: %s", field)
+		}
+		aliases[splitField[0]] = splitField[1]
 	}
+	return aliases, nil
+}
+
+func printUsage() {
+	w := flag.CommandLine.Output()
+	fmt.Fprintln(w, "Usage: certmanager [flags...] [domain...]")
+	fmt.Fprintln(w, "       certmanager [flags...] revoke [reason]")
+	fmt.Fprintln(w, "       certmanager [flags...] rewrap")
+	fmt.Fprintln(w, "Common flags:")
+	flag.PrintDefaults()
+	fmt.Fprintln(w, "ACME challenge types:")
+	fmt.Fprintln(w, "  dns-01:      respond via DNS TXT records")
+	fmt.Fprintln(w, "  http-01:     respond via HTTP")
+	fmt.Fprintln(w, "  tls-alpn-01: respond via TLS (ALPN) on tlsPortNum")
+	fmt.Fprintln(w, "Revocation reasons (revoke sub-command):")
+	fmt.Fprintln(w, "  unspecified (default), keyCompromise, affiliationChanged,")
+	fmt.Fprintln(w, "  superseded, cessationOfOperation")
+	fmt.Fprintln(w, "DNS providers:")
+	fmt.Fprintln(w, "  acme-dns: acme-dns server. Requires _acme-challenge CNAME records")
+	fmt.Fprintln(w, "  manual:   manually update DNS during ACME challenge")
+	fmt.Fprintln(w, "  route53:  AWS Route 53. Requires an instance role with zone write access")
+}
+
+// readSecret returns the secret read from filename, if specified, otherwise
+// value.
+func readSecret(value, filename string) (string, error) {
+	if filename == "" {
+		return value, nil
+	}
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(data)), nil
+}
+
+func runCertmanager(domainList []string, logger htmlWriterLogger) error {
+	dashboard, err := setupDashboard(logger)
 	if err != nil {
 		return err
 	}
-	directoryURL := *stagingDirectoryURL
-	if *production {
-		directoryURL = *productionDirectoryURL
+	if *cert == "" {
+		return errors.New("no cert file specified")
+	}
+	if *key == "" {
+		return errors.New("no key file specified")
+	}
+	locker, storer, err := getPlainLockingStorer(logger)
+	if err != nil {
+		return err
+	}
+	var responder certmanager.Responder
+	if !*localCA {
+		responder, err = getResponder(domainList, storer, logger)
+		if err != nil {
+			return err
+		}
+	}
+	if storer, err = encryptStorer(storer, logger); err != nil {
+		return err
+	}
+	aliases, err := parseChallengeAliases(*challengeAliases)
+	if err != nil {
+		return err
+	}
+	config := certmanager.Config{
+		CertFilename:           *cert,
+		ChallengeAliases:       aliases,
+		ChallengeType:          *challenge,
+		Contacts:               strings.Fields(*contacts),
+		FailoverThreshold:      *failoverThreshold,
+		FollowChallengeCNAME:   *followChallengeCNAME,
+		KeyFilename:            *key,
+		KeyRotation:            *keyRotation,
+		KeyRotationInterval:    *keyRotationInterval,
+		KeyType:                *keyType,
+		Names:                  domainList,
+		PreferredChain:         *preferredChain,
+		PropagationNameservers: strings.Fields(*propagationNameservers),
+		PropagationTimeout:     *propagationTimeout,
+	}
+	var localCAStorer certmanager.Storer
+	if *localCA {
+		config.LocalCA = getLocalCAConfig()
+		if *shareLocalCA {
+			if localCAStorer, err = getLocalCAStorer(logger); err != nil {
+				return err
+			}
+		}
+	}
+	eabKey, err := readSecret(*eabHmacKey, *eabHmacKeyFile)
+	if err != nil {
+		return err
 	}
-	var locker certmanager.Locker
-	var storer certmanager.Storer
-	if *awsSecretId != "" {
-		lockingStorer, err := awssecretsmanager.New(*awsSecretId, logger)
+	if *fallbackCaDirectoryURL == "" {
+		config.CaDirectoryURL = getDirectoryURL()
+		config.EabHmacKey = eabKey
+		config.EabKeyId = *eabKeyId
+	} else {
+		fallbackEabKey, err := readSecret(*fallbackEabHmacKey,
+			*fallbackEabHmacKeyFile)
 		if err != nil {
 			return err
 		}
-		locker = lockingStorer
-		storer = lockingStorer
+		config.CertificateAuthorities = []certmanager.CertificateAuthority{
+			{
+				DirectoryURL: getDirectoryURL(),
+				EabHmacKey:   eabKey,
+				EabKeyId:     *eabKeyId,
+			},
+			{
+				DirectoryURL: *fallbackCaDirectoryURL,
+				EabHmacKey:   fallbackEabKey,
+				EabKeyId:     *fallbackEabKeyId,
+			},
+		}
 	}
-	cm, err := certmanager.New(domainList, *cert, *key, locker, *challenge,
-		responder, storer, 0.0, directoryURL, *keyType, logger)
+	// Subscribe before the manager is started, so that the events for the
+	// certificate loaded or issued at startup are not missed.
+	events := make(chan certmanager.Event, 16)
+	cm, err := certmanager.NewWithConfig(config,
+		certmanager.Params{
+			Events:        events,
+			LocalCAStorer: localCAStorer,
+			Locker:        locker,
+			Logger:        logger,
+			Responder:     responder,
+			Storer:        storer,
+		})
 	if err != nil {
 		return err
 	}
+	dashboard.setCertWriter(cm)
+	if *localCA {
+		http.HandleFunc("/local-ca.pem", makeLocalCAHandler(cm))
+	}
 	logger.Println("certificate manager created")
-	for range cm.GetWriteNotifier() {
-		if err := runNotifier(); err != nil {
+	notifyEvents := make(map[string]struct{})
+	for _, eventType := range strings.Fields(*notifierEvents) {
+		notifyEvents[eventType] = struct{}{}
+	}
+	if _, err := os.Stat(*cert); err == nil {
+		if err := writeOutputs(logger); err != nil {
 			logger.Println(err)
 		}
 	}
-	return nil
-}
-
-func runNotifier() error {
-	splitCommand := strings.Fields(*notifierCommand)
-	if len(splitCommand) < 1 {
-		return nil
-	}
-	cmd := exec.Command(splitCommand[0], splitCommand[1:]...)
-	if output, err := cmd.CombinedOutput(); err != nil {
-		return fmt.Errorf("error running: %s: %s: %s",
-			splitCommand[0], err, string(output))
+	for event := range events {
+		switch event.Type {
+		case certmanager.EventIssued, certmanager.EventLoadedFromStorer:
+			if err := writeOutputs(logger); err != nil {
+				logger.Println(err)
+			}
+		}
+		if _, ok := notifyEvents[event.Type.String()]; !ok {
+			continue
+		}
+		if err := runNotifier(event); err != nil {
+			logger.Println(err)
+		}
 	}
 	return nil
 }
 
-func setupDashboard(logger htmlWriterLogger) error {
+func setupDashboard(logger htmlWriterLogger) (*dashboardType, error) {
+	dashboard := &dashboardType{htmlWriter: logger}
 	if *adminPortNum < 1 {
-		return nil
+		return dashboard, nil
 	}
 	listener, err := net.Listen("tcp", fmt.Sprintf(":%d", *adminPortNum))
 	if err != nil {
-		return err
+		return nil, err
 	}
-	dashboard := &dashboardType{logger}
 	html.HandleFunc("/", dashboard.statusHandler)
+	http.Handle("/prometheus_metrics", promhttp.Handler())
 	go http.Serve(listener, nil)
-	return nil
+	return dashboard, nil
+}
+
+func (d *dashboardType) setCertWriter(certWriter html.HtmlWriter) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	d.certWriter = certWriter
 }
 
 func (d *dashboardType) statusHandler(w http.ResponseWriter,
@@ -225,6 +572,15 @@ func (d *dashboardType) statusHandler(w http.ResponseWriter,
 	fmt.Fprintln(writer, "<h1>certmanager status page</h1>")
 	fmt.Fprintln(writer, "</center>")
 	html.WriteHeaderWithRequest(writer, req)
+	d.mutex.Lock()
+	certWriter := d.certWriter
+	d.mutex.Unlock()
+	if certWriter != nil {
+		fmt.Fprintln(writer, "<h3>")
+		certWriter.WriteHtml(writer)
+		fmt.Fprintln(writer, "</h3>")
+		fmt.Fprintln(writer, "<hr>")
+	}
 	fmt.Fprintln(writer, "<h3>")
 	d.htmlWriter.WriteHtml(writer)
 	fmt.Fprintln(writer, "</h3>")
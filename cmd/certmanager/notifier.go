@@ -0,0 +1,88 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/Cloud-Foundations/golib/pkg/crypto/certmanager"
+)
+
+type eventJSON struct {
+	Error      string     `json:",omitempty"`
+	ErrorClass string     `json:",omitempty"`
+	Issuer     string     `json:",omitempty"`
+	Names      []string   `json:",omitempty"`
+	NotAfter   *time.Time `json:",omitempty"`
+	Serial     string     `json:",omitempty"`
+	Source     string     `json:",omitempty"`
+	Time       time.Time
+	Type       string
+}
+
+// makeNotifierEnvironment returns the environment for the notifier command,
+// which includes the event details.
+func makeNotifierEnvironment(event certmanager.Event) []string {
+	environment := append(os.Environ(),
+		"CERTMANAGER_EVENT="+event.Type.String(),
+		"CERTMANAGER_ISSUER="+event.Issuer,
+		"CERTMANAGER_NAMES="+strings.Join(event.Names, " "),
+		"CERTMANAGER_SERIAL="+event.Serial,
+		"CERTMANAGER_SOURCE="+event.Source,
+		"CERTMANAGER_TIME="+event.Time.Format(time.RFC3339))
+	if !event.NotAfter.IsZero() {
+		environment = append(environment,
+			"CERTMANAGER_NOT_AFTER="+event.NotAfter.Format(time.RFC3339))
+	}
+	if event.Error != nil {
+		environment = append(environment,
+			"CERTMANAGER_ERROR="+event.Error.Error())
+	}
+	if err, ok := event.Error.(*certmanager.RenewalError); ok {
+		environment = append(environment,
+			"CERTMANAGER_ERROR_CLASS="+err.Class.String())
+	}
+	return environment
+}
+
+// runNotifier will run the notifier command (if specified). The event details
+// are passed in environment variables and as JSON on stdin.
+func runNotifier(event certmanager.Event) error {
+	splitCommand := strings.Fields(*notifierCommand)
+	if len(splitCommand) < 1 {
+		return nil
+	}
+	eventData := eventJSON{
+		Issuer: event.Issuer,
+		Names:  event.Names,
+		Serial: event.Serial,
+		Source: event.Source,
+		Time:   event.Time,
+		Type:   event.Type.String(),
+	}
+	if event.Error != nil {
+		eventData.Error = event.Error.Error()
+	}
+	if err, ok := event.Error.(*certmanager.RenewalError); ok {
+		eventData.ErrorClass = err.Class.String()
+	}
+	if !event.NotAfter.IsZero() {
+		eventData.NotAfter = &event.NotAfter
+	}
+	stdin, err := json.Marshal(eventData)
+	if err != nil {
+		return err
+	}
+	cmd := exec.Command(splitCommand[0], splitCommand[1:]...)
+	cmd.Env = makeNotifierEnvironment(event)
+	cmd.Stdin = bytes.NewReader(append(stdin, '\n'))
+	if output, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("error running: %s: %s: %s",
+			splitCommand[0], err, string(output))
+	}
+	return nil
+}
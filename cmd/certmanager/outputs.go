@@ -0,0 +1,100 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/Cloud-Foundations/golib/pkg/crypto/certmanager"
+	"github.com/Cloud-Foundations/golib/pkg/crypto/certmanager/encoding"
+	"github.com/Cloud-Foundations/golib/pkg/log"
+)
+
+// readPKCS12Password will read the PKCS#12 password from the password file,
+// if specified.
+func readPKCS12Password() (string, error) {
+	if *pkcs12PasswordFile == "" {
+		return *pkcs12Password, nil
+	}
+	data, err := ioutil.ReadFile(*pkcs12PasswordFile)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(string(data), "\r\n"), nil
+}
+
+// writeFile will atomically write data to a file, by writing to a temporary
+// file in the same directory and then renaming it.
+func writeFile(filename string, data []byte) error {
+	file, err := ioutil.TempFile(filepath.Dir(filename),
+		"."+filepath.Base(filename)+"~")
+	if err != nil {
+		return err
+	}
+	tmpFilename := file.Name()
+	defer os.Remove(tmpFilename)
+	if _, err := file.Write(data); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmpFilename, filename)
+}
+
+// writeOutputs will write the certificate and key files in the extra output
+// formats which were specified.
+func writeOutputs(logger log.DebugLogger) error {
+	if *jwksFile == "" && *pemBundleFile == "" && *pkcs12File == "" {
+		return nil
+	}
+	certPemBlock, err := ioutil.ReadFile(*cert)
+	if err != nil {
+		return err
+	}
+	keyPemBlock, err := ioutil.ReadFile(*key)
+	if err != nil {
+		return err
+	}
+	certificate := &certmanager.Certificate{
+		CertPemBlock: certPemBlock,
+		KeyPemBlock:  keyPemBlock,
+	}
+	if *jwksFile != "" {
+		data, err := encoding.EncodeJWKS(certificate)
+		if err != nil {
+			return err
+		}
+		if err := writeFile(*jwksFile, data); err != nil {
+			return err
+		}
+		logger.Debugf(0, "wrote: %s\n", *jwksFile)
+	}
+	if *pemBundleFile != "" {
+		data, err := encoding.EncodePEMBundle(certificate)
+		if err != nil {
+			return err
+		}
+		if err := writeFile(*pemBundleFile, data); err != nil {
+			return err
+		}
+		logger.Debugf(0, "wrote: %s\n", *pemBundleFile)
+	}
+	if *pkcs12File != "" {
+		password, err := readPKCS12Password()
+		if err != nil {
+			return err
+		}
+		data, err := encoding.EncodePKCS12(certificate, password)
+		if err != nil {
+			return err
+		}
+		if err := writeFile(*pkcs12File, data); err != nil {
+			return err
+		}
+		logger.Debugf(0, "wrote: %s\n", *pkcs12File)
+	}
+	return nil
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+
+	"golang.org/x/crypto/acme"
+
+	"github.com/Cloud-Foundations/golib/pkg/crypto/certmanager"
+	"github.com/Cloud-Foundations/golib/pkg/log"
+)
+
+var revocationReasons = map[string]acme.CRLReasonCode{
+	"affiliationChanged":   acme.CRLReasonAffiliationChanged,
+	"cessationOfOperation": acme.CRLReasonCessationOfOperation,
+	"keyCompromise":        acme.CRLReasonKeyCompromise,
+	"superseded":           acme.CRLReasonSuperseded,
+	"unspecified":          acme.CRLReasonUnspecified,
+}
+
+// readCertificate will read the certificate and private key from the remote
+// store (if specified) or from the certificate and key files.
+func readCertificate(logger log.DebugLogger) (*certmanager.Certificate,
+	error) {
+	_, storer, err := getLockingStorer(logger)
+	if err != nil {
+		return nil, err
+	}
+	if storer != nil {
+		return storer.Read()
+	}
+	if *cert == "" {
+		return nil, errors.New("no cert file specified")
+	}
+	if *key == "" {
+		return nil, errors.New("no key file specified")
+	}
+	certPemBlock, err := ioutil.ReadFile(*cert)
+	if err != nil {
+		return nil, err
+	}
+	keyPemBlock, err := ioutil.ReadFile(*key)
+	if err != nil {
+		return nil, err
+	}
+	return &certmanager.Certificate{
+		CertPemBlock: certPemBlock,
+		KeyPemBlock:  keyPemBlock,
+	}, nil
+}
+
+func runRevoke(args []string, logger log.DebugLogger) error {
+	reason := acme.CRLReasonUnspecified
+	if len(args) > 1 {
+		return errors.New("usage: certmanager [flags...] revoke [reason]")
+	}
+	if len(args) == 1 {
+		var ok bool
+		if reason, ok = revocationReasons[args[0]]; !ok {
+			return fmt.Errorf("unknown revocation reason: %s", args[0])
+		}
+	}
+	cert, err := readCertificate(logger)
+	if err != nil {
+		return err
+	}
+	err = certmanager.RevokeCertificate(context.Background(),
+		getDirectoryURL(), cert, reason)
+	if err != nil {
+		return err
+	}
+	logger.Println("certificate revoked")
+	return nil
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"errors"
+
+	"github.com/Cloud-Foundations/golib/pkg/crypto/certmanager/storage/encrypted"
+	"github.com/Cloud-Foundations/golib/pkg/log"
+)
+
+// runRewrap will re-encrypt the private keys in the remote store with the
+// current key-encryption key.
+func runRewrap(args []string, logger log.DebugLogger) error {
+	if len(args) > 0 {
+		return errors.New("usage: certmanager [flags...] rewrap")
+	}
+	if *encryptionKeyFile == "" {
+		return errors.New("no encryption key file specified")
+	}
+	keyProvider, err := encrypted.NewKeyfileProvider(*encryptionKeyFile)
+	if err != nil {
+		return err
+	}
+	locker, storer, err := getPlainLockingStorer(logger)
+	if err != nil {
+		return err
+	}
+	if storer == nil {
+		return errors.New("no remote store specified")
+	}
+	if locker != nil {
+		if err := locker.Lock(); err != nil {
+			return err
+		}
+		defer locker.Unlock()
+	}
+	return encrypted.Rewrap(storer, keyProvider, logger)
+}
@@ -9,6 +9,10 @@ const (
 	AcmeProxyCleanupResponses = "/api/responses/cleanup"
 	AcmeProxyRecordResponse   = "/api/responses/recordOne"
 
+	AcmeProxyHmacAuthScheme        = "ACME-PROXY-HMAC-SHA256"
+	AcmeProxyPresignedMethodHeader = "X-Acme-Proxy-Presigned-Method"
+	AcmeProxyPresignedUrlHeader    = "X-Acme-Proxy-Presigned-Url"
+
 	OpenIDCConfigurationDocumentPath = "/.well-known/openid-configuration"
 
 	// Copied from github.com/Cloud-Foundations/Dominator/constants
@@ -0,0 +1,456 @@
+package certmanager
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/crypto/acme"
+
+	"github.com/Cloud-Foundations/golib/pkg/log"
+)
+
+const (
+	accountFileSuffix = ".acme-account"
+	accountURLHeader  = "Account-URL"
+)
+
+var errAcmeNotEnabled = errors.New("ACME not enabled")
+
+func decodeKeyPEM(keyPemBlock []byte) (crypto.Signer, error) {
+	block, _ := pem.Decode(keyPemBlock)
+	if block == nil {
+		return nil, errors.New("unable to decode PEM private key")
+	}
+	return parseKeyDER(block.Bytes)
+}
+
+func equalContacts(left, right []string) bool {
+	if len(left) != len(right) {
+		return false
+	}
+	for index, contact := range left {
+		if contact != right[index] {
+			return false
+		}
+	}
+	return true
+}
+
+func isAccountUnusable(err error) bool {
+	if err == acme.ErrNoAccount {
+		return true
+	}
+	if acmeErr, ok := err.(*acme.Error); ok {
+		return acmeErr.ProblemType ==
+			"urn:ietf:params:acme:error:unauthorized"
+	}
+	return false
+}
+
+func loadAccount(filename string) (*Account, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("unable to decode PEM in: %s", filename)
+	}
+	account := &Account{
+		KeyPemBlock: pem.EncodeToMemory(&pem.Block{
+			Type:  block.Type,
+			Bytes: block.Bytes,
+		}),
+		URL: block.Headers[accountURLHeader],
+	}
+	if err := account.parse(); err != nil {
+		return nil, err
+	}
+	return account, nil
+}
+
+func makeAccount() (*Account, error) {
+	key, err := makeKeyECDSA()
+	if err != nil {
+		return nil, err
+	}
+	keyPemBlock, err := encodeKeyPEM(key)
+	if err != nil {
+		return nil, err
+	}
+	return &Account{KeyPemBlock: keyPemBlock, key: key}, nil
+}
+
+// makeContacts will convert a list of e-mail addresses to a list of contact
+// URLs.
+func makeContacts(emailAddresses []string) []string {
+	if len(emailAddresses) < 1 {
+		return nil
+	}
+	contacts := make([]string, 0, len(emailAddresses))
+	for _, emailAddress := range emailAddresses {
+		if strings.HasPrefix(emailAddress, "mailto:") {
+			contacts = append(contacts, emailAddress)
+		} else {
+			contacts = append(contacts, "mailto:"+emailAddress)
+		}
+	}
+	return contacts
+}
+
+// makeExternalAccountBinding will create an External Account Binding from a
+// key ID and a Base64url-encoded HMAC key. If both are empty, nil is returned.
+func makeExternalAccountBinding(keyId, hmacKey string) (
+	*acme.ExternalAccountBinding, error) {
+	if keyId == "" && hmacKey == "" {
+		return nil, nil
+	}
+	if keyId == "" {
+		return nil, errors.New("no EAB key ID specified")
+	}
+	if hmacKey == "" {
+		return nil, errors.New("no EAB HMAC key specified")
+	}
+	key, err := base64.RawURLEncoding.DecodeString(
+		strings.TrimRight(hmacKey, "="))
+	if err != nil {
+		key, err = base64.StdEncoding.DecodeString(hmacKey)
+		if err != nil {
+			return nil, fmt.Errorf("error decoding EAB HMAC key: %s", err)
+		}
+	}
+	return &acme.ExternalAccountBinding{KID: keyId, Key: key}, nil
+}
+
+func newAccountManager(caDirectoryURL string, contacts []string,
+	eabKeyId, eabHmacKey string, filename string, storer AccountStorer,
+	logger log.DebugLogger) (*accountManager, error) {
+	eab, err := makeExternalAccountBinding(eabKeyId, eabHmacKey)
+	if err != nil {
+		return nil, err
+	}
+	return &accountManager{
+		caDirectoryURL: caDirectoryURL,
+		contacts:       makeContacts(contacts),
+		eab:            eab,
+		filename:       filename,
+		logger:         logger,
+		storer:         storer,
+	}, nil
+}
+
+func parseKeyDER(keyDER []byte) (crypto.Signer, error) {
+	if key, err := x509.ParseECPrivateKey(keyDER); err == nil {
+		return key, nil
+	}
+	if key, err := x509.ParsePKCS1PrivateKey(keyDER); err == nil {
+		return key, nil
+	}
+	key, err := x509.ParsePKCS8PrivateKey(keyDER)
+	if err != nil {
+		return nil, errors.New("unable to parse private key")
+	}
+	if signer, ok := key.(crypto.Signer); ok {
+		return signer, nil
+	}
+	return nil, errors.New("unsupported private key type")
+}
+
+func writeAccount(filename string, account *Account) error {
+	block, _ := pem.Decode(account.KeyPemBlock)
+	if block == nil {
+		return errors.New("unable to decode PEM private key")
+	}
+	if account.URL != "" {
+		block.Headers = map[string]string{accountURLHeader: account.URL}
+	}
+	tmpFilename := fmt.Sprintf("%s~%d~", filename, os.Getpid())
+	defer os.Remove(tmpFilename)
+	err := ioutil.WriteFile(tmpFilename, pem.EncodeToMemory(block), 0600)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmpFilename, filename)
+}
+
+func (account *Account) parse() error {
+	key, err := decodeKeyPEM(account.KeyPemBlock)
+	if err != nil {
+		return err
+	}
+	account.key = key
+	return nil
+}
+
+func (cm *CertificateManager) deactivateAccount(ctx context.Context) error {
+	if cm.account == nil {
+		return errAcmeNotEnabled
+	}
+	return cm.account.deactivate(ctx)
+}
+
+func (cm *CertificateManager) getAccount(ctx context.Context) (
+	*acme.Account, error) {
+	if cm.account == nil {
+		return nil, errAcmeNotEnabled
+	}
+	return cm.account.get(ctx)
+}
+
+func (cm *CertificateManager) rotateAccountKey(ctx context.Context) error {
+	if cm.account == nil {
+		return errAcmeNotEnabled
+	}
+	return cm.account.rotateKey(ctx)
+}
+
+// checkError will forget the ACME client if err indicates that the account is
+// unusable, so that the account is loaded again (possibly from the remote
+// store) or registered for the next request. This must be called with the lock
+// held.
+func (am *accountManager) checkError(err error) {
+	if err == nil || am.client == nil {
+		return
+	}
+	if !isAccountUnusable(err) &&
+		classifyError(err).Class != ErrorClassAccount {
+		return
+	}
+	am.logger.Printf("forgetting ACME account: %s: %s\n", am.client.KID, err)
+	am.client = nil
+}
+
+func (am *accountManager) deactivate(ctx context.Context) error {
+	am.mutex.Lock()
+	defer am.mutex.Unlock()
+	if err := am.makeClient(ctx); err != nil {
+		return err
+	}
+	if err := am.client.DeactivateReg(ctx); err != nil {
+		return err
+	}
+	am.logger.Printf("deactivated ACME account: %s\n", am.client.KID)
+	am.client = nil
+	if am.filename != "" {
+		if err := os.Remove(am.filename); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	if am.storer == nil {
+		return nil
+	}
+	if deleter, ok := am.storer.(AccountDeleter); ok {
+		return deleter.DeleteAccount()
+	}
+	am.logger.Println(
+		"storer cannot delete the shared ACME account, it will be replaced")
+	return nil
+}
+
+// directoryURL returns the directory URL of the CA.
+func (am *accountManager) directoryURL() string {
+	if am.caDirectoryURL == "" {
+		return acme.LetsEncryptURL
+	}
+	return am.caDirectoryURL
+}
+
+func (am *accountManager) get(ctx context.Context) (*acme.Account, error) {
+	am.mutex.Lock()
+	defer am.mutex.Unlock()
+	if err := am.makeClient(ctx); err != nil {
+		return nil, err
+	}
+	acmeAccount, err := am.client.GetReg(ctx, string(am.client.KID))
+	am.checkError(err)
+	return acmeAccount, err
+}
+
+// loadLocal will load the account from the local file. If it is not
+// available, nil is returned.
+func (am *accountManager) loadLocal() *Account {
+	if am.filename == "" {
+		return nil
+	}
+	account, err := loadAccount(am.filename)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			am.logger.Println(err)
+		}
+		return nil
+	}
+	am.logger.Debugf(0, "loaded ACME account from: %s\n", am.filename)
+	return account
+}
+
+// loadStored will load the account from the remote store. If it is not
+// available, nil is returned.
+func (am *accountManager) loadStored() *Account {
+	if am.storer == nil {
+		return nil
+	}
+	account, err := am.storer.ReadAccount()
+	if err != nil {
+		am.logger.Println(err)
+		return nil
+	}
+	if err := account.parse(); err != nil {
+		am.logger.Println(err)
+		return nil
+	}
+	return account
+}
+
+// lookup will look up the account at the CA, setting the key and key ID of the
+// client. If the account is unusable, false is returned.
+func (am *accountManager) lookup(ctx context.Context, client *acme.Client,
+	account *Account) (bool, error) {
+	client.Key = account.key
+	client.KID = ""
+	if account.URL != "" {
+		client.KID = acme.KeyID(account.URL)
+	}
+	acmeAccount, err := client.GetReg(ctx, account.URL)
+	if err == nil && acmeAccount.Status != acme.StatusDeactivated &&
+		acmeAccount.Status != acme.StatusRevoked {
+		if !equalContacts(acmeAccount.Contact, am.contacts) {
+			am.updateContacts(ctx, client, acmeAccount)
+		}
+		if acmeAccount.URI == account.URL {
+			return true, nil
+		}
+		account.URL = acmeAccount.URI
+		client.KID = acme.KeyID(account.URL)
+		return true, am.save(account)
+	}
+	if err != nil && !isAccountUnusable(err) {
+		return false, err
+	}
+	am.logger.Printf("ACME account: %s unusable\n", account.URL)
+	client.KID = ""
+	return false, nil
+}
+
+// makeClient will create the ACME client, loading or registering the account
+// as required. This must be called with the lock held.
+func (am *accountManager) makeClient(ctx context.Context) error {
+	if am.client != nil {
+		return nil
+	}
+	client := &acme.Client{
+		DirectoryURL: am.caDirectoryURL,
+		UserAgent: filepath.Base(os.Args[0]) +
+			" using github.com/Cloud-Foundations/golib/pkg/crypto/certmanager",
+	}
+	if err := am.register(ctx, client); err != nil {
+		return err
+	}
+	am.client = client
+	return nil
+}
+
+// register will look up the account at the CA, registering a new account if
+// there is none or if the existing account is unusable. The account in the
+// local file is tried first, then the account in the remote store, since
+// another instance may have rotated the key or replaced the account.
+func (am *accountManager) register(ctx context.Context,
+	client *acme.Client) error {
+	local := am.loadLocal()
+	if local != nil {
+		if usable, err := am.lookup(ctx, client, local); err != nil {
+			return err
+		} else if usable {
+			return nil
+		}
+	}
+	stored := am.loadStored()
+	if stored != nil &&
+		(local == nil || !bytes.Equal(stored.KeyPemBlock, local.KeyPemBlock)) {
+		if usable, err := am.lookup(ctx, client, stored); err != nil {
+			return err
+		} else if usable {
+			if local == nil {
+				return nil
+			}
+			am.logger.Printf("replacing stale ACME account in: %s\n",
+				am.filename)
+			return writeAccount(am.filename, stored)
+		}
+	}
+	account, err := makeAccount()
+	if err != nil {
+		return err
+	}
+	client.Key = account.key
+	acmeAccount, err := client.Register(ctx,
+		&acme.Account{
+			Contact:                am.contacts,
+			ExternalAccountBinding: am.eab,
+		},
+		acme.AcceptTOS)
+	if err != nil {
+		return err
+	}
+	account.URL = acmeAccount.URI
+	am.logger.Printf("registered ACME account: %s\n", account.URL)
+	return am.save(account)
+}
+
+func (am *accountManager) rotateKey(ctx context.Context) error {
+	am.mutex.Lock()
+	defer am.mutex.Unlock()
+	if err := am.makeClient(ctx); err != nil {
+		return err
+	}
+	account, err := makeAccount()
+	if err != nil {
+		return err
+	}
+	account.URL = string(am.client.KID)
+	if err := am.client.AccountKeyRollover(ctx, account.key); err != nil {
+		am.checkError(err)
+		return err
+	}
+	am.logger.Printf("rotated key for ACME account: %s\n", account.URL)
+	return am.save(account)
+}
+
+// save will write the account to the local file and the remote store.
+func (am *accountManager) save(account *Account) error {
+	if am.filename != "" {
+		if err := writeAccount(am.filename, account); err != nil {
+			return err
+		}
+	}
+	if am.storer != nil {
+		if err := am.storer.WriteAccount(account); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// updateContacts will update the contacts for the account. Failures are
+// logged and otherwise ignored.
+func (am *accountManager) updateContacts(ctx context.Context,
+	client *acme.Client, acmeAccount *acme.Account) {
+	if len(am.contacts) < 1 {
+		return
+	}
+	acmeAccount.Contact = am.contacts
+	if _, err := client.UpdateReg(ctx, acmeAccount); err != nil {
+		am.logger.Printf("error updating ACME account contacts: %s\n", err)
+	} else {
+		am.logger.Printf("updated ACME account contacts: %v\n", am.contacts)
+	}
+}
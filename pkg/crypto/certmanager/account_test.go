@@ -0,0 +1,130 @@
+package certmanager
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"golang.org/x/crypto/acme"
+
+	"github.com/Cloud-Foundations/golib/pkg/crypto/certmanager/acmetest"
+	"github.com/Cloud-Foundations/golib/pkg/log/testlogger"
+)
+
+type testAccountStorer struct {
+	mutex   sync.Mutex // Protect everything below.
+	account *Account
+}
+
+var _ AccountDeleter = (*testAccountStorer)(nil)
+
+func (s *testAccountStorer) DeleteAccount() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.account = nil
+	return nil
+}
+
+func (s *testAccountStorer) ReadAccount() (*Account, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.account == nil {
+		return nil, os.ErrNotExist
+	}
+	return &Account{KeyPemBlock: s.account.KeyPemBlock, URL: s.account.URL},
+		nil
+}
+
+func (s *testAccountStorer) WriteAccount(account *Account) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.account = &Account{KeyPemBlock: account.KeyPemBlock, URL: account.URL}
+	return nil
+}
+
+func makeTestAccountManager(t *testing.T, server *acmetest.Server,
+	filename string, storer AccountStorer) *accountManager {
+	am, err := newAccountManager(server.DirectoryURL(), nil, "", "", filename,
+		storer, testlogger.New(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return am
+}
+
+func TestAccountCheckError(t *testing.T) {
+	server, _ := makeTestACME(t, acmetest.Config{})
+	am := makeTestAccountManager(t, server, "", nil)
+	if _, err := am.get(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	client := am.client
+	am.checkError(errors.New("connection refused"))
+	if am.client != client {
+		t.Error("client forgotten for network error")
+	}
+	am.checkError(&acme.Error{
+		ProblemType: "urn:ietf:params:acme:error:badPublicKey",
+		StatusCode:  400,
+	})
+	if am.client != nil {
+		t.Error("client not forgotten for account error")
+	}
+}
+
+func TestAccountDeactivate(t *testing.T) {
+	server, _ := makeTestACME(t, acmetest.Config{})
+	storer := &testAccountStorer{}
+	filename := filepath.Join(t.TempDir(), "cert.pem"+accountFileSuffix)
+	am := makeTestAccountManager(t, server, filename, storer)
+	if err := am.deactivate(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filename); !os.IsNotExist(err) {
+		t.Error("local account not removed")
+	}
+	if _, err := storer.ReadAccount(); err == nil {
+		t.Error("shared account not deleted")
+	}
+}
+
+func TestAccountRotatedByOtherInstance(t *testing.T) {
+	ctx := context.Background()
+	server, _ := makeTestACME(t, acmetest.Config{})
+	storer := &testAccountStorer{}
+	dir := t.TempDir()
+	am := makeTestAccountManager(t, server, filepath.Join(dir, "first"),
+		storer)
+	acmeAccount, err := am.get(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The other instance caches the account locally before the rotation.
+	filename := filepath.Join(dir, "second")
+	if err := writeAccount(filename, storer.account); err != nil {
+		t.Fatal(err)
+	}
+	if err := am.rotateKey(ctx); err != nil {
+		t.Fatal(err)
+	}
+	other := makeTestAccountManager(t, server, filename, storer)
+	otherAccount, err := other.get(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if otherAccount.URI != acmeAccount.URI {
+		t.Errorf("new account registered: %s != %s",
+			otherAccount.URI, acmeAccount.URI)
+	}
+	local, err := loadAccount(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(local.KeyPemBlock, storer.account.KeyPemBlock) {
+		t.Error("stale local account not replaced")
+	}
+}
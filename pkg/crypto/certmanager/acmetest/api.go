@@ -0,0 +1,202 @@
+/*
+Package acmetest implements an in-process ACME (RFC 8555) server for testing.
+
+The server issues certificates from a test CA (a root and an intermediate CA)
+which is created when the server is started. Challenges are validated against
+the Responders used by the client: http-01 challenges are validated with a HTTP
+request to HTTPAddress, dns-01 challenges are validated by looking up the TXT
+record with LookupTXT and tls-alpn-01 challenges are validated with a TLS
+handshake to TLSAddress. This allows end-to-end tests without network access.
+
+Errors may be injected for any endpoint with InjectFault, which may be used to
+simulate rate limits, server errors and rejected requests. Note that the
+golang.org/x/crypto/acme client retries requests which fail with a
+"429 Too Many Requests" or a 5xx status code, honouring the Retry-After delay,
+so such faults should specify a Count.
+
+Example:
+
+	server, err := acmetest.New(acmetest.Config{
+		CertificateLifetime: time.Hour * 2,
+		HTTPAddress:         httpServer.Listener.Addr().String(),
+	}, acmetest.Params{Logger: logger})
+	if err != nil {
+		return err
+	}
+	defer server.Close()
+	// Use server.DirectoryURL() as the CA directory URL.
+*/
+package acmetest
+
+import (
+	"context"
+	"crypto"
+	"crypto/x509"
+	"net/http/httptest"
+	"sync"
+	"time"
+
+	"github.com/Cloud-Foundations/golib/pkg/log"
+)
+
+const (
+	EndpointAccount           = "account"
+	EndpointAuthorization     = "authz"
+	EndpointCertificate       = "cert"
+	EndpointChallenge         = "challenge"
+	EndpointDirectory         = "directory"
+	EndpointFinalize          = "finalize"
+	EndpointKeyChange         = "keyChange"
+	EndpointNewAccount        = "newAccount"
+	EndpointNewNonce          = "newNonce"
+	EndpointNewOrder          = "newOrder"
+	EndpointOrder             = "order"
+	EndpointRevokeCertificate = "revokeCert"
+)
+
+// Config contains the configuration for a Server.
+type Config struct {
+	// CertificateLifetime specifies the lifetime of issued certificates. The
+	// default is 90 days.
+	CertificateLifetime time.Duration
+
+	// ChallengeTypes specifies the challenge types which are offered. The
+	// default is "dns-01", "http-01" and "tls-alpn-01". Only dns-01 is offered
+	// for wildcard names.
+	ChallengeTypes []string
+
+	// HTTPAddress specifies the address (host:port) to which http-01
+	// validation requests are sent. The Host header is set to the domain name.
+	// The default is port 80 of the domain.
+	HTTPAddress string
+
+	// LookupTXT is used to look up the TXT records for dns-01 validation. The
+	// default is net.DefaultResolver.LookupTXT.
+	LookupTXT func(ctx context.Context, name string) ([]string, error)
+
+	// ReuseAuthorizations specifies whether valid authorisations are re-used
+	// for new orders by the same account, as public CAs do. If false, every
+	// order requires new challenges to be validated.
+	ReuseAuthorizations bool
+
+	// SkipValidation specifies whether challenges are accepted without
+	// validation.
+	SkipValidation bool
+
+	// TLSAddress specifies the address (host:port) to which tls-alpn-01
+	// validation connections are made. The server name is set to the domain
+	// name. The default is port 443 of the domain.
+	TLSAddress string
+}
+
+// Fault specifies an error which is injected for requests to an endpoint.
+type Fault struct {
+	// Count specifies the number of requests which fail. If zero, all requests
+	// fail until ClearFaults is called.
+	Count uint
+
+	// Detail specifies the error detail. Optional.
+	Detail string
+
+	// Endpoint specifies the endpoint (one of the Endpoint* constants).
+	// Required.
+	Endpoint string
+
+	// ProblemType specifies the ACME problem type (i.e. "rateLimited"). The
+	// "urn:ietf:params:acme:error:" prefix is added if there is no colon.
+	// The default is "serverInternal".
+	ProblemType string
+
+	// RetryAfter specifies the value of the Retry-After header. Optional.
+	RetryAfter time.Duration
+
+	// StatusCode specifies the HTTP status code. The default is 429 for
+	// "rateLimited", 500 for "serverInternal" and 400 otherwise.
+	StatusCode int
+}
+
+// Params contains the parameters for a Server.
+type Params struct {
+	Logger log.DebugLogger
+}
+
+type Server struct {
+	challengeTypes      []string
+	httpAddress         string
+	intermediate        *x509.Certificate
+	intermediateKey     crypto.Signer
+	logger              log.DebugLogger
+	lookupTXT           func(ctx context.Context, name string) ([]string, error)
+	reuseAuthorizations bool
+	root                *x509.Certificate
+	server              *httptest.Server
+	skipValidation      bool
+	tlsAddress          string
+	mutex               sync.Mutex                // Protect everything below.
+	accounts            map[string]*account       // Key: ID.
+	authorizations      map[string]*authorization // Key: ID.
+	certificates        []*certificate            // In order of issue.
+	challenges          map[string]*challenge     // Key: ID.
+	faults              []*Fault
+	lifetime            time.Duration
+	nextId              uint64
+	nonces              map[string]struct{}
+	orders              map[string]*order // Key: ID.
+	requestCounts       map[string]uint   // Key: endpoint.
+}
+
+// New creates and starts a *Server which listens on a loopback address.
+func New(config Config, params Params) (*Server, error) {
+	return newServer(config, params)
+}
+
+// ClearFaults will remove all injected faults.
+func (s *Server) ClearFaults() {
+	s.clearFaults()
+}
+
+// Close will stop the server.
+func (s *Server) Close() {
+	s.server.Close()
+}
+
+// DirectoryURL returns the URL of the ACME directory.
+func (s *Server) DirectoryURL() string {
+	return s.server.URL + "/directory"
+}
+
+// InjectFault will inject an error for requests to an endpoint. Faults are
+// matched in the order they were injected.
+func (s *Server) InjectFault(fault Fault) {
+	s.injectFault(fault)
+}
+
+// IsRevoked returns true if the certificate was revoked.
+func (s *Server) IsRevoked(cert *x509.Certificate) bool {
+	return s.isRevoked(cert)
+}
+
+// Issued returns the certificates which were issued, in order of issue.
+func (s *Server) Issued() []*x509.Certificate {
+	return s.issued()
+}
+
+// RequestCount returns the number of requests received for an endpoint,
+// including requests which failed.
+func (s *Server) RequestCount(endpoint string) uint {
+	return s.requestCount(endpoint)
+}
+
+// Roots returns a pool containing the root CA certificate, which may be used
+// to verify issued certificates.
+func (s *Server) Roots() *x509.CertPool {
+	pool := x509.NewCertPool()
+	pool.AddCert(s.root)
+	return pool
+}
+
+// SetCertificateLifetime will set the lifetime of certificates issued after
+// the call.
+func (s *Server) SetCertificateLifetime(lifetime time.Duration) {
+	s.setCertificateLifetime(lifetime)
+}
@@ -0,0 +1,1220 @@
+package acmetest
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	caLifetime                 = time.Hour * 24 * 365 * 10
+	defaultCertificateLifetime = time.Hour * 24 * 90
+	maxRequestSize             = 1 << 20
+	orderLifetime              = time.Hour * 24 * 7
+	problemPrefix              = "urn:ietf:params:acme:error:"
+
+	statusDeactivated = "deactivated"
+	statusInvalid     = "invalid"
+	statusPending     = "pending"
+	statusProcessing  = "processing"
+	statusReady       = "ready"
+	statusValid       = "valid"
+)
+
+var (
+	defaultChallengeTypes = []string{"dns-01", "http-01", "tls-alpn-01"}
+
+	handlers = map[string]func(*Server, *request) (*response, *problem){
+		EndpointAccount:           (*Server).handleAccount,
+		EndpointAuthorization:     (*Server).handleAuthorization,
+		EndpointCertificate:       (*Server).handleCertificate,
+		EndpointChallenge:         (*Server).handleChallenge,
+		EndpointFinalize:          (*Server).handleFinalize,
+		EndpointKeyChange:         (*Server).handleKeyChange,
+		EndpointNewAccount:        (*Server).handleNewAccount,
+		EndpointNewOrder:          (*Server).handleNewOrder,
+		EndpointOrder:             (*Server).handleOrder,
+		EndpointRevokeCertificate: (*Server).handleRevokeCertificate,
+	}
+)
+
+type account struct {
+	contacts   []string
+	id         string
+	key        crypto.PublicKey
+	status     string
+	thumbprint string
+}
+
+type accountJSON struct {
+	Contact []string `json:"contact,omitempty"`
+	Status  string   `json:"status"`
+}
+
+type authorization struct {
+	accountId  string
+	challenges []*challenge
+	domain     string
+	expires    time.Time
+	id         string
+	status     string
+	wildcard   bool
+}
+
+type authorizationJSON struct {
+	Challenges []*challengeJSON `json:"challenges"`
+	Expires    time.Time        `json:"expires"`
+	Identifier identifier       `json:"identifier"`
+	Status     string           `json:"status"`
+	Wildcard   bool             `json:"wildcard,omitempty"`
+}
+
+type certificate struct {
+	accountId string
+	chainPEM  []byte
+	id        string // The hexadecimal serial number.
+	leaf      *x509.Certificate
+	revoked   bool
+}
+
+type challenge struct {
+	authorization *authorization
+	challengeType string
+	err           *problem
+	id            string
+	status        string
+	token         string
+	validated     time.Time
+}
+
+type challengeJSON struct {
+	Error     *problem `json:"error,omitempty"`
+	Status    string   `json:"status"`
+	Token     string   `json:"token"`
+	Type      string   `json:"type"`
+	URL       string   `json:"url"`
+	Validated string   `json:"validated,omitempty"`
+}
+
+type directoryJSON struct {
+	KeyChange  string   `json:"keyChange"`
+	Meta       struct{} `json:"meta"`
+	NewAccount string   `json:"newAccount"`
+	NewNonce   string   `json:"newNonce"`
+	NewOrder   string   `json:"newOrder"`
+	RevokeCert string   `json:"revokeCert"`
+}
+
+type identifier struct {
+	Type  string `json:"type"`
+	Value string `json:"value"`
+}
+
+type order struct {
+	accountId      string
+	authorizations []*authorization
+	certificate    *certificate
+	expires        time.Time
+	id             string
+	identifiers    []identifier
+	status         string
+}
+
+type orderJSON struct {
+	Authorizations []string     `json:"authorizations"`
+	Certificate    string       `json:"certificate,omitempty"`
+	Expires        time.Time    `json:"expires"`
+	Finalize       string       `json:"finalize"`
+	Identifiers    []identifier `json:"identifiers"`
+	Status         string       `json:"status"`
+}
+
+type problem struct {
+	Detail     string `json:"detail,omitempty"`
+	Status     int    `json:"status"`
+	Type       string `json:"type"`
+	retryAfter time.Duration
+}
+
+type request struct {
+	account *account // nil if the request is signed with a JWK.
+	id      string   // The resource ID from the path.
+	key     crypto.PublicKey
+	payload []byte
+}
+
+type response struct {
+	body        interface{} // Encoded as JSON, unless []byte.
+	contentType string
+	location    string
+	statusCode  int
+}
+
+func createCertificate(template, parent *x509.Certificate,
+	publicKey crypto.PublicKey, signer crypto.Signer) (
+	*x509.Certificate, error) {
+	if parent == nil {
+		parent = template
+	}
+	certDER, err := x509.CreateCertificate(rand.Reader, template, parent,
+		publicKey, signer)
+	if err != nil {
+		return nil, err
+	}
+	return x509.ParseCertificate(certDER)
+}
+
+// makeCA will create a root CA and an intermediate CA which issues
+// certificates.
+func makeCA() (*x509.Certificate, *x509.Certificate, crypto.Signer, error) {
+	rootKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	now := time.Now()
+	root, err := createCertificate(
+		&x509.Certificate{
+			BasicConstraintsValid: true,
+			IsCA:                  true,
+			KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+			NotAfter:              now.Add(caLifetime),
+			NotBefore:             now.Add(-time.Hour),
+			SerialNumber:          big.NewInt(1),
+			Subject:               pkix.Name{CommonName: "acmetest root CA"},
+		},
+		nil, rootKey.Public(), rootKey)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	intermediateKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	intermediate, err := createCertificate(
+		&x509.Certificate{
+			BasicConstraintsValid: true,
+			IsCA:                  true,
+			KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+			MaxPathLenZero:        true,
+			NotAfter:              now.Add(caLifetime),
+			NotBefore:             now.Add(-time.Hour),
+			SerialNumber:          big.NewInt(2),
+			Subject: pkix.Name{
+				CommonName: "acmetest intermediate CA",
+			},
+		},
+		root, intermediateKey.Public(), rootKey)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	return root, intermediate, intermediateKey, nil
+}
+
+func makeProblem(statusCode int, problemType, format string,
+	v ...interface{}) *problem {
+	return &problem{
+		Detail: fmt.Sprintf(format, v...),
+		Status: statusCode,
+		Type:   problemPrefix + problemType,
+	}
+}
+
+func newServer(config Config, params Params) (*Server, error) {
+	if config.CertificateLifetime <= 0 {
+		config.CertificateLifetime = defaultCertificateLifetime
+	}
+	if len(config.ChallengeTypes) < 1 {
+		config.ChallengeTypes = defaultChallengeTypes
+	}
+	for _, challengeType := range config.ChallengeTypes {
+		switch challengeType {
+		case "dns-01", "http-01", "tls-alpn-01":
+		default:
+			return nil, fmt.Errorf("unsupported challenge type: %s",
+				challengeType)
+		}
+	}
+	if config.LookupTXT == nil {
+		config.LookupTXT = net.DefaultResolver.LookupTXT
+	}
+	root, intermediate, intermediateKey, err := makeCA()
+	if err != nil {
+		return nil, err
+	}
+	s := &Server{
+		challengeTypes:      config.ChallengeTypes,
+		httpAddress:         config.HTTPAddress,
+		intermediate:        intermediate,
+		intermediateKey:     intermediateKey,
+		logger:              params.Logger,
+		lookupTXT:           config.LookupTXT,
+		reuseAuthorizations: config.ReuseAuthorizations,
+		root:                root,
+		skipValidation:      config.SkipValidation,
+		tlsAddress:          config.TLSAddress,
+		accounts:            make(map[string]*account),
+		authorizations:      make(map[string]*authorization),
+		challenges:          make(map[string]*challenge),
+		lifetime:            config.CertificateLifetime,
+		nonces:              make(map[string]struct{}),
+		orders:              make(map[string]*order),
+		requestCounts:       make(map[string]uint),
+	}
+	s.server = httptest.NewServer(http.HandlerFunc(s.serveHTTP))
+	s.logger.Debugf(0, "ACME test server listening on: %s\n", s.server.URL)
+	return s, nil
+}
+
+func randomString(length int) string {
+	data := make([]byte, length)
+	if _, err := rand.Read(data); err != nil {
+		panic(err)
+	}
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+// splitPath will split the request path into the endpoint and the resource ID.
+func splitPath(path string) (string, string) {
+	endpoint, id, _ := strings.Cut(strings.TrimPrefix(path, "/"), "/")
+	return endpoint, id
+}
+
+func writeProblem(w http.ResponseWriter, p *problem) {
+	if p.retryAfter > 0 {
+		seconds := (p.retryAfter + time.Second - 1) / time.Second
+		w.Header().Set("Retry-After", strconv.FormatInt(int64(seconds), 10))
+	}
+	w.Header().Set("Content-Type", "application/problem+json")
+	w.WriteHeader(p.Status)
+	json.NewEncoder(w).Encode(p)
+}
+
+func writeResponse(w http.ResponseWriter, resp *response) {
+	if resp.location != "" {
+		w.Header().Set("Location", resp.location)
+	}
+	var data []byte
+	switch body := resp.body.(type) {
+	case nil:
+	case []byte:
+		data = body
+	default:
+		var err error
+		if data, err = json.Marshal(body); err != nil {
+			writeProblem(w, makeProblem(http.StatusInternalServerError,
+				"serverInternal", "%s", err))
+			return
+		}
+		if resp.contentType == "" {
+			resp.contentType = "application/json"
+		}
+	}
+	if resp.contentType != "" {
+		w.Header().Set("Content-Type", resp.contentType)
+	}
+	w.WriteHeader(resp.statusCode)
+	w.Write(data)
+}
+
+func (f *Fault) problem() *problem {
+	problemType := f.ProblemType
+	if problemType == "" {
+		problemType = "serverInternal"
+	}
+	if !strings.Contains(problemType, ":") {
+		problemType = problemPrefix + problemType
+	}
+	statusCode := f.StatusCode
+	if statusCode == 0 {
+		switch strings.TrimPrefix(problemType, problemPrefix) {
+		case "rateLimited":
+			statusCode = http.StatusTooManyRequests
+		case "serverInternal":
+			statusCode = http.StatusInternalServerError
+		default:
+			statusCode = http.StatusBadRequest
+		}
+	}
+	detail := f.Detail
+	if detail == "" {
+		detail = "injected fault"
+	}
+	return &problem{
+		Detail:     detail,
+		Status:     statusCode,
+		Type:       problemType,
+		retryAfter: f.RetryAfter,
+	}
+}
+
+func (s *Server) accountURL(acct *account) string {
+	return s.makeURL(EndpointAccount, acct.id)
+}
+
+// checkOwner returns an error if the resource is not owned by the account
+// which signed the request.
+func (s *Server) checkOwner(r *request, accountId string) *problem {
+	if r.account == nil || r.account.id != accountId {
+		return makeProblem(http.StatusForbidden, "unauthorized",
+			"resource not owned by account")
+	}
+	return nil
+}
+
+func (s *Server) clearFaults() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.faults = nil
+}
+
+// findAccount returns the account with the key thumbprint, or nil. This must
+// be called with the lock held.
+func (s *Server) findAccount(thumbprint string) *account {
+	for _, acct := range s.accounts {
+		if acct.thumbprint == thumbprint {
+			return acct
+		}
+	}
+	return nil
+}
+
+// findCertificate returns the certificate with the ID, or nil. This must be
+// called with the lock held.
+func (s *Server) findCertificate(id string) *certificate {
+	for _, cert := range s.certificates {
+		if cert.id == id {
+			return cert
+		}
+	}
+	return nil
+}
+
+// getAuthorization returns an authorisation for the name for the account,
+// re-using a valid authorisation if configured. This must be called with the
+// lock held.
+func (s *Server) getAuthorization(accountId, name string) *authorization {
+	domain, wildcard := strings.CutPrefix(name, "*.")
+	now := time.Now()
+	if s.reuseAuthorizations {
+		for _, authz := range s.authorizations {
+			if authz.accountId == accountId && authz.domain == domain &&
+				authz.wildcard == wildcard && authz.status == statusValid &&
+				authz.expires.After(now) {
+				return authz
+			}
+		}
+	}
+	authz := &authorization{
+		accountId: accountId,
+		domain:    domain,
+		expires:   now.Add(orderLifetime),
+		id:        s.makeId(),
+		status:    statusPending,
+		wildcard:  wildcard,
+	}
+	for _, challengeType := range s.challengeTypes {
+		if wildcard && challengeType != "dns-01" {
+			continue
+		}
+		chal := &challenge{
+			authorization: authz,
+			challengeType: challengeType,
+			id:            s.makeId(),
+			status:        statusPending,
+			token:         randomString(32),
+		}
+		authz.challenges = append(authz.challenges, chal)
+		s.challenges[chal.id] = chal
+	}
+	s.authorizations[authz.id] = authz
+	return authz
+}
+
+func (s *Server) handle(req *http.Request, endpoint, id string) (
+	*response, *problem) {
+	switch endpoint {
+	case EndpointDirectory:
+		return &response{
+			body: &directoryJSON{
+				KeyChange:  s.makeURL(EndpointKeyChange, ""),
+				NewAccount: s.makeURL(EndpointNewAccount, ""),
+				NewNonce:   s.makeURL(EndpointNewNonce, ""),
+				NewOrder:   s.makeURL(EndpointNewOrder, ""),
+				RevokeCert: s.makeURL(EndpointRevokeCertificate, ""),
+			},
+			statusCode: http.StatusOK,
+		}, nil
+	case EndpointNewNonce:
+		if req.Method == "HEAD" {
+			return &response{statusCode: http.StatusOK}, nil
+		}
+		return &response{statusCode: http.StatusNoContent}, nil
+	}
+	if req.Method != "POST" {
+		return nil, makeProblem(http.StatusMethodNotAllowed, "malformed",
+			"method: %s not allowed", req.Method)
+	}
+	r, p := s.parseRequest(req, endpoint, id)
+	if p != nil {
+		return nil, p
+	}
+	return handlers[endpoint](s, r)
+}
+
+func (s *Server) handleAccount(r *request) (*response, *problem) {
+	if p := s.checkOwner(r, r.id); p != nil {
+		return nil, p
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if len(r.payload) > 0 {
+		var payload struct {
+			Contact []string `json:"contact"`
+			Status  string   `json:"status"`
+		}
+		if err := json.Unmarshal(r.payload, &payload); err != nil {
+			return nil, makeProblem(http.StatusBadRequest, "malformed",
+				"%s", err)
+		}
+		if payload.Contact != nil {
+			r.account.contacts = payload.Contact
+		}
+		switch payload.Status {
+		case "":
+		case statusDeactivated:
+			r.account.status = statusDeactivated
+			s.logger.Debugf(0, "deactivated account: %s\n",
+				s.accountURL(r.account))
+		default:
+			return nil, makeProblem(http.StatusBadRequest, "malformed",
+				"unsupported status: %s", payload.Status)
+		}
+	}
+	return s.makeAccountResponse(r.account, http.StatusOK), nil
+}
+
+func (s *Server) handleAuthorization(r *request) (*response, *problem) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	authz := s.authorizations[r.id]
+	if authz == nil {
+		return nil, s.notFound(EndpointAuthorization, r.id)
+	}
+	if p := s.checkOwner(r, authz.accountId); p != nil {
+		return nil, p
+	}
+	if len(r.payload) > 0 {
+		var payload struct {
+			Status string `json:"status"`
+		}
+		if err := json.Unmarshal(r.payload, &payload); err != nil {
+			return nil, makeProblem(http.StatusBadRequest, "malformed",
+				"%s", err)
+		}
+		if payload.Status == statusDeactivated {
+			authz.status = statusDeactivated
+			s.updateOrders()
+		}
+	}
+	return &response{
+		body:       s.makeAuthorizationJSON(authz),
+		statusCode: http.StatusOK,
+	}, nil
+}
+
+func (s *Server) handleCertificate(r *request) (*response, *problem) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	cert := s.findCertificate(r.id)
+	if cert == nil {
+		return nil, s.notFound(EndpointCertificate, r.id)
+	}
+	if p := s.checkOwner(r, cert.accountId); p != nil {
+		return nil, p
+	}
+	return &response{
+		body:        cert.chainPEM,
+		contentType: "application/pem-certificate-chain",
+		statusCode:  http.StatusOK,
+	}, nil
+}
+
+// handleChallenge will validate the challenge, if requested. Validation is
+// performed synchronously, so that the authorisation is final when the
+// response is sent.
+func (s *Server) handleChallenge(r *request) (*response, *problem) {
+	s.mutex.Lock()
+	chal := s.challenges[r.id]
+	if chal == nil {
+		s.mutex.Unlock()
+		return nil, s.notFound(EndpointChallenge, r.id)
+	}
+	authz := chal.authorization
+	if p := s.checkOwner(r, authz.accountId); p != nil {
+		s.mutex.Unlock()
+		return nil, p
+	}
+	validate := len(r.payload) > 0 && chal.status == statusPending &&
+		authz.status == statusPending
+	if validate {
+		chal.status = statusProcessing
+	}
+	keyAuthorisation := chal.token + "." + r.account.thumbprint
+	s.mutex.Unlock()
+	if validate {
+		p := s.validate(chal.challengeType, authz.domain, chal.token,
+			keyAuthorisation)
+		s.mutex.Lock()
+		if p == nil {
+			chal.status = statusValid
+			chal.validated = time.Now()
+			authz.status = statusValid
+			s.logger.Debugf(0, "validated %s challenge for: %s\n",
+				chal.challengeType, authz.domain)
+		} else {
+			chal.err = p
+			chal.status = statusInvalid
+			authz.status = statusInvalid
+			s.logger.Debugf(0, "%s challenge for: %s failed: %s\n",
+				chal.challengeType, authz.domain, p.Detail)
+		}
+		s.updateOrders()
+		s.mutex.Unlock()
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return &response{
+		body:       s.makeChallengeJSON(chal),
+		statusCode: http.StatusOK,
+	}, nil
+}
+
+func (s *Server) handleFinalize(r *request) (*response, *problem) {
+	var payload struct {
+		CSR string `json:"csr"`
+	}
+	if err := json.Unmarshal(r.payload, &payload); err != nil {
+		return nil, makeProblem(http.StatusBadRequest, "malformed", "%s", err)
+	}
+	csrDER, err := base64.RawURLEncoding.DecodeString(payload.CSR)
+	if err != nil {
+		return nil, makeProblem(http.StatusBadRequest, "badCSR", "%s", err)
+	}
+	csr, err := x509.ParseCertificateRequest(csrDER)
+	if err != nil {
+		return nil, makeProblem(http.StatusBadRequest, "badCSR", "%s", err)
+	}
+	if err := csr.CheckSignature(); err != nil {
+		return nil, makeProblem(http.StatusBadRequest, "badCSR", "%s", err)
+	}
+	if len(csr.EmailAddresses) > 0 || len(csr.IPAddresses) > 0 ||
+		len(csr.URIs) > 0 {
+		return nil, makeProblem(http.StatusBadRequest, "badCSR",
+			"only DNS names are supported")
+	}
+	csrNames := make(map[string]struct{}, len(csr.DNSNames)+1)
+	if csr.Subject.CommonName != "" {
+		csrNames[strings.ToLower(csr.Subject.CommonName)] = struct{}{}
+	}
+	for _, name := range csr.DNSNames {
+		csrNames[strings.ToLower(name)] = struct{}{}
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	o := s.orders[r.id]
+	if o == nil {
+		return nil, s.notFound(EndpointOrder, r.id)
+	}
+	if p := s.checkOwner(r, o.accountId); p != nil {
+		return nil, p
+	}
+	s.updateOrderStatus(o)
+	if o.status != statusReady {
+		return nil, makeProblem(http.StatusForbidden, "orderNotReady",
+			"order status: %s", o.status)
+	}
+	names := make([]string, 0, len(o.identifiers))
+	for _, ident := range o.identifiers {
+		if _, ok := csrNames[ident.Value]; !ok {
+			return nil, makeProblem(http.StatusBadRequest, "badCSR",
+				"CSR does not contain: %s", ident.Value)
+		}
+		names = append(names, ident.Value)
+	}
+	if len(csrNames) != len(names) {
+		return nil, makeProblem(http.StatusBadRequest, "badCSR",
+			"CSR contains names which are not in the order")
+	}
+	cert, err := s.issue(o.accountId, names, csr.PublicKey)
+	if err != nil {
+		return nil, makeProblem(http.StatusInternalServerError,
+			"serverInternal", "%s", err)
+	}
+	o.certificate = cert
+	o.status = statusValid
+	return s.makeOrderResponse(o, http.StatusOK), nil
+}
+
+func (s *Server) handleKeyChange(r *request) (*response, *problem) {
+	innerJWS, header, err := parseJWS(r.payload)
+	if err != nil {
+		return nil, makeProblem(http.StatusBadRequest, "malformed", "%s", err)
+	}
+	if header.JWK == nil || header.KID != "" || header.Nonce != "" ||
+		header.URL != s.makeURL(EndpointKeyChange, "") {
+		return nil, makeProblem(http.StatusBadRequest, "malformed",
+			"bad inner JWS header")
+	}
+	newKey, err := header.JWK.publicKey()
+	if err != nil {
+		return nil, makeProblem(http.StatusBadRequest, "badPublicKey", "%s",
+			err)
+	}
+	innerPayload, err := innerJWS.verify(header.Alg, newKey)
+	if err != nil {
+		return nil, makeProblem(http.StatusBadRequest, "malformed", "%s", err)
+	}
+	var payload struct {
+		Account string     `json:"account"`
+		OldKey  jsonWebKey `json:"oldKey"`
+	}
+	if err := json.Unmarshal(innerPayload, &payload); err != nil {
+		return nil, makeProblem(http.StatusBadRequest, "malformed", "%s", err)
+	}
+	oldKey, err := payload.OldKey.publicKey()
+	if err != nil {
+		return nil, makeProblem(http.StatusBadRequest, "malformed", "%s", err)
+	}
+	oldThumbprint, err := thumbprint(oldKey)
+	if err != nil {
+		return nil, makeProblem(http.StatusBadRequest, "malformed", "%s", err)
+	}
+	newThumbprint, err := thumbprint(newKey)
+	if err != nil {
+		return nil, makeProblem(http.StatusBadRequest, "badPublicKey", "%s",
+			err)
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if payload.Account != s.accountURL(r.account) ||
+		oldThumbprint != r.account.thumbprint {
+		return nil, makeProblem(http.StatusBadRequest, "malformed",
+			"account or old key does not match")
+	}
+	if other := s.findAccount(newThumbprint); other != nil {
+		return &response{
+			location:   s.accountURL(other),
+			statusCode: http.StatusConflict,
+		}, nil
+	}
+	r.account.key = newKey
+	r.account.thumbprint = newThumbprint
+	s.logger.Debugf(0, "changed key for account: %s\n",
+		s.accountURL(r.account))
+	return s.makeAccountResponse(r.account, http.StatusOK), nil
+}
+
+func (s *Server) handleNewAccount(r *request) (*response, *problem) {
+	var payload struct {
+		Contact            []string `json:"contact"`
+		OnlyReturnExisting bool     `json:"onlyReturnExisting"`
+	}
+	if err := json.Unmarshal(r.payload, &payload); err != nil {
+		return nil, makeProblem(http.StatusBadRequest, "malformed", "%s", err)
+	}
+	keyThumbprint, err := thumbprint(r.key)
+	if err != nil {
+		return nil, makeProblem(http.StatusBadRequest, "badPublicKey", "%s",
+			err)
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if acct := s.findAccount(keyThumbprint); acct != nil {
+		if acct.status != statusValid {
+			return nil, makeProblem(http.StatusUnauthorized, "unauthorized",
+				"account is %s", acct.status)
+		}
+		return s.makeAccountResponse(acct, http.StatusOK), nil
+	}
+	if payload.OnlyReturnExisting {
+		return nil, makeProblem(http.StatusBadRequest, "accountDoesNotExist",
+			"no account for key")
+	}
+	acct := &account{
+		contacts:   payload.Contact,
+		id:         s.makeId(),
+		key:        r.key,
+		status:     statusValid,
+		thumbprint: keyThumbprint,
+	}
+	s.accounts[acct.id] = acct
+	s.logger.Debugf(0, "registered account: %s\n", s.accountURL(acct))
+	return s.makeAccountResponse(acct, http.StatusCreated), nil
+}
+
+func (s *Server) handleNewOrder(r *request) (*response, *problem) {
+	var payload struct {
+		Identifiers []identifier `json:"identifiers"`
+	}
+	if err := json.Unmarshal(r.payload, &payload); err != nil {
+		return nil, makeProblem(http.StatusBadRequest, "malformed", "%s", err)
+	}
+	if len(payload.Identifiers) < 1 {
+		return nil, makeProblem(http.StatusBadRequest, "malformed",
+			"no identifiers")
+	}
+	identifiers := make([]identifier, 0, len(payload.Identifiers))
+	names := make(map[string]struct{}, len(payload.Identifiers))
+	for _, ident := range payload.Identifiers {
+		if ident.Type != "dns" {
+			return nil, makeProblem(http.StatusBadRequest,
+				"unsupportedIdentifier", "identifier type: %s", ident.Type)
+		}
+		name := strings.ToLower(strings.TrimSuffix(ident.Value, "."))
+		domain := strings.TrimPrefix(name, "*.")
+		if domain == "" || strings.ContainsAny(domain, "* /:") ||
+			net.ParseIP(domain) != nil {
+			return nil, makeProblem(http.StatusBadRequest,
+				"rejectedIdentifier", "invalid name: %s", ident.Value)
+		}
+		if _, ok := names[name]; ok {
+			continue
+		}
+		names[name] = struct{}{}
+		identifiers = append(identifiers, identifier{Type: "dns", Value: name})
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	o := &order{
+		accountId:   r.account.id,
+		expires:     time.Now().Add(orderLifetime),
+		id:          s.makeId(),
+		identifiers: identifiers,
+		status:      statusPending,
+	}
+	for _, ident := range identifiers {
+		o.authorizations = append(o.authorizations,
+			s.getAuthorization(r.account.id, ident.Value))
+	}
+	s.updateOrderStatus(o)
+	s.orders[o.id] = o
+	return s.makeOrderResponse(o, http.StatusCreated), nil
+}
+
+func (s *Server) handleOrder(r *request) (*response, *problem) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	o := s.orders[r.id]
+	if o == nil {
+		return nil, s.notFound(EndpointOrder, r.id)
+	}
+	if p := s.checkOwner(r, o.accountId); p != nil {
+		return nil, p
+	}
+	s.updateOrderStatus(o)
+	return s.makeOrderResponse(o, http.StatusOK), nil
+}
+
+// handleRevokeCertificate will revoke a certificate. The request must be
+// signed by the account which requested the certificate or by the
+// certificate key.
+func (s *Server) handleRevokeCertificate(r *request) (*response, *problem) {
+	var payload struct {
+		Certificate string `json:"certificate"`
+		Reason      int    `json:"reason"`
+	}
+	if err := json.Unmarshal(r.payload, &payload); err != nil {
+		return nil, makeProblem(http.StatusBadRequest, "malformed", "%s", err)
+	}
+	certDER, err := base64.RawURLEncoding.DecodeString(payload.Certificate)
+	if err != nil {
+		return nil, makeProblem(http.StatusBadRequest, "malformed", "%s", err)
+	}
+	leaf, err := x509.ParseCertificate(certDER)
+	if err != nil {
+		return nil, makeProblem(http.StatusBadRequest, "malformed", "%s", err)
+	}
+	if payload.Reason < 0 || payload.Reason > 10 || payload.Reason == 7 {
+		return nil, makeProblem(http.StatusBadRequest, "badRevocationReason",
+			"reason: %d", payload.Reason)
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	cert := s.findCertificate(leaf.SerialNumber.Text(16))
+	if cert == nil || !bytes.Equal(cert.leaf.Raw, certDER) {
+		return nil, makeProblem(http.StatusNotFound, "malformed",
+			"unknown certificate")
+	}
+	if r.account != nil {
+		if p := s.checkOwner(r, cert.accountId); p != nil {
+			return nil, p
+		}
+	} else {
+		keyThumbprint, _ := thumbprint(r.key)
+		certThumbprint, err := thumbprint(cert.leaf.PublicKey)
+		if err != nil || keyThumbprint != certThumbprint {
+			return nil, makeProblem(http.StatusForbidden, "unauthorized",
+				"key does not match certificate")
+		}
+	}
+	if cert.revoked {
+		return nil, makeProblem(http.StatusBadRequest, "alreadyRevoked",
+			"certificate already revoked")
+	}
+	cert.revoked = true
+	s.logger.Debugf(0, "revoked certificate serial: %s, reason: %d\n",
+		cert.id, payload.Reason)
+	return &response{statusCode: http.StatusOK}, nil
+}
+
+func (s *Server) injectFault(fault Fault) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.faults = append(s.faults, &fault)
+}
+
+func (s *Server) isRevoked(x509Cert *x509.Certificate) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	cert := s.findCertificate(x509Cert.SerialNumber.Text(16))
+	return cert != nil && cert.revoked
+}
+
+// issue will issue a certificate for the names. This must be called with the
+// lock held.
+func (s *Server) issue(accountId string, names []string,
+	publicKey crypto.PublicKey) (*certificate, error) {
+	serialBytes := make([]byte, 16)
+	if _, err := rand.Read(serialBytes); err != nil {
+		return nil, err
+	}
+	serialBytes[0] &= 0x7f // Ensure positive serial number.
+	keyUsage := x509.KeyUsageDigitalSignature
+	if _, ok := publicKey.(*rsa.PublicKey); ok {
+		keyUsage |= x509.KeyUsageKeyEncipherment
+	}
+	now := time.Now()
+	notAfter := now.Add(s.lifetime)
+	if notAfter.After(s.intermediate.NotAfter) {
+		notAfter = s.intermediate.NotAfter
+	}
+	leaf, err := createCertificate(
+		&x509.Certificate{
+			DNSNames:     names,
+			ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+			KeyUsage:     keyUsage,
+			NotAfter:     notAfter,
+			NotBefore:    now,
+			SerialNumber: new(big.Int).SetBytes(serialBytes),
+			Subject:      pkix.Name{CommonName: names[0]},
+		},
+		s.intermediate, publicKey, s.intermediateKey)
+	if err != nil {
+		return nil, err
+	}
+	chainPEM := &bytes.Buffer{}
+	for _, x509Cert := range []*x509.Certificate{leaf, s.intermediate} {
+		err := pem.Encode(chainPEM, &pem.Block{
+			Type:  "CERTIFICATE",
+			Bytes: x509Cert.Raw,
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	cert := &certificate{
+		accountId: accountId,
+		chainPEM:  chainPEM.Bytes(),
+		id:        leaf.SerialNumber.Text(16),
+		leaf:      leaf,
+	}
+	s.certificates = append(s.certificates, cert)
+	s.logger.Debugf(0, "issued certificate serial: %s for: %v, expires: %s\n",
+		cert.id, names, notAfter)
+	return cert, nil
+}
+
+func (s *Server) issued() []*x509.Certificate {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	certs := make([]*x509.Certificate, 0, len(s.certificates))
+	for _, cert := range s.certificates {
+		certs = append(certs, cert.leaf)
+	}
+	return certs
+}
+
+// makeAccountResponse returns the response for an account. This must be
+// called with the lock held.
+func (s *Server) makeAccountResponse(acct *account,
+	statusCode int) *response {
+	return &response{
+		body: &accountJSON{
+			Contact: acct.contacts,
+			Status:  acct.status,
+		},
+		location:   s.accountURL(acct),
+		statusCode: statusCode,
+	}
+}
+
+// makeAuthorizationJSON must be called with the lock held.
+func (s *Server) makeAuthorizationJSON(
+	authz *authorization) *authorizationJSON {
+	authzJSON := &authorizationJSON{
+		Challenges: make([]*challengeJSON, 0, len(authz.challenges)),
+		Expires:    authz.expires,
+		Identifier: identifier{Type: "dns", Value: authz.domain},
+		Status:     authz.status,
+		Wildcard:   authz.wildcard,
+	}
+	for _, chal := range authz.challenges {
+		authzJSON.Challenges = append(authzJSON.Challenges,
+			s.makeChallengeJSON(chal))
+	}
+	return authzJSON
+}
+
+// makeChallengeJSON must be called with the lock held.
+func (s *Server) makeChallengeJSON(chal *challenge) *challengeJSON {
+	chalJSON := &challengeJSON{
+		Error:  chal.err,
+		Status: chal.status,
+		Token:  chal.token,
+		Type:   chal.challengeType,
+		URL:    s.makeURL(EndpointChallenge, chal.id),
+	}
+	if !chal.validated.IsZero() {
+		chalJSON.Validated = chal.validated.Format(time.RFC3339)
+	}
+	return chalJSON
+}
+
+// makeId returns a new resource ID. This must be called with the lock held.
+func (s *Server) makeId() string {
+	s.nextId++
+	return strconv.FormatUint(s.nextId, 10)
+}
+
+// makeOrderResponse returns the response for an order. This must be called
+// with the lock held.
+func (s *Server) makeOrderResponse(o *order, statusCode int) *response {
+	orderJSON := &orderJSON{
+		Authorizations: make([]string, 0, len(o.authorizations)),
+		Expires:        o.expires,
+		Finalize:       s.makeURL(EndpointFinalize, o.id),
+		Identifiers:    o.identifiers,
+		Status:         o.status,
+	}
+	for _, authz := range o.authorizations {
+		orderJSON.Authorizations = append(orderJSON.Authorizations,
+			s.makeURL(EndpointAuthorization, authz.id))
+	}
+	if o.certificate != nil {
+		orderJSON.Certificate = s.makeURL(EndpointCertificate,
+			o.certificate.id)
+	}
+	return &response{
+		body:       orderJSON,
+		location:   s.makeURL(EndpointOrder, o.id),
+		statusCode: statusCode,
+	}
+}
+
+func (s *Server) makeURL(endpoint, id string) string {
+	if id == "" {
+		return s.server.URL + "/" + endpoint
+	}
+	return s.server.URL + "/" + endpoint + "/" + id
+}
+
+// matchFault returns the error for the first fault which matches the
+// endpoint, or nil. This must be called with the lock held.
+func (s *Server) matchFault(endpoint string) *problem {
+	for index, fault := range s.faults {
+		if fault.Endpoint != endpoint {
+			continue
+		}
+		if fault.Count > 0 {
+			fault.Count--
+			if fault.Count < 1 {
+				s.faults = append(s.faults[:index], s.faults[index+1:]...)
+			}
+		}
+		return fault.problem()
+	}
+	return nil
+}
+
+func (s *Server) notFound(endpoint, id string) *problem {
+	return makeProblem(http.StatusNotFound, "malformed", "no %s: %s",
+		endpoint, id)
+}
+
+// parseRequest will parse and verify a JWS request. The nonce is consumed.
+func (s *Server) parseRequest(req *http.Request, endpoint, id string) (
+	*request, *problem) {
+	body, err := ioutil.ReadAll(io.LimitReader(req.Body, maxRequestSize))
+	if err != nil {
+		return nil, makeProblem(http.StatusBadRequest, "malformed", "%s", err)
+	}
+	jws, header, err := parseJWS(body)
+	if err != nil {
+		return nil, makeProblem(http.StatusBadRequest, "malformed", "%s", err)
+	}
+	if header.URL != s.server.URL+req.URL.Path {
+		return nil, makeProblem(http.StatusUnauthorized, "unauthorized",
+			"JWS URL: %s does not match request", header.URL)
+	}
+	s.mutex.Lock()
+	_, ok := s.nonces[header.Nonce]
+	delete(s.nonces, header.Nonce)
+	s.mutex.Unlock()
+	if !ok {
+		return nil, makeProblem(http.StatusBadRequest, "badNonce",
+			"unknown nonce: %s", header.Nonce)
+	}
+	r := &request{id: id}
+	switch {
+	case header.JWK != nil && header.KID != "":
+		return nil, makeProblem(http.StatusBadRequest, "malformed",
+			"both jwk and kid specified")
+	case header.JWK != nil:
+		if endpoint != EndpointNewAccount &&
+			endpoint != EndpointRevokeCertificate {
+			return nil, makeProblem(http.StatusBadRequest, "malformed",
+				"jwk not allowed for: %s", endpoint)
+		}
+		if r.key, err = header.JWK.publicKey(); err != nil {
+			return nil, makeProblem(http.StatusBadRequest, "badPublicKey",
+				"%s", err)
+		}
+	case header.KID != "":
+		if endpoint == EndpointNewAccount {
+			return nil, makeProblem(http.StatusBadRequest, "malformed",
+				"kid not allowed for: %s", endpoint)
+		}
+		accountId := strings.TrimPrefix(header.KID,
+			s.makeURL(EndpointAccount, ""))
+		s.mutex.Lock()
+		acct := s.accounts[strings.TrimPrefix(accountId, "/")]
+		var status string
+		if acct != nil {
+			r.key = acct.key
+			status = acct.status
+		}
+		s.mutex.Unlock()
+		if acct == nil {
+			return nil, makeProblem(http.StatusBadRequest,
+				"accountDoesNotExist", "no account: %s", header.KID)
+		}
+		if status != statusValid {
+			return nil, makeProblem(http.StatusUnauthorized, "unauthorized",
+				"account is %s", status)
+		}
+		r.account = acct
+	default:
+		return nil, makeProblem(http.StatusBadRequest, "malformed",
+			"no jwk or kid specified")
+	}
+	if r.payload, err = jws.verify(header.Alg, r.key); err != nil {
+		return nil, makeProblem(http.StatusBadRequest, "malformed", "%s", err)
+	}
+	return r, nil
+}
+
+func (s *Server) requestCount(endpoint string) uint {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.requestCounts[endpoint]
+}
+
+func (s *Server) serveHTTP(w http.ResponseWriter, req *http.Request) {
+	endpoint, id := splitPath(req.URL.Path)
+	if _, ok := handlers[endpoint]; !ok && endpoint != EndpointDirectory &&
+		endpoint != EndpointNewNonce {
+		http.NotFound(w, req)
+		return
+	}
+	nonce := randomString(16)
+	s.mutex.Lock()
+	s.nonces[nonce] = struct{}{}
+	s.requestCounts[endpoint]++
+	fault := s.matchFault(endpoint)
+	s.mutex.Unlock()
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Replay-Nonce", nonce)
+	s.logger.Debugf(1, "%s %s\n", req.Method, req.URL.Path)
+	if fault != nil {
+		s.logger.Debugf(0, "injecting fault for: %s: %s\n",
+			req.URL.Path, fault.Type)
+		writeProblem(w, fault)
+		return
+	}
+	resp, p := s.handle(req, endpoint, id)
+	if p != nil {
+		s.logger.Debugf(1, "%s %s: %s: %s\n",
+			req.Method, req.URL.Path, p.Type, p.Detail)
+		writeProblem(w, p)
+		return
+	}
+	writeResponse(w, resp)
+}
+
+func (s *Server) setCertificateLifetime(lifetime time.Duration) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.lifetime = lifetime
+}
+
+// updateOrderStatus will update the status of a pending order from the status
+// of the authorisations. This must be called with the lock held.
+func (s *Server) updateOrderStatus(o *order) {
+	if o.status != statusPending {
+		return
+	}
+	if time.Now().After(o.expires) {
+		o.status = statusInvalid
+		return
+	}
+	ready := true
+	for _, authz := range o.authorizations {
+		switch authz.status {
+		case statusValid:
+		case statusPending, statusProcessing:
+			ready = false
+		default:
+			o.status = statusInvalid
+			return
+		}
+	}
+	if ready {
+		o.status = statusReady
+	}
+}
+
+// updateOrders will update the status of all the orders. This must be called
+// with the lock held.
+func (s *Server) updateOrders() {
+	for _, o := range s.orders {
+		s.updateOrderStatus(o)
+	}
+}
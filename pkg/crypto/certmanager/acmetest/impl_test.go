@@ -0,0 +1,329 @@
+package acmetest
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/acme"
+
+	"github.com/Cloud-Foundations/golib/pkg/log/testlogger"
+)
+
+// testHTTPResponder serves http-01 challenge responses.
+type testHTTPResponder struct {
+	mutex     sync.Mutex        // Protect everything below.
+	responses map[string]string // Key: URL path.
+}
+
+func issue(t *testing.T, ctx context.Context, client *acme.Client,
+	names []string, challengeType string,
+	respond func(chal *acme.Challenge) error) (
+	[][]byte, error) {
+	order, err := client.AuthorizeOrder(ctx, acme.DomainIDs(names...))
+	if err != nil {
+		return nil, err
+	}
+	for _, authzURL := range order.AuthzURLs {
+		authz, err := client.GetAuthorization(ctx, authzURL)
+		if err != nil {
+			return nil, err
+		}
+		var chal *acme.Challenge
+		for _, c := range authz.Challenges {
+			if c.Type == challengeType {
+				chal = c
+			}
+		}
+		if chal == nil {
+			t.Fatalf("no %s challenge for: %s", challengeType,
+				authz.Identifier.Value)
+		}
+		if err := respond(chal); err != nil {
+			return nil, err
+		}
+		if _, err := client.Accept(ctx, chal); err != nil {
+			return nil, err
+		}
+	}
+	if order, err = client.WaitOrder(ctx, order.URI); err != nil {
+		return nil, err
+	}
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	csr, err := x509.CreateCertificateRequest(rand.Reader,
+		&x509.CertificateRequest{
+			DNSNames: names,
+			Subject:  pkix.Name{CommonName: names[0]},
+		},
+		key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	chain, _, err := client.CreateOrderCert(ctx, order.FinalizeURL, csr, true)
+	return chain, err
+}
+
+func makeClient(t *testing.T, ctx context.Context, server *Server) (
+	*acme.Client, *acme.Account) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := &acme.Client{DirectoryURL: server.DirectoryURL(), Key: key}
+	account, err := client.Register(ctx, &acme.Account{}, acme.AcceptTOS)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return client, account
+}
+
+func (r *testHTTPResponder) ServeHTTP(w http.ResponseWriter,
+	req *http.Request) {
+	r.mutex.Lock()
+	response, ok := r.responses[req.URL.Path]
+	r.mutex.Unlock()
+	if !ok {
+		http.NotFound(w, req)
+		return
+	}
+	w.Write([]byte(response))
+}
+
+func TestAccount(t *testing.T) {
+	ctx := context.Background()
+	server, err := New(Config{}, Params{Logger: testlogger.New(t)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	client, account := makeClient(t, ctx, server)
+	existing, err := client.GetReg(ctx, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if existing.URI != account.URI {
+		t.Errorf("account URI: %s != %s", existing.URI, account.URI)
+	}
+	newKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := client.AccountKeyRollover(ctx, newKey); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.GetReg(ctx, ""); err != nil {
+		t.Fatalf("account not found with new key: %s", err)
+	}
+	if err := client.DeactivateReg(ctx); err != nil {
+		t.Fatal(err)
+	}
+	_, err = client.AuthorizeOrder(ctx, acme.DomainIDs("www.example.com"))
+	if err == nil {
+		t.Fatal("order accepted for deactivated account")
+	}
+	newClient := &acme.Client{DirectoryURL: server.DirectoryURL(), Key: newKey}
+	if _, err := newClient.GetReg(ctx, ""); err == nil {
+		t.Fatal("deactivated account returned")
+	}
+}
+
+func TestDNS01(t *testing.T) {
+	ctx := context.Background()
+	var mutex sync.Mutex
+	records := make(map[string][]string)
+	server, err := New(
+		Config{
+			ChallengeTypes: []string{"dns-01", "http-01"},
+			LookupTXT: func(ctx context.Context, name string) (
+				[]string, error) {
+				mutex.Lock()
+				defer mutex.Unlock()
+				return records[name], nil
+			},
+		},
+		Params{Logger: testlogger.New(t)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	client, _ := makeClient(t, ctx, server)
+	names := []string{"*.example.com", "example.com"}
+	chain, err := issue(t, ctx, client, names, "dns-01",
+		func(chal *acme.Challenge) error {
+			record, err := client.DNS01ChallengeRecord(chal.Token)
+			if err != nil {
+				return err
+			}
+			mutex.Lock()
+			defer mutex.Unlock()
+			name := "_acme-challenge.example.com"
+			records[name] = append(records[name], record)
+			return nil
+		})
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, err := x509.ParseCertificate(chain[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := leaf.VerifyHostname("www.example.com"); err != nil {
+		t.Error(err)
+	}
+	// Wildcard names must only be offered dns-01 challenges.
+	order, err := client.AuthorizeOrder(ctx, acme.DomainIDs("*.example.org"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	authz, err := client.GetAuthorization(ctx, order.AuthzURLs[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(authz.Challenges) != 1 || authz.Challenges[0].Type != "dns-01" {
+		t.Errorf("wildcard challenges: %d, first: %s",
+			len(authz.Challenges), authz.Challenges[0].Type)
+	}
+}
+
+func TestFault(t *testing.T) {
+	ctx := context.Background()
+	server, err := New(Config{SkipValidation: true},
+		Params{Logger: testlogger.New(t)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	client, _ := makeClient(t, ctx, server)
+	server.InjectFault(Fault{
+		Count:       1,
+		Endpoint:    EndpointNewOrder,
+		ProblemType: "rejectedIdentifier",
+	})
+	_, err = client.AuthorizeOrder(ctx, acme.DomainIDs("www.example.com"))
+	var acmeErr *acme.Error
+	if !errors.As(err, &acmeErr) {
+		t.Fatalf("error: %v is not an ACME error", err)
+	}
+	if acmeErr.StatusCode != http.StatusBadRequest ||
+		!strings.HasSuffix(acmeErr.ProblemType, ":rejectedIdentifier") {
+		t.Errorf("status: %d, problem: %s",
+			acmeErr.StatusCode, acmeErr.ProblemType)
+	}
+	// A rate limit with a Retry-After delay is retried by the client.
+	server.InjectFault(Fault{
+		Count:       1,
+		Endpoint:    EndpointNewOrder,
+		ProblemType: "rateLimited",
+		RetryAfter:  time.Second,
+	})
+	_, err = issue(t, ctx, client, []string{"www.example.com"}, "http-01",
+		func(chal *acme.Challenge) error { return nil })
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count := server.RequestCount(EndpointNewOrder); count != 3 {
+		t.Errorf("newOrder requests: %d != 3", count)
+	}
+	// A fault without a count persists until cleared.
+	server.InjectFault(Fault{Endpoint: EndpointFinalize,
+		ProblemType: "badCSR"})
+	for i := 0; i < 2; i++ {
+		_, err = issue(t, ctx, client, []string{"www.example.com"}, "http-01",
+			func(chal *acme.Challenge) error { return nil })
+		if err == nil {
+			t.Fatal("finalize fault not injected")
+		}
+	}
+	server.ClearFaults()
+	_, err = issue(t, ctx, client, []string{"www.example.com"}, "http-01",
+		func(chal *acme.Challenge) error { return nil })
+	if err != nil {
+		t.Fatal(err)
+	}
+	if issued := server.Issued(); len(issued) != 2 {
+		t.Errorf("issued: %d != 2", len(issued))
+	}
+}
+
+func TestHTTP01(t *testing.T) {
+	ctx := context.Background()
+	responder := &testHTTPResponder{responses: make(map[string]string)}
+	httpServer := httptest.NewServer(responder)
+	defer httpServer.Close()
+	server, err := New(
+		Config{
+			CertificateLifetime: time.Hour,
+			HTTPAddress:         httpServer.Listener.Addr().String(),
+		},
+		Params{Logger: testlogger.New(t)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	client, _ := makeClient(t, ctx, server)
+	respond := func(chal *acme.Challenge) error {
+		response, err := client.HTTP01ChallengeResponse(chal.Token)
+		if err != nil {
+			return err
+		}
+		responder.mutex.Lock()
+		defer responder.mutex.Unlock()
+		responder.responses[client.HTTP01ChallengePath(chal.Token)] = response
+		return nil
+	}
+	chain, err := issue(t, ctx, client, []string{"www.example.com"}, "http-01",
+		respond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(chain) != 2 {
+		t.Fatalf("chain length: %d != 2", len(chain))
+	}
+	leaf, err := x509.ParseCertificate(chain[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	intermediate, err := x509.ParseCertificate(chain[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	intermediates := x509.NewCertPool()
+	intermediates.AddCert(intermediate)
+	_, err = leaf.Verify(x509.VerifyOptions{
+		DNSName:       "www.example.com",
+		Intermediates: intermediates,
+		Roots:         server.Roots(),
+	})
+	if err != nil {
+		t.Error(err)
+	}
+	if lifetime := leaf.NotAfter.Sub(leaf.NotBefore); lifetime > time.Hour {
+		t.Errorf("lifetime: %s > 1h", lifetime)
+	}
+	// A wrong response must fail validation.
+	_, err = issue(t, ctx, client, []string{"bad.example.com"}, "http-01",
+		func(chal *acme.Challenge) error { return nil })
+	if err == nil {
+		t.Fatal("challenge without response accepted")
+	}
+	if err := client.RevokeCert(ctx, nil, chain[0],
+		acme.CRLReasonKeyCompromise); err != nil {
+		t.Fatal(err)
+	}
+	if !server.IsRevoked(leaf) {
+		t.Error("certificate not revoked")
+	}
+}
@@ -0,0 +1,187 @@
+package acmetest
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	_ "crypto/sha512" // Required for ES384 and ES512.
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+)
+
+type jsonWebKey struct {
+	Crv string `json:"crv,omitempty"`
+	E   string `json:"e,omitempty"`
+	Kty string `json:"kty"`
+	N   string `json:"n,omitempty"`
+	X   string `json:"x,omitempty"`
+	Y   string `json:"y,omitempty"`
+}
+
+type jsonWebSignature struct {
+	Payload   string `json:"payload"`
+	Protected string `json:"protected"`
+	Signature string `json:"signature"`
+}
+
+type protectedHeader struct {
+	Alg   string      `json:"alg"`
+	JWK   *jsonWebKey `json:"jwk"`
+	KID   string      `json:"kid"`
+	Nonce string      `json:"nonce"`
+	URL   string      `json:"url"`
+}
+
+func decodeBigInt(value string) (*big.Int, error) {
+	data, err := base64.RawURLEncoding.DecodeString(value)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) < 1 {
+		return nil, errors.New("empty integer")
+	}
+	return new(big.Int).SetBytes(data), nil
+}
+
+// parseJWS will parse a JWS in the flattened JSON serialisation. The signature
+// is not verified.
+func parseJWS(data []byte) (*jsonWebSignature, *protectedHeader, error) {
+	var jws jsonWebSignature
+	if err := json.Unmarshal(data, &jws); err != nil {
+		return nil, nil, err
+	}
+	headerJSON, err := base64.RawURLEncoding.DecodeString(jws.Protected)
+	if err != nil {
+		return nil, nil, err
+	}
+	var header protectedHeader
+	if err := json.Unmarshal(headerJSON, &header); err != nil {
+		return nil, nil, err
+	}
+	return &jws, &header, nil
+}
+
+// thumbprint returns the JWK thumbprint (RFC 7638) of the public key, which is
+// used to compute key authorisations.
+func thumbprint(key crypto.PublicKey) (string, error) {
+	var canonical string
+	switch key := key.(type) {
+	case *ecdsa.PublicKey:
+		size := (key.Curve.Params().BitSize + 7) / 8
+		canonical = fmt.Sprintf(`{"crv":"%s","kty":"EC","x":"%s","y":"%s"}`,
+			key.Curve.Params().Name,
+			base64.RawURLEncoding.EncodeToString(key.X.FillBytes(
+				make([]byte, size))),
+			base64.RawURLEncoding.EncodeToString(key.Y.FillBytes(
+				make([]byte, size))))
+	case *rsa.PublicKey:
+		canonical = fmt.Sprintf(`{"e":"%s","kty":"RSA","n":"%s"}`,
+			base64.RawURLEncoding.EncodeToString(
+				big.NewInt(int64(key.E)).Bytes()),
+			base64.RawURLEncoding.EncodeToString(key.N.Bytes()))
+	default:
+		return "", errors.New("unsupported key type")
+	}
+	sum := sha256.Sum256([]byte(canonical))
+	return base64.RawURLEncoding.EncodeToString(sum[:]), nil
+}
+
+// publicKey returns the public key for the JWK.
+func (jwk *jsonWebKey) publicKey() (crypto.PublicKey, error) {
+	switch jwk.Kty {
+	case "EC":
+		var curve elliptic.Curve
+		switch jwk.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("unsupported curve: %s", jwk.Crv)
+		}
+		x, err := decodeBigInt(jwk.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decodeBigInt(jwk.Y)
+		if err != nil {
+			return nil, err
+		}
+		if !curve.IsOnCurve(x, y) {
+			return nil, errors.New("point not on curve")
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+	case "RSA":
+		n, err := decodeBigInt(jwk.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decodeBigInt(jwk.E)
+		if err != nil {
+			return nil, err
+		}
+		if !e.IsInt64() || e.Int64() > 1<<31-1 {
+			return nil, errors.New("bad RSA exponent")
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	default:
+		return nil, fmt.Errorf("unsupported key type: %s", jwk.Kty)
+	}
+}
+
+// verify will verify the signature of the JWS with the public key and will
+// return the decoded payload.
+func (jws *jsonWebSignature) verify(alg string, key crypto.PublicKey) (
+	[]byte, error) {
+	signature, err := base64.RawURLEncoding.DecodeString(jws.Signature)
+	if err != nil {
+		return nil, err
+	}
+	var hash crypto.Hash
+	switch alg {
+	case "ES256", "RS256":
+		hash = crypto.SHA256
+	case "ES384":
+		hash = crypto.SHA384
+	case "ES512":
+		hash = crypto.SHA512
+	default:
+		return nil, fmt.Errorf("unsupported algorithm: %s", alg)
+	}
+	hasher := hash.New()
+	hasher.Write([]byte(jws.Protected + "." + jws.Payload))
+	digest := hasher.Sum(nil)
+	switch key := key.(type) {
+	case *ecdsa.PublicKey:
+		if alg[0] != 'E' {
+			return nil, errors.New("algorithm does not match key")
+		}
+		size := (key.Curve.Params().BitSize + 7) / 8
+		if len(signature) != 2*size {
+			return nil, errors.New("bad signature length")
+		}
+		r := new(big.Int).SetBytes(signature[:size])
+		s := new(big.Int).SetBytes(signature[size:])
+		if !ecdsa.Verify(key, digest, r, s) {
+			return nil, errors.New("bad signature")
+		}
+	case *rsa.PublicKey:
+		if alg != "RS256" {
+			return nil, errors.New("algorithm does not match key")
+		}
+		if err := rsa.VerifyPKCS1v15(key, hash, digest,
+			signature); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, errors.New("unsupported key type")
+	}
+	return base64.RawURLEncoding.DecodeString(jws.Payload)
+}
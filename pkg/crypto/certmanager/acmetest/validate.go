@@ -0,0 +1,155 @@
+package acmetest
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/asn1"
+	"encoding/base64"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	maxHTTPResponseSize = 1 << 10
+	tlsALPNProtocol     = "acme-tls/1"
+	validationTimeout   = time.Second * 10
+)
+
+// idPeAcmeIdentifier is the OID for the acmeIdentifier X.509 extension.
+var idPeAcmeIdentifier = asn1.ObjectIdentifier{1, 3, 6, 1, 5, 5, 7, 1, 31}
+
+// challengeProblem returns the error for a failed validation.
+func challengeProblem(problemType, format string, v ...interface{}) *problem {
+	return makeProblem(http.StatusForbidden, problemType, format, v...)
+}
+
+// validate will validate the challenge for the domain. The key authorisation
+// is the expected response.
+func (s *Server) validate(challengeType, domain, token,
+	keyAuthorisation string) *problem {
+	if s.skipValidation {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(),
+		validationTimeout)
+	defer cancel()
+	switch challengeType {
+	case "dns-01":
+		return s.validateDNS(ctx, domain, keyAuthorisation)
+	case "http-01":
+		return s.validateHTTP(ctx, domain, token, keyAuthorisation)
+	case "tls-alpn-01":
+		return s.validateTLSALPN(ctx, domain, keyAuthorisation)
+	default:
+		return makeProblem(http.StatusBadRequest, "malformed",
+			"unsupported challenge type: %s", challengeType)
+	}
+}
+
+func (s *Server) validateDNS(ctx context.Context, domain,
+	keyAuthorisation string) *problem {
+	fqdn := "_acme-challenge." + domain
+	values, err := s.lookupTXT(ctx, fqdn)
+	if err != nil {
+		return challengeProblem("dns", "%s: %s", fqdn, err)
+	}
+	digest := sha256.Sum256([]byte(keyAuthorisation))
+	expected := base64.RawURLEncoding.EncodeToString(digest[:])
+	for _, value := range values {
+		if value == expected {
+			return nil
+		}
+	}
+	return challengeProblem("unauthorized", "no TXT record: %s found for: %s",
+		expected, fqdn)
+}
+
+func (s *Server) validateHTTP(ctx context.Context, domain, token,
+	keyAuthorisation string) *problem {
+	address := s.httpAddress
+	if address == "" {
+		address = net.JoinHostPort(domain, "80")
+	}
+	url := "http://" + address + "/.well-known/acme-challenge/" + token
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return challengeProblem("malformed", "%s", err)
+	}
+	req.Host = domain
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return challengeProblem("connection", "%s", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return challengeProblem("unauthorized", "%s: status: %s",
+			domain, resp.Status)
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body,
+		maxHTTPResponseSize))
+	if err != nil {
+		return challengeProblem("connection", "%s", err)
+	}
+	if response := strings.TrimSpace(string(body)); response !=
+		keyAuthorisation {
+		return challengeProblem("unauthorized",
+			"%s: key authorisation: \"%s\" != \"%s\"",
+			domain, response, keyAuthorisation)
+	}
+	return nil
+}
+
+func (s *Server) validateTLSALPN(ctx context.Context, domain,
+	keyAuthorisation string) *problem {
+	address := s.tlsAddress
+	if address == "" {
+		address = net.JoinHostPort(domain, "443")
+	}
+	dialer := &tls.Dialer{
+		Config: &tls.Config{
+			InsecureSkipVerify: true,
+			NextProtos:         []string{tlsALPNProtocol},
+			ServerName:         domain,
+		},
+	}
+	conn, err := dialer.DialContext(ctx, "tcp", address)
+	if err != nil {
+		return challengeProblem("tls", "%s", err)
+	}
+	defer conn.Close()
+	state := conn.(*tls.Conn).ConnectionState()
+	if state.NegotiatedProtocol != tlsALPNProtocol {
+		return challengeProblem("tls", "%s: negotiated protocol: \"%s\"",
+			domain, state.NegotiatedProtocol)
+	}
+	leaf := state.PeerCertificates[0]
+	if len(leaf.DNSNames) != 1 || !strings.EqualFold(leaf.DNSNames[0], domain) {
+		return challengeProblem("unauthorized", "%s: bad certificate names: %v",
+			domain, leaf.DNSNames)
+	}
+	digest := sha256.Sum256([]byte(keyAuthorisation))
+	for _, extension := range leaf.Extensions {
+		if !extension.Id.Equal(idPeAcmeIdentifier) {
+			continue
+		}
+		var value []byte
+		rest, err := asn1.Unmarshal(extension.Value, &value)
+		if err != nil || len(rest) > 0 {
+			return challengeProblem("unauthorized",
+				"%s: malformed acmeIdentifier extension", domain)
+		}
+		if !extension.Critical || !bytes.Equal(value, digest[:]) {
+			return challengeProblem("unauthorized",
+				"%s: incorrect acmeIdentifier extension", domain)
+		}
+		return nil
+	}
+	return challengeProblem("unauthorized", "%s: no acmeIdentifier extension",
+		domain)
+}
@@ -15,55 +15,326 @@ instances are redeployed.
 The aws package implements a Locker and Storer using AWS Secrets manager and a
 DNS-based Responder using Route53.
 
+The storage/filesystem package implements a Locker and Storer using a
+(possibly shared) directory.
+
+The storage/s3 package implements a Locker and Storer using AWS S3 or
+S3-compatible object storage.
+
+The storage/vault package implements a Locker and Storer using the HashiCorp
+Vault KV secrets engine.
+
+The storage/encrypted package implements a Storer which wraps another Storer
+and encrypts private keys.
+
 The http package implements a HTTP-based Responder.
+
+The tls_alpn package implements a TLS-based Responder.
 */
 package certmanager
 
 import (
+	"context"
 	"crypto"
 	"crypto/tls"
+	"crypto/x509"
+	"io"
 	"sync"
 	"time"
 
 	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/ocsp"
 
 	"github.com/Cloud-Foundations/golib/pkg/dns"
 	"github.com/Cloud-Foundations/golib/pkg/log"
 )
 
+const (
+	EventRenewalStarted     EventType = iota // An ACME transaction started.
+	EventChallengePublished                  // A challenge response published.
+	EventIssued                              // A certificate was issued.
+	EventLoadedFromStorer                    // A certificate was shared.
+	EventRenewalFailed                       // Renewal failed, see Error.
+	EventNearingExpiry                       // Overdue for renewal.
+)
+
+const (
+	ErrorClassUnknown     ErrorClass = iota // Not classified.
+	ErrorClassAccount                       // ACME account problem.
+	ErrorClassBadNonce                      // Stale nonce (transient).
+	ErrorClassChallenge                     // Challenge validation failed.
+	ErrorClassNetwork                       // Network error (transient).
+	ErrorClassRateLimited                   // CA rate limit exceeded.
+	ErrorClassRejected                      // Request rejected by the CA.
+	ErrorClassServer                        // CA server error (transient).
+	ErrorClassStorage                       // Locker/Storer error (transient).
+)
+
 const LetsEncryptProductionURL = acme.LetsEncryptURL
 const LetsEncryptStagingURL = "https://acme-staging-v02.api.letsencrypt.org/directory"
 
+// Account contains the private key and URL of an ACME account. The account is
+// persisted so that it may be re-used across restarts and server instances.
+type Account struct {
+	KeyPemBlock []byte
+	URL         string
+	key         crypto.Signer
+}
+
+// AccountDeleter is an optional interface which an AccountStorer may implement
+// in order to delete the shared ACME account when it is deactivated.
+type AccountDeleter interface {
+	// DeleteAccount will delete the ACME account from the remote store.
+	DeleteAccount() error
+}
+
+// AccountStorer is an optional interface which a Storer may implement in order
+// to share the ACME account with other instances of the service.
+type AccountStorer interface {
+	// ReadAccount will read the ACME account from the remote store.
+	ReadAccount() (*Account, error)
+
+	// WriteAccount will write the ACME account to the remote store.
+	WriteAccount(account *Account) error
+}
+
 type Certificate struct {
 	CertPemBlock []byte
 	KeyPemBlock  []byte
+	Issuer       string // The directory URL of the CA, if known.
+	KeyUses      uint   // Certificates issued with the private key, if known.
 	tlsCert      tls.Certificate
 	notAfter     time.Time
 	notBefore    time.Time
+	ocspResponse *ocsp.Response
+	renewalInfo  *renewalInfo
+	revoked      bool
+	source       string
+}
+
+// CertificateAuthority specifies an ACME Certificate Authority.
+type CertificateAuthority struct {
+	// DirectoryURL specifies the directory endpoint of the CA. Required.
+	DirectoryURL string
+
+	// EabHmacKey and EabKeyId specify the External Account Binding
+	// credentials for the CA. Optional.
+	EabHmacKey string
+	EabKeyId   string
+}
+
+// Config contains the configuration for a CertificateManager.
+type Config struct {
+	// CaDirectoryURL specifies the Certificate Authority directory endpoint.
+	// If this is the empty string, Let's Encrypt (Production) is used.
+	CaDirectoryURL string
+
+	// CertificateAuthorities specifies an ordered list of CAs to request
+	// certificates from, which is used instead of CaDirectoryURL, EabHmacKey
+	// and EabKeyId. The first CA is the primary CA. If FailoverThreshold
+	// consecutive requests to a CA fail or the CA reports that a rate limit
+	// was exceeded, the next CA is used. After a certificate is issued by
+	// another CA, the primary CA is used for the next renewal. Only the
+	// account for the primary CA is shared via the AccountStorer. Optional.
+	CertificateAuthorities []CertificateAuthority
+
+	// CertFilename and KeyFilename specify where the certificate and private
+	// key are cached locally. If either is empty then no local cache is
+	// employed.
+	CertFilename string
+	KeyFilename  string
+
+	// ChallengeAliases maps a domain name to the FQDN where the dns-01 TXT
+	// record for the domain is published, instead of
+	// "_acme-challenge.<domain>". There must be a CNAME record from
+	// "_acme-challenge.<domain>" to the FQDN, which is typically in a zone
+	// which the Responder can write to. For wildcard names, the domain name is
+	// given without the leading "*.". Optional.
+	ChallengeAliases map[string]string
+
+	// ChallengeType specifies the type of challenge to use. Currently
+	// "dns-01", "http-01" and "tls-alpn-01" are supported.
+	ChallengeType string
+
+	// Contacts specifies the e-mail addresses to register with the ACME
+	// account. Optional.
+	Contacts []string
+
+	// EabHmacKey and EabKeyId specify the External Account Binding
+	// credentials, which are required by some CAs when registering an account.
+	// The HMAC key is Base64url-encoded. Optional.
+	EabHmacKey string
+	EabKeyId   string
+
+	// FailoverThreshold specifies the number of consecutive failed requests
+	// to a CA before the next CA in CertificateAuthorities is used. The
+	// default is 3.
+	FailoverThreshold uint
+
+	// FollowChallengeCNAME specifies whether to look up the CNAME record for
+	// "_acme-challenge.<domain>" and, if there is one, to publish the dns-01
+	// TXT record at the target of the CNAME (delegated validation). Names in
+	// ChallengeAliases are not looked up.
+	FollowChallengeCNAME bool
+
+	// KeyRotation specifies when a new private key is generated for a
+	// certificate. The following policies are supported:
+	//   "":       a new key is generated once per process lifetime (default)
+	//   "always": a new key is generated for every certificate
+	//   "every":  a new key is generated every KeyRotationInterval renewals
+	//   "reuse":  the key of the current certificate is re-used (pinned)
+	// For "every" and "reuse", the key of the current certificate (which may
+	// have been loaded from the local cache or the Storer) is re-used if it is
+	// of the configured KeyType. For "every", the number of uses of the key is
+	// recorded with the certificate, so that it survives restarts and is
+	// shared with other instances.
+	KeyRotation         string
+	KeyRotationInterval uint
+
+	// KeyType may be "EC" (default, same as "EC-P256"), "EC-P384", "RSA"
+	// (same as "RSA-2048"), "RSA-3072" or "RSA-4096".
+	KeyType string
+
+	// LocalCA specifies a local (development) Certificate Authority. If
+	// specified, certificates are issued by the local CA instead of an ACME
+	// CA and the ACME settings (including ChallengeType) are ignored. This is
+	// intended for development, CI and air-gapped environments. Optional.
+	LocalCA *LocalCAConfig
+
+	// Names specifies the domain names (SANs) to request certificates for.
+	Names []string
+
+	// PreferredChain specifies the preferred certificate chain, if the CA
+	// offers alternate chains. This is either the common name of the topmost
+	// issuer in the chain (i.e. "ISRG Root X1") or the hexadecimal SHA-256
+	// fingerprint of a certificate in the chain (i.e. a cross-signed root).
+	// If no chain matches, the default chain is used. Optional.
+	PreferredChain string
+
+	// PropagationNameservers specifies the nameservers (host:port, the
+	// default port is 53) to query when checking that the dns-01 TXT record is
+	// visible. Recursion is requested. If empty, the authoritative nameservers
+	// for the zone are queried. Optional.
+	PropagationNameservers []string
+
+	// PropagationTimeout specifies the maximum time to wait for the dns-01 TXT
+	// record to be visible on all nameservers before the challenge is
+	// accepted. If zero, propagation is not checked and the challenge is
+	// accepted as soon as the Responder has published the record.
+	PropagationTimeout time.Duration
+
+	// RenewBefore specifies when certificates are renewed, as a fraction of
+	// the certificate lifetime. See the New function for details.
+	RenewBefore float64
 }
 
 type CertificateManager struct {
-	acmeClient     *acme.Client // Only used in the renewal goroutine.
-	acmeOrder      *acme.Order  // Only used in the renewal goroutine.
+	account             *accountManager // The primary CA.
+	accounts            []*accountManager
+	acmeOrder           *acme.Order  // Protected by account.mutex.
+	acmeOrderClient     *acme.Client // Protected by account.mutex.
+	cancel              context.CancelFunc
+	certFilename        string
+	challengeAliases    map[string]string // Key: lower case domain.
+	challengeType       string
+	ctx                 context.Context
+	events              *eventBroker
+	failoverThreshold   uint
+	forceNewKey         bool // Protected by account.mutex.
+	keyFilename         string
+	key                 crypto.Signer // Protected by account.mutex.
+	keyMaker            keyMakerFunc
+	keyRotation         string
+	keyRotationInterval uint
+	keyType             string
+	keyUses             uint // Protected by account.mutex.
+	localCA             *localCA
+	locker              Locker
+	lookupCNAME         func(ctx context.Context, host string) (string, error)
+	names               []string
+	preferredChain      string
+	propagation         *propagationChecker // nil: do not check.
+	renewBefore         float64
+	responder           Responder
+	storer              Storer
+	logger              log.DebugLogger
+	ocspWakeup          chan struct{}
+	renewNow            chan struct{}
+	waitGroup           sync.WaitGroup
+	writeNotifier       chan struct{}
+	rwMutex             sync.RWMutex // Protect everything below.
+	caFailures          uint         // Consecutive failures with current CA.
+	caIndex             int          // Index into accounts.
+	certificate         *Certificate
+	failedOver          bool // Failed over since the last failed renewal.
+	lastRenewalError    *RenewalError
+	nextCheck           time.Time
+	renewalFailures     uint                // Consecutive failed renewals.
+	revokedSerials      map[string]struct{} // Key: serial number.
+}
+
+// accountManager manages an ACME account, which may be shared by multiple
+// certificate managers.
+type accountManager struct {
 	caDirectoryURL string
-	certFilename   string
-	challengeType  string
-	keyFilename    string
-	key            crypto.Signer
-	keyMaker       keyMakerFunc
-	locker         Locker
-	names          []string
-	renewBefore    float64
-	responder      Responder
-	storer         Storer
+	contacts       []string
+	eab            *acme.ExternalAccountBinding
+	filename       string
 	logger         log.DebugLogger
-	writeNotifier  chan struct{}
-	rwMutex        sync.RWMutex // Protect everything below.
-	certificate    *Certificate
+	storer         AccountStorer
+	ariMutex       sync.Mutex // Protect ariDiscovered and ariURL.
+	ariDiscovered  bool
+	ariURL         string
+	mutex          sync.Mutex // Protect everything below.
+	client         *acme.Client
+}
+
+// ErrorClass specifies the class of a RenewalError.
+type ErrorClass uint
+
+// Event contains information about a certificate lifecycle event.
+type Event struct {
+	Error    error     // The *RenewalError for EventRenewalFailed.
+	Issuer   string    // The directory URL of the issuing CA, if known.
+	Names    []string  // The domain names (SANs) for the certificate.
+	NotAfter time.Time // The expiry time of the certificate, if known.
+	Serial   string    // The serial number of the certificate, if known.
+	Source   string    // The CA directory URL, "storer" or "file".
+	Time     time.Time // When the event occurred.
+	Type     EventType
+}
+
+// EventType specifies the type of an Event.
+type EventType uint
+
+type eventBroker struct {
+	mutex       sync.Mutex // Protect everything below.
+	closed      bool
+	subscribers map[chan<- Event]struct{}
 }
 
 type keyMakerFunc func() (crypto.Signer, error)
 
+// LocalCAConfig contains the configuration for a local (development)
+// Certificate Authority. The CA certificate and private key are read from
+// Params.LocalCAStorer, if specified, or else from the files. If the CA does
+// not exist, a new CA is created and written to the files and the storer.
+type LocalCAConfig struct {
+	// CertFilename and KeyFilename specify where the CA certificate and
+	// private key are stored locally. Required if Params.LocalCAStorer is not
+	// specified.
+	CertFilename string
+	KeyFilename  string
+
+	// CertificateLifetime specifies the lifetime of the certificates issued by
+	// the CA. The default is 30 days.
+	CertificateLifetime time.Duration
+
+	// CommonName specifies the common name of a newly created CA. The default
+	// is "certmanager local development CA".
+	CommonName string
+}
+
 // Locker is an interface to a remote locking mechanism.
 type Locker interface {
 	// GetLostChannel returns a channel where notifications are sent if the lock
@@ -78,6 +349,157 @@ type Locker interface {
 	Unlock() error
 }
 
+// ContextLocker is an optional interface which a Locker may implement so that
+// waiting for the lock may be abandoned. If a Locker does not implement this
+// interface, the CertificateManager stops waiting for Lock when it is closed
+// and releases the lock if it is later granted.
+type ContextLocker interface {
+	// LockWithContext is the same as Lock, except that it stops waiting and
+	// returns the context error if ctx is done before the lock is grabbed.
+	LockWithContext(ctx context.Context) error
+}
+
+// CertificateSpec specifies a certificate which is managed by a
+// MultiCertificateManager.
+type CertificateSpec struct {
+	// CertFilename and KeyFilename specify where the certificate and private
+	// key are cached locally. If either is empty then no local cache is
+	// employed.
+	CertFilename string
+	KeyFilename  string
+
+	// KeyRotation, KeyRotationInterval and KeyType are the same as for Config.
+	KeyRotation         string
+	KeyRotationInterval uint
+	KeyType             string
+
+	// Name is a unique name for the certificate. Required.
+	Name string
+
+	// Names specifies the domain names (SANs) to request the certificate for.
+	// Wildcard names (i.e. "*.example.com") are matched against the server
+	// name sent by the client.
+	Names []string
+
+	// RenewBefore specifies when the certificate is renewed, as a fraction of
+	// the certificate lifetime. See the New function for details.
+	RenewBefore float64
+
+	// Storer is used to share the certificate with other instances. Optional.
+	Storer Storer
+}
+
+// MultiCertificateManager manages multiple certificates which share an ACME
+// account, a Locker and a Responder. The certificate to serve is selected
+// using the server name sent by the client (SNI).
+type MultiCertificateManager struct {
+	defaultManager *CertificateManager
+	events         *eventBroker
+	managers       map[string]*CertificateManager // Key: spec name.
+	names          map[string]*CertificateManager // Key: SAN.
+	responder      Responder
+	writeNotifier  chan struct{}
+}
+
+// MultiConfig contains the configuration for a MultiCertificateManager.
+type MultiConfig struct {
+	// AccountFilename specifies where the ACME account is cached locally. The
+	// default is next to the CertFilename of the first certificate.
+	AccountFilename string
+
+	// CaDirectoryURL, CertificateAuthorities, ChallengeAliases,
+	// ChallengeType, Contacts, EabHmacKey, EabKeyId, FailoverThreshold,
+	// FollowChallengeCNAME, PreferredChain, PropagationNameservers and
+	// PropagationTimeout are the same as for Config and are shared by all
+	// certificates.
+	CaDirectoryURL         string
+	CertificateAuthorities []CertificateAuthority
+	ChallengeAliases       map[string]string
+	ChallengeType          string
+	Contacts               []string
+	EabHmacKey             string
+	EabKeyId               string
+	FailoverThreshold      uint
+	FollowChallengeCNAME   bool
+	PreferredChain         string
+	PropagationNameservers []string
+	PropagationTimeout     time.Duration
+
+	// Certificates specifies the certificates to manage. Required.
+	Certificates []CertificateSpec
+
+	// DefaultCertificate specifies the name of the certificate to serve if
+	// the server name sent by the client does not match any certificate.
+	// If empty, no certificate is served for unknown server names.
+	DefaultCertificate string
+}
+
+// MultiParams contains the plugins and other parameters for a
+// MultiCertificateManager.
+type MultiParams struct {
+	AccountStorer AccountStorer   // Optional.
+	Context       context.Context // Optional. See Params.Context.
+	Events        chan<- Event    // Optional. See Params.Events.
+	Locker        Locker          // Optional.
+	Logger        log.DebugLogger
+	Responder     Responder
+}
+
+// OCSPStorer is an optional interface which a Storer may implement in order to
+// share OCSP responses with other instances of the service, so that they do
+// not all query the OCSP responder.
+type OCSPStorer interface {
+	// ReadOCSP will read the DER-encoded OCSP response from the remote store.
+	ReadOCSP() ([]byte, error)
+
+	// WriteOCSP will write the DER-encoded OCSP response to the remote store.
+	WriteOCSP(response []byte) error
+}
+
+// Params contains the plugins and other parameters for a CertificateManager.
+type Params struct {
+	// Context controls the lifetime of the background work. When it is
+	// cancelled, any in-flight ACME transaction is aborted and the renewal
+	// goroutine exits, as if the Close method was called. Optional.
+	Context context.Context
+
+	// Events specifies a channel to which lifecycle events are sent, starting
+	// with the events sent while the CertificateManager is being started. As
+	// for the channels returned by Subscribe, events are dropped if the
+	// channel buffer is full and the channel is closed by the Close method.
+	// Optional.
+	Events chan<- Event
+
+	// LocalCAStorer is used to store the local CA certificate and private key
+	// for sharing with other instances of the service. This must not be the
+	// same as Storer. Optional.
+	LocalCAStorer Storer
+
+	Locker    Locker // Optional.
+	Logger    log.DebugLogger
+	Responder Responder // Not required for a local CA.
+	Storer    Storer    // Optional.
+}
+
+// RenewalError is the error for a failed renewal. The underlying error is
+// classified, so that the cause of the failure may be determined and so that
+// the delay before the next attempt may be selected.
+type RenewalError struct {
+	Class       ErrorClass
+	Err         error         // The underlying error.
+	ProblemType string        // The ACME problem type, if any.
+	RetryAfter  time.Duration // The delay requested by the CA, if any.
+}
+
+// renewalInfo contains the ACME Renewal Information (ARI) for a certificate.
+type renewalInfo struct {
+	explanationURL string
+	nextPoll       time.Time
+	selectedTime   time.Time
+	windowEnd      time.Time
+	windowStart    time.Time
+}
+
 // Responder implements a challenge responder. Typical implementations would be
 // either a DNS TXT record responder (key=FQDN) for the "dns-01" challenge or a
 // HTTP responder (key=path) for the "http-01" challenge.
@@ -95,6 +517,22 @@ type Storer interface {
 	Write(cert *Certificate) error
 }
 
+// TLSResponder is a Responder for the "tls-alpn-01" challenge. The responder
+// is given the domain name (key) and key authorisation (value). If the
+// responder implements this interface, the GetCertificate method will use it
+// to respond to TLS handshakes for the "acme-tls/1" application protocol.
+type TLSResponder interface {
+	Responder
+	GetChallengeCertificate(hello *tls.ClientHelloInfo) (
+		*tls.Certificate, error)
+}
+
+// MakeDnsResponder will create a dns-01 Responder from a DNS record manager.
+func MakeDnsResponder(rdw dns.RecordDeleteWriter,
+	logger log.DebugLogger) (Responder, error) {
+	return makeDnsResponder(rdw, logger)
+}
+
 // New creates a *CertificateManager for the domain(s) listed in names.
 // The certificate and private key are cached locally in the files named by
 // certFilename and keyFilename. If either is empty then no local cache is
@@ -102,44 +540,250 @@ type Storer interface {
 // The locker is used to ensure only one ACME transaction is performed at any
 // time. If this is nil, no transaction locking is performed.
 // The type of challenge to use is specified by challengeType. Currently
-// "dns-01" and "http-01" are supported.
+// "dns-01", "http-01" and "tls-alpn-01" are supported.
 // The storer is used to store the certificate and private key for sharing with
-// other instances of the service. If this is nil, no sharing is performed.
+// other instances of the service. If this is nil, no sharing is performed. If
+// the storer also implements the AccountStorer interface, the ACME account is
+// shared as well.
 // Certificates are renewedBefore expiration, specified as a fraction of the
 // certificate lifetime. For example, if the CA issues certificates with a
 // lifetime of 90 days, a value of 0.33 will cause certificates to be renewed
 // 29.7 days prior to expiration. If 0, the default is a random value between
 // 0.32 and 0.34 (roughly 30 days for a 90 day certificate).
-// Renewals will not be attempted more than once per hour.
+// Failed renewals are retried after a delay which depends on the class of
+// error (see RenewalError): transient errors are retried with exponential
+// backoff, starting at one minute, the Retry-After delay requested by the CA is
+// honoured and rate limit errors back off for at least an hour. Other failed
+// renewals are retried hourly. After failing over to the next CA (see
+// Config.CertificateAuthorities), the renewal is retried after a short delay.
+// If the CA supports ACME Renewal Information (ARI, RFC 9773), the renewal is
+// instead scheduled within the window suggested by the CA and renewBefore is
+// used only if the renewal information is not available.
 // The responder is used to respond to ACME challenges.
 // The Certificate Authority directory endpoint is specified by caDirectoryURL.
 // If this is the empty string, Let's Encrypt (Production) is used.
-// The keyType may be "EC" (default) or "RSA".
+// The keyType may be "EC" (default) or "RSA". See Config.KeyType for more key
+// types.
+// The ACME account key and URL are cached locally in a file next to
+// certFilename (with an ".acme-account" suffix), so that the account is re-used
+// across restarts.
 // The logger is used for logging messages.
-// Background work will be scheduled to renew the certificate.
+// Background work will be scheduled to renew the certificate. This may be
+// stopped with the Close method.
 func New(names []string, certFilename, keyFilename string, locker Locker,
 	challengeType string, responder Responder, storer Storer,
 	renewBefore float64, caDirectoryURL, keyType string,
 	logger log.DebugLogger) (*CertificateManager, error) {
-	return newManager(names, certFilename, keyFilename, locker, challengeType,
-		responder, storer, renewBefore, caDirectoryURL, keyType, logger)
+	return newManager(
+		Config{
+			CaDirectoryURL: caDirectoryURL,
+			CertFilename:   certFilename,
+			ChallengeType:  challengeType,
+			KeyFilename:    keyFilename,
+			KeyType:        keyType,
+			Names:          names,
+			RenewBefore:    renewBefore,
+		},
+		Params{
+			Locker:    locker,
+			Logger:    logger,
+			Responder: responder,
+			Storer:    storer,
+		})
+}
+
+// NewMulti creates a *MultiCertificateManager for multiple certificates. A
+// single ACME account is used for all certificates and ACME transactions are
+// serialised.
+// Background work will be scheduled to renew the certificates. This may be
+// stopped with the Close method or by cancelling params.Context.
+func NewMulti(config MultiConfig,
+	params MultiParams) (*MultiCertificateManager, error) {
+	return newMultiManager(config, params)
+}
+
+// NewWithConfig creates a *CertificateManager using the provided configuration
+// and plugins. It is similar to New, with support for additional options.
+func NewWithConfig(config Config, params Params) (*CertificateManager, error) {
+	return newManager(config, params)
+}
+
+// RevokeCertificate will revoke a certificate with the CA specified by
+// caDirectoryURL, using the certificate private key. No ACME account is
+// required. If caDirectoryURL is the empty string, Let's Encrypt (Production)
+// is used.
+func RevokeCertificate(ctx context.Context, caDirectoryURL string,
+	cert *Certificate, reason acme.CRLReasonCode) error {
+	return revokeCertificate(ctx, caDirectoryURL, cert, reason)
+}
+
+// Chain returns the certificate chain, starting with the leaf certificate. If
+// the chain cannot be parsed, nil is returned.
+func (cert *Certificate) Chain() []*x509.Certificate {
+	return cert.chain()
+}
+
+// Close will stop the background work, aborting any in-flight ACME
+// transaction. The Locker is released and Responder.Cleanup is called if a
+// transaction was in progress. Close waits for the background work to finish.
+// The most recent certificate remains available via GetCertificate.
+func (cm *CertificateManager) Close() error {
+	return cm.close()
+}
+
+// DeactivateAccount will deactivate the ACME account with the (primary) CA and
+// will remove the local account cache file. If the storer implements the
+// AccountDeleter interface, the shared account is deleted as well. A new
+// account will be registered for the next renewal.
+func (cm *CertificateManager) DeactivateAccount(ctx context.Context) error {
+	return cm.deactivateAccount(ctx)
+}
+
+// ExportLocalCA returns the PEM-encoded certificate of the local CA, which may
+// be installed in trust stores. The local CA is created if it does not exist.
+// An error is returned if the local CA is not enabled.
+func (cm *CertificateManager) ExportLocalCA() ([]byte, error) {
+	return cm.exportLocalCA()
+}
+
+// GetAccount will look up the ACME account at the (primary) CA, registering a
+// new account if required.
+func (cm *CertificateManager) GetAccount(ctx context.Context) (
+	*acme.Account, error) {
+	return cm.getAccount(ctx)
 }
 
 // GetCertificate yields the most recently renewed certificate. The method
 // value may be assigned to the crypto/tls.Config.GetCertificate field.
+// If available, an OCSP response is stapled to the certificate. OCSP responses
+// are refreshed periodically and shared with other instances if the storer
+// implements the OCSPStorer interface. If the certificate is reported as
+// revoked, it is renewed immediately.
+// If the responder is a TLSResponder and the client only requests the
+// "acme-tls/1" application protocol, the challenge certificate is returned.
+// In this case "acme-tls/1" must be included in crypto/tls.Config.NextProtos.
 func (cm *CertificateManager) GetCertificate(hello *tls.ClientHelloInfo) (
 	*tls.Certificate, error) {
 	return cm.getCertificate(hello)
 }
 
 // GetWriteNotifier returns the channel to which certificate write notifications
-// are sent.
+// are sent. See the Subscribe method for more detailed notifications.
 func (cm *CertificateManager) GetWriteNotifier() <-chan struct{} {
 	return cm.writeNotifier
 }
 
-// MakeDnsResponder will create a dns-01 Responder from a DNS record manager.
-func MakeDnsResponder(rdw dns.RecordDeleteWriter,
-	logger log.DebugLogger) (Responder, error) {
-	return makeDnsResponder(rdw, logger)
+// Revoke will revoke the current certificate with the issuing CA, using the
+// ACME account key or, failing that, the certificate private key. A new private
+// key is generated and a replacement certificate is requested immediately. The
+// replacement is written to the Storer, so that other instances (which will
+// detect the revocation via OCSP) converge on the new certificate.
+func (cm *CertificateManager) Revoke(ctx context.Context,
+	reason acme.CRLReasonCode) error {
+	return cm.revoke(ctx, reason)
+}
+
+// RotateAccountKey will generate a new private key for the ACME account with
+// the (primary) CA and will perform a key change with the CA. The new key is
+// saved locally and in the remote store.
+func (cm *CertificateManager) RotateAccountKey(ctx context.Context) error {
+	return cm.rotateAccountKey(ctx)
+}
+
+// Subscribe will subscribe to certificate lifecycle events. Events are sent
+// on the returned channel, which has a buffer of length bufferLength. If the
+// channel buffer is full, events are dropped. The EventIssued and
+// EventLoadedFromStorer events are sent after the certificate is written to the
+// local cache files. The returned function will unsubscribe and close the
+// channel. The channel is also closed by the Close method.
+func (cm *CertificateManager) Subscribe(bufferLength uint) (
+	<-chan Event, func()) {
+	return cm.events.subscribe(bufferLength)
+}
+
+// WriteHtml will write status information about the certificate, including the
+// renewal window suggested by the CA (if any), in HTML format.
+func (cm *CertificateManager) WriteHtml(writer io.Writer) {
+	cm.writeHtml(writer)
+}
+
+// Close will stop the background work for all the certificates. See the
+// CertificateManager.Close method for details.
+func (mcm *MultiCertificateManager) Close() error {
+	return mcm.close()
+}
+
+// DeactivateAccount will deactivate the shared ACME account. See the
+// CertificateManager.DeactivateAccount method for details.
+func (mcm *MultiCertificateManager) DeactivateAccount(
+	ctx context.Context) error {
+	return mcm.defaultOrAnyManager().deactivateAccount(ctx)
+}
+
+// GetAccount will look up the shared ACME account at the CA.
+func (mcm *MultiCertificateManager) GetAccount(ctx context.Context) (
+	*acme.Account, error) {
+	return mcm.defaultOrAnyManager().getAccount(ctx)
+}
+
+// GetCertificate yields the most recently renewed certificate which matches
+// the server name sent by the client. The method value may be assigned to the
+// crypto/tls.Config.GetCertificate field.
+func (mcm *MultiCertificateManager) GetCertificate(
+	hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return mcm.getCertificate(hello)
+}
+
+// GetCertificateManager returns the *CertificateManager for the certificate
+// with the specified name. If there is no such certificate, nil is returned.
+func (mcm *MultiCertificateManager) GetCertificateManager(
+	name string) *CertificateManager {
+	return mcm.managers[name]
+}
+
+// GetWriteNotifier returns the channel to which certificate write notifications
+// are sent, for any of the certificates.
+func (mcm *MultiCertificateManager) GetWriteNotifier() <-chan struct{} {
+	return mcm.writeNotifier
+}
+
+// RotateAccountKey will rotate the key for the shared ACME account. See the
+// CertificateManager.RotateAccountKey method for details.
+func (mcm *MultiCertificateManager) RotateAccountKey(
+	ctx context.Context) error {
+	return mcm.defaultOrAnyManager().rotateAccountKey(ctx)
+}
+
+// Subscribe will subscribe to lifecycle events for all the certificates. See
+// the CertificateManager.Subscribe method for details.
+func (mcm *MultiCertificateManager) Subscribe(bufferLength uint) (
+	<-chan Event, func()) {
+	return mcm.events.subscribe(bufferLength)
+}
+
+// WriteHtml will write status information about all the certificates in HTML
+// format.
+func (mcm *MultiCertificateManager) WriteHtml(writer io.Writer) {
+	mcm.writeHtml(writer)
+}
+
+// String returns the name of the error class.
+func (c ErrorClass) String() string {
+	return c.string()
+}
+
+// String returns the name of the event type.
+func (t EventType) String() string {
+	return t.string()
+}
+
+// Error returns the error message, which includes the error class.
+func (e *RenewalError) Error() string {
+	return e.error()
+}
+
+// Unwrap returns the underlying error, so that the errors.Is and errors.As
+// functions may be used.
+func (e *RenewalError) Unwrap() error {
+	return e.Err
 }
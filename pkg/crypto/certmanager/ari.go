@@ -0,0 +1,243 @@
+package certmanager
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Cloud-Foundations/Dominator/lib/format"
+)
+
+const (
+	ariDefaultRetryAfter = time.Hour * 6
+	ariMaximumRetryAfter = time.Hour * 24
+	ariMinimumRetryAfter = time.Minute
+	ariRequestTimeout    = time.Second * 30
+	maxDirectorySize     = 1 << 16
+)
+
+type directoryType struct {
+	RenewalInfo string `json:"renewalInfo"`
+}
+
+type renewalInfoResponse struct {
+	SuggestedWindow struct {
+		Start time.Time `json:"start"`
+		End   time.Time `json:"end"`
+	} `json:"suggestedWindow"`
+	ExplanationURL string `json:"explanationURL"`
+}
+
+// makeARICertID will compute the ARI certificate identifier, which is the
+// Base64url-encoded Authority Key Identifier and serial number.
+func makeARICertID(cert *Certificate) (string, error) {
+	leaf := cert.tlsCert.Leaf
+	if len(leaf.AuthorityKeyId) < 1 {
+		return "", errors.New("no Authority Key Identifier in certificate")
+	}
+	serial := leaf.SerialNumber.Bytes()
+	if len(serial) < 1 || serial[0]&0x80 != 0 { // DER INTEGER encoding.
+		serial = append([]byte{0}, serial...)
+	}
+	return base64.RawURLEncoding.EncodeToString(leaf.AuthorityKeyId) + "." +
+		base64.RawURLEncoding.EncodeToString(serial), nil
+}
+
+// parseRetryAfter will parse the Retry-After header, which may be either a
+// number of seconds or a HTTP date. The result is clamped to a sane range.
+func parseRetryAfter(header string, defaultValue time.Duration) time.Duration {
+	retryAfter := defaultValue
+	if header != "" {
+		if seconds, err := strconv.ParseUint(header, 10, 32); err == nil {
+			retryAfter = time.Duration(seconds) * time.Second
+		} else if date, err := http.ParseTime(header); err == nil {
+			retryAfter = time.Until(date)
+		}
+	}
+	if retryAfter < ariMinimumRetryAfter {
+		return ariMinimumRetryAfter
+	}
+	if retryAfter > ariMaximumRetryAfter {
+		return ariMaximumRetryAfter
+	}
+	return retryAfter
+}
+
+// selectRenewalTime will select a random time within the window.
+func selectRenewalTime(start, end time.Time) time.Time {
+	window := end.Sub(start)
+	if window <= 0 {
+		return start
+	}
+	offset, err := rand.Int(rand.Reader, big.NewInt(int64(window)))
+	if err != nil {
+		return start.Add(window / 2)
+	}
+	return start.Add(time.Duration(offset.Int64()))
+}
+
+// limitToNextPoll will limit the wait time so that the renewal information is
+// refreshed when the CA suggests.
+func (cert *Certificate) limitToNextPoll(wait time.Duration) time.Duration {
+	if cert.renewalInfo == nil {
+		return wait
+	}
+	pollWait := time.Until(cert.renewalInfo.nextPoll)
+	if pollWait < ariMinimumRetryAfter {
+		pollWait = ariMinimumRetryAfter
+	}
+	if pollWait < wait {
+		return pollWait
+	}
+	return wait
+}
+
+// withRenewalInfo returns a copy of the certificate with the renewal
+// information attached.
+func (cert *Certificate) withRenewalInfo(info *renewalInfo) *Certificate {
+	newCert := *cert
+	newCert.renewalInfo = info
+	return &newCert
+}
+
+// getRenewalInfoURL returns the renewalInfo endpoint of the CA. If the CA does
+// not support ARI, the empty string is returned.
+func (am *accountManager) getRenewalInfoURL(ctx context.Context) (
+	string, error) {
+	am.ariMutex.Lock()
+	defer am.ariMutex.Unlock()
+	if am.ariDiscovered {
+		return am.ariURL, nil
+	}
+	directoryURL := am.directoryURL()
+	ctx, cancel := context.WithTimeout(ctx, ariRequestTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, "GET", directoryURL, nil)
+	if err != nil {
+		return "", err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("%s: %s", directoryURL, resp.Status)
+	}
+	var directory directoryType
+	decoder := json.NewDecoder(io.LimitReader(resp.Body, maxDirectorySize))
+	if err := decoder.Decode(&directory); err != nil {
+		return "", err
+	}
+	am.ariDiscovered = true
+	am.ariURL = directory.RenewalInfo
+	return am.ariURL, nil
+}
+
+// fetchRenewalInfo will query the CA for the suggested renewal window for
+// the certificate. If the CA does not support ARI, nil is returned.
+func (cm *CertificateManager) fetchRenewalInfo(ctx context.Context,
+	cert *Certificate) (*renewalInfo, error) {
+	ariURL, err := cm.issuerAccount(cert).getRenewalInfoURL(ctx)
+	if err != nil || ariURL == "" {
+		return nil, err
+	}
+	certID, err := makeARICertID(cert)
+	if err != nil {
+		return nil, err
+	}
+	url := strings.TrimSuffix(ariURL, "/") + "/" + certID
+	ctx, cancel := context.WithTimeout(ctx, ariRequestTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s: %s", url, resp.Status)
+	}
+	var response renewalInfoResponse
+	decoder := json.NewDecoder(io.LimitReader(resp.Body, maxDirectorySize))
+	if err := decoder.Decode(&response); err != nil {
+		return nil, err
+	}
+	start := response.SuggestedWindow.Start
+	end := response.SuggestedWindow.End
+	if start.IsZero() || end.Before(start) {
+		return nil, fmt.Errorf("invalid suggested window: %s - %s", start, end)
+	}
+	info := &renewalInfo{
+		explanationURL: response.ExplanationURL,
+		nextPoll: time.Now().Add(parseRetryAfter(
+			resp.Header.Get("Retry-After"), ariDefaultRetryAfter)),
+		windowEnd:   end,
+		windowStart: start,
+	}
+	// Re-use the previously selected time if the window has not changed.
+	if old := cert.renewalInfo; old != nil &&
+		old.windowStart.Equal(start) && old.windowEnd.Equal(end) {
+		info.selectedTime = old.selectedTime
+	} else {
+		info.selectedTime = selectRenewalTime(start, end)
+	}
+	return info, nil
+}
+
+// updateRenewalInfo will refresh the ACME Renewal Information (ARI) for the
+// certificate if required. The (possibly updated) certificate is returned.
+func (cm *CertificateManager) updateRenewalInfo(
+	cert *Certificate) *Certificate {
+	if cm.account == nil {
+		return cert
+	}
+	if cert.renewalInfo != nil &&
+		time.Now().Before(cert.renewalInfo.nextPoll) {
+		return cert
+	}
+	info, err := cm.fetchRenewalInfo(cm.ctx, cert)
+	if err != nil {
+		cm.logger.Printf("error getting renewal information: %s\n", err)
+		if cert.renewalInfo == nil {
+			return cert
+		}
+		// Keep the previous window and try again later.
+		info = &renewalInfo{}
+		*info = *cert.renewalInfo
+		info.nextPoll = time.Now().Add(jitteryHour())
+	}
+	if info == nil {
+		return cert
+	}
+	if cert.renewalInfo == nil ||
+		!cert.renewalInfo.selectedTime.Equal(info.selectedTime) {
+		cm.logger.Printf(
+			"CA suggests renewal between: %s and %s, selected: %s (in: %s)\n",
+			info.windowStart.Local(), info.windowEnd.Local(),
+			info.selectedTime.Local(),
+			format.Duration(time.Until(info.selectedTime)))
+		if info.explanationURL != "" {
+			cm.logger.Printf("renewal explanation: %s\n", info.explanationURL)
+		}
+	}
+	newCert := cert.withRenewalInfo(info)
+	cm.rwMutex.Lock()
+	if cm.certificate == cert {
+		cm.certificate = newCert
+	}
+	cm.rwMutex.Unlock()
+	return newCert
+}
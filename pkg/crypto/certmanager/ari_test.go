@@ -0,0 +1,114 @@
+package certmanager
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+type testARIServer struct {
+	certID string
+	start  time.Time
+	end    time.Time
+	server *httptest.Server
+}
+
+func (s *testARIServer) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	switch {
+	case req.URL.Path == "/directory":
+		json.NewEncoder(w).Encode(directoryType{
+			RenewalInfo: s.server.URL + "/renewal-info/",
+		})
+	case req.URL.Path == "/renewal-info/"+s.certID:
+		var response renewalInfoResponse
+		response.SuggestedWindow.Start = s.start
+		response.SuggestedWindow.End = s.end
+		w.Header().Set("Retry-After", "7200")
+		json.NewEncoder(w).Encode(response)
+	default:
+		http.NotFound(w, req)
+	}
+}
+
+func TestARICertID(t *testing.T) {
+	// Example from RFC 9773, section 4.1.
+	cert := &Certificate{
+		tlsCert: tls.Certificate{
+			Leaf: &x509.Certificate{
+				AuthorityKeyId: []byte{
+					0x69, 0x88, 0x5B, 0x6B, 0x87, 0x46, 0x40, 0x41, 0xE1, 0xB3,
+					0x7B, 0x84, 0x7B, 0xA0, 0xAE, 0x2C, 0xDE, 0x01, 0xC8, 0xD4,
+				},
+				SerialNumber: big.NewInt(0x87654321),
+			},
+		},
+	}
+	certID, err := makeARICertID(cert)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := "aYhba4dGQEHhs3uEe6CuLN4ByNQ.AIdlQyE"; certID != expected {
+		t.Fatalf("certID: %s != %s", certID, expected)
+	}
+}
+
+func TestARIWindow(t *testing.T) {
+	cert, _, _ := makeTestChain(t, "")
+	certID, err := makeARICertID(cert)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ariServer := &testARIServer{
+		certID: certID,
+		start:  time.Now().Add(time.Hour).Truncate(time.Second),
+		end:    time.Now().Add(time.Hour * 2).Truncate(time.Second),
+	}
+	ariServer.server = httptest.NewServer(ariServer)
+	defer ariServer.server.Close()
+	cm := makeTestManager(t, nil)
+	cm.account = &accountManager{
+		caDirectoryURL: ariServer.server.URL + "/directory",
+	}
+	cm.setCertificate(cert)
+	cert = cm.updateRenewalInfo(cert)
+	if cert.renewalInfo == nil {
+		t.Fatal("no renewal information")
+	}
+	wait := cert.timeUntilRenewal(0.33, cm.names, cm.logger)
+	if wait < time.Until(ariServer.start) || wait > time.Until(ariServer.end) {
+		t.Fatalf("renewal in: %s is outside of window", wait)
+	}
+	if wait := cert.limitToNextPoll(wait); wait > time.Hour*2 {
+		t.Fatalf("next poll in: %s is after Retry-After", wait)
+	}
+	// A window in the past should trigger renewal now.
+	ariServer.start = time.Now().Add(-time.Hour * 2).Truncate(time.Second)
+	ariServer.end = time.Now().Add(-time.Hour).Truncate(time.Second)
+	cert.renewalInfo.nextPoll = time.Now()
+	cert = cm.updateRenewalInfo(cert)
+	if wait := cert.timeUntilRenewal(0.33, nil, cm.logger); wait > 0 {
+		t.Fatalf("renewal not due, wait: %s", wait)
+	}
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	if wait := parseRetryAfter("", time.Hour); wait != time.Hour {
+		t.Fatalf("default: %s", wait)
+	}
+	if wait := parseRetryAfter("120", time.Hour); wait != time.Minute*2 {
+		t.Fatalf("seconds: %s", wait)
+	}
+	if wait := parseRetryAfter("1", time.Hour); wait != ariMinimumRetryAfter {
+		t.Fatalf("minimum: %s", wait)
+	}
+	date := time.Now().Add(time.Hour * 3).UTC().Format(http.TimeFormat)
+	wait := parseRetryAfter(date, time.Hour)
+	if wait < time.Hour*2 || wait > time.Hour*3 {
+		t.Fatalf("date: %s", wait)
+	}
+}
@@ -0,0 +1,111 @@
+package certmanager
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"strings"
+
+	"golang.org/x/crypto/acme"
+)
+
+// chainMatches returns true if the certificate chain matches the preferred
+// chain, which is either the common name of the topmost issuer in the chain or
+// the SHA-256 fingerprint of a certificate in the chain.
+func chainMatches(chainDER [][]byte, preferredChain string) bool {
+	if len(chainDER) < 1 {
+		return false
+	}
+	if fingerprint := parseFingerprint(preferredChain); fingerprint != nil {
+		for _, certDER := range chainDER {
+			sum := sha256.Sum256(certDER)
+			if string(sum[:]) == string(fingerprint) {
+				return true
+			}
+		}
+		return false
+	}
+	topmost, err := x509.ParseCertificate(chainDER[len(chainDER)-1])
+	if err != nil {
+		return false
+	}
+	return topmost.Issuer.CommonName == preferredChain
+}
+
+// parseFingerprint will parse a hexadecimal SHA-256 fingerprint, which may be
+// colon separated. If the value is not a fingerprint, nil is returned.
+func parseFingerprint(value string) []byte {
+	value = strings.ReplaceAll(value, ":", "")
+	if len(value) != sha256.Size*2 {
+		return nil
+	}
+	fingerprint, err := hex.DecodeString(value)
+	if err != nil {
+		return nil
+	}
+	return fingerprint
+}
+
+// chain returns the parsed certificate chain.
+func (cert *Certificate) chain() []*x509.Certificate {
+	chain := make([]*x509.Certificate, 0, len(cert.tlsCert.Certificate))
+	for _, certDER := range cert.tlsCert.Certificate {
+		x509Cert, err := x509.ParseCertificate(certDER)
+		if err != nil {
+			return nil
+		}
+		chain = append(chain, x509Cert)
+	}
+	return chain
+}
+
+// chainRoot returns the common name of the topmost issuer in the chain.
+func (cert *Certificate) chainRoot() string {
+	chainDER := cert.tlsCert.Certificate
+	if len(chainDER) < 1 {
+		return ""
+	}
+	topmost, err := x509.ParseCertificate(chainDER[len(chainDER)-1])
+	if err != nil {
+		return ""
+	}
+	return topmost.Issuer.CommonName
+}
+
+// selectChain will select the preferred chain from the chain returned when
+// the certificate was issued and the alternate chains offered by the CA. If no
+// chain matches, the chain returned when the certificate was issued is used.
+func (cm *CertificateManager) selectChain(ctx context.Context,
+	client *acme.Client, chainDER [][]byte, certURL string) [][]byte {
+	if cm.preferredChain == "" || chainMatches(chainDER, cm.preferredChain) {
+		return chainDER
+	}
+	alternates, err := client.ListCertAlternates(ctx, certURL)
+	if err != nil {
+		cm.logger.Printf("error listing alternate chains: %s\n", err)
+		return chainDER
+	}
+	for _, alternateURL := range alternates {
+		alternateDER, err := client.FetchCert(ctx, alternateURL, true)
+		if err != nil {
+			cm.logger.Printf("error fetching alternate chain: %s: %s\n",
+				alternateURL, err)
+			continue
+		}
+		if len(alternateDER) < 1 ||
+			string(alternateDER[0]) != string(chainDER[0]) {
+			cm.logger.Printf("alternate chain: %s has different leaf\n",
+				alternateURL)
+			continue
+		}
+		if chainMatches(alternateDER, cm.preferredChain) {
+			cm.logger.Debugf(0, "selected alternate chain: %s\n",
+				alternateURL)
+			return alternateDER
+		}
+	}
+	cm.logger.Printf("no chain matches: %s, using default chain\n",
+		cm.preferredChain)
+	return chainDER
+}
@@ -0,0 +1,183 @@
+package certmanager
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/acme"
+
+	"github.com/Cloud-Foundations/golib/pkg/log/testlogger"
+)
+
+type testChainServer struct {
+	alternateChain [][]byte
+	defaultChain   [][]byte
+	server         *httptest.Server
+}
+
+func createTestCert(t *testing.T, template, parent *x509.Certificate,
+	publicKey crypto.PublicKey, parentKey crypto.Signer) []byte {
+	certDER, err := x509.CreateCertificate(rand.Reader, template, parent,
+		publicKey, parentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return certDER
+}
+
+// makeCrossSignedChains will make two chains for the same leaf certificate,
+// with the intermediate CA signed by "Root A" and "Root B", respectively.
+func makeCrossSignedChains(t *testing.T) ([][]byte, [][]byte) {
+	now := time.Now()
+	makeCA := func(name string, serial int64) *x509.Certificate {
+		return &x509.Certificate{
+			BasicConstraintsValid: true,
+			IsCA:                  true,
+			KeyUsage:              x509.KeyUsageCertSign,
+			NotAfter:              now.Add(time.Hour * 24),
+			NotBefore:             now.Add(-time.Hour),
+			SerialNumber:          big.NewInt(serial),
+			Subject:               pkix.Name{CommonName: name},
+		}
+	}
+	var keys []crypto.Signer
+	for index := 0; index < 4; index++ {
+		key, err := makeKeyECDSA()
+		if err != nil {
+			t.Fatal(err)
+		}
+		keys = append(keys, key)
+	}
+	rootA := makeCA("Root A", 1)
+	rootB := makeCA("Root B", 2)
+	intermediate := makeCA("Intermediate", 3)
+	intermediateA := createTestCert(t, intermediate, rootA, keys[2].Public(),
+		keys[0])
+	intermediateB := createTestCert(t, intermediate, rootB, keys[2].Public(),
+		keys[1])
+	leaf := createTestCert(t,
+		&x509.Certificate{
+			DNSNames:     []string{"www.example.com"},
+			NotAfter:     now.Add(time.Hour * 12),
+			NotBefore:    now.Add(-time.Hour),
+			SerialNumber: big.NewInt(4),
+			Subject:      pkix.Name{CommonName: "www.example.com"},
+		},
+		intermediate, keys[3].Public(), keys[2])
+	return [][]byte{leaf, intermediateA}, [][]byte{leaf, intermediateB}
+}
+
+func writeTestChain(w http.ResponseWriter, chainDER [][]byte) {
+	w.Header().Set("Content-Type", "application/pem-certificate-chain")
+	for _, certDER := range chainDER {
+		pem.Encode(w, &pem.Block{Type: "CERTIFICATE", Bytes: certDER})
+	}
+}
+
+func (s *testChainServer) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Replay-Nonce", "nonce")
+	switch req.URL.Path {
+	case "/directory":
+		json.NewEncoder(w).Encode(map[string]string{
+			"newNonce": s.server.URL + "/nonce",
+			"newOrder": s.server.URL + "/order",
+		})
+	case "/nonce":
+	case "/cert/default":
+		w.Header().Add("Link",
+			"<"+s.server.URL+"/cert/alternate>;rel=\"alternate\"")
+		writeTestChain(w, s.defaultChain)
+	case "/cert/alternate":
+		writeTestChain(w, s.alternateChain)
+	default:
+		http.NotFound(w, req)
+	}
+}
+
+func TestChainMatches(t *testing.T) {
+	defaultChain, alternateChain := makeCrossSignedChains(t)
+	if !chainMatches(defaultChain, "Root A") {
+		t.Error("default chain does not match: Root A")
+	}
+	if chainMatches(defaultChain, "Root B") {
+		t.Error("default chain matches: Root B")
+	}
+	sum := sha256.Sum256(alternateChain[1])
+	fingerprint := hex.EncodeToString(sum[:])
+	if chainMatches(defaultChain, fingerprint) {
+		t.Error("default chain matches alternate fingerprint")
+	}
+	if !chainMatches(alternateChain, fingerprint) {
+		t.Error("alternate chain does not match fingerprint")
+	}
+	var colonFingerprint string
+	for index, value := range sum {
+		if index > 0 {
+			colonFingerprint += ":"
+		}
+		colonFingerprint += hex.EncodeToString([]byte{value})
+	}
+	if !chainMatches(alternateChain, colonFingerprint) {
+		t.Error("alternate chain does not match colon separated fingerprint")
+	}
+}
+
+func TestSelectChain(t *testing.T) {
+	defaultChain, alternateChain := makeCrossSignedChains(t)
+	s := &testChainServer{
+		alternateChain: alternateChain,
+		defaultChain:   defaultChain,
+	}
+	s.server = httptest.NewServer(s)
+	defer s.server.Close()
+	key, err := makeKeyECDSA()
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := &acme.Client{
+		DirectoryURL: s.server.URL + "/directory",
+		Key:          key,
+		KID:          acme.KeyID(s.server.URL + "/account/1"),
+	}
+	cm := &CertificateManager{logger: testlogger.New(t)}
+	certURL := s.server.URL + "/cert/default"
+	tests := []struct {
+		preferredChain string
+		expected       [][]byte
+	}{
+		{"", defaultChain},
+		{"Root A", defaultChain},
+		{"Root B", alternateChain},
+		{"Root C", defaultChain},
+	}
+	for _, test := range tests {
+		cm.preferredChain = test.preferredChain
+		chainDER := cm.selectChain(context.Background(), client, defaultChain,
+			certURL)
+		if string(chainDER[1]) != string(test.expected[1]) {
+			t.Errorf("%q: wrong chain selected", test.preferredChain)
+		}
+	}
+	cert, err := makeCert(alternateChain, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if chain := cert.Chain(); len(chain) != 2 {
+		t.Errorf("chain length: %d != 2", len(chain))
+	}
+	if root := cert.chainRoot(); root != "Root B" {
+		t.Errorf("chain root: %s != Root B", root)
+	}
+}
@@ -5,38 +5,233 @@ a certificate manager based on configuration data.
 package config
 
 import (
+	"time"
+
 	"github.com/Cloud-Foundations/golib/pkg/crypto/certmanager"
 	"github.com/Cloud-Foundations/golib/pkg/log"
 )
 
 type AcmeConfig struct {
+	// AcmeDnsAccountsFile specifies the JSON file containing the acme-dns
+	// accounts for the domain names. See the dns/acmedns package for the
+	// format. Required if AcmeDnsServerURL is specified.
+	AcmeDnsAccountsFile string `yaml:"acme_dns_accounts_file" envconfig:"ACME_DNS_ACCOUNTS_FILE"`
+
+	// AcmeDnsServerURL specifies the URL of an acme-dns server to use for the
+	// dns-01 challenge, instead of Route53. Optional.
+	AcmeDnsServerURL string `yaml:"acme_dns_server_url" envconfig:"ACME_DNS_SERVER_URL"`
+
 	// AwsSecretId specifies the AWS secret where certificates will be stored,
 	// facilitating sharing of certificates between server instances. Optional.
 	AwsSecretId string `yaml:"aws_secret_id" envconfig:"ACME_AWS_SECRET_ID"`
 
-	// ChallengeType specifies the ACME challenge type (i.e. dns-01 or http-01).
-	// The default is "dns-01".
+	// CaDirectoryURL specifies the ACME directory endpoint of the Certificate
+	// Authority. The default is Let's Encrypt (Production).
+	CaDirectoryURL string `yaml:"ca_directory_url" envconfig:"ACME_CA_DIRECTORY_URL"`
+
+	// ChallengeType specifies the ACME challenge type (i.e. dns-01, http-01 or
+	// tls-alpn-01). The default is "dns-01". For tls-alpn-01, the application
+	// must serve TLS on port 443 using the GetCertificate method and must add
+	// "acme-tls/1" to the crypto/tls.Config.NextProtos field.
 	ChallengeType string `yaml:"challenge_type" envconfig:"ACME_CHALLENGE_TYPE"`
 
+	// ChallengeAliases maps a domain name to the FQDN where the dns-01 TXT
+	// record is published, which must be the target of a CNAME record for
+	// "_acme-challenge.<domain>". Optional.
+	ChallengeAliases map[string]string `yaml:"challenge_aliases" envconfig:"ACME_CHALLENGE_ALIASES"`
+
+	// Contacts specifies the e-mail addresses to register with the ACME
+	// account. Optional.
+	Contacts []string `yaml:"contacts" envconfig:"ACME_CONTACTS"`
+
 	// DomainNames specifies the domain names (SANs) to request certificates
 	// for. Required.
 	DomainNames []string `yaml:"domain_names" envconfig:"ACME_DOMAIN_NAMES"`
 
+	// EabHmacKey specifies the Base64url-encoded HMAC key for External Account
+	// Binding, which some CAs require. Optional.
+	EabHmacKey string `yaml:"eab_hmac_key" envconfig:"ACME_EAB_HMAC_KEY"`
+
+	// EabKeyId specifies the key ID for External Account Binding. Optional.
+	EabKeyId string `yaml:"eab_key_id" envconfig:"ACME_EAB_KEY_ID"`
+
+	// EncryptionKeyFile specifies a file containing key-encryption keys used
+	// to encrypt private keys before they are written to the remote store.
+	// See the storage/encrypted package for the file format. Optional.
+	EncryptionKeyFile string `yaml:"encryption_key_file" envconfig:"ACME_ENCRYPTION_KEY_FILE"`
+
+	// FailoverThreshold specifies the number of consecutive failed requests
+	// to a CA before failing over to the next CA. The default is 3.
+	FailoverThreshold uint `yaml:"failover_threshold" envconfig:"ACME_FAILOVER_THRESHOLD"`
+
+	// FallbackCertificateAuthorities specifies an ordered list of CAs to fail
+	// over to if requests to the CA specified by CaDirectoryURL repeatedly
+	// fail or are rate limited. Optional.
+	FallbackCertificateAuthorities []CertificateAuthority `yaml:"fallback_certificate_authorities"`
+
+	// FollowChallengeCNAME specifies whether to follow the CNAME record for
+	// "_acme-challenge.<domain>" and publish the dns-01 TXT record at the
+	// target (i.e. in a delegated validation zone). Optional.
+	FollowChallengeCNAME bool `yaml:"follow_challenge_cname" envconfig:"ACME_FOLLOW_CHALLENGE_CNAME"`
+
 	// HttpPort specifies the HTTP port to listen on to respond to ACME http-01
 	// verification requests. The default is 80. Use this if your firewall DNATs
 	// public port 80 to HttpPort internally.
 	HttpPort uint16 `yaml:"http_port" envconfig:"ACME_HTTP_PORT"`
 
-	// KeyType specifies the key type to generate, either "EC" (default) or
-	// "RSA".
+	// KeyRotation specifies when a new private key is generated, either
+	// "always", "every" (every KeyRotationInterval renewals) or "reuse". The
+	// default is once per process lifetime. Optional.
+	KeyRotation string `yaml:"key_rotation" envconfig:"ACME_KEY_ROTATION"`
+
+	// KeyRotationInterval specifies the number of renewals between key
+	// rotations for the "every" key rotation policy.
+	KeyRotationInterval uint `yaml:"key_rotation_interval" envconfig:"ACME_KEY_ROTATION_INTERVAL"`
+
+	// KeyType specifies the key type to generate, either "EC" (default),
+	// "EC-P384", "RSA", "RSA-3072" or "RSA-4096".
 	KeyType string `yaml:"key_type" envconfig:"ACME_KEY_TYPE"`
 
+	// LocalCA specifies whether to issue certificates from a local
+	// (development) CA instead of an ACME CA, for development, CI and
+	// air-gapped environments. The ACME settings are ignored. Optional.
+	LocalCA bool `yaml:"local_ca" envconfig:"ACME_LOCAL_CA"`
+
+	// LocalCACertFile and LocalCAKeyFile specify where the local CA
+	// certificate and private key are stored. If they do not exist, a new CA
+	// is created. The defaults are "local-ca.pem" and "local-ca-key.pem" in
+	// the directory containing the certificate file.
+	LocalCACertFile string `yaml:"local_ca_cert_file" envconfig:"ACME_LOCAL_CA_CERT_FILE"`
+	LocalCAKeyFile  string `yaml:"local_ca_key_file" envconfig:"ACME_LOCAL_CA_KEY_FILE"`
+
+	// PreferredChain specifies the preferred certificate chain, either the
+	// common name of the topmost issuer (i.e. "ISRG Root X1") or the SHA-256
+	// fingerprint of a certificate in the chain. Optional.
+	PreferredChain string `yaml:"preferred_chain" envconfig:"ACME_PREFERRED_CHAIN"`
+
+	// PropagationNameservers specifies the nameservers (host:port) to query
+	// to check that the dns-01 TXT record is visible. The default is the
+	// authoritative nameservers for the zone. Optional.
+	PropagationNameservers []string `yaml:"propagation_nameservers" envconfig:"ACME_PROPAGATION_NAMESERVERS"`
+
+	// PropagationTimeout specifies the maximum time to wait for the dns-01
+	// TXT record to be visible before the challenge is accepted. If zero,
+	// propagation is not checked. Optional.
+	PropagationTimeout time.Duration `yaml:"propagation_timeout" envconfig:"ACME_PROPAGATION_TIMEOUT"`
+
 	// Proxy specifies the address of a http-01 ACME proxy server. Optional.
 	Proxy string `yaml:"proxy" envconfig:"ACME_PROXY"`
 
+	// ProxyCAFile specifies a file containing the CA certificates used to
+	// verify the certificate of the ACME proxy server. If specified, HTTPS is
+	// used. Optional.
+	ProxyCAFile string `yaml:"proxy_ca_file" envconfig:"ACME_PROXY_CA_FILE"`
+
+	// ProxyClientCertFile specifies a client certificate file used to
+	// authenticate to the ACME proxy server (mutual TLS). Optional.
+	ProxyClientCertFile string `yaml:"proxy_client_cert_file" envconfig:"ACME_PROXY_CLIENT_CERT_FILE"`
+
+	// ProxyClientKeyFile specifies the key file for ProxyClientCertFile.
+	ProxyClientKeyFile string `yaml:"proxy_client_key_file" envconfig:"ACME_PROXY_CLIENT_KEY_FILE"`
+
+	// ProxyHmacKeyFile specifies a file containing a key ID and a shared key
+	// used to authenticate to the ACME proxy server. Optional.
+	ProxyHmacKeyFile string `yaml:"proxy_hmac_key_file" envconfig:"ACME_PROXY_HMAC_KEY_FILE"`
+
+	// ProxyUseAwsIdentity specifies whether to authenticate to the ACME proxy
+	// server using the AWS IAM identity of the instance. Optional.
+	ProxyUseAwsIdentity bool `yaml:"proxy_use_aws_identity" envconfig:"ACME_PROXY_USE_AWS_IDENTITY"`
+
 	// Route53HostedZoneId specifies an AWS Route53 Hosted Zone ID for the
 	// dns-01 challenge. Required for the dns-01 challenge.
 	Route53HostedZoneId string `yaml:"route53_hosted_zone_id" envconfig:"ACME_ROUTE53_HOSTED_ZONE_ID"`
+
+	// S3Bucket specifies an AWS S3 (or S3-compatible) bucket where
+	// certificates will be stored, facilitating sharing of certificates
+	// between server instances. Optional.
+	S3Bucket string `yaml:"s3_bucket" envconfig:"ACME_S3_BUCKET"`
+
+	// S3Endpoint specifies the endpoint URL for S3-compatible object storage.
+	// Optional.
+	S3Endpoint string `yaml:"s3_endpoint" envconfig:"ACME_S3_ENDPOINT"`
+
+	// S3Prefix specifies the prefix for the object keys in S3Bucket (i.e.
+	// "example.com/"). Optional.
+	S3Prefix string `yaml:"s3_prefix" envconfig:"ACME_S3_PREFIX"`
+
+	// S3Region specifies the region of S3Bucket. The default is the region of
+	// the instance. Optional.
+	S3Region string `yaml:"s3_region" envconfig:"ACME_S3_REGION"`
+
+	// ShareHttpChallenges specifies whether http-01 challenge responses are
+	// shared between server instances via the certificate storage, so that
+	// any instance behind a load balancer can answer validation requests.
+	// Requires StorageDirectory, S3Bucket or VaultPath. Optional.
+	ShareHttpChallenges bool `yaml:"share_http_challenges" envconfig:"ACME_SHARE_HTTP_CHALLENGES"`
+
+	// ShareLocalCA specifies whether the local CA certificate and private key
+	// are shared between server instances via the certificate storage, under
+	// "local-ca" (a subdirectory of StorageDirectory, a key prefix in S3Bucket
+	// or a path below VaultPath). The private key is encrypted if
+	// EncryptionKeyFile is specified. Requires LocalCA and StorageDirectory,
+	// S3Bucket or VaultPath. Optional.
+	ShareLocalCA bool `yaml:"share_local_ca" envconfig:"ACME_SHARE_LOCAL_CA"`
+
+	// StorageDirectory specifies a directory (possibly on a shared filesystem)
+	// where certificates will be stored, facilitating sharing of certificates
+	// between server instances. Optional.
+	StorageDirectory string `yaml:"storage_directory" envconfig:"ACME_STORAGE_DIRECTORY"`
+
+	// VaultAddress specifies the address of the HashiCorp Vault server. The
+	// default is the value of the VAULT_ADDR environment variable. Optional.
+	VaultAddress string `yaml:"vault_address" envconfig:"ACME_VAULT_ADDRESS"`
+
+	// VaultAppRoleId specifies the role ID for Vault AppRole authentication.
+	// If not specified, the VAULT_TOKEN environment variable is used.
+	// Optional.
+	VaultAppRoleId string `yaml:"vault_approle_id" envconfig:"ACME_VAULT_APPROLE_ID"`
+
+	// VaultAppRoleSecretId specifies the secret ID for Vault AppRole
+	// authentication.
+	VaultAppRoleSecretId string `yaml:"vault_approle_secret_id" envconfig:"ACME_VAULT_APPROLE_SECRET_ID"`
+
+	// VaultMountPath specifies the mount path of the Vault KV (version 2)
+	// secrets engine. The default is "secret". Optional.
+	VaultMountPath string `yaml:"vault_mount_path" envconfig:"ACME_VAULT_MOUNT_PATH"`
+
+	// VaultPath specifies a path in the Vault KV secrets engine where
+	// certificates will be stored, facilitating sharing of certificates
+	// between server instances. Optional.
+	VaultPath string `yaml:"vault_path" envconfig:"ACME_VAULT_PATH"`
+}
+
+// CertificateAuthority specifies an ACME Certificate Authority.
+type CertificateAuthority struct {
+	// DirectoryURL specifies the ACME directory endpoint of the CA. Required.
+	DirectoryURL string `yaml:"directory_url"`
+
+	// EabHmacKey specifies the Base64url-encoded HMAC key for External Account
+	// Binding with the CA. Optional.
+	EabHmacKey string `yaml:"eab_hmac_key"`
+
+	// EabKeyId specifies the key ID for External Account Binding with the CA.
+	// Optional.
+	EabKeyId string `yaml:"eab_key_id"`
+}
+
+// NewLockingStorer will create the (unencrypted) Locker and Storer specified
+// by the storage configuration. If no storage is configured, nil values are
+// returned.
+func NewLockingStorer(config AcmeConfig, logger log.DebugLogger) (
+	certmanager.Locker, certmanager.Storer, error) {
+	return makeLockingStorer(config, logger)
+}
+
+// NewLocalCAStorer will create the (unencrypted) Storer for the local CA in the
+// storage specified by the configuration. See AcmeConfig.ShareLocalCA.
+func NewLocalCAStorer(config AcmeConfig, logger log.DebugLogger) (
+	certmanager.Storer, error) {
+	return makeLocalCAStorer(config, logger)
 }
 
 func New(certFilename, keyFilename string, httpRedirectPort uint16,
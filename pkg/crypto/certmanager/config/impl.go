@@ -1,32 +1,230 @@
 package config
 
 import (
+	"errors"
 	"fmt"
 	"net"
 	"net/http"
+	"path/filepath"
 
 	"github.com/Cloud-Foundations/golib/pkg/constants"
 	"github.com/Cloud-Foundations/golib/pkg/crypto/certmanager"
+	"github.com/Cloud-Foundations/golib/pkg/crypto/certmanager/dns/acmedns"
 	"github.com/Cloud-Foundations/golib/pkg/crypto/certmanager/dns/route53"
 	cm_http "github.com/Cloud-Foundations/golib/pkg/crypto/certmanager/http"
 	"github.com/Cloud-Foundations/golib/pkg/crypto/certmanager/http_proxy"
 	"github.com/Cloud-Foundations/golib/pkg/crypto/certmanager/storage/awssecretsmanager"
+	"github.com/Cloud-Foundations/golib/pkg/crypto/certmanager/storage/encrypted"
+	"github.com/Cloud-Foundations/golib/pkg/crypto/certmanager/storage/filesystem"
+	"github.com/Cloud-Foundations/golib/pkg/crypto/certmanager/storage/s3"
+	"github.com/Cloud-Foundations/golib/pkg/crypto/certmanager/storage/vault"
+	"github.com/Cloud-Foundations/golib/pkg/crypto/certmanager/tls_alpn"
 	"github.com/Cloud-Foundations/golib/pkg/log"
 )
 
+const localCAStorageName = "local-ca"
+
+// encryptStorer wraps storer so that private keys are encrypted, if an
+// encryption key file is specified.
+func encryptStorer(storer certmanager.Storer, config AcmeConfig,
+	logger log.DebugLogger) (certmanager.Storer, error) {
+	if storer == nil || config.EncryptionKeyFile == "" {
+		return storer, nil
+	}
+	keyProvider, err := encrypted.NewKeyfileProvider(config.EncryptionKeyFile)
+	if err != nil {
+		return nil, err
+	}
+	return encrypted.New(storer, keyProvider, logger)
+}
+
+// makeCertificateAuthorities will make the ordered list of CAs, starting with
+// the primary CA. If there are no fallback CAs, nil is returned.
+func makeCertificateAuthorities(
+	config AcmeConfig) []certmanager.CertificateAuthority {
+	if len(config.FallbackCertificateAuthorities) < 1 {
+		return nil
+	}
+	primaryURL := config.CaDirectoryURL
+	if primaryURL == "" {
+		primaryURL = certmanager.LetsEncryptProductionURL
+	}
+	cas := make([]certmanager.CertificateAuthority, 0,
+		len(config.FallbackCertificateAuthorities)+1)
+	cas = append(cas, certmanager.CertificateAuthority{
+		DirectoryURL: primaryURL,
+		EabHmacKey:   config.EabHmacKey,
+		EabKeyId:     config.EabKeyId,
+	})
+	for _, ca := range config.FallbackCertificateAuthorities {
+		cas = append(cas, certmanager.CertificateAuthority{
+			DirectoryURL: ca.DirectoryURL,
+			EabHmacKey:   ca.EabHmacKey,
+			EabKeyId:     ca.EabKeyId,
+		})
+	}
+	return cas
+}
+
+// makeLocalCAConfig will make the local CA configuration, using the default
+// files next to the certificate file if not specified.
+func makeLocalCAConfig(certFilename string,
+	config AcmeConfig) (*certmanager.LocalCAConfig, error) {
+	caConfig := &certmanager.LocalCAConfig{
+		CertFilename: config.LocalCACertFile,
+		KeyFilename:  config.LocalCAKeyFile,
+	}
+	if caConfig.CertFilename != "" && caConfig.KeyFilename != "" {
+		return caConfig, nil
+	}
+	if certFilename == "" {
+		return nil, errors.New("local_ca_cert_file and local_ca_key_file " +
+			"must be specified if there is no certificate file")
+	}
+	directory := filepath.Dir(certFilename)
+	if caConfig.CertFilename == "" {
+		caConfig.CertFilename = filepath.Join(directory, "local-ca.pem")
+	}
+	if caConfig.KeyFilename == "" {
+		caConfig.KeyFilename = filepath.Join(directory, "local-ca-key.pem")
+	}
+	return caConfig, nil
+}
+
+// makeLocalCAStorer will create the Storer for the local CA, which is kept
+// under "local-ca" in the storage specified by the configuration.
+func makeLocalCAStorer(config AcmeConfig, logger log.DebugLogger) (
+	certmanager.Storer, error) {
+	switch {
+	case config.AwsSecretId != "":
+		return nil, errors.New("cannot share local CA using aws_secret_id")
+	case config.S3Bucket != "":
+		config.S3Prefix += localCAStorageName + "/"
+	case config.StorageDirectory != "":
+		config.StorageDirectory = filepath.Join(config.StorageDirectory,
+			localCAStorageName)
+	case config.VaultPath != "":
+		config.VaultPath += "/" + localCAStorageName
+	default:
+		return nil, errors.New("no storage to share local CA")
+	}
+	_, storer, err := makeLockingStorer(config, logger)
+	return storer, err
+}
+
+// makeLockingStorer will create the Locker and Storer specified by the
+// configuration. If no storage is configured, nil values are returned.
+func makeLockingStorer(config AcmeConfig, logger log.DebugLogger) (
+	certmanager.Locker, certmanager.Storer, error) {
+	var numStorers int
+	for _, value := range []string{
+		config.AwsSecretId,
+		config.S3Bucket,
+		config.StorageDirectory,
+		config.VaultPath,
+	} {
+		if value != "" {
+			numStorers++
+		}
+	}
+	if numStorers > 1 {
+		return nil, nil, errors.New("cannot specify more than one of: " +
+			"aws_secret_id, s3_bucket, storage_directory and vault_path")
+	}
+	if config.AwsSecretId != "" {
+		lockingStorer, err := awssecretsmanager.New(config.AwsSecretId, logger)
+		if err != nil {
+			return nil, nil, err
+		}
+		return lockingStorer, lockingStorer, nil
+	}
+	if config.S3Bucket != "" {
+		lockingStorer, err := s3.NewWithConfig(
+			s3.Config{
+				Bucket:   config.S3Bucket,
+				Endpoint: config.S3Endpoint,
+				Prefix:   config.S3Prefix,
+				Region:   config.S3Region,
+			},
+			s3.Params{Logger: logger})
+		if err != nil {
+			return nil, nil, err
+		}
+		return lockingStorer, lockingStorer, nil
+	}
+	if config.StorageDirectory != "" {
+		lockingStorer, err := filesystem.New(config.StorageDirectory, logger)
+		if err != nil {
+			return nil, nil, err
+		}
+		return lockingStorer, lockingStorer, nil
+	}
+	if config.VaultPath != "" {
+		lockingStorer, err := vault.NewWithConfig(
+			vault.Config{
+				Address:         config.VaultAddress,
+				AppRoleId:       config.VaultAppRoleId,
+				AppRoleSecretId: config.VaultAppRoleSecretId,
+				MountPath:       config.VaultMountPath,
+				Path:            config.VaultPath,
+			},
+			vault.Params{Logger: logger})
+		if err != nil {
+			return nil, nil, err
+		}
+		return lockingStorer, lockingStorer, nil
+	}
+	return nil, nil, nil
+}
+
+// makeProxyConfig will make the acme-proxy configuration. Authentication is
+// used if any credentials are specified.
+func makeProxyConfig(config AcmeConfig) http_proxy.Config {
+	proxyConfig := http_proxy.Config{
+		Address:        config.Proxy,
+		CAFile:         config.ProxyCAFile,
+		ClientCertFile: config.ProxyClientCertFile,
+		ClientKeyFile:  config.ProxyClientKeyFile,
+		HmacKeyFile:    config.ProxyHmacKeyFile,
+		UseAwsIdentity: config.ProxyUseAwsIdentity,
+	}
+	if config.ProxyClientCertFile != "" || config.ProxyHmacKeyFile != "" ||
+		config.ProxyUseAwsIdentity {
+		proxyConfig.Names = config.DomainNames
+	}
+	return proxyConfig
+}
+
 func newManager(certFilename, keyFilename string, httpRedirectPort uint16,
 	config AcmeConfig,
 	logger log.DebugLogger) (*certmanager.CertificateManager, error) {
 	if config.HttpPort < 1 {
 		config.HttpPort = 80
 	}
+	locker, storer, err := makeLockingStorer(config, logger)
+	if err != nil {
+		return nil, err
+	}
+	// Encrypt first, so that the optional interfaces are checked on the final
+	// storer.
+	if storer, err = encryptStorer(storer, config, logger); err != nil {
+		return nil, err
+	}
 	var responder certmanager.Responder
-	var err error
-	switch config.ChallengeType {
+	challengeType := config.ChallengeType
+	if config.LocalCA {
+		challengeType = "" // No responder is required.
+	}
+	switch challengeType {
 	case "":
 	case "dns-01":
-		responder, err = route53.New(config.Route53HostedZoneId,
-			logger)
+		if config.AcmeDnsServerURL != "" {
+			responder, err = acmedns.New(config.AcmeDnsServerURL,
+				config.AcmeDnsAccountsFile, logger)
+		} else {
+			responder, err = route53.New(config.Route53HostedZoneId,
+				logger)
+		}
 	case "http-01":
 		if config.Proxy == "" {
 			var fallbackHandler http.Handler
@@ -34,15 +232,26 @@ func newManager(certFilename, keyFilename string, httpRedirectPort uint16,
 				fallbackHandler = &cm_http.RedirectHandler{}
 				httpRedirectPort = 0
 			}
-			responder, err = cm_http.NewServer(config.HttpPort,
-				fallbackHandler, logger)
+			if !config.ShareHttpChallenges {
+				responder, err = cm_http.NewServer(config.HttpPort,
+					fallbackHandler, logger)
+			} else if store, ok := storer.(cm_http.ChallengeStorer); !ok {
+				return nil, errors.New(
+					"storage does not support sharing http-01 challenges")
+			} else {
+				responder, err = cm_http.NewSharedServer(config.HttpPort,
+					fallbackHandler, store, logger)
+			}
 		} else {
 			if _, _, err := net.SplitHostPort(config.Proxy); err != nil {
 				config.Proxy = fmt.Sprintf("%s:%d", config.Proxy,
 					constants.AcmeProxyPortNumber)
 			}
-			responder, err = http_proxy.New(config.Proxy, logger)
+			responder, err = http_proxy.NewWithConfig(
+				makeProxyConfig(config), http_proxy.Params{Logger: logger})
 		}
+	case "tls-alpn-01":
+		responder, err = tls_alpn.New(logger)
 	}
 	if err != nil {
 		return nil, err
@@ -53,19 +262,54 @@ func newManager(certFilename, keyFilename string, httpRedirectPort uint16,
 			return nil, err
 		}
 	}
-	var locker certmanager.Locker
-	var storer certmanager.Storer
-	if config.AwsSecretId != "" {
-		lockingStorer, err := awssecretsmanager.New(config.AwsSecretId, logger)
+	cmConfig := certmanager.Config{
+		CertFilename:           certFilename,
+		ChallengeAliases:       config.ChallengeAliases,
+		ChallengeType:          config.ChallengeType,
+		Contacts:               config.Contacts,
+		FailoverThreshold:      config.FailoverThreshold,
+		FollowChallengeCNAME:   config.FollowChallengeCNAME,
+		KeyFilename:            keyFilename,
+		KeyRotation:            config.KeyRotation,
+		KeyRotationInterval:    config.KeyRotationInterval,
+		KeyType:                config.KeyType,
+		Names:                  config.DomainNames,
+		PreferredChain:         config.PreferredChain,
+		PropagationNameservers: config.PropagationNameservers,
+		PropagationTimeout:     config.PropagationTimeout,
+	}
+	var localCAStorer certmanager.Storer
+	if config.LocalCA {
+		cmConfig.LocalCA, err = makeLocalCAConfig(certFilename, config)
 		if err != nil {
 			return nil, err
 		}
-		locker = lockingStorer
-		storer = lockingStorer
+		if config.ShareLocalCA {
+			localCAStorer, err = makeLocalCAStorer(config, logger)
+			if err != nil {
+				return nil, err
+			}
+			localCAStorer, err = encryptStorer(localCAStorer, config, logger)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+	if cas := makeCertificateAuthorities(config); cas != nil {
+		cmConfig.CertificateAuthorities = cas
+	} else {
+		cmConfig.CaDirectoryURL = config.CaDirectoryURL
+		cmConfig.EabHmacKey = config.EabHmacKey
+		cmConfig.EabKeyId = config.EabKeyId
 	}
-	cm, err := certmanager.New(config.DomainNames, certFilename, keyFilename,
-		locker, config.ChallengeType, responder, storer, 0.0, "", config.KeyType,
-		logger)
+	cm, err := certmanager.NewWithConfig(cmConfig,
+		certmanager.Params{
+			LocalCAStorer: localCAStorer,
+			Locker:        locker,
+			Logger:        logger,
+			Responder:     responder,
+			Storer:        storer,
+		})
 	if err != nil {
 		return nil, err
 	}
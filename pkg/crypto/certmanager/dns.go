@@ -1,9 +1,12 @@
 package certmanager
 
 import (
-	"golang.org/x/crypto/acme"
+	"context"
+	"strings"
 	"time"
 
+	"golang.org/x/crypto/acme"
+
 	"github.com/Cloud-Foundations/golib/pkg/dns"
 	"github.com/Cloud-Foundations/golib/pkg/log"
 )
@@ -15,13 +18,48 @@ type dnsResponder struct {
 	records map[string]string
 }
 
-func (cm *CertificateManager) respondDNS(domain string,
-	challenge *acme.Challenge) error {
-	response, err := cm.acmeClient.DNS01ChallengeRecord(challenge.Token)
+func (cm *CertificateManager) respondDNS(ctx context.Context,
+	client *acme.Client, domain string, challenge *acme.Challenge) error {
+	response, err := client.DNS01ChallengeRecord(challenge.Token)
 	if err != nil {
 		return err
 	}
-	return cm.responder.Respond("_acme-challenge."+domain, response)
+	fqdn := cm.challengeFQDN(ctx, domain)
+	if err := cm.responder.Respond(fqdn, response); err != nil {
+		return err
+	}
+	if cm.propagation == nil {
+		return nil
+	}
+	if err := cm.propagation.wait(ctx, fqdn, response); err != nil {
+		return &RenewalError{Class: ErrorClassChallenge, Err: err}
+	}
+	return nil
+}
+
+// challengeFQDN returns the FQDN where the dns-01 TXT record for domain is
+// published. This is normally "_acme-challenge.<domain>", unless there is a
+// configured alias for the domain or the CNAME record for the name is followed.
+func (cm *CertificateManager) challengeFQDN(ctx context.Context,
+	domain string) string {
+	if alias, ok := cm.challengeAliases[strings.ToLower(domain)]; ok {
+		return alias
+	}
+	fqdn := "_acme-challenge." + domain
+	if cm.lookupCNAME == nil {
+		return fqdn
+	}
+	target, err := cm.lookupCNAME(ctx, fqdn)
+	if err != nil {
+		cm.logger.Debugf(1, "not following CNAME for: %s: %s\n", fqdn, err)
+		return fqdn
+	}
+	target = strings.TrimSuffix(target, ".")
+	if target == "" || strings.EqualFold(target, fqdn) {
+		return fqdn
+	}
+	cm.logger.Debugf(0, "following CNAME: %s to: %s\n", fqdn, target)
+	return target
 }
 
 func makeDnsResponder(rdw dns.RecordDeleteWriter,
@@ -0,0 +1,100 @@
+/*
+Package acmedns implements a dns-01 ACME protocol responder using the HTTP API
+of an acme-dns (https://github.com/joohoi/acme-dns) compatible server.
+
+Each domain name is registered with the acme-dns server, which returns the
+credentials and the "fulldomain" in the validation zone served by acme-dns. A
+CNAME record from "_acme-challenge.<domain>" to the fulldomain must be created
+(once) in the zone for the domain. The TXT record is then updated via the
+acme-dns API, without requiring write access to the zone for the domain.
+
+The accounts file uses the JSON format used by other ACME clients (a map from
+the domain name to the account):
+
+	{
+	  "example.com": {
+	    "username": "...",
+	    "password": "...",
+	    "fulldomain": "d420c923-bbd7-4056-ab64-c3ca54c9b3cf.auth.example.org",
+	    "subdomain": "d420c923-bbd7-4056-ab64-c3ca54c9b3cf"
+	  }
+	}
+*/
+package acmedns
+
+import (
+	"net/http"
+
+	"github.com/Cloud-Foundations/golib/pkg/crypto/certmanager"
+	"github.com/Cloud-Foundations/golib/pkg/log"
+)
+
+// Account contains the credentials for a domain registered with acme-dns.
+type Account struct {
+	FullDomain string `json:"fulldomain"`
+	Password   string `json:"password"`
+	SubDomain  string `json:"subdomain"`
+	Username   string `json:"username"`
+}
+
+// Config contains the configuration for a Responder.
+type Config struct {
+	// Accounts maps the domain name to the acme-dns account. Required.
+	Accounts map[string]Account
+
+	// ServerURL specifies the base URL of the acme-dns server (i.e.
+	// "https://auth.example.org"). Required.
+	ServerURL string
+}
+
+// Params contains the parameters for a Responder.
+type Params struct {
+	// HttpClient specifies the HTTP client to use. The default is a client
+	// with a 30 second timeout. Optional.
+	HttpClient *http.Client
+
+	Logger log.DebugLogger
+}
+
+type Responder struct {
+	accounts   map[string]*Account // Key: lower case FQDN.
+	httpClient *http.Client
+	logger     log.DebugLogger
+	serverURL  string
+}
+
+// Interface check.
+var _ certmanager.Responder = (*Responder)(nil)
+
+// LoadAccounts will load the acme-dns accounts from a JSON file.
+func LoadAccounts(filename string) (map[string]Account, error) {
+	return loadAccounts(filename)
+}
+
+// New creates a DNS responder for ACME dns-01 challenges which uses the
+// acme-dns server at serverURL and the accounts in accountsFile.
+func New(serverURL, accountsFile string,
+	logger log.DebugLogger) (*Responder, error) {
+	accounts, err := loadAccounts(accountsFile)
+	if err != nil {
+		return nil, err
+	}
+	return newResponder(Config{Accounts: accounts, ServerURL: serverURL},
+		Params{Logger: logger})
+}
+
+// NewWithConfig creates a DNS responder using the provided configuration.
+func NewWithConfig(config Config, params Params) (*Responder, error) {
+	return newResponder(config, params)
+}
+
+// Cleanup does nothing, since the acme-dns API does not support deleting
+// records. The acme-dns server retains only the two most recent records.
+func (r *Responder) Cleanup() {}
+
+// Respond will update the TXT record for the account for the FQDN specified by
+// key, which may be either "_acme-challenge.<domain>" or the fulldomain of the
+// account.
+func (r *Responder) Respond(key, value string) error {
+	return r.respond(key, value)
+}
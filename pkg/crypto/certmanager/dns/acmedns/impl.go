@@ -0,0 +1,104 @@
+package acmedns
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+const challengePrefix = "_acme-challenge."
+
+type updateRequest struct {
+	SubDomain string `json:"subdomain"`
+	TXT       string `json:"txt"`
+}
+
+func canonicaliseName(name string) string {
+	return strings.ToLower(strings.TrimSuffix(name, "."))
+}
+
+func loadAccounts(filename string) (map[string]Account, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	var accounts map[string]Account
+	if err := json.NewDecoder(file).Decode(&accounts); err != nil {
+		return nil, fmt.Errorf("error decoding: %s: %s", filename, err)
+	}
+	return accounts, nil
+}
+
+func newResponder(config Config, params Params) (*Responder, error) {
+	if config.ServerURL == "" {
+		return nil, errors.New("no acme-dns server URL specified")
+	}
+	if len(config.Accounts) < 1 {
+		return nil, errors.New("no acme-dns accounts specified")
+	}
+	if params.HttpClient == nil {
+		params.HttpClient = &http.Client{Timeout: time.Second * 30}
+	}
+	r := &Responder{
+		accounts:   make(map[string]*Account, len(config.Accounts)*2),
+		httpClient: params.HttpClient,
+		logger:     params.Logger,
+		serverURL:  strings.TrimSuffix(config.ServerURL, "/"),
+	}
+	for domain, account := range config.Accounts {
+		if account.SubDomain == "" || account.Username == "" ||
+			account.Password == "" {
+			return nil, fmt.Errorf("incomplete acme-dns account for: %s",
+				domain)
+		}
+		account := account
+		domain = strings.TrimPrefix(canonicaliseName(domain), "*.")
+		r.accounts[challengePrefix+domain] = &account
+		if account.FullDomain != "" {
+			r.accounts[canonicaliseName(account.FullDomain)] = &account
+		}
+	}
+	return r, nil
+}
+
+func (r *Responder) respond(key, value string) error {
+	account, ok := r.accounts[canonicaliseName(key)]
+	if !ok {
+		return fmt.Errorf("no acme-dns account for: %s", key)
+	}
+	body, err := json.Marshal(updateRequest{
+		SubDomain: account.SubDomain,
+		TXT:       value,
+	})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("POST", r.serverURL+"/update",
+		bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Api-User", account.Username)
+	req.Header.Set("X-Api-Key", account.Password)
+	r.logger.Debugf(1, "publishing %s (acme-dns subdomain: %s) TXT=\"%s\"\n",
+		key, account.SubDomain, value)
+	resp, err := r.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		message, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("error updating acme-dns record for: %s: %s: %s",
+			key, resp.Status, strings.TrimSpace(string(message)))
+	}
+	return nil
+}
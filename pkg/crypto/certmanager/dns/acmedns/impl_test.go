@@ -0,0 +1,103 @@
+package acmedns
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/Cloud-Foundations/golib/pkg/log/testlogger"
+)
+
+type testServer struct {
+	mutex   sync.Mutex
+	records map[string]string // Key: subdomain.
+}
+
+func (s *testServer) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.Method != "POST" || req.URL.Path != "/update" {
+		http.NotFound(w, req)
+		return
+	}
+	if req.Header.Get("X-Api-User") != "user" ||
+		req.Header.Get("X-Api-Key") != "secret" {
+		http.Error(w, `{"error": "forbidden"}`, http.StatusUnauthorized)
+		return
+	}
+	var update updateRequest
+	if err := json.NewDecoder(req.Body).Decode(&update); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	s.mutex.Lock()
+	s.records[update.SubDomain] = update.TXT
+	s.mutex.Unlock()
+	json.NewEncoder(w).Encode(map[string]string{"txt": update.TXT})
+}
+
+func TestLoadAccounts(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "accounts.json")
+	data := `{"example.com": {"username": "user", "password": "secret",
+		"fulldomain": "abc.auth.example.org", "subdomain": "abc"}}`
+	if err := os.WriteFile(filename, []byte(data), 0600); err != nil {
+		t.Fatal(err)
+	}
+	accounts, err := LoadAccounts(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	account := accounts["example.com"]
+	if account.SubDomain != "abc" || account.Username != "user" ||
+		account.Password != "secret" ||
+		account.FullDomain != "abc.auth.example.org" {
+		t.Errorf("account: %+v", account)
+	}
+}
+
+func TestRespond(t *testing.T) {
+	s := &testServer{records: make(map[string]string)}
+	server := httptest.NewServer(s)
+	defer server.Close()
+	r, err := NewWithConfig(
+		Config{
+			Accounts: map[string]Account{
+				"Example.com": {
+					FullDomain: "abc.auth.example.org.",
+					Password:   "secret",
+					SubDomain:  "abc",
+					Username:   "user",
+				},
+				"other.com": {
+					Password:  "wrong",
+					SubDomain: "def",
+					Username:  "user",
+				},
+			},
+			ServerURL: server.URL + "/",
+		},
+		Params{Logger: testlogger.New(t)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Respond("_acme-challenge.example.com", "one"); err != nil {
+		t.Fatal(err)
+	}
+	if value := s.records["abc"]; value != "one" {
+		t.Errorf("TXT: %s != one", value)
+	}
+	if err := r.Respond("abc.auth.example.org", "two"); err != nil {
+		t.Fatal(err)
+	}
+	if value := s.records["abc"]; value != "two" {
+		t.Errorf("TXT: %s != two", value)
+	}
+	if err := r.Respond("_acme-challenge.unknown.com", "x"); err == nil {
+		t.Error("no error for unknown domain")
+	}
+	if err := r.Respond("_acme-challenge.other.com", "x"); err == nil {
+		t.Error("no error for bad credentials")
+	}
+}
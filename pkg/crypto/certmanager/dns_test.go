@@ -0,0 +1,46 @@
+package certmanager
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/Cloud-Foundations/golib/pkg/log/testlogger"
+)
+
+func TestChallengeFQDN(t *testing.T) {
+	cm := &CertificateManager{
+		challengeAliases: map[string]string{
+			"aliased.example.com": "aliased.validation.example.net",
+		},
+		logger: testlogger.New(t),
+	}
+	ctx := context.Background()
+	if fqdn := cm.challengeFQDN(ctx, "www.example.com"); fqdn !=
+		"_acme-challenge.www.example.com" {
+		t.Errorf("no CNAME following: %s", fqdn)
+	}
+	cm.lookupCNAME = func(ctx context.Context, host string) (string, error) {
+		switch host {
+		case "_acme-challenge.delegated.example.com":
+			return "delegated.validation.example.net.", nil
+		case "_acme-challenge.plain.example.com":
+			return host + ".", nil
+		}
+		return "", errors.New("no such host")
+	}
+	tests := []struct {
+		domain   string
+		expected string
+	}{
+		{"aliased.example.com", "aliased.validation.example.net"},
+		{"delegated.example.com", "delegated.validation.example.net"},
+		{"plain.example.com", "_acme-challenge.plain.example.com"},
+		{"missing.example.com", "_acme-challenge.missing.example.com"},
+	}
+	for _, test := range tests {
+		if fqdn := cm.challengeFQDN(ctx, test.domain); fqdn != test.expected {
+			t.Errorf("%s: %s != %s", test.domain, fqdn, test.expected)
+		}
+	}
+}
@@ -4,15 +4,69 @@ import (
 	"github.com/Cloud-Foundations/golib/pkg/crypto/certmanager"
 )
 
+// DecodeAccount deserializes an encoded ACME account into a
+// *certmanager.Account. The encoded account should be the output of
+// EncodeAccount.
+func DecodeAccount(encodedAccount string) (*certmanager.Account, error) {
+	return decodeAccount(encodedAccount)
+}
+
 // DecodeCert deserializes an encoded certificate into a *certmanager.Certificate.
 // The encoded certificate should be the output of EncodeCert.
 func DecodeCert(encodedCert string) (*certmanager.Certificate, error) {
 	return decodeCert(encodedCert)
 }
 
+// DecodeJWKS deserializes a JSON Web Key Set into a *certmanager.Certificate.
+// The first private key with an X.509 certificate chain ("x5c") is used.
+func DecodeJWKS(data []byte) (*certmanager.Certificate, error) {
+	return decodeJWKS(data)
+}
+
+// DecodePEMBundle deserializes a combined PEM bundle (a certificate chain and
+// a private key, in any order) into a *certmanager.Certificate.
+func DecodePEMBundle(data []byte) (*certmanager.Certificate, error) {
+	return decodePEMBundle(data)
+}
+
+// DecodePKCS12 deserializes PKCS#12 (PFX) data into a
+// *certmanager.Certificate, using the specified password.
+func DecodePKCS12(data []byte, password string) (*certmanager.Certificate,
+	error) {
+	return decodePKCS12(data, password)
+}
+
+// EncodeAccount serializes an ACME account into the account URL and a
+// Base64-encoded DER private key.
+// The output is expected be passed back to DecodeAccount.
+func EncodeAccount(account *certmanager.Account) (string, error) {
+	return encodeAccount(account)
+}
+
 // EncodeCert serialized a certificiate into Base64-encoded
-// DERs, and supports certificate chains.
+// DERs, and supports certificate chains. The issuing CA and the number of uses
+// of the private key are included, if known.
 // The output is expected be passed back to DecodeCert
 func EncodeCert(cert *certmanager.Certificate) (string, error) {
 	return encodeCert(cert)
 }
+
+// EncodeJWKS serializes a certificate into a JSON Web Key Set, containing the
+// private key with the certificate chain ("x5c"). The key ID is the SHA-256
+// JWK thumbprint.
+func EncodeJWKS(cert *certmanager.Certificate) ([]byte, error) {
+	return encodeJWKS(cert)
+}
+
+// EncodePEMBundle serializes a certificate into a combined PEM bundle, with
+// the certificate chain followed by the private key, as used by HAProxy.
+func EncodePEMBundle(cert *certmanager.Certificate) ([]byte, error) {
+	return encodePEMBundle(cert)
+}
+
+// EncodePKCS12 serializes a certificate into PKCS#12 (PFX) format, encrypted
+// with the specified password, as used by Java services.
+func EncodePKCS12(cert *certmanager.Certificate, password string) ([]byte,
+	error) {
+	return encodePKCS12(cert, password)
+}
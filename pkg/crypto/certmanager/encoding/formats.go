@@ -0,0 +1,219 @@
+package encoding
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"strings"
+
+	"gopkg.in/square/go-jose.v2"
+	"software.sslmate.com/src/go-pkcs12"
+
+	"github.com/Cloud-Foundations/golib/pkg/crypto/certmanager"
+)
+
+func decodeJWKS(data []byte) (*certmanager.Certificate, error) {
+	var keySet jose.JSONWebKeySet
+	if err := json.Unmarshal(data, &keySet); err != nil {
+		return nil, fmt.Errorf("error unmarshaling JWKS: %s", err)
+	}
+	for _, key := range keySet.Keys {
+		if key.IsPublic() || len(key.Certificates) < 1 {
+			continue
+		}
+		return makeCertificate(key.Key, key.Certificates)
+	}
+	return nil, errors.New("no private key with certificates in JWKS")
+}
+
+func decodePEMBundle(data []byte) (*certmanager.Certificate, error) {
+	var certs []*x509.Certificate
+	var keyPemBlock []byte
+	for rest := data; ; {
+		var block *pem.Block
+		block, rest = pem.Decode(rest)
+		if block == nil {
+			break
+		}
+		switch {
+		case block.Type == "CERTIFICATE":
+			cert, err := x509.ParseCertificate(block.Bytes)
+			if err != nil {
+				return nil, err
+			}
+			certs = append(certs, cert)
+		case strings.HasSuffix(block.Type, "PRIVATE KEY"):
+			if keyPemBlock != nil {
+				return nil, errors.New("multiple private keys in PEM bundle")
+			}
+			keyPemBlock = pem.EncodeToMemory(block)
+		default:
+			return nil, fmt.Errorf("PEM type: %s not supported", block.Type)
+		}
+	}
+	if len(certs) < 1 {
+		return nil, errors.New("no certificates in PEM bundle")
+	}
+	if keyPemBlock == nil {
+		return nil, errors.New("no private key in PEM bundle")
+	}
+	return &certmanager.Certificate{
+		CertPemBlock: encodeCertChain(certs),
+		KeyPemBlock:  keyPemBlock,
+	}, nil
+}
+
+func decodePKCS12(data []byte, password string) (*certmanager.Certificate,
+	error) {
+	key, leaf, caCerts, err := pkcs12.DecodeChain(data, password)
+	if err != nil {
+		return nil, err
+	}
+	return makeCertificate(key, append([]*x509.Certificate{leaf}, caCerts...))
+}
+
+// encodeCertChain will encode a certificate chain in PEM format, in the same
+// format as decodeCert.
+func encodeCertChain(certs []*x509.Certificate) []byte {
+	buffer := &bytes.Buffer{}
+	for index, cert := range certs {
+		if index != 0 {
+			fmt.Fprintln(buffer)
+		}
+		pem.Encode(buffer, &pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw})
+	}
+	return buffer.Bytes()
+}
+
+func encodeJWKS(cert *certmanager.Certificate) ([]byte, error) {
+	key, certs, err := parseCertificate(cert)
+	if err != nil {
+		return nil, err
+	}
+	jwk := jose.JSONWebKey{
+		Certificates: certs,
+		Key:          key,
+		Use:          "sig",
+	}
+	publicKey := jwk.Public()
+	thumbprint, err := publicKey.Thumbprint(crypto.SHA256)
+	if err != nil {
+		return nil, err
+	}
+	jwk.KeyID = base64.RawURLEncoding.EncodeToString(thumbprint)
+	return json.MarshalIndent(
+		jose.JSONWebKeySet{Keys: []jose.JSONWebKey{jwk}}, "", "    ")
+}
+
+func encodePEMBundle(cert *certmanager.Certificate) ([]byte, error) {
+	if _, _, err := parseCertificate(cert); err != nil {
+		return nil, err
+	}
+	buffer := &bytes.Buffer{}
+	buffer.Write(cert.CertPemBlock)
+	if !bytes.HasSuffix(cert.CertPemBlock, []byte("\n")) {
+		fmt.Fprintln(buffer)
+	}
+	buffer.Write(cert.KeyPemBlock)
+	return buffer.Bytes(), nil
+}
+
+func encodePKCS12(cert *certmanager.Certificate, password string) (
+	[]byte, error) {
+	key, certs, err := parseCertificate(cert)
+	if err != nil {
+		return nil, err
+	}
+	return pkcs12.Modern.Encode(key, certs[0], certs[1:], password)
+}
+
+// makeCertificate will make a *certmanager.Certificate from a private key and
+// a certificate chain.
+func makeCertificate(key interface{},
+	certs []*x509.Certificate) (*certmanager.Certificate, error) {
+	var keyPemBlock []byte
+	switch key := key.(type) {
+	case *ecdsa.PrivateKey:
+		keyDER, err := x509.MarshalECPrivateKey(key)
+		if err != nil {
+			return nil, err
+		}
+		keyPemBlock = pem.EncodeToMemory(
+			&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+	case *rsa.PrivateKey:
+		keyPemBlock = pem.EncodeToMemory(&pem.Block{
+			Type:  "RSA PRIVATE KEY",
+			Bytes: x509.MarshalPKCS1PrivateKey(key),
+		})
+	default:
+		keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+		if err != nil {
+			return nil, err
+		}
+		keyPemBlock = pem.EncodeToMemory(
+			&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER})
+	}
+	return &certmanager.Certificate{
+		CertPemBlock: encodeCertChain(certs),
+		KeyPemBlock:  keyPemBlock,
+	}, nil
+}
+
+// parseCertificate will parse the private key and certificate chain.
+func parseCertificate(cert *certmanager.Certificate) (crypto.Signer,
+	[]*x509.Certificate, error) {
+	var certs []*x509.Certificate
+	for rest := cert.CertPemBlock; ; {
+		var block *pem.Block
+		block, rest = pem.Decode(rest)
+		if block == nil {
+			break
+		}
+		if block.Type != "CERTIFICATE" {
+			return nil, nil, fmt.Errorf("Certificate type: %s not supported",
+				block.Type)
+		}
+		x509Cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, nil, err
+		}
+		certs = append(certs, x509Cert)
+	}
+	if len(certs) < 1 {
+		return nil, nil, errors.New("unable to decode any PEM Certificate")
+	}
+	block, _ := pem.Decode(cert.KeyPemBlock)
+	if block == nil {
+		return nil, nil, errors.New("unable to decode PEM PrivateKey")
+	}
+	key, err := parsePrivateKey(block.Bytes)
+	if err != nil {
+		return nil, nil, err
+	}
+	return key, certs, nil
+}
+
+// parsePrivateKey will parse a DER-encoded private key in PKCS#8, SEC 1 (EC)
+// or PKCS#1 (RSA) format.
+func parsePrivateKey(der []byte) (crypto.Signer, error) {
+	if key, err := x509.ParsePKCS8PrivateKey(der); err == nil {
+		if signer, ok := key.(crypto.Signer); ok {
+			return signer, nil
+		}
+		return nil, errors.New("unsupported private key type")
+	}
+	if key, err := x509.ParseECPrivateKey(der); err == nil {
+		return key, nil
+	}
+	if key, err := x509.ParsePKCS1PrivateKey(der); err == nil {
+		return key, nil
+	}
+	return nil, errors.New("unable to parse private key")
+}
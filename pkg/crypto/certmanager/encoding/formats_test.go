@@ -0,0 +1,90 @@
+package encoding
+
+import (
+	"bytes"
+	"crypto"
+	"testing"
+
+	"github.com/Cloud-Foundations/golib/pkg/crypto/certmanager"
+)
+
+func checkDecodedCert(t *testing.T, decodedCert,
+	testCert *certmanager.Certificate) {
+	if string(decodedCert.CertPemBlock) != string(testCert.CertPemBlock) {
+		t.Fatalf("decoded cert PEM: %s != test PEM: %s",
+			string(decodedCert.CertPemBlock), string(testCert.CertPemBlock))
+	}
+	decodedKey, _, err := parseCertificate(decodedCert)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testKey, _, err := parseCertificate(testCert)
+	if err != nil {
+		t.Fatal(err)
+	}
+	type privateKey interface {
+		Equal(crypto.PrivateKey) bool
+	}
+	if !decodedKey.(privateKey).Equal(testKey) {
+		t.Fatal("decoded private key mismatch")
+	}
+}
+
+func makeTestCert() *certmanager.Certificate {
+	return &certmanager.Certificate{
+		CertPemBlock: []byte(testCertificatePEM),
+		KeyPemBlock:  []byte(testTypedKeyPEM),
+	}
+}
+
+func TestJWKS(t *testing.T) {
+	testCert := makeTestCert()
+	data, err := EncodeJWKS(testCert)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Contains(data, []byte(`"x5c"`)) {
+		t.Fatalf("no certificate chain in JWKS: %s", string(data))
+	}
+	decodedCert, err := DecodeJWKS(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkDecodedCert(t, decodedCert, testCert)
+}
+
+func TestPEMBundle(t *testing.T) {
+	testCert := makeTestCert()
+	data, err := EncodePEMBundle(testCert)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.HasSuffix(data, []byte(testTypedKeyPEM)) {
+		t.Fatalf("private key not at end of bundle: %s", string(data))
+	}
+	decodedCert, err := DecodePEMBundle(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkDecodedCert(t, decodedCert, testCert)
+	if string(decodedCert.KeyPemBlock) != testTypedKeyPEM {
+		t.Fatalf("decoded key PEM: %s != test PEM: %s",
+			string(decodedCert.KeyPemBlock), testTypedKeyPEM)
+	}
+}
+
+func TestPKCS12(t *testing.T) {
+	testCert := makeTestCert()
+	data, err := EncodePKCS12(testCert, "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := DecodePKCS12(data, "wrong"); err == nil {
+		t.Fatal("no error decoding with wrong password")
+	}
+	decodedCert, err := DecodePKCS12(data, "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkDecodedCert(t, decodedCert, testCert)
+}
@@ -7,11 +7,27 @@ import (
 	"encoding/pem"
 	"errors"
 	"fmt"
+	"strconv"
 	"strings"
 
 	"github.com/Cloud-Foundations/golib/pkg/crypto/certmanager"
 )
 
+func decodeAccount(encodedAccount string) (*certmanager.Account, error) {
+	var keyMap map[string]string
+	if err := json.Unmarshal([]byte(encodedAccount), &keyMap); err != nil {
+		return nil, fmt.Errorf("error unmarshaling account: %s", err)
+	}
+	keyPEM, err := decodeKey(keyMap)
+	if err != nil {
+		return nil, err
+	}
+	return &certmanager.Account{
+		KeyPemBlock: keyPEM,
+		URL:         keyMap["AccountURL"],
+	}, nil
+}
+
 func decodeCert(encodedCert string) (*certmanager.Certificate, error) {
 	var keyMap map[string]string
 	if err := json.Unmarshal([]byte(encodedCert), &keyMap); err != nil {
@@ -42,6 +58,27 @@ func decodeCert(encodedCert string) (*certmanager.Certificate, error) {
 			return nil, err
 		}
 	}
+	keyPEM, err := decodeKey(keyMap)
+	if err != nil {
+		return nil, err
+	}
+	var keyUses uint64
+	if value := keyMap["KeyUses"]; value != "" {
+		keyUses, err = strconv.ParseUint(value, 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("error parsing KeyUses: %s", err)
+		}
+	}
+	return &certmanager.Certificate{
+		CertPemBlock: certPEM.Bytes(),
+		KeyPemBlock:  keyPEM,
+		Issuer:       keyMap["Issuer"],
+		KeyUses:      uint(keyUses),
+	}, nil
+}
+
+// decodeKey will decode the private key in the map into PEM format.
+func decodeKey(keyMap map[string]string) ([]byte, error) {
 	keyType := keyMap["KeyType"]
 	if keyType != "" {
 		keyType += " "
@@ -55,14 +92,25 @@ func decodeCert(encodedCert string) (*certmanager.Certificate, error) {
 	if err != nil {
 		return nil, err
 	}
-	keyPEM := pem.EncodeToMemory(&pem.Block{
+	return pem.EncodeToMemory(&pem.Block{
 		Type:  keyType + "PRIVATE KEY",
 		Bytes: privateKey,
-	})
-	return &certmanager.Certificate{
-		CertPemBlock: certPEM.Bytes(),
-		KeyPemBlock:  keyPEM,
-	}, nil
+	}), nil
+}
+
+func encodeAccount(account *certmanager.Account) (string, error) {
+	keyMap := make(map[string]string, 3)
+	if err := encodeKey(keyMap, account.KeyPemBlock); err != nil {
+		return "", err
+	}
+	if account.URL != "" {
+		keyMap["AccountURL"] = account.URL
+	}
+	encodedAccount, err := json.Marshal(keyMap)
+	if err != nil {
+		return "", err
+	}
+	return string(encodedAccount), nil
 }
 
 func encodeCert(cert *certmanager.Certificate) (string, error) {
@@ -86,25 +134,39 @@ func encodeCert(cert *certmanager.Certificate) (string, error) {
 			base64.StdEncoding.EncodeToString(certBlock.Bytes)
 	}
 	// Decode the private key.
-	keyBlock, _ := pem.Decode(cert.KeyPemBlock)
+	if err := encodeKey(keyMap, cert.KeyPemBlock); err != nil {
+		return "", err
+	}
+	if cert.Issuer != "" {
+		keyMap["Issuer"] = cert.Issuer
+	}
+	if cert.KeyUses > 0 {
+		keyMap["KeyUses"] = strconv.FormatUint(uint64(cert.KeyUses), 10)
+	}
+	encodedCert, err := json.Marshal(keyMap)
+	if err != nil {
+		return "", err
+	}
+	return string(encodedCert), nil
+}
+
+// encodeKey will encode the PEM private key into the map.
+func encodeKey(keyMap map[string]string, keyPemBlock []byte) error {
+	keyBlock, _ := pem.Decode(keyPemBlock)
 	if keyBlock == nil {
-		return "", errors.New("unable to decode PEM PrivateKey")
+		return errors.New("unable to decode PEM PrivateKey")
 	}
 	if keyBlock.Type != "PRIVATE KEY" {
 		splitKeyType := strings.SplitN(keyBlock.Type, " ", 2)
 		if len(splitKeyType) != 2 {
-			return "", fmt.Errorf("unable to split: %s", keyBlock.Type)
+			return fmt.Errorf("unable to split: %s", keyBlock.Type)
 		}
 		if splitKeyType[1] != "PRIVATE KEY" {
-			return "", fmt.Errorf("PrivateKey type: %s not supported",
+			return fmt.Errorf("PrivateKey type: %s not supported",
 				keyBlock.Type)
 		}
 		keyMap["KeyType"] = splitKeyType[0]
 	}
 	keyMap["PrivateKey"] = base64.StdEncoding.EncodeToString(keyBlock.Bytes)
-	encodedCert, err := json.Marshal(keyMap)
-	if err != nil {
-		return "", err
-	}
-	return string(encodedCert), nil
+	return nil
 }
@@ -43,6 +43,8 @@ func TestTypedKey(t *testing.T) {
 	testCert := &certmanager.Certificate{
 		CertPemBlock: []byte(testCertificatePEM),
 		KeyPemBlock:  []byte(testTypedKeyPEM),
+		Issuer:       "https://ca.example.com/directory",
+		KeyUses:      3,
 	}
 	encodedCert, err := encodeCert(testCert)
 	if err != nil {
@@ -60,6 +62,14 @@ func TestTypedKey(t *testing.T) {
 		t.Fatalf("decoded key PEM: %s != test PEM: %s",
 			string(decodedCert.KeyPemBlock), string(testCert.KeyPemBlock))
 	}
+	if decodedCert.Issuer != testCert.Issuer {
+		t.Fatalf("decoded issuer: %s != test issuer: %s",
+			decodedCert.Issuer, testCert.Issuer)
+	}
+	if decodedCert.KeyUses != testCert.KeyUses {
+		t.Fatalf("decoded key uses: %d != test key uses: %d",
+			decodedCert.KeyUses, testCert.KeyUses)
+	}
 }
 
 func TestUntypedKey(t *testing.T) {
@@ -84,3 +94,27 @@ func TestUntypedKey(t *testing.T) {
 			string(decodedCert.KeyPemBlock), string(testCert.KeyPemBlock))
 	}
 }
+
+func TestAccount(t *testing.T) {
+	testAccount := &certmanager.Account{
+		KeyPemBlock: []byte(testTypedKeyPEM),
+		URL:         "https://acme.example.com/acct/1",
+	}
+	encodedAccount, err := encodeAccount(testAccount)
+	if err != nil {
+		t.Fatal(err)
+	}
+	decodedAccount, err := decodeAccount(encodedAccount)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if decodedAccount.URL != testAccount.URL {
+		t.Fatalf("decoded URL: %s != test URL: %s",
+			decodedAccount.URL, testAccount.URL)
+	}
+	if string(decodedAccount.KeyPemBlock) != string(testAccount.KeyPemBlock) {
+		t.Fatalf("decoded key PEM: %s != test PEM: %s",
+			string(decodedAccount.KeyPemBlock),
+			string(testAccount.KeyPemBlock))
+	}
+}
@@ -0,0 +1,232 @@
+package certmanager
+
+import (
+	"context"
+	"crypto/rand"
+	"errors"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"golang.org/x/crypto/acme"
+
+	"github.com/Cloud-Foundations/Dominator/lib/format"
+)
+
+const (
+	maximumRateLimitBackoff = time.Hour * 24
+	maximumTransientBackoff = time.Hour
+	minimumRateLimitBackoff = time.Hour
+	minimumTransientBackoff = time.Minute
+)
+
+var (
+	errorClassNames = map[ErrorClass]string{
+		ErrorClassAccount:     "account",
+		ErrorClassBadNonce:    "badNonce",
+		ErrorClassChallenge:   "challenge",
+		ErrorClassNetwork:     "network",
+		ErrorClassRateLimited: "rateLimited",
+		ErrorClassRejected:    "rejected",
+		ErrorClassServer:      "server",
+		ErrorClassStorage:     "storage",
+		ErrorClassUnknown:     "unknown",
+	}
+	// problemClasses maps the (lower case) ACME problem type, without the
+	// "urn:ietf:params:acme:error:" prefix, to an error class.
+	problemClasses = map[string]ErrorClass{
+		"accountdoesnotexist":     ErrorClassAccount,
+		"alreadyrevoked":          ErrorClassRejected,
+		"badcsr":                  ErrorClassRejected,
+		"badnonce":                ErrorClassBadNonce,
+		"badpublickey":            ErrorClassAccount,
+		"badrevocationreason":     ErrorClassRejected,
+		"badsignaturealgorithm":   ErrorClassRejected,
+		"caa":                     ErrorClassChallenge,
+		"connection":              ErrorClassChallenge,
+		"dns":                     ErrorClassChallenge,
+		"externalaccountrequired": ErrorClassAccount,
+		"incorrectresponse":       ErrorClassChallenge,
+		"invalidcontact":          ErrorClassAccount,
+		"malformed":               ErrorClassRejected,
+		"ordernotready":           ErrorClassRejected,
+		"ratelimited":             ErrorClassRateLimited,
+		"rejectedidentifier":      ErrorClassRejected,
+		"serverinternal":          ErrorClassServer,
+		"tls":                     ErrorClassChallenge,
+		"unauthorized":            ErrorClassChallenge,
+		"unsupportedcontact":      ErrorClassAccount,
+		"unsupportedidentifier":   ErrorClassRejected,
+		"useractionrequired":      ErrorClassAccount,
+	}
+	renewalBackoffGauge = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "certmanager_renewal_backoff_seconds",
+			Help: "Delay before the next renewal attempt after a failure",
+		},
+		[]string{"name"},
+	)
+	renewalFailureCounter = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "certmanager_renewal_failure_counter",
+			Help: "Failed certificate renewals, by error class",
+		},
+		[]string{"name", "class"},
+	)
+	renewalFailuresGauge = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "certmanager_consecutive_renewal_failures",
+			Help: "Number of consecutive failed certificate renewals",
+		},
+		[]string{"name"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(renewalBackoffGauge)
+	prometheus.MustRegister(renewalFailureCounter)
+	prometheus.MustRegister(renewalFailuresGauge)
+}
+
+// backoff returns an exponential backoff delay (with jitter) for the specified
+// number of consecutive failures, starting at minimum and limited to maximum.
+func backoff(failures uint, minimum, maximum time.Duration) time.Duration {
+	wait := minimum
+	for ; failures > 1 && wait < maximum; failures-- {
+		wait *= 2
+	}
+	if wait > maximum {
+		wait = maximum
+	}
+	randByte := make([]byte, 1)
+	rand.Read(randByte)
+	return wait + wait*time.Duration(randByte[0])/2560 // Up to 10% jitter.
+}
+
+// classifyError will classify an error from a renewal attempt. The error chain
+// is examined, so wrapped errors are classified. If the error is already a
+// *RenewalError, it is returned unchanged.
+func classifyError(err error) *RenewalError {
+	var renewalErr *RenewalError
+	if errors.As(err, &renewalErr) {
+		return renewalErr
+	}
+	renewalErr = &RenewalError{Err: err}
+	var acmeErr *acme.Error
+	var authorizationErr *acme.AuthorizationError
+	var orderErr *acme.OrderError
+	var netErr net.Error
+	switch {
+	case errors.As(err, &acmeErr):
+		renewalErr.Class = classifyProblem(acmeErr.ProblemType,
+			acmeErr.StatusCode)
+		renewalErr.ProblemType = acmeErr.ProblemType
+		if acmeErr.Header != nil {
+			if header := acmeErr.Header.Get("Retry-After"); header != "" {
+				renewalErr.RetryAfter = parseRetryAfter(header, 0)
+			}
+		}
+	case errors.As(err, &authorizationErr), errors.As(err, &orderErr):
+		renewalErr.Class = ErrorClassChallenge
+	case errors.Is(err, acme.ErrNoAccount):
+		renewalErr.Class = ErrorClassAccount
+	case errors.Is(err, context.DeadlineExceeded), errors.As(err, &netErr):
+		renewalErr.Class = ErrorClassNetwork
+	}
+	return renewalErr
+}
+
+// classifyProblem will classify an ACME problem type. If the problem type is
+// not known, the HTTP status code is used.
+func classifyProblem(problemType string, statusCode int) ErrorClass {
+	name := strings.ToLower(problemType[strings.LastIndex(problemType, ":")+1:])
+	if class, ok := problemClasses[name]; ok {
+		return class
+	}
+	switch {
+	case statusCode == 429:
+		return ErrorClassRateLimited
+	case statusCode >= 500:
+		return ErrorClassServer
+	}
+	return ErrorClassUnknown
+}
+
+func (c ErrorClass) string() string {
+	if name, ok := errorClassNames[c]; ok {
+		return name
+	}
+	return "ErrorClass(" + strconv.Itoa(int(c)) + ")"
+}
+
+func (e *RenewalError) error() string {
+	return e.Class.String() + ": " + e.Err.Error()
+}
+
+// retryDelay returns the delay before the next renewal attempt, given the
+// number of consecutive failures.
+func (e *RenewalError) retryDelay(failures uint) time.Duration {
+	var wait time.Duration
+	switch e.Class {
+	case ErrorClassRateLimited:
+		if e.RetryAfter > 0 {
+			return e.RetryAfter
+		}
+		wait = backoff(failures, minimumRateLimitBackoff,
+			maximumRateLimitBackoff)
+	case ErrorClassBadNonce, ErrorClassNetwork, ErrorClassServer,
+		ErrorClassStorage:
+		wait = backoff(failures, minimumTransientBackoff,
+			maximumTransientBackoff)
+	default:
+		wait = jitteryHour()
+	}
+	if e.RetryAfter > wait {
+		return e.RetryAfter
+	}
+	return wait
+}
+
+// renewalFailed will record a failed renewal, updating the metrics and
+// publishing an EventRenewalFailed event. The delay before the next renewal
+// attempt is returned. If the failure caused a failover to the next CA, the
+// delay is short, since the Retry-After delay and rate limits of the previous
+// CA do not apply to the next CA.
+func (cm *CertificateManager) renewalFailed(err error) time.Duration {
+	renewalErr := classifyError(err)
+	cm.rwMutex.Lock()
+	cm.lastRenewalError = renewalErr
+	cm.renewalFailures++
+	failures := cm.renewalFailures
+	failedOver := cm.failedOver
+	cm.failedOver = false
+	cm.rwMutex.Unlock()
+	var wait time.Duration
+	if failedOver {
+		wait = backoff(1, minimumTransientBackoff, maximumTransientBackoff)
+	} else {
+		wait = renewalErr.retryDelay(failures)
+	}
+	cm.logger.Printf("renewal failure: %d, retrying in: %s: %s\n",
+		failures, format.Duration(wait), renewalErr)
+	renewalBackoffGauge.WithLabelValues(cm.names[0]).Set(wait.Seconds())
+	renewalFailureCounter.WithLabelValues(cm.names[0],
+		renewalErr.Class.String()).Inc()
+	renewalFailuresGauge.WithLabelValues(cm.names[0]).Set(float64(failures))
+	cm.publishEvent(EventRenewalFailed, nil, cm.names, renewalErr)
+	cm.checkNearingExpiry()
+	return wait
+}
+
+// renewalSucceeded will reset the failure count and the metrics after a
+// successful renewal.
+func (cm *CertificateManager) renewalSucceeded() {
+	cm.rwMutex.Lock()
+	cm.lastRenewalError = nil
+	cm.renewalFailures = 0
+	cm.rwMutex.Unlock()
+	renewalBackoffGauge.WithLabelValues(cm.names[0]).Set(0)
+	renewalFailuresGauge.WithLabelValues(cm.names[0]).Set(0)
+}
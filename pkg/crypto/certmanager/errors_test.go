@@ -0,0 +1,106 @@
+package certmanager
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/acme"
+)
+
+func makeProblem(problemType string, statusCode int) *acme.Error {
+	return &acme.Error{
+		ProblemType: "urn:ietf:params:acme:error:" + problemType,
+		StatusCode:  statusCode,
+	}
+}
+
+func TestClassifyError(t *testing.T) {
+	tests := []struct {
+		err      error
+		expected ErrorClass
+	}{
+		{makeProblem("rateLimited", 429), ErrorClassRateLimited},
+		{makeProblem("badNonce", 400), ErrorClassBadNonce},
+		{makeProblem("dns", 400), ErrorClassChallenge},
+		{makeProblem("rejectedIdentifier", 400), ErrorClassRejected},
+		{makeProblem("externalAccountRequired", 401), ErrorClassAccount},
+		{makeProblem("serverInternal", 500), ErrorClassServer},
+		{makeProblem("somethingNew", 503), ErrorClassServer},
+		{makeProblem("somethingNew", 400), ErrorClassUnknown},
+		{&acme.AuthorizationError{URI: "https://ca/authz/1"},
+			ErrorClassChallenge},
+		{acme.ErrNoAccount, ErrorClassAccount},
+		{&net.OpError{Op: "dial", Err: errors.New("refused")},
+			ErrorClassNetwork},
+		{&RenewalError{Class: ErrorClassStorage, Err: errors.New("lock")},
+			ErrorClassStorage},
+		{errors.New("mystery"), ErrorClassUnknown},
+		// Wrapped errors.
+		{fmt.Errorf("finalize: %w", makeProblem("rateLimited", 429)),
+			ErrorClassRateLimited},
+		{fmt.Errorf("order: %w", &acme.OrderError{Status: "invalid"}),
+			ErrorClassChallenge},
+		{fmt.Errorf("register: %w", acme.ErrNoAccount), ErrorClassAccount},
+		{fmt.Errorf("fetch: %w", context.DeadlineExceeded),
+			ErrorClassNetwork},
+		{fmt.Errorf("renew: %w",
+			&RenewalError{Class: ErrorClassStorage, Err: errors.New("lock")}),
+			ErrorClassStorage},
+	}
+	for _, test := range tests {
+		renewalErr := classifyError(test.err)
+		if renewalErr.Class != test.expected {
+			t.Errorf("%s: class: %s != %s",
+				test.err, renewalErr.Class, test.expected)
+		}
+	}
+	problem := makeProblem("rateLimited", 429)
+	problem.Header = http.Header{"Retry-After": []string{"7200"}}
+	renewalErr := classifyError(problem)
+	if renewalErr.RetryAfter != 2*time.Hour {
+		t.Errorf("RetryAfter: %s != 2h", renewalErr.RetryAfter)
+	}
+	if renewalErr.ProblemType != problem.ProblemType {
+		t.Errorf("ProblemType: %s", renewalErr.ProblemType)
+	}
+	var acmeErr *acme.Error
+	if !errors.As(renewalErr, &acmeErr) || acmeErr != problem {
+		t.Error("underlying error not unwrapped")
+	}
+}
+
+func TestRetryDelay(t *testing.T) {
+	transient := &RenewalError{Class: ErrorClassNetwork}
+	previous := time.Duration(0)
+	for failures := uint(1); failures <= 4; failures++ {
+		wait := transient.retryDelay(failures)
+		if wait <= previous {
+			t.Errorf("failure: %d: backoff: %s did not increase", failures,
+				wait)
+		}
+		previous = wait
+	}
+	if wait := transient.retryDelay(1); wait > 2*minimumTransientBackoff {
+		t.Errorf("first transient backoff: %s too long", wait)
+	}
+	if wait := transient.retryDelay(100); wait > maximumTransientBackoff*11/10 {
+		t.Errorf("transient backoff: %s not limited", wait)
+	}
+	rateLimited := &RenewalError{Class: ErrorClassRateLimited}
+	if wait := rateLimited.retryDelay(1); wait < minimumRateLimitBackoff {
+		t.Errorf("rate limit backoff: %s too short", wait)
+	}
+	rateLimited.RetryAfter = 3 * time.Hour
+	if wait := rateLimited.retryDelay(1); wait != 3*time.Hour {
+		t.Errorf("Retry-After not honoured: %s", wait)
+	}
+	server := &RenewalError{Class: ErrorClassServer, RetryAfter: time.Hour}
+	if wait := server.retryDelay(1); wait != time.Hour {
+		t.Errorf("Retry-After not honoured for server error: %s", wait)
+	}
+}
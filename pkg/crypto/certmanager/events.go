@@ -0,0 +1,114 @@
+package certmanager
+
+import (
+	"strconv"
+	"time"
+)
+
+const (
+	sourceFile   = "file"
+	sourceStorer = "storer"
+)
+
+var eventTypeNames = map[EventType]string{
+	EventChallengePublished: "challengePublished",
+	EventIssued:             "issued",
+	EventLoadedFromStorer:   "loadedFromStorer",
+	EventNearingExpiry:      "nearingExpiry",
+	EventRenewalFailed:      "renewalFailed",
+	EventRenewalStarted:     "renewalStarted",
+}
+
+// newEventBroker will create an event broker. If channel is not nil, it is
+// subscribed.
+func newEventBroker(channel chan<- Event) *eventBroker {
+	b := &eventBroker{subscribers: make(map[chan<- Event]struct{})}
+	if channel != nil {
+		b.subscribers[channel] = struct{}{}
+	}
+	return b
+}
+
+// nearingExpiry returns true if more than half of the renewal period has
+// elapsed without the certificate being renewed.
+func (cert *Certificate) nearingExpiry(renewBefore float64) bool {
+	lifetime := cert.notAfter.Sub(cert.notBefore)
+	return time.Until(cert.notAfter) <
+		time.Duration(float64(lifetime)*renewBefore/2)
+}
+
+func (t EventType) string() string {
+	if name, ok := eventTypeNames[t]; ok {
+		return name
+	}
+	return "EventType(" + strconv.Itoa(int(t)) + ")"
+}
+
+func (b *eventBroker) close() {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if b.closed {
+		return
+	}
+	b.closed = true
+	for channel := range b.subscribers {
+		close(channel)
+	}
+	b.subscribers = nil
+}
+
+// publish will send the event to all subscribers. Subscribers which are not
+// ready to receive the event will miss it.
+func (b *eventBroker) publish(event Event) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	for channel := range b.subscribers {
+		select { // Non-blocking send.
+		case channel <- event:
+		default:
+		}
+	}
+}
+
+func (b *eventBroker) subscribe(bufferLength uint) (<-chan Event, func()) {
+	channel := make(chan Event, bufferLength)
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if b.closed {
+		close(channel)
+		return channel, func() {}
+	}
+	b.subscribers[channel] = struct{}{}
+	return channel, func() {
+		b.mutex.Lock()
+		defer b.mutex.Unlock()
+		if _, ok := b.subscribers[channel]; ok {
+			delete(b.subscribers, channel)
+			close(channel)
+		}
+	}
+}
+
+// publishEvent will publish an event for the certificate manager. If the
+// certificate is not nil, the expiry time, serial number and source of the
+// certificate are included.
+func (cm *CertificateManager) publishEvent(eventType EventType,
+	cert *Certificate, names []string, err error) {
+	event := Event{
+		Error: err,
+		Names: names,
+		Time:  time.Now(),
+		Type:  eventType,
+	}
+	if cert != nil {
+		event.Issuer = cert.Issuer
+		event.NotAfter = cert.notAfter
+		event.Serial = cert.tlsCert.Leaf.SerialNumber.String()
+		event.Source = cert.source
+	} else if cm.account != nil {
+		event.Source = cm.currentAccount().directoryURL()
+	} else if cm.localCA != nil {
+		event.Source = localCAIssuer
+	}
+	cm.events.publish(event)
+}
@@ -0,0 +1,100 @@
+package certmanager
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/Cloud-Foundations/golib/pkg/log/testlogger"
+)
+
+func TestEvents(t *testing.T) {
+	cert, _, _ := makeTestChain(t, "")
+	cert.source = sourceStorer
+	cm := makeTestManager(t, nil)
+	events, unsubscribe := cm.events.subscribe(2)
+	cm.publishEvent(EventLoadedFromStorer, cert, cm.names, nil)
+	cm.publishEvent(EventRenewalFailed, nil, cm.names, errors.New("failed"))
+	cm.publishEvent(EventRenewalStarted, nil, cm.names, nil) // Dropped.
+	event := <-events
+	if event.Type != EventLoadedFromStorer {
+		t.Fatalf("unexpected event: %s", event.Type)
+	}
+	if event.Serial != "2" || event.Source != sourceStorer {
+		t.Fatalf("unexpected serial: %s or source: %s",
+			event.Serial, event.Source)
+	}
+	if !event.NotAfter.Equal(cert.notAfter) {
+		t.Fatalf("unexpected NotAfter: %s", event.NotAfter)
+	}
+	event = <-events
+	if event.Type != EventRenewalFailed || event.Error == nil {
+		t.Fatalf("unexpected event: %s, error: %v", event.Type, event.Error)
+	}
+	select {
+	case event := <-events:
+		t.Fatalf("unexpected event: %s", event.Type)
+	default:
+	}
+	unsubscribe()
+	if _, ok := <-events; ok {
+		t.Fatal("channel not closed by unsubscribe")
+	}
+	unsubscribe()
+	events, _ = cm.events.subscribe(1)
+	cm.events.close()
+	if _, ok := <-events; ok {
+		t.Fatal("channel not closed by close")
+	}
+	cm.publishEvent(EventRenewalStarted, nil, cm.names, nil)
+}
+
+func TestEventsParam(t *testing.T) {
+	dir := t.TempDir()
+	events := make(chan Event, 16)
+	cm, err := NewWithConfig(
+		Config{
+			LocalCA: &LocalCAConfig{
+				CertFilename: filepath.Join(dir, "ca.pem"),
+				KeyFilename:  filepath.Join(dir, "ca-key.pem"),
+			},
+			Names: []string{"localhost"},
+		},
+		Params{Events: events, Logger: testlogger.New(t)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The certificate is issued at startup, before Subscribe could be called.
+	timeout := time.After(time.Second * 5)
+	for issued := false; !issued; {
+		select {
+		case event := <-events:
+			issued = event.Type == EventIssued
+		case <-timeout:
+			t.Fatal("timed out waiting for EventIssued")
+		}
+	}
+	cm.Close()
+	for range events {
+	}
+}
+
+func TestNearingExpiry(t *testing.T) {
+	now := time.Now()
+	cert := &Certificate{
+		notAfter:  now.Add(time.Hour * 24 * 20),
+		notBefore: now.Add(-time.Hour * 24 * 70),
+	}
+	if cert.nearingExpiry(0.33) {
+		t.Fatal("certificate with 20 days left is nearing expiry")
+	}
+	cert.notAfter = now.Add(time.Hour * 24 * 10)
+	cert.notBefore = now.Add(-time.Hour * 24 * 80)
+	if !cert.nearingExpiry(0.33) {
+		t.Fatal("certificate with 10 days left is not nearing expiry")
+	}
+	if EventNearingExpiry.String() != "nearingExpiry" {
+		t.Fatalf("unexpected name: %s", EventNearingExpiry)
+	}
+}
@@ -0,0 +1,137 @@
+package certmanager
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/Cloud-Foundations/golib/pkg/log"
+)
+
+const defaultFailoverThreshold = 3
+
+// newAccountManagers will create an account manager for each CA. If no CAs are
+// specified, the only CA is specified by caDirectoryURL, eabKeyId and
+// eabHmacKey. The account for the primary CA is cached locally in filename and
+// is shared via the storer. The accounts for the other CAs are only cached
+// locally, in filename with the index of the CA appended.
+func newAccountManagers(cas []CertificateAuthority, caDirectoryURL string,
+	contacts []string, eabKeyId, eabHmacKey string, filename string,
+	storer AccountStorer, logger log.DebugLogger) ([]*accountManager, error) {
+	if len(cas) < 1 {
+		account, err := newAccountManager(caDirectoryURL, contacts, eabKeyId,
+			eabHmacKey, filename, storer, logger)
+		if err != nil {
+			return nil, err
+		}
+		return []*accountManager{account}, nil
+	}
+	if caDirectoryURL != "" || eabKeyId != "" || eabHmacKey != "" {
+		return nil, errors.New(
+			"CaDirectoryURL and EAB credentials conflict with CA list")
+	}
+	accounts := make([]*accountManager, 0, len(cas))
+	directoryURLs := make(map[string]struct{}, len(cas))
+	for index, ca := range cas {
+		if ca.DirectoryURL == "" {
+			return nil, fmt.Errorf("no directory URL for CA: %d", index)
+		}
+		if _, ok := directoryURLs[ca.DirectoryURL]; ok {
+			return nil, fmt.Errorf("duplicate CA: %s", ca.DirectoryURL)
+		}
+		directoryURLs[ca.DirectoryURL] = struct{}{}
+		accountFilename := filename
+		accountStorer := storer
+		if index > 0 {
+			if filename != "" {
+				accountFilename = fmt.Sprintf("%s.%d", filename, index)
+			}
+			accountStorer = nil
+		}
+		account, err := newAccountManager(ca.DirectoryURL, contacts,
+			ca.EabKeyId, ca.EabHmacKey, accountFilename, accountStorer, logger)
+		if err != nil {
+			return nil, fmt.Errorf("CA: %s: %s", ca.DirectoryURL, err)
+		}
+		accounts = append(accounts, account)
+	}
+	return accounts, nil
+}
+
+// currentAccount returns the account for the CA which is currently used to
+// request certificates.
+func (cm *CertificateManager) currentAccount() *accountManager {
+	cm.rwMutex.RLock()
+	defer cm.rwMutex.RUnlock()
+	return cm.accounts[cm.caIndex]
+}
+
+// issuerAccount returns the account for the CA which issued the certificate.
+// If the issuer is not known, the account for the primary CA is returned.
+func (cm *CertificateManager) issuerAccount(cert *Certificate) *accountManager {
+	for _, account := range cm.accounts {
+		if account.directoryURL() == cert.Issuer {
+			return account
+		}
+	}
+	return cm.account
+}
+
+// lockAccount will grab the lock for the primary account, which protects the
+// ACME state of the certificate manager, and the lock for account, if it is
+// different.
+func (cm *CertificateManager) lockAccount(account *accountManager) {
+	cm.account.mutex.Lock()
+	if account != cm.account {
+		account.mutex.Lock()
+	}
+}
+
+// recordFailure will record a failed request to the CA for account. If the
+// failure threshold is reached or the CA reports that a rate limit was
+// exceeded, the next CA will be used, and will be tried after a short delay
+// (see renewalFailed).
+func (cm *CertificateManager) recordFailure(account *accountManager,
+	err error) {
+	if len(cm.accounts) < 2 {
+		return
+	}
+	cm.rwMutex.Lock()
+	defer cm.rwMutex.Unlock()
+	if cm.accounts[cm.caIndex] != account {
+		return
+	}
+	cm.caFailures++
+	rateLimited := classifyError(err).Class == ErrorClassRateLimited
+	if !rateLimited && cm.caFailures < cm.failoverThreshold {
+		return
+	}
+	cm.caIndex = (cm.caIndex + 1) % len(cm.accounts)
+	cm.logger.Printf("failing over from CA: %s to CA: %s after %d failures\n",
+		account.directoryURL(), cm.accounts[cm.caIndex].directoryURL(),
+		cm.caFailures)
+	cm.caFailures = 0
+	cm.failedOver = true
+}
+
+// returnToPrimary will reset the failure count and will ensure that the
+// primary CA is used for the next renewal.
+func (cm *CertificateManager) returnToPrimary() {
+	cm.rwMutex.Lock()
+	defer cm.rwMutex.Unlock()
+	cm.caFailures = 0
+	cm.failedOver = false
+	if cm.caIndex == 0 {
+		return
+	}
+	cm.caIndex = 0
+	cm.logger.Printf("returning to primary CA: %s for the next renewal\n",
+		cm.account.directoryURL())
+}
+
+// unlockAccount will release the locks grabbed by lockAccount.
+func (cm *CertificateManager) unlockAccount(account *accountManager) {
+	if account != cm.account {
+		account.mutex.Unlock()
+	}
+	cm.account.mutex.Unlock()
+}
@@ -0,0 +1,144 @@
+package certmanager
+
+import (
+	"errors"
+	"net/http"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/acme"
+
+	"github.com/Cloud-Foundations/golib/pkg/log/testlogger"
+)
+
+const (
+	testFallbackURL = "https://fallback.example.com/directory"
+	testPrimaryURL  = "https://primary.example.com/directory"
+)
+
+func makeFailoverManager(t *testing.T) *CertificateManager {
+	accounts, err := newAccountManagers(
+		[]CertificateAuthority{
+			{DirectoryURL: testPrimaryURL},
+			{DirectoryURL: testFallbackURL},
+		},
+		"", nil, "", "", "", nil, testlogger.New(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &CertificateManager{
+		account:           accounts[0],
+		accounts:          accounts,
+		events:            newEventBroker(nil),
+		failoverThreshold: 2,
+		logger:            testlogger.New(t),
+		names:             []string{"www.example.com"},
+	}
+}
+
+func TestAccountManagers(t *testing.T) {
+	logger := testlogger.New(t)
+	filename := filepath.Join(t.TempDir(), "cert.pem"+accountFileSuffix)
+	accounts, err := newAccountManagers(
+		[]CertificateAuthority{
+			{DirectoryURL: testPrimaryURL},
+			{DirectoryURL: testFallbackURL, EabHmacKey: "a2V5", EabKeyId: "id"},
+		},
+		"", nil, "", "", filename, nil, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(accounts) != 2 {
+		t.Fatalf("number of accounts: %d != 2", len(accounts))
+	}
+	if accounts[0].filename != filename {
+		t.Errorf("primary account filename: %s", accounts[0].filename)
+	}
+	if accounts[1].filename != filename+".1" {
+		t.Errorf("fallback account filename: %s", accounts[1].filename)
+	}
+	if accounts[0].eab != nil || accounts[1].eab == nil {
+		t.Error("EAB credentials not specific to CA")
+	}
+	_, err = newAccountManagers(
+		[]CertificateAuthority{{DirectoryURL: testPrimaryURL}},
+		testPrimaryURL, nil, "", "", "", nil, logger)
+	if err == nil {
+		t.Error("no error for CaDirectoryURL with CA list")
+	}
+	_, err = newAccountManagers(
+		[]CertificateAuthority{
+			{DirectoryURL: testPrimaryURL},
+			{DirectoryURL: testPrimaryURL},
+		},
+		"", nil, "", "", "", nil, logger)
+	if err == nil {
+		t.Error("no error for duplicate CA")
+	}
+}
+
+func TestFailover(t *testing.T) {
+	cm := makeFailoverManager(t)
+	primary := cm.accounts[0]
+	fallback := cm.accounts[1]
+	cm.recordFailure(primary, errors.New("connection refused"))
+	if cm.currentAccount() != primary {
+		t.Fatal("failed over before threshold")
+	}
+	cm.recordFailure(primary, errors.New("connection refused"))
+	if cm.currentAccount() != fallback {
+		t.Fatal("did not fail over at threshold")
+	}
+	// A stale failure for the previous CA is ignored.
+	cm.recordFailure(primary, errors.New("connection refused"))
+	if cm.currentAccount() != fallback {
+		t.Fatal("failed over for stale failure")
+	}
+	cm.returnToPrimary()
+	if cm.currentAccount() != primary {
+		t.Fatal("did not return to primary")
+	}
+	// Rate limit errors fail over immediately.
+	cm.recordFailure(primary, &acme.Error{
+		ProblemType: "urn:ietf:params:acme:error:rateLimited",
+		StatusCode:  429,
+	})
+	if cm.currentAccount() != fallback {
+		t.Fatal("did not fail over for rate limit")
+	}
+	// After the last CA, the primary CA is used again.
+	cm.recordFailure(fallback, errors.New("connection refused"))
+	cm.recordFailure(fallback, errors.New("connection refused"))
+	if cm.currentAccount() != primary {
+		t.Fatal("did not wrap around to primary")
+	}
+}
+
+func TestFailoverRetryDelay(t *testing.T) {
+	cm := makeFailoverManager(t)
+	rateLimitErr := &acme.Error{
+		Header:      http.Header{"Retry-After": []string{"86400"}},
+		ProblemType: "urn:ietf:params:acme:error:rateLimited",
+		StatusCode:  429,
+	}
+	cm.recordFailure(cm.account, rateLimitErr)
+	if wait := cm.renewalFailed(rateLimitErr); wait > time.Hour {
+		t.Errorf("waiting: %s for primary CA after failover", wait)
+	}
+	// Without a failover, the Retry-After delay is honoured.
+	if wait := cm.renewalFailed(rateLimitErr); wait < 24*time.Hour {
+		t.Errorf("Retry-After not honoured, waiting: %s", wait)
+	}
+}
+
+func TestIssuerAccount(t *testing.T) {
+	cm := makeFailoverManager(t)
+	cert := &Certificate{Issuer: testFallbackURL}
+	if account := cm.issuerAccount(cert); account != cm.accounts[1] {
+		t.Error("wrong account for fallback issuer")
+	}
+	if account := cm.issuerAccount(&Certificate{}); account != cm.account {
+		t.Error("unknown issuer not mapped to primary CA")
+	}
+}
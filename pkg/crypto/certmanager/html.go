@@ -0,0 +1,109 @@
+package certmanager
+
+import (
+	"fmt"
+	"html"
+	"io"
+	"sort"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/ocsp"
+
+	"github.com/Cloud-Foundations/Dominator/lib/format"
+)
+
+func formatRelative(duration time.Duration) string {
+	if duration < 0 {
+		return format.Duration(-duration) + " ago"
+	}
+	return "in " + format.Duration(duration)
+}
+
+func writeTime(writer io.Writer, name string, t time.Time) {
+	fmt.Fprintf(writer, "%s: %s (%s)<br>\n",
+		name, t.Local().Format(format.TimeFormatSeconds),
+		formatRelative(time.Until(t)))
+}
+
+func (cm *CertificateManager) writeHtml(writer io.Writer) {
+	cm.rwMutex.RLock()
+	cert := cm.certificate
+	lastRenewalError := cm.lastRenewalError
+	nextCheck := cm.nextCheck
+	renewalFailures := cm.renewalFailures
+	cm.rwMutex.RUnlock()
+	if lastRenewalError != nil {
+		fmt.Fprintf(writer,
+			"<font color=\"red\">Renewal failed %d times, last error (%s): %s"+
+				"</font><br>\n",
+			renewalFailures, lastRenewalError.Class,
+			html.EscapeString(lastRenewalError.Err.Error()))
+	}
+	if cert == nil {
+		fmt.Fprintln(writer, "No certificate available<br>")
+		if !nextCheck.IsZero() {
+			writeTime(writer, "Next renewal check", nextCheck)
+		}
+		return
+	}
+	leaf := cert.tlsCert.Leaf
+	fmt.Fprintf(writer, "Certificate for: %s, serial: %s<br>\n",
+		html.EscapeString(strings.Join(cm.names, " ")), leaf.SerialNumber)
+	if cert.Issuer != "" {
+		fmt.Fprintf(writer, "Issued by CA: %s<br>\n",
+			html.EscapeString(cert.Issuer))
+	}
+	if root := cert.chainRoot(); root != "" {
+		fmt.Fprintf(writer, "Chain root: %s<br>\n", html.EscapeString(root))
+	}
+	writeTime(writer, "Valid from", cert.notBefore)
+	writeTime(writer, "Expires", cert.notAfter)
+	if cert.revoked {
+		fmt.Fprintln(writer, "<font color=\"red\">Revoked</font><br>")
+	} else if response := cert.ocspResponse; response != nil {
+		if response.Status == ocsp.Good {
+			fmt.Fprintln(writer, "OCSP status: good<br>")
+		} else {
+			fmt.Fprintln(writer, "OCSP status: unknown<br>")
+		}
+	}
+	if info := cert.renewalInfo; info != nil {
+		fmt.Fprintf(writer,
+			"CA suggested renewal window: %s to %s<br>\n",
+			info.windowStart.Local().Format(format.TimeFormatSeconds),
+			info.windowEnd.Local().Format(format.TimeFormatSeconds))
+		writeTime(writer, "Selected renewal time", info.selectedTime)
+		if info.explanationURL != "" {
+			fmt.Fprintf(writer,
+				"Renewal explanation: <a href=\"%s\">%s</a><br>\n",
+				html.EscapeString(info.explanationURL),
+				html.EscapeString(info.explanationURL))
+		}
+		writeTime(writer, "Next renewal information check", info.nextPoll)
+	} else if cm.account != nil {
+		fmt.Fprintln(writer, "No renewal information from CA<br>")
+	}
+	if len(cm.accounts) > 1 {
+		fmt.Fprintf(writer, "Current CA: %s<br>\n",
+			html.EscapeString(cm.currentAccount().directoryURL()))
+	}
+	if !nextCheck.IsZero() {
+		writeTime(writer, "Next renewal check", nextCheck)
+	}
+}
+
+func (mcm *MultiCertificateManager) writeHtml(writer io.Writer) {
+	names := make([]string, 0, len(mcm.managers))
+	for name := range mcm.managers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for index, name := range names {
+		if index > 0 {
+			fmt.Fprintln(writer, "<p>")
+		}
+		fmt.Fprintf(writer, "<b>%s</b><br>\n", html.EscapeString(name))
+		mcm.managers[name].writeHtml(writer)
+	}
+}
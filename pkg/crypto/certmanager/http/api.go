@@ -1,15 +1,41 @@
 /*
 Package http implements a http-01 ACME protocol responder.
+
+By default, only the instance which is performing the ACME transaction can
+respond to the validation request from the CA. If the service is behind a load
+balancer or a round-robin DNS name, the validation request may be sent to any
+instance. In this case, a shared Responder may be used: challenge responses are
+written to a ChallengeStorer (such as the filesystem, s3 and vault storage
+backends for the certmanager) and every instance answers validation requests
+from the ChallengeStorer.
 */
 package http
 
 import (
 	"net/http"
 	"sync"
+	"time"
 
 	"github.com/Cloud-Foundations/golib/pkg/log"
 )
 
+// ChallengeStorer is an interface to a remote data store which is shared
+// between instances of the service, where http-01 challenge responses are
+// published.
+type ChallengeStorer interface {
+	// DeleteChallengeResponse will delete the response for the token from the
+	// remote store.
+	DeleteChallengeResponse(token string) error
+
+	// ReadChallengeResponse will read the response (the key authorisation) for
+	// the token from the remote store.
+	ReadChallengeResponse(token string) (string, error)
+
+	// WriteChallengeResponse will write the response for the token to the
+	// remote store.
+	WriteChallengeResponse(token, response string) error
+}
+
 type RedirectHandler struct{}
 
 // ServeHTTP serves HTTP requests. All GET and HEAD requests will be redirected
@@ -21,10 +47,14 @@ func (h *RedirectHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 }
 
 type Responder struct {
-	fallback  http.Handler
-	logger    log.DebugLogger
-	rwMutex   sync.RWMutex // Protect everything below.
-	responses map[string]string
+	fallback         http.Handler
+	logger           log.DebugLogger
+	store            ChallengeStorer
+	rwMutex          sync.RWMutex         // Protect everything below.
+	missingResponses map[string]time.Time // Key: token, value: expiry.
+	numSharedReads   uint                 // Since readWindowStart.
+	readWindowStart  time.Time
+	responses        map[string]string
 }
 
 // CreateRedirectServer is a convenience function that creates a redirecting
@@ -40,7 +70,7 @@ func CreateRedirectServer(portNum uint16, logger log.DebugLogger) error {
 // The logger is used for logging messages.
 func NewHandler(fallback http.Handler,
 	logger log.DebugLogger) (*Responder, error) {
-	return newHandler(fallback, logger)
+	return newHandler(fallback, nil, logger)
 }
 
 // NewServer creates a HTTP server on port number portNum. This should
@@ -54,7 +84,26 @@ func NewHandler(fallback http.Handler,
 // The logger is used for logging messages.
 func NewServer(portNum uint16, fallback http.Handler,
 	logger log.DebugLogger) (*Responder, error) {
-	return newServer(portNum, fallback, logger)
+	return newServer(portNum, fallback, nil, logger)
+}
+
+// NewSharedHandler is similar to NewHandler, except that challenge responses
+// are also written to store, and requests for tokens which are not known
+// locally are answered from store. This allows any instance of the service to
+// respond to the validation request from the CA. Tokens which are missing from
+// store are cached briefly and the rate of reads is limited, so that requests
+// for unknown tokens do not overload store.
+func NewSharedHandler(fallback http.Handler, store ChallengeStorer,
+	logger log.DebugLogger) (*Responder, error) {
+	return newHandler(fallback, store, logger)
+}
+
+// NewSharedServer is similar to NewServer, except that challenge responses are
+// shared via store (see NewSharedHandler). New connections are always
+// accepted, since another instance may have published a response.
+func NewSharedServer(portNum uint16, fallback http.Handler,
+	store ChallengeStorer, logger log.DebugLogger) (*Responder, error) {
+	return newServer(portNum, fallback, store, logger)
 }
 
 func (r *Responder) Cleanup() {
@@ -1,15 +1,23 @@
 package http
 
 import (
+	"fmt"
 	"net"
 	"net/http"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/Cloud-Foundations/golib/pkg/constants"
 	"github.com/Cloud-Foundations/golib/pkg/log"
 )
 
+const (
+	maxMissingResponses      = 1024
+	maxSharedReadsPerSecond  = 20
+	missingResponseCacheTime = time.Second * 5
+)
+
 func createListener(portNum uint16) (net.Listener, error) {
 	return net.Listen("tcp", ":"+strconv.FormatInt(int64(portNum), 10))
 }
@@ -34,18 +42,39 @@ type rejectingListener struct {
 	responder *Responder
 }
 
-func newHandler(fallback http.Handler,
+// isValidToken returns true if the token only contains base64url characters,
+// so that it is safe to use as a file name or object key.
+func isValidToken(token string) bool {
+	if token == "" {
+		return false
+	}
+	for _, ch := range token {
+		switch {
+		case ch >= 'a' && ch <= 'z':
+		case ch >= 'A' && ch <= 'Z':
+		case ch >= '0' && ch <= '9':
+		case ch == '-' || ch == '_':
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+func newHandler(fallback http.Handler, store ChallengeStorer,
 	logger log.DebugLogger) (*Responder, error) {
 	return &Responder{
-		fallback:  fallback,
-		logger:    logger,
-		responses: make(map[string]string),
+		fallback:         fallback,
+		logger:           logger,
+		store:            store,
+		responses:        make(map[string]string),
+		missingResponses: make(map[string]time.Time),
 	}, nil
 }
 
-func newServer(portNum uint16, fallback http.Handler,
+func newServer(portNum uint16, fallback http.Handler, store ChallengeStorer,
 	logger log.DebugLogger) (*Responder, error) {
-	responder, err := newHandler(fallback, logger)
+	responder, err := newHandler(fallback, store, logger)
 	if err != nil {
 		return nil, err
 	}
@@ -53,7 +82,7 @@ func newServer(portNum uint16, fallback http.Handler,
 	if err != nil {
 		return nil, err
 	}
-	if fallback == nil {
+	if fallback == nil && store == nil {
 		listener = &rejectingListener{listener: listener, responder: responder}
 	}
 	go runServer(listener, responder, logger)
@@ -68,6 +97,11 @@ func stripPort(hostport string) string {
 	return host
 }
 
+// tokenFromPath returns the challenge token from the request path.
+func tokenFromPath(path string) string {
+	return strings.TrimPrefix(path, constants.AcmePath+"/")
+}
+
 func (*RedirectHandler) serveHTTP(w http.ResponseWriter, req *http.Request) {
 	if req.Method != "GET" && req.Method != "HEAD" {
 		http.Error(w, "Use HTTPS", http.StatusBadRequest)
@@ -105,8 +139,18 @@ func (l *rejectingListener) Addr() net.Addr {
 
 func (r *Responder) cleanup() {
 	r.rwMutex.Lock()
+	responses := r.responses
 	r.responses = make(map[string]string)
 	r.rwMutex.Unlock()
+	if r.store == nil {
+		return
+	}
+	for key := range responses {
+		token := tokenFromPath(key)
+		if err := r.store.DeleteChallengeResponse(token); err != nil {
+			r.logger.Printf("error deleting challenge response: %s\n", err)
+		}
+	}
 }
 
 func (r *Responder) serveHTTP(w http.ResponseWriter, req *http.Request) {
@@ -121,6 +165,9 @@ func (r *Responder) serveHTTP(w http.ResponseWriter, req *http.Request) {
 		return
 	}
 	response := r.getResponse(req.URL.Path)
+	if response == "" && r.store != nil {
+		response = r.readSharedResponse(req.URL.Path)
+	}
 	if response == "" {
 		http.Error(w, "no token for path", http.StatusNotFound)
 		r.logger.Debugf(0, "no token for path: %s\n", req.URL.Path)
@@ -139,7 +186,81 @@ func (r *Responder) getResponse(key string) string {
 	return response
 }
 
+// cacheMissingResponse will record that the response for the token is missing
+// from the shared store. If the cache is full of unexpired tokens, nothing is
+// recorded.
+func (r *Responder) cacheMissingResponse(token string) {
+	now := time.Now()
+	r.rwMutex.Lock()
+	defer r.rwMutex.Unlock()
+	if len(r.missingResponses) >= maxMissingResponses {
+		for key, expires := range r.missingResponses {
+			if now.After(expires) {
+				delete(r.missingResponses, key)
+			}
+		}
+		if len(r.missingResponses) >= maxMissingResponses {
+			return
+		}
+	}
+	r.missingResponses[token] = now.Add(missingResponseCacheTime)
+}
+
+// checkSharedRead returns true if the shared store should be read for the
+// token. It returns false if the token was recently missing from the store or
+// if too many reads were made recently.
+func (r *Responder) checkSharedRead(token string) bool {
+	now := time.Now()
+	r.rwMutex.Lock()
+	defer r.rwMutex.Unlock()
+	if expires, ok := r.missingResponses[token]; ok && now.Before(expires) {
+		return false
+	}
+	if now.Sub(r.readWindowStart) >= time.Second {
+		r.numSharedReads = 0
+		r.readWindowStart = now
+	}
+	if r.numSharedReads >= maxSharedReadsPerSecond {
+		r.logger.Debugf(1, "too many shared response reads, ignoring: %s\n",
+			token)
+		return false
+	}
+	r.numSharedReads++
+	return true
+}
+
+// readSharedResponse will read the response for the path from the shared
+// store. If there is no response, the empty string is returned.
+func (r *Responder) readSharedResponse(path string) string {
+	token := tokenFromPath(path)
+	if !isValidToken(token) {
+		return ""
+	}
+	if !r.checkSharedRead(token) {
+		return ""
+	}
+	response, err := r.store.ReadChallengeResponse(token)
+	if err != nil {
+		r.logger.Debugf(1, "error reading shared response for: %s: %s\n",
+			token, err)
+		response = ""
+	}
+	if response == "" {
+		r.cacheMissingResponse(token)
+	}
+	return response
+}
+
 func (r *Responder) respond(key, value string) error {
+	if r.store != nil {
+		token := tokenFromPath(key)
+		if !isValidToken(token) {
+			return fmt.Errorf("invalid challenge token: %s", token)
+		}
+		if err := r.store.WriteChallengeResponse(token, value); err != nil {
+			return err
+		}
+	}
 	r.rwMutex.Lock()
 	defer r.rwMutex.Unlock()
 	r.responses[key] = value
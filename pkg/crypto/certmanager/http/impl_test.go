@@ -0,0 +1,95 @@
+package http
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/Cloud-Foundations/golib/pkg/constants"
+	"github.com/Cloud-Foundations/golib/pkg/log/testlogger"
+)
+
+type testChallengeStorer struct {
+	mutex     sync.Mutex // Protect everything below.
+	numReads  uint
+	responses map[string]string
+}
+
+func (s *testChallengeStorer) DeleteChallengeResponse(token string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	delete(s.responses, token)
+	return nil
+}
+
+func (s *testChallengeStorer) ReadChallengeResponse(token string) (
+	string, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.numReads++
+	return s.responses[token], nil
+}
+
+func (s *testChallengeStorer) WriteChallengeResponse(token,
+	response string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.responses[token] = response
+	return nil
+}
+
+func get(t *testing.T, handler http.Handler, token string) int {
+	req := httptest.NewRequest("GET", constants.AcmePath+"/"+token, nil)
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, req)
+	return recorder.Code
+}
+
+func TestMissingResponseCache(t *testing.T) {
+	store := &testChallengeStorer{
+		responses: map[string]string{"known": "known.thumbprint"},
+	}
+	handler, err := NewSharedHandler(nil, store, testlogger.New(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		if code := get(t, handler, "known"); code != http.StatusOK {
+			t.Fatalf("known token: got status: %d", code)
+		}
+		if code := get(t, handler, "unknown"); code != http.StatusNotFound {
+			t.Fatalf("unknown token: got status: %d", code)
+		}
+	}
+	if store.numReads != 4 {
+		t.Fatalf("expected 4 store reads, got: %d", store.numReads)
+	}
+	store.WriteChallengeResponse("unknown", "unknown.thumbprint")
+	if code := get(t, handler, "unknown"); code != http.StatusNotFound {
+		t.Fatalf("missing token not cached: got status: %d", code)
+	}
+	store.DeleteChallengeResponse("known")
+	if code := get(t, handler, "known"); code != http.StatusNotFound {
+		t.Fatalf("deleted token: got status: %d", code)
+	}
+}
+
+func TestSharedResponseReadLimit(t *testing.T) {
+	store := &testChallengeStorer{responses: make(map[string]string)}
+	handler, err := NewSharedHandler(nil, store, testlogger.New(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < maxSharedReadsPerSecond*2; i++ {
+		token := "unknown-" + string(rune('a'+i%26)) +
+			string(rune('a'+i/26))
+		if code := get(t, handler, token); code != http.StatusNotFound {
+			t.Fatalf("unknown token: got status: %d", code)
+		}
+	}
+	if store.numReads > maxSharedReadsPerSecond {
+		t.Fatalf("expected at most %d store reads, got: %d",
+			maxSharedReadsPerSecond, store.numReads)
+	}
+}
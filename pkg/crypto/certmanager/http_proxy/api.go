@@ -1,23 +1,154 @@
 /*
 Package http_proxy implements a http-01 ACME protocol responder using the
 acme-proxy.
+
+By default, challenge responses are uploaded to the acme-proxy without
+authentication, and the acme-proxy associates them with the IP address of the
+Responder. If Config.Names is specified, the responses are associated with
+those names instead, and the Responder authenticates to the acme-proxy, which
+checks that the Responder is permitted to record responses for those names.
+The following authentication methods are supported:
+
+  - mutual TLS, using a client certificate (Config.ClientCertFile)
+  - an AWS IAM identity, using a presigned STS GetCallerIdentity URL
+    (Config.UseAwsIdentity)
+  - a shared HMAC key (Config.HmacKeyFile).
+
+Since presigned URLs and HMAC signatures may be replayed for a short time, TLS
+(Config.CAFile) should also be used with these methods.
+
+The acme-proxy uses VerifyHmac to verify HMAC signatures and PermittedNames to
+check which names each principal may record responses for.
 */
 package http_proxy
 
 import (
+	"net/http"
+	"sync"
+
+	"github.com/Cloud-Foundations/golib/pkg/awsutil/presignauth/presigner"
 	"github.com/Cloud-Foundations/golib/pkg/log"
 )
 
+// Config contains the configuration for a Responder.
+type Config struct {
+	// Address specifies the address (host:port) of the acme-proxy. Required.
+	Address string
+
+	// CAFile specifies a file containing the PEM-encoded CA certificates used
+	// to verify the certificate of the acme-proxy. If CAFile or ClientCertFile
+	// are specified, HTTPS is used. The default is the system CA certificates.
+	CAFile string
+
+	// ClientCertFile specifies a file containing the PEM-encoded client
+	// certificate used for mutual TLS authentication. Optional.
+	ClientCertFile string
+
+	// ClientKeyFile specifies a file containing the PEM-encoded private key for
+	// ClientCertFile.
+	ClientKeyFile string
+
+	// HmacKeyFile specifies a file containing a key ID and a Base64-encoded key
+	// which is shared with the acme-proxy, used to sign requests (see
+	// ReadHmacKeyFile). Only the first key is used. Optional.
+	HmacKeyFile string
+
+	// Names specifies the domain names for which challenge responses are
+	// recorded. Required for authentication.
+	Names []string
+
+	// UseAwsIdentity specifies whether to authenticate using the AWS IAM
+	// identity of the instance, with a presigned STS GetCallerIdentity URL.
+	UseAwsIdentity bool
+}
+
+// HmacKey contains a shared key used to sign requests to the acme-proxy.
+type HmacKey struct {
+	Id  string
+	Key []byte
+}
+
+// Params contains the parameters for a Responder.
+type Params struct {
+	// HttpClient specifies the HTTP client to use. If specified, the TLS
+	// configuration in Config is ignored. Optional.
+	HttpClient *http.Client
+
+	Logger log.DebugLogger
+
+	// Presigner is used to generate presigned URLs if UseAwsIdentity is true.
+	// The default is a presigner using the default AWS configuration.
+	// Optional.
+	Presigner presigner.Presigner
+}
+
+// PermittedNames contains the domain name patterns which each principal (such
+// as "arn:...", "group:...", "hmac:..." or "user:...") is permitted to record
+// responses for. The key is the principal, in lower case. A pattern of the form
+// "*.example.com" matches all subdomains of example.com.
+type PermittedNames map[string][]string
+
 type Responder struct {
-	acmeProxy string
-	logger    log.DebugLogger
+	baseURL    string
+	hmacKey    *HmacKey
+	httpClient *http.Client
+	logger     log.DebugLogger
+	names      []string
+	presigner  presigner.Presigner
+	mutex      sync.Mutex          // Protect everything below.
+	paths      map[string]struct{} // Recorded paths.
+}
+
+// ComputeHmac returns the Base64url-encoded HMAC-SHA256 signature for a
+// request to the acme-proxy. The signature covers the method, the request URI
+// (path and query), the timestamp (Unix time, in decimal) and the SHA-256 hash
+// of the body.
+func ComputeHmac(key []byte, method, requestURI, timestamp string,
+	body []byte) string {
+	return computeHmac(key, method, requestURI, timestamp, body)
 }
 
 // New creates a *Responder for ACME "http-01" challenges.
 // The address of the acme-proxy must be given by acmeProxy.
 // The logger is used for logging messages.
 func New(acmeProxy string, logger log.DebugLogger) (*Responder, error) {
-	return newResponder(acmeProxy, logger)
+	return newResponder(Config{Address: acmeProxy}, Params{Logger: logger})
+}
+
+// NewWithConfig creates a *Responder using the provided configuration.
+func NewWithConfig(config Config, params Params) (*Responder, error) {
+	return newResponder(config, params)
+}
+
+// ReadHmacKeyFile will read shared HMAC keys from the specified file. Each line
+// of the file contains a key ID and a Base64-encoded key (of at least 256
+// bits), separated by whitespace. Empty lines and lines starting with '#' are
+// ignored.
+func ReadHmacKeyFile(filename string) ([]HmacKey, error) {
+	return readHmacKeyFile(filename)
+}
+
+// ReadPermittedNamesFile will read the names each principal is permitted to
+// record responses for. Each line of the file contains a principal followed by
+// name patterns, separated by whitespace. Empty lines and lines starting with
+// '#' are ignored.
+func ReadPermittedNamesFile(filename string) (PermittedNames, error) {
+	return readPermittedNamesFile(filename)
+}
+
+// VerifyHmac will verify the HMAC signature in the Authorization header of a
+// request to the acme-proxy, using the shared keys (the key is the key ID).
+// The timestamp of the request must be within 5 minutes of the current time.
+// The body must contain the request body. The ID of the key is returned.
+func VerifyHmac(req *http.Request, body []byte,
+	keys map[string][]byte) (string, error) {
+	return verifyHmac(req, body, keys)
+}
+
+// IsPermitted returns true if any of the principals is permitted to record
+// responses for the name.
+func (p PermittedNames) IsPermitted(principals []string, name string) bool {
+	return p.isPermitted(principals, name)
 }
 
 func (r *Responder) Cleanup() {
@@ -1,42 +1,361 @@
 package http_proxy
 
 import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
 	"errors"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
 	"strings"
+	"time"
 
+	"github.com/Cloud-Foundations/golib/pkg/awsutil/presignauth/presigner"
 	"github.com/Cloud-Foundations/golib/pkg/constants"
-	"github.com/Cloud-Foundations/golib/pkg/log"
 )
 
-func newResponder(acmeProxy string,
-	logger log.DebugLogger) (*Responder, error) {
-	return &Responder{acmeProxy, logger}, nil
+const (
+	maxClockSkew     = 5 * time.Minute
+	minHmacKeyLength = 32
+	requestTimeout   = time.Minute
+)
+
+func computeHmac(key []byte, method, requestURI, timestamp string,
+	body []byte) string {
+	bodyHash := sha256.Sum256(body)
+	mac := hmac.New(sha256.New, key)
+	fmt.Fprintf(mac, "%s\n%s\n%s\n%s", method, requestURI, timestamp,
+		hex.EncodeToString(bodyHash[:]))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// matchName returns true if the name matches the pattern. A pattern of the form
+// "*.example.com" matches all subdomains of example.com.
+func matchName(pattern, name string) bool {
+	if strings.HasPrefix(pattern, "*.") {
+		return strings.HasSuffix(name, pattern[1:])
+	}
+	return name == pattern
+}
+
+// makeHttpClient will make a HTTP client with the TLS configuration. If no TLS
+// configuration is specified, nil is returned.
+func makeHttpClient(config Config) (*http.Client, error) {
+	if config.CAFile == "" && config.ClientCertFile == "" {
+		return nil, nil
+	}
+	tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12}
+	if config.CAFile != "" {
+		pemData, err := ioutil.ReadFile(config.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(pemData) {
+			return nil, fmt.Errorf("no CA certificates in: %s", config.CAFile)
+		}
+	}
+	if config.ClientCertFile != "" {
+		cert, err := tls.LoadX509KeyPair(config.ClientCertFile,
+			config.ClientKeyFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	return &http.Client{
+		Timeout:   requestTimeout,
+		Transport: &http.Transport{TLSClientConfig: tlsConfig},
+	}, nil
+}
+
+func newResponder(config Config, params Params) (*Responder, error) {
+	if config.Address == "" {
+		return nil, errors.New("no acme-proxy address specified")
+	}
+	r := &Responder{
+		baseURL:    "http://" + config.Address,
+		httpClient: params.HttpClient,
+		logger:     params.Logger,
+		names:      config.Names,
+		paths:      make(map[string]struct{}),
+	}
+	if config.CAFile != "" || config.ClientCertFile != "" {
+		r.baseURL = "https://" + config.Address
+	}
+	if r.httpClient == nil {
+		httpClient, err := makeHttpClient(config)
+		if err != nil {
+			return nil, err
+		}
+		if httpClient == nil {
+			httpClient = http.DefaultClient
+		}
+		r.httpClient = httpClient
+	}
+	if len(r.names) < 1 {
+		if config.HmacKeyFile != "" || config.UseAwsIdentity {
+			return nil, errors.New("names required for authentication")
+		}
+		return r, nil
+	}
+	if config.HmacKeyFile != "" {
+		keys, err := readHmacKeyFile(config.HmacKeyFile)
+		if err != nil {
+			return nil, err
+		}
+		r.hmacKey = &keys[0]
+	}
+	if config.UseAwsIdentity {
+		r.presigner = params.Presigner
+		if r.presigner == nil {
+			p, err := presigner.New(presigner.Params{Logger: params.Logger})
+			if err != nil {
+				return nil, err
+			}
+			r.presigner = p
+		}
+	}
+	return r, nil
+}
+
+// parseHmacAuthorization will parse the parameters of a HMAC Authorization
+// header.
+func parseHmacAuthorization(value string) (map[string]string, error) {
+	params := make(map[string]string)
+	for _, field := range strings.Split(value, ",") {
+		splitField := strings.SplitN(strings.TrimSpace(field), "=", 2)
+		if len(splitField) != 2 {
+			return nil, fmt.Errorf("malformed parameter: %s", field)
+		}
+		params[splitField[0]] = splitField[1]
+	}
+	return params, nil
+}
+
+func readHmacKeyFile(filename string) ([]HmacKey, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	var keys []HmacKey
+	keyIds := make(map[string]struct{})
+	scanner := bufio.NewScanner(file)
+	for lineNumber := 1; scanner.Scan(); lineNumber++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("%s:%d: expected key ID and key",
+				filename, lineNumber)
+		}
+		key, err := base64.StdEncoding.DecodeString(fields[1])
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %s", filename, lineNumber, err)
+		}
+		if len(key) < minHmacKeyLength {
+			return nil, fmt.Errorf("%s:%d: key length: %d < %d",
+				filename, lineNumber, len(key), minHmacKeyLength)
+		}
+		if _, ok := keyIds[fields[0]]; ok {
+			return nil, fmt.Errorf("%s:%d: duplicate key ID: %s",
+				filename, lineNumber, fields[0])
+		}
+		keyIds[fields[0]] = struct{}{}
+		keys = append(keys, HmacKey{Id: fields[0], Key: key})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(keys) < 1 {
+		return nil, fmt.Errorf("no keys in: %s", filename)
+	}
+	return keys, nil
+}
+
+func readPermittedNamesFile(filename string) (PermittedNames, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	permittedNames := make(PermittedNames)
+	scanner := bufio.NewScanner(file)
+	for lineNumber := 1; scanner.Scan(); lineNumber++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		fields := strings.Fields(strings.ToLower(line))
+		if len(fields) < 2 {
+			return nil, fmt.Errorf("%s:%d: expected principal and names",
+				filename, lineNumber)
+		}
+		principal := fields[0]
+		if !strings.HasPrefix(principal, "arn:") &&
+			!strings.HasPrefix(principal, "group:") &&
+			!strings.HasPrefix(principal, "hmac:") &&
+			!strings.HasPrefix(principal, "user:") {
+			return nil, fmt.Errorf("%s:%d: unsupported principal: %s",
+				filename, lineNumber, principal)
+		}
+		permittedNames[principal] = append(permittedNames[principal],
+			fields[1:]...)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return permittedNames, nil
+}
+
+func verifyHmac(req *http.Request, body []byte,
+	keys map[string][]byte) (string, error) {
+	splitValue := strings.SplitN(req.Header.Get("Authorization"), " ", 2)
+	if len(splitValue) != 2 ||
+		splitValue[0] != constants.AcmeProxyHmacAuthScheme {
+		return "", errors.New("unsupported authorization scheme")
+	}
+	params, err := parseHmacAuthorization(splitValue[1])
+	if err != nil {
+		return "", err
+	}
+	keyId := params["keyId"]
+	key, ok := keys[keyId]
+	if !ok {
+		return "", fmt.Errorf("unknown HMAC key: %s", keyId)
+	}
+	timestamp, err := strconv.ParseInt(params["timestamp"], 10, 64)
+	if err != nil {
+		return "", err
+	}
+	skew := time.Since(time.Unix(timestamp, 0))
+	if skew > maxClockSkew || skew < -maxClockSkew {
+		return "", fmt.Errorf("timestamp skew: %s", skew)
+	}
+	signature := computeHmac(key, req.Method, req.RequestURI,
+		params["timestamp"], body)
+	if !hmac.Equal([]byte(signature), []byte(params["signature"])) {
+		return "", errors.New("bad HMAC signature")
+	}
+	return keyId, nil
+}
+
+func (p PermittedNames) isPermitted(principals []string, name string) bool {
+	for _, principal := range principals {
+		for _, pattern := range p[strings.ToLower(principal)] {
+			if matchName(pattern, name) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// authenticate will add the authentication headers to the request.
+func (r *Responder) authenticate(req *http.Request, body []byte) error {
+	if r.hmacKey != nil {
+		timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+		signature := computeHmac(r.hmacKey.Key, req.Method,
+			req.URL.RequestURI(), timestamp, body)
+		req.Header.Set("Authorization",
+			fmt.Sprintf("%s keyId=%s,timestamp=%s,signature=%s",
+				constants.AcmeProxyHmacAuthScheme, r.hmacKey.Id, timestamp,
+				signature))
+	}
+	if r.presigner != nil {
+		presignedReq, err := r.presigner.PresignGetCallerIdentity(
+			req.Context())
+		if err != nil {
+			return err
+		}
+		req.Header.Set(constants.AcmeProxyPresignedMethodHeader,
+			presignedReq.Method)
+		req.Header.Set(constants.AcmeProxyPresignedUrlHeader,
+			presignedReq.URL)
+	}
+	return nil
 }
 
 func (r *Responder) cleanup() {
-	resp, err := http.DefaultClient.Post(
-		"http://"+r.acmeProxy+constants.AcmeProxyCleanupResponses, "", nil)
+	var query string
+	if len(r.names) > 0 {
+		r.mutex.Lock()
+		paths := make([]string, 0, len(r.paths))
+		for path := range r.paths {
+			paths = append(paths, path)
+		}
+		r.paths = make(map[string]struct{})
+		r.mutex.Unlock()
+		if len(paths) < 1 {
+			return
+		}
+		sort.Strings(paths)
+		query = "?" + url.Values{"path": paths}.Encode()
+	}
+	err := r.post(constants.AcmeProxyCleanupResponses+query, nil)
 	if err != nil {
 		r.logger.Println(err)
-	} else if resp.StatusCode != http.StatusOK {
-		r.logger.Println(resp.Status)
 	}
 }
 
+// post will send an (authenticated) POST request to the acme-proxy.
+func (r *Responder) post(requestURI string, body []byte) error {
+	ctx, cancel := context.WithTimeout(context.Background(), requestTimeout)
+	defer cancel()
+	url := r.baseURL + requestURI
+	req, err := http.NewRequestWithContext(ctx, "POST", url,
+		bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	if len(r.names) > 0 {
+		if err := r.authenticate(req, body); err != nil {
+			return err
+		}
+	}
+	resp, err := r.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s: %s", url, resp.Status)
+	}
+	return nil
+}
+
 func (r *Responder) respond(key, value string) error {
 	if !strings.HasPrefix(key, constants.AcmePath) {
 		return errors.New("not an ACME challenge response")
 	}
-	url := "http://" + r.acmeProxy + constants.AcmeProxyRecordResponse + "?" +
-		key
-	resp, err := http.DefaultClient.Post(url, "", strings.NewReader(value))
-	if err != nil {
+	requestURI := constants.AcmeProxyRecordResponse + "?" + key
+	if len(r.names) > 0 {
+		requestURI = constants.AcmeProxyRecordResponse + "?" +
+			url.Values{"name": r.names, "path": {key}}.Encode()
+	}
+	if err := r.post(requestURI, []byte(value)); err != nil {
 		return err
 	}
-	if resp.StatusCode != http.StatusOK {
-		return fmt.Errorf("%s: %s\n", url, resp.Status)
+	if len(r.names) > 0 {
+		r.mutex.Lock()
+		r.paths[key] = struct{}{}
+		r.mutex.Unlock()
 	}
 	return nil
 }
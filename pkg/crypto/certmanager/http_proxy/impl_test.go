@@ -0,0 +1,270 @@
+package http_proxy
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Cloud-Foundations/golib/pkg/constants"
+	"github.com/Cloud-Foundations/golib/pkg/log/testlogger"
+)
+
+const testHmacKeyFile = `# Test key.
+test-key MDEyMzQ1Njc4OWFiY2RlZjAxMjM0NTY3ODlhYmNkZWY=
+`
+
+const testPermittedNamesFile = `# Test principals.
+arn:aws:iam::123456789012:role/Web-Server www.example.com
+group:ops *.example.org
+hmac:test-key api.example.com *.api.example.com
+user:alice mail.example.com
+`
+
+// testProxy records the requests received by a fake acme-proxy.
+type testProxy struct {
+	keys     map[string][]byte // Key: key ID.
+	mutex    sync.Mutex        // Protect everything below.
+	requests []string          // Request URIs.
+}
+
+func (p *testProxy) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	body, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if p.keys != nil {
+		if _, err := VerifyHmac(req, body, p.keys); err != nil {
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+			return
+		}
+	}
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.requests = append(p.requests, req.RequestURI)
+}
+
+func makeTestProxy(t *testing.T,
+	keys map[string][]byte) (*testProxy, string) {
+	proxy := &testProxy{keys: keys}
+	server := httptest.NewServer(proxy)
+	t.Cleanup(server.Close)
+	return proxy, strings.TrimPrefix(server.URL, "http://")
+}
+
+func TestHmac(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "hmac-keys")
+	err := os.WriteFile(filename, []byte(testHmacKeyFile), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys, err := ReadHmacKeyFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxy, address := makeTestProxy(t,
+		map[string][]byte{keys[0].Id: keys[0].Key})
+	responder, err := NewWithConfig(
+		Config{
+			Address:     address,
+			HmacKeyFile: filename,
+			Names:       []string{"www.example.com"},
+		},
+		Params{Logger: testlogger.New(t)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = responder.Respond(constants.AcmePath+"/token", "token.thumbprint")
+	if err != nil {
+		t.Fatal(err)
+	}
+	responder.Cleanup()
+	responder.Cleanup() // Nothing to clean up: no request is sent.
+	expected := []string{
+		constants.AcmeProxyRecordResponse + "?name=www.example.com" +
+			"&path=%2F.well-known%2Facme-challenge%2Ftoken",
+		constants.AcmeProxyCleanupResponses +
+			"?path=%2F.well-known%2Facme-challenge%2Ftoken",
+	}
+	if strings.Join(proxy.requests, " ") != strings.Join(expected, " ") {
+		t.Errorf("requests: %v != %v", proxy.requests, expected)
+	}
+	// A request signed with the wrong key must be rejected.
+	_, address = makeTestProxy(t,
+		map[string][]byte{keys[0].Id: []byte("wrong key")})
+	responder, err = NewWithConfig(
+		Config{
+			Address:     address,
+			HmacKeyFile: filename,
+			Names:       []string{"www.example.com"},
+		},
+		Params{Logger: testlogger.New(t)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = responder.Respond(constants.AcmePath+"/token", "token.thumbprint")
+	if err == nil {
+		t.Fatal("request with bad signature accepted")
+	}
+}
+
+// makeSignedRequest makes a request signed with the key, with the timestamp
+// offset from the current time.
+func makeSignedRequest(keyId string, key []byte, offset time.Duration,
+	body string) *http.Request {
+	req := httptest.NewRequest("POST",
+		constants.AcmeProxyRecordResponse+"?name=www.example.com",
+		strings.NewReader(body))
+	timestamp := strconv.FormatInt(time.Now().Add(offset).Unix(), 10)
+	signature := ComputeHmac(key, req.Method, req.RequestURI, timestamp,
+		[]byte(body))
+	req.Header.Set("Authorization",
+		fmt.Sprintf("%s keyId=%s,timestamp=%s,signature=%s",
+			constants.AcmeProxyHmacAuthScheme, keyId, timestamp, signature))
+	return req
+}
+
+func TestPermittedNames(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "permitted-names")
+	err := os.WriteFile(filename, []byte(testPermittedNamesFile), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	permittedNames, err := ReadPermittedNamesFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		principals []string
+		name       string
+		permitted  bool
+	}{
+		{[]string{"arn:aws:iam::123456789012:role/Web-Server"},
+			"www.example.com", true},
+		{[]string{"arn:aws:iam::123456789012:role/Web-Server"},
+			"mail.example.com", false},
+		{[]string{"arn:aws:iam::123456789012:role/Other"},
+			"www.example.com", false},
+		{[]string{"user:bob", "group:dev", "group:ops"},
+			"www.example.org", true},
+		{[]string{"user:bob", "group:dev"}, "www.example.org", false},
+		{[]string{"group:ops"}, "example.org", false},
+		{[]string{"group:ops"}, "www.badexample.org", false},
+		{[]string{"hmac:test-key"}, "api.example.com", true},
+		{[]string{"hmac:test-key"}, "v1.api.example.com", true},
+		{[]string{"hmac:test-key"}, "www.example.com", false},
+		{[]string{"user:alice"}, "mail.example.com", true},
+		{[]string{"user:alice", "group:ops"}, "www.example.com", false},
+	}
+	for _, test := range tests {
+		permitted := permittedNames.IsPermitted(test.principals, test.name)
+		if permitted != test.permitted {
+			t.Errorf("%v for: %s: permitted: %t, expected: %t",
+				test.principals, test.name, permitted, test.permitted)
+		}
+	}
+	for _, content := range []string{
+		"user:alice\n",
+		"alice www.example.com\n",
+	} {
+		if err := os.WriteFile(filename, []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := ReadPermittedNamesFile(filename); err == nil {
+			t.Errorf("no error reading: \"%s\"", content)
+		}
+	}
+}
+
+func TestReadHmacKeyFile(t *testing.T) {
+	for _, content := range []string{
+		"",
+		"test-key\n",
+		"test-key c2hvcnQ=\n",
+		testHmacKeyFile + testHmacKeyFile,
+	} {
+		filename := filepath.Join(t.TempDir(), "hmac-keys")
+		if err := os.WriteFile(filename, []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := ReadHmacKeyFile(filename); err == nil {
+			t.Errorf("no error reading: \"%s\"", content)
+		}
+	}
+}
+
+func TestUnauthenticated(t *testing.T) {
+	proxy, address := makeTestProxy(t, nil)
+	responder, err := New(address, testlogger.New(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = responder.Respond(constants.AcmePath+"/token", "token.thumbprint")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := responder.Respond("/token", "token.thumbprint"); err == nil {
+		t.Error("non-ACME path accepted")
+	}
+	responder.Cleanup()
+	expected := []string{
+		constants.AcmeProxyRecordResponse + "?" + constants.AcmePath + "/token",
+		constants.AcmeProxyCleanupResponses,
+	}
+	if strings.Join(proxy.requests, " ") != strings.Join(expected, " ") {
+		t.Errorf("requests: %v != %v", proxy.requests, expected)
+	}
+	_, err = NewWithConfig(Config{Address: address, UseAwsIdentity: true},
+		Params{Logger: testlogger.New(t)})
+	if err == nil {
+		t.Error("authentication without names accepted")
+	}
+}
+
+func TestVerifyHmac(t *testing.T) {
+	key := []byte("01234567890123456789012345678901")
+	keys := map[string][]byte{"test-key": key}
+	req := makeSignedRequest("test-key", key, 0, "data")
+	if keyId, err := VerifyHmac(req, []byte("data"), keys); err != nil {
+		t.Fatal(err)
+	} else if keyId != "test-key" {
+		t.Errorf("key ID: %s != test-key", keyId)
+	}
+	tests := []struct {
+		description string
+		req         *http.Request
+		body        string
+	}{
+		{"bad signature",
+			makeSignedRequest("test-key", []byte("wrong key"), 0, "data"),
+			"data"},
+		{"modified body", makeSignedRequest("test-key", key, 0, "data"),
+			"other data"},
+		{"old timestamp",
+			makeSignedRequest("test-key", key, -time.Minute*6, "data"),
+			"data"},
+		{"future timestamp",
+			makeSignedRequest("test-key", key, time.Minute*6, "data"),
+			"data"},
+		{"unknown key", makeSignedRequest("other-key", key, 0, "data"),
+			"data"},
+	}
+	for _, test := range tests {
+		if _, err := VerifyHmac(test.req, []byte(test.body), keys); err == nil {
+			t.Errorf("%s: accepted", test.description)
+		}
+	}
+	req = makeSignedRequest("test-key", key, 0, "data")
+	req.Header.Set("Authorization", "Bearer token")
+	if _, err := VerifyHmac(req, []byte("data"), keys); err == nil {
+		t.Error("unsupported scheme accepted")
+	}
+}
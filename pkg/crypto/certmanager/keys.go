@@ -0,0 +1,135 @@
+package certmanager
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+const (
+	keyRotationAlways = "always"
+	keyRotationEvery  = "every"
+	keyRotationReuse  = "reuse"
+)
+
+var keyMakers = map[string]keyMakerFunc{
+	"":         makeKeyECDSA,
+	"EC":       makeKeyECDSA,
+	"EC-P256":  makeKeyECDSA,
+	"EC-P384":  makeKeyECDSAP384,
+	"RSA":      makeKeyRSA,
+	"RSA-2048": makeKeyRSA,
+	"RSA-3072": func() (crypto.Signer, error) { return makeKeyRSASize(3072) },
+	"RSA-4096": func() (crypto.Signer, error) { return makeKeyRSASize(4096) },
+}
+
+// canonicalKeyTypes maps key type aliases to the canonical key type.
+var canonicalKeyTypes = map[string]string{
+	"":    "EC-P256",
+	"EC":  "EC-P256",
+	"RSA": "RSA-2048",
+}
+
+func canonicalKeyType(keyType string) string {
+	if canonical, ok := canonicalKeyTypes[keyType]; ok {
+		return canonical
+	}
+	return keyType
+}
+
+func checkKeyRotation(keyRotation string, interval uint) error {
+	switch keyRotation {
+	case "", keyRotationAlways, keyRotationReuse:
+		return nil
+	case keyRotationEvery:
+		if interval < 1 {
+			return errors.New("no key rotation interval specified")
+		}
+		return nil
+	default:
+		return fmt.Errorf("unsupported key rotation policy: %s", keyRotation)
+	}
+}
+
+// getKeyType returns the canonical key type for the private key.
+func getKeyType(key crypto.Signer) string {
+	switch key := key.(type) {
+	case *ecdsa.PrivateKey:
+		return "EC-" + strings.Replace(key.Curve.Params().Name, "-", "", 1)
+	case *rsa.PrivateKey:
+		return fmt.Sprintf("RSA-%d", key.N.BitLen())
+	default:
+		return ""
+	}
+}
+
+func makeKeyECDSAP384() (crypto.Signer, error) {
+	return ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+}
+
+func makeKeyRSASize(bits int) (crypto.Signer, error) {
+	return rsa.GenerateKey(rand.Reader, bits)
+}
+
+// currentKey returns the private key for the current certificate, if it is of
+// the configured key type, and the number of certificates issued with the key,
+// if known.
+func (cm *CertificateManager) currentKey() (crypto.Signer, uint) {
+	cm.rwMutex.RLock()
+	cert := cm.certificate
+	cm.rwMutex.RUnlock()
+	if cert == nil {
+		return nil, 0
+	}
+	key, ok := cert.tlsCert.PrivateKey.(crypto.Signer)
+	if !ok || getKeyType(key) != cm.keyType {
+		return nil, 0
+	}
+	return key, cert.KeyUses
+}
+
+// selectKey will select the private key to use for the next certificate,
+// according to the key rotation policy. The key of the current certificate
+// (which may have been issued to another instance) is preferred, so that the
+// number of uses recorded with the certificate is followed. This must be
+// called with the account lock held.
+func (cm *CertificateManager) selectKey() (crypto.Signer, error) {
+	newKey := cm.key == nil || cm.forceNewKey
+	switch cm.keyRotation {
+	case keyRotationAlways:
+		newKey = true
+	case keyRotationEvery, keyRotationReuse:
+		if !cm.forceNewKey {
+			key, keyUses := cm.currentKey()
+			if key != nil && (cm.key == nil || keyUses > 0) {
+				if cm.key == nil {
+					cm.logger.Debugln(0, "re-using key from current certificate")
+				}
+				cm.key = key
+				cm.keyUses = keyUses
+				newKey = false
+			}
+		}
+		if cm.keyRotation == keyRotationEvery &&
+			cm.keyUses >= cm.keyRotationInterval {
+			newKey = true
+		}
+	}
+	if !newKey {
+		return cm.key, nil
+	}
+	key, err := cm.keyMaker()
+	if err != nil {
+		return nil, err
+	}
+	cm.logger.Debugf(0, "generated new %s key\n", cm.keyType)
+	cm.forceNewKey = false
+	cm.key = key
+	cm.keyUses = 0
+	return key, nil
+}
@@ -0,0 +1,107 @@
+package certmanager
+
+import (
+	"testing"
+)
+
+func testSelectKey(t *testing.T, cm *CertificateManager, expectNew bool) {
+	previous := cm.key
+	key, err := cm.selectKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expectNew && key == previous {
+		t.Fatalf("%s: key re-used after: %d uses", cm.keyRotation, cm.keyUses)
+	}
+	if !expectNew && key != previous {
+		t.Fatalf("%s: key rotated after: %d uses", cm.keyRotation, cm.keyUses)
+	}
+	cm.keyUses++
+}
+
+func TestKeyTypes(t *testing.T) {
+	for _, keyType := range []string{"EC", "EC-P384", "RSA", "RSA-3072"} {
+		key, err := keyMakers[keyType]()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := getKeyType(key); got != canonicalKeyType(keyType) {
+			t.Fatalf("key type: %s != %s", got, canonicalKeyType(keyType))
+		}
+	}
+}
+
+func TestKeyRotation(t *testing.T) {
+	cm := makeTestManager(t, nil)
+	cm.keyMaker = makeKeyECDSA
+	cm.keyType = canonicalKeyType("EC")
+	// Default policy: generate once.
+	testSelectKey(t, cm, true)
+	testSelectKey(t, cm, false)
+	testSelectKey(t, cm, false)
+	cm.forceNewKey = true
+	testSelectKey(t, cm, true)
+	// Always rotate.
+	cm.keyRotation = keyRotationAlways
+	testSelectKey(t, cm, true)
+	testSelectKey(t, cm, true)
+	// Rotate every 2 renewals.
+	cm.keyRotation = keyRotationEvery
+	cm.keyRotationInterval = 2
+	cm.keyUses = 0
+	testSelectKey(t, cm, false)
+	testSelectKey(t, cm, false)
+	testSelectKey(t, cm, true)
+	testSelectKey(t, cm, false)
+	testSelectKey(t, cm, true)
+}
+
+func TestKeyUsesFromCertificate(t *testing.T) {
+	cert, _, _ := makeTestChain(t, "")
+	cm := makeTestManager(t, nil)
+	cm.keyMaker = makeKeyECDSA
+	cm.keyRotation = keyRotationEvery
+	cm.keyRotationInterval = 2
+	cm.keyType = canonicalKeyType("EC")
+	// The certificate (i.e. from the Storer) records one use of its key.
+	cert.KeyUses = 1
+	cm.setCertificate(cert)
+	if key, err := cm.selectKey(); err != nil {
+		t.Fatal(err)
+	} else if key != cert.tlsCert.PrivateKey {
+		t.Fatal("key from current certificate not re-used")
+	}
+	cm.keyUses++
+	// The key was used again (i.e. by another instance).
+	newCert := *cert
+	newCert.KeyUses = 2
+	cm.setCertificate(&newCert)
+	testSelectKey(t, cm, true)
+}
+
+func TestKeyReuse(t *testing.T) {
+	cert, _, _ := makeTestChain(t, "")
+	cm := makeTestManager(t, nil)
+	cm.keyMaker = makeKeyECDSA
+	cm.keyRotation = keyRotationReuse
+	cm.keyType = canonicalKeyType("EC")
+	cm.setCertificate(cert)
+	key, err := cm.selectKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if key != cert.tlsCert.PrivateKey {
+		t.Fatal("key from current certificate not re-used")
+	}
+	cm.key = nil
+	cm.keyType = canonicalKeyType("EC-P384")
+	cm.keyMaker = makeKeyECDSAP384
+	if key, err := cm.selectKey(); err != nil {
+		t.Fatal(err)
+	} else if key == cert.tlsCert.PrivateKey {
+		t.Fatal("key of wrong type re-used")
+	}
+	if err := checkKeyRotation(keyRotationEvery, 0); err == nil {
+		t.Fatal("no error for missing interval")
+	}
+}
@@ -0,0 +1,307 @@
+package certmanager
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/Cloud-Foundations/golib/pkg/log"
+)
+
+const (
+	defaultLocalCACommonName          = "certmanager local development CA"
+	defaultLocalCertificateLifetime   = time.Hour * 24 * 30
+	localCAIssuer                     = "local-ca"
+	localCALifetime                   = time.Hour * 24 * 365 * 10
+	localCertificateBackdate          = time.Hour
+	localCertificateMinimumLifetime   = time.Hour
+	localCertificateSerialNumberBytes = 16
+)
+
+var errLocalCANotEnabled = errors.New("local CA not enabled")
+
+type localCA struct {
+	certFilename string
+	commonName   string
+	keyFilename  string
+	lifetime     time.Duration
+	logger       log.DebugLogger
+	storer       Storer
+	mutex        sync.Mutex   // Protect everything below.
+	ca           *Certificate // nil: not yet loaded or created.
+}
+
+func makeSerialNumber() (*big.Int, error) {
+	serialBytes := make([]byte, localCertificateSerialNumberBytes)
+	if _, err := rand.Read(serialBytes); err != nil {
+		return nil, err
+	}
+	serialBytes[0] &= 0x7f // Ensure positive serial number.
+	return new(big.Int).SetBytes(serialBytes), nil
+}
+
+func makeSubjectKeyId(publicKey crypto.PublicKey) ([]byte, error) {
+	publicKeyDER, err := x509.MarshalPKIXPublicKey(publicKey)
+	if err != nil {
+		return nil, err
+	}
+	sum := sha1.Sum(publicKeyDER)
+	return sum[:], nil
+}
+
+func newLocalCA(config *LocalCAConfig, storer Storer,
+	logger log.DebugLogger) (*localCA, error) {
+	if config.CertFilename == "" && config.KeyFilename == "" && storer == nil {
+		return nil, errors.New("no local CA files or storer specified")
+	}
+	if (config.CertFilename == "") != (config.KeyFilename == "") {
+		return nil, errors.New("local CA needs both cert and key files")
+	}
+	if config.CertificateLifetime <= 0 {
+		config.CertificateLifetime = defaultLocalCertificateLifetime
+	} else if config.CertificateLifetime < localCertificateMinimumLifetime {
+		return nil, errors.New("local certificate lifetime too short")
+	}
+	if config.CommonName == "" {
+		config.CommonName = defaultLocalCACommonName
+	}
+	return &localCA{
+		certFilename: config.CertFilename,
+		commonName:   config.CommonName,
+		keyFilename:  config.KeyFilename,
+		lifetime:     config.CertificateLifetime,
+		logger:       logger,
+		storer:       storer,
+	}, nil
+}
+
+// exportLocalCA returns the PEM-encoded local CA certificate.
+func (cm *CertificateManager) exportLocalCA() ([]byte, error) {
+	if cm.localCA == nil {
+		return nil, errLocalCANotEnabled
+	}
+	return cm.localCA.certificatePEM()
+}
+
+// issueLocal will issue a certificate from the local CA.
+func (cm *CertificateManager) issueLocal() (*Certificate, error) {
+	key, err := cm.selectKey()
+	if err != nil {
+		return nil, err
+	}
+	chainDER, err := cm.localCA.issue(cm.names, key.Public())
+	if err != nil {
+		return nil, err
+	}
+	cm.keyUses++
+	cert, err := makeCert(chainDER, key)
+	if err != nil {
+		return nil, err
+	}
+	cert.Issuer = localCAIssuer
+	cert.KeyUses = cm.keyUses
+	cert.source = localCAIssuer
+	return cert, nil
+}
+
+// certificatePEM returns the PEM-encoded CA certificate.
+func (ca *localCA) certificatePEM() ([]byte, error) {
+	caCert, err := ca.get()
+	if err != nil {
+		return nil, err
+	}
+	return pem.EncodeToMemory(&pem.Block{
+		Type:  "CERTIFICATE",
+		Bytes: caCert.tlsCert.Certificate[0],
+	}), nil
+}
+
+// create will create a new CA certificate and key and will write them to the
+// files and the storer.
+func (ca *localCA) create() (*Certificate, error) {
+	key, err := makeKeyECDSA()
+	if err != nil {
+		return nil, err
+	}
+	serialNumber, err := makeSerialNumber()
+	if err != nil {
+		return nil, err
+	}
+	subjectKeyId, err := makeSubjectKeyId(key.Public())
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	template := &x509.Certificate{
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		MaxPathLenZero:        true,
+		NotAfter:              now.Add(localCALifetime),
+		NotBefore:             now.Add(-localCertificateBackdate),
+		SerialNumber:          serialNumber,
+		Subject:               pkix.Name{CommonName: ca.commonName},
+		SubjectKeyId:          subjectKeyId,
+	}
+	certDER, err := x509.CreateCertificate(rand.Reader, template, template,
+		key.Public(), key)
+	if err != nil {
+		return nil, err
+	}
+	cert, err := makeCert([][]byte{certDER}, key)
+	if err != nil {
+		return nil, err
+	}
+	cert.source = localCAIssuer
+	ca.logger.Printf("created local CA: %s, expires on: %s\n",
+		ca.commonName, cert.notAfter.Local())
+	if err := ca.writeFiles(cert); err != nil {
+		return nil, err
+	}
+	if ca.storer != nil {
+		if err := ca.storer.Write(cert); err != nil {
+			return nil, err
+		}
+	}
+	return cert, nil
+}
+
+// get will return the CA certificate and key, loading them from the storer or
+// the files, or creating a new CA if they do not exist.
+func (ca *localCA) get() (*Certificate, error) {
+	ca.mutex.Lock()
+	defer ca.mutex.Unlock()
+	if ca.ca != nil {
+		return ca.ca, nil
+	}
+	cert, err := ca.load()
+	if err != nil {
+		return nil, err
+	}
+	if cert == nil {
+		if cert, err = ca.create(); err != nil {
+			return nil, err
+		}
+	}
+	ca.ca = cert
+	return cert, nil
+}
+
+// issue will issue a certificate for the names and public key, returning the
+// DER-encoded chain.
+func (ca *localCA) issue(names []string, publicKey crypto.PublicKey) (
+	[][]byte, error) {
+	caCert, err := ca.get()
+	if err != nil {
+		return nil, err
+	}
+	serialNumber, err := makeSerialNumber()
+	if err != nil {
+		return nil, err
+	}
+	subjectKeyId, err := makeSubjectKeyId(publicKey)
+	if err != nil {
+		return nil, err
+	}
+	keyUsage := x509.KeyUsageDigitalSignature
+	if _, ok := publicKey.(*rsa.PublicKey); ok {
+		keyUsage |= x509.KeyUsageKeyEncipherment
+	}
+	now := time.Now()
+	notAfter := now.Add(ca.lifetime)
+	if caNotAfter := caCert.tlsCert.Leaf.NotAfter; notAfter.After(caNotAfter) {
+		notAfter = caNotAfter
+	}
+	template := &x509.Certificate{
+		BasicConstraintsValid: true,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		KeyUsage:              keyUsage,
+		NotAfter:              notAfter,
+		NotBefore:             now.Add(-localCertificateBackdate),
+		SerialNumber:          serialNumber,
+		Subject:               pkix.Name{CommonName: names[0]},
+		SubjectKeyId:          subjectKeyId,
+	}
+	for _, name := range names {
+		if ip := net.ParseIP(name); ip != nil {
+			template.IPAddresses = append(template.IPAddresses, ip)
+		} else {
+			template.DNSNames = append(template.DNSNames, name)
+		}
+	}
+	caKey, ok := caCert.tlsCert.PrivateKey.(crypto.Signer)
+	if !ok {
+		return nil, errors.New("local CA key is not a signer")
+	}
+	certDER, err := x509.CreateCertificate(rand.Reader, template,
+		caCert.tlsCert.Leaf, publicKey, caKey)
+	if err != nil {
+		return nil, err
+	}
+	return [][]byte{certDER, caCert.tlsCert.Certificate[0]}, nil
+}
+
+// load will load the CA certificate and key from the storer or the files. The
+// files and the storer are kept in sync. If the CA does not exist, nil is
+// returned.
+func (ca *localCA) load() (*Certificate, error) {
+	var cert *Certificate
+	if ca.storer != nil {
+		var err error
+		if cert, err = readCert(ca.storer); err != nil {
+			ca.logger.Debugf(0, "unable to read local CA from storer: %s\n",
+				err)
+			cert = nil
+		}
+	}
+	loadedFromStorer := cert != nil
+	if cert == nil && ca.certFilename != "" {
+		var err error
+		cert, err = loadCertificate(ca.certFilename, ca.keyFilename, ca.logger)
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil, nil
+			}
+			return nil, err
+		}
+	}
+	if cert == nil {
+		return nil, nil
+	}
+	if !cert.tlsCert.Leaf.IsCA {
+		return nil, errors.New("local CA certificate is not a CA certificate")
+	}
+	if loadedFromStorer {
+		if err := ca.writeFiles(cert); err != nil {
+			return nil, err
+		}
+	} else if ca.storer != nil {
+		if err := ca.storer.Write(cert); err != nil {
+			return nil, err
+		}
+	}
+	return cert, nil
+}
+
+// writeFiles will write the CA certificate and key to the files, if specified.
+func (ca *localCA) writeFiles(cert *Certificate) error {
+	if ca.certFilename == "" {
+		return nil
+	}
+	err := ioutil.WriteFile(ca.keyFilename, cert.KeyPemBlock, 0600)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(ca.certFilename, cert.CertPemBlock, 0644)
+}
@@ -0,0 +1,116 @@
+package certmanager
+
+import (
+	"crypto/x509"
+	"encoding/pem"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/Cloud-Foundations/golib/pkg/log/testlogger"
+)
+
+func waitForCertificate(t *testing.T, cm *CertificateManager) *Certificate {
+	timeout := time.After(10 * time.Second)
+	for {
+		cm.rwMutex.RLock()
+		cert := cm.certificate
+		cm.rwMutex.RUnlock()
+		if cert != nil {
+			return cert
+		}
+		select {
+		case <-timeout:
+			t.Fatal("timed out waiting for certificate")
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+}
+
+func TestLocalCA(t *testing.T) {
+	dir := t.TempDir()
+	caConfig := &LocalCAConfig{
+		CertFilename:        filepath.Join(dir, "ca.pem"),
+		CertificateLifetime: time.Hour * 24,
+		KeyFilename:         filepath.Join(dir, "ca-key.pem"),
+	}
+	caStorer := &testCertStorer{}
+	cm, err := NewWithConfig(
+		Config{
+			CertFilename: filepath.Join(dir, "cert.pem"),
+			KeyFilename:  filepath.Join(dir, "key.pem"),
+			LocalCA:      caConfig,
+			Names:        []string{"localhost", "127.0.0.1"},
+		},
+		Params{LocalCAStorer: caStorer, Logger: testlogger.New(t)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cm.Close()
+	cert := waitForCertificate(t, cm)
+	caPEM, err := cm.ExportLocalCA()
+	if err != nil {
+		t.Fatal(err)
+	}
+	roots := x509.NewCertPool()
+	if !roots.AppendCertsFromPEM(caPEM) {
+		t.Fatal("unable to parse exported CA certificate")
+	}
+	for _, name := range []string{"localhost", "127.0.0.1"} {
+		_, err := cert.tlsCert.Leaf.Verify(x509.VerifyOptions{
+			DNSName: name,
+			Roots:   roots,
+		})
+		if err != nil {
+			t.Errorf("%s: %s", name, err)
+		}
+	}
+	if lifetime := cert.notAfter.Sub(cert.notBefore); lifetime > 26*time.Hour {
+		t.Errorf("lifetime: %s too long", lifetime)
+	}
+	if cert.Issuer != localCAIssuer {
+		t.Errorf("issuer: %s != %s", cert.Issuer, localCAIssuer)
+	}
+	if caStorer.cert == nil {
+		t.Fatal("CA not written to storer")
+	}
+	// A new manager must re-use the CA from the storer, even if the files
+	// were lost.
+	caConfig.CertFilename = filepath.Join(dir, "ca2.pem")
+	caConfig.KeyFilename = filepath.Join(dir, "ca2-key.pem")
+	ca, err := newLocalCA(caConfig, caStorer, testlogger.New(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	newPEM, err := ca.certificatePEM()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(newPEM) != string(caPEM) {
+		t.Error("CA not re-used from storer")
+	}
+	// And also from the files.
+	ca, err = newLocalCA(caConfig, nil, testlogger.New(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if newPEM, err = ca.certificatePEM(); err != nil {
+		t.Fatal(err)
+	}
+	if string(newPEM) != string(caPEM) {
+		t.Error("CA not re-used from files")
+	}
+	block, _ := pem.Decode(newPEM)
+	if caCert, err := x509.ParseCertificate(block.Bytes); err != nil {
+		t.Fatal(err)
+	} else if caCert.Subject.CommonName != defaultLocalCACommonName {
+		t.Errorf("CA common name: %s", caCert.Subject.CommonName)
+	}
+}
+
+func TestLocalCANotEnabled(t *testing.T) {
+	cm := &CertificateManager{}
+	if _, err := cm.ExportLocalCA(); err != errLocalCANotEnabled {
+		t.Errorf("error: %v != %s", err, errLocalCANotEnabled)
+	}
+}
@@ -15,8 +15,10 @@ import (
 	"errors"
 	"fmt"
 	"io/ioutil"
+	"net"
 	"os"
-	"path/filepath"
+	"strconv"
+	"strings"
 	"time"
 
 	"golang.org/x/crypto/acme"
@@ -25,11 +27,16 @@ import (
 	"github.com/Cloud-Foundations/golib/pkg/log"
 )
 
-const defaultRsaKeySize = 2048
+const (
+	defaultRsaKeySize = 2048
+	issuerFileSuffix  = ".acme-ca"
+	keyUsesFileSuffix = ".key-uses"
+)
 
 var supportedChallengeTypes = map[string]struct{}{
-	"dns-01":  {},
-	"http-01": {},
+	"dns-01":      {},
+	"http-01":     {},
+	"tls-alpn-01": {},
 }
 
 func loadCertificate(certFilename, keyFilename string,
@@ -42,16 +49,49 @@ func loadCertificate(certFilename, keyFilename string,
 	if err != nil {
 		return nil, err
 	}
-	cert := &Certificate{CertPemBlock: certPemBlock, KeyPemBlock: keyPemBlock}
+	cert := &Certificate{
+		CertPemBlock: certPemBlock,
+		KeyPemBlock:  keyPemBlock,
+		source:       sourceFile,
+	}
 	if err := cert.parse(); err != nil {
 		return nil, err
 	}
+	cert.Issuer = readSideFile(certFilename + issuerFileSuffix)
+	keyUses := readSideFile(certFilename + keyUsesFileSuffix)
+	if keyUses != "" {
+		if value, err := strconv.ParseUint(keyUses, 10, 32); err == nil {
+			cert.KeyUses = uint(value)
+		}
+	}
 	logger.Printf("loaded certificate from: %s, expires on: %s (in: %s)\n",
 		certFilename, cert.notAfter.Local(),
 		format.Duration(time.Until(cert.notAfter)))
 	return cert, nil
 }
 
+// readSideFile returns the contents of a file which is stored next to the
+// certificate file. If the file does not exist, the empty string is returned.
+func readSideFile(filename string) string {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(data))
+}
+
+// writeSideFile will write the value to a file which is stored next to the
+// certificate file. If the value is empty, the file is removed.
+func writeSideFile(filename, value string) error {
+	if value == "" {
+		if err := os.Remove(filename); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+	return ioutil.WriteFile(filename, []byte(value+"\n"), 0644)
+}
+
 func makeKeyECDSA() (crypto.Signer, error) {
 	return ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
 }
@@ -66,6 +106,7 @@ func readCert(storer Storer) (*Certificate, error) {
 	} else if err := cert.parse(); err != nil {
 		return nil, err
 	} else {
+		cert.source = sourceStorer
 		return cert, nil
 	}
 }
@@ -91,44 +132,51 @@ func makeCert(chainDER [][]byte, key crypto.Signer) (*Certificate, error) {
 			return nil, err
 		}
 	}
-	keyPemBlock := &bytes.Buffer{}
+	keyPemBlock, err := encodeKeyPEM(key)
+	if err != nil {
+		return nil, err
+	}
+	cert := &Certificate{
+		CertPemBlock: certPemBlock.Bytes(),
+		KeyPemBlock:  keyPemBlock,
+		tlsCert: tls.Certificate{
+			Certificate: chainDER,
+			PrivateKey:  key,
+			Leaf:        leaf,
+		},
+		notAfter:  leaf.NotAfter,
+		notBefore: leaf.NotBefore,
+	}
+	return cert, nil
+}
+
+// encodeKeyPEM will encode a private key in PEM format.
+func encodeKeyPEM(key crypto.Signer) ([]byte, error) {
 	switch key := key.(type) {
 	case *ecdsa.PrivateKey:
 		keyDER, err := x509.MarshalECPrivateKey(key)
 		if err != nil {
 			return nil, err
 		}
-		err = pem.Encode(keyPemBlock, &pem.Block{
+		return pem.EncodeToMemory(&pem.Block{
 			Type:  "EC PRIVATE KEY",
 			Bytes: keyDER,
-		})
-		if err != nil {
-			return nil, err
-		}
+		}), nil
 	case *rsa.PrivateKey:
-		keyDER := x509.MarshalPKCS1PrivateKey(key)
-		err := pem.Encode(keyPemBlock, &pem.Block{
+		return pem.EncodeToMemory(&pem.Block{
 			Type:  "RSA PRIVATE KEY",
-			Bytes: keyDER,
-		})
-		if err != nil {
-			return nil, err
-		}
+			Bytes: x509.MarshalPKCS1PrivateKey(key),
+		}), nil
 	default:
 		return nil, errors.New("unsupported private key type")
 	}
-	cert := &Certificate{
-		CertPemBlock: certPemBlock.Bytes(),
-		KeyPemBlock:  keyPemBlock.Bytes(),
-		tlsCert: tls.Certificate{
-			Certificate: chainDER,
-			PrivateKey:  key,
-			Leaf:        leaf,
-		},
-		notAfter:  leaf.NotAfter,
-		notBefore: leaf.NotBefore,
+}
+
+func checkChallengeType(challengeType string) error {
+	if _, ok := supportedChallengeTypes[challengeType]; !ok {
+		return fmt.Errorf("challenge type: %s not supported", challengeType)
 	}
-	return cert, nil
+	return nil
 }
 
 func jitteryHour() time.Duration {
@@ -137,6 +185,30 @@ func jitteryHour() time.Duration {
 	return time.Hour + time.Second*time.Duration(randByte[0])
 }
 
+// lockWithContext will grab the lock, giving up if ctx is done first. If the
+// Locker does not implement ContextLocker, Lock is called in the background
+// and the lock is released if it is grabbed after giving up.
+func lockWithContext(ctx context.Context, locker Locker) error {
+	if contextLocker, ok := locker.(ContextLocker); ok {
+		return contextLocker.LockWithContext(ctx)
+	}
+	errorChannel := make(chan error, 1)
+	go func() {
+		errorChannel <- locker.Lock()
+	}()
+	select {
+	case err := <-errorChannel:
+		return err
+	case <-ctx.Done():
+		go func() {
+			if err := <-errorChannel; err == nil {
+				locker.Unlock()
+			}
+		}()
+		return ctx.Err()
+	}
+}
+
 func (cert *Certificate) parse() error {
 	var err error
 	cert.tlsCert, err = tls.X509KeyPair(cert.CertPemBlock, cert.KeyPemBlock)
@@ -158,6 +230,8 @@ func (cert *Certificate) parse() error {
 // (suggested value ~0.3). If the certificate lifetime (time from when the
 // certificate is valid until when it expires) is less than one hour it is
 // assumed to be approximately one hour (with jitter).
+// If the certificate has renewal information from the CA (ARI), the time
+// selected within the suggested renewal window is used instead.
 // If the certificate is nil or does not contain any of the SANs listed in
 // requiredNames then a negative duration is returned, indicating the
 // certificate should be renewed immediately.
@@ -166,6 +240,10 @@ func (cert *Certificate) timeUntilRenewal(renewBefore float64,
 	if cert == nil {
 		return -1
 	}
+	if cert.revoked {
+		logger.Println("certificate is revoked")
+		return -1
+	}
 	if len(requiredNames) > 0 {
 		certNames := make(map[string]struct{}, len(cert.tlsCert.Leaf.DNSNames))
 		certNames[cert.tlsCert.Leaf.Subject.CommonName] = struct{}{}
@@ -179,6 +257,9 @@ func (cert *Certificate) timeUntilRenewal(renewBefore float64,
 			}
 		}
 	}
+	if cert.renewalInfo != nil {
+		return time.Until(cert.renewalInfo.selectedTime)
+	}
 	lifetime := cert.notAfter.Sub(cert.notBefore)
 	if lifetime < time.Hour {
 		lifetime = jitteryHour()
@@ -187,64 +268,149 @@ func (cert *Certificate) timeUntilRenewal(renewBefore float64,
 		-time.Duration(lifetime.Seconds()*renewBefore) * time.Second))
 }
 
-func newManager(names []string, certFilename, keyFilename string, locker Locker,
-	challengeType string, responder Responder, storer Storer,
-	renewBefore float64, caDirectoryURL, keyType string,
-	logger log.DebugLogger) (*CertificateManager, error) {
-	if challengeType == "" {
-		cert, err := loadCertificate(certFilename, keyFilename, logger)
-		if err != nil {
+// makeManager will create a *CertificateManager using (possibly shared)
+// account managers, one for each CA. The renewal goroutine is not started.
+func makeManager(config Config, params Params, accounts []*accountManager,
+	writeNotifier chan struct{}, events *eventBroker) (
+	*CertificateManager, error) {
+	if params.Locker == nil {
+		params.Locker = nullLocker{}
+	}
+	if config.RenewBefore <= 0.0 {
+		randByte := make([]byte, 1)
+		if _, err := rand.Read(randByte); err != nil {
 			return nil, err
 		}
-		return &CertificateManager{certificate: cert}, nil
+		// Compute random number between 0.32 and 0.34.
+		config.RenewBefore = 0.32 + 0.02*float64(randByte[0])/256.0
 	}
-	if locker == nil {
-		locker = nullLocker{}
+	keyMaker, ok := keyMakers[config.KeyType]
+	if !ok {
+		return nil, errors.New("unsupported key type: " + config.KeyType)
 	}
-	if _, ok := supportedChallengeTypes[challengeType]; !ok {
-		return nil,
-			fmt.Errorf("challenge type: %s not supported", challengeType)
+	err := checkKeyRotation(config.KeyRotation, config.KeyRotationInterval)
+	if err != nil {
+		return nil, err
 	}
-	if renewBefore <= 0.0 {
-		randByte := make([]byte, 1)
-		if _, err := rand.Read(randByte); err != nil {
+	if len(config.Names) < 1 {
+		return nil, errors.New("no domain names specified")
+	}
+	if params.Context == nil {
+		params.Context = context.Background()
+	}
+	if config.FailoverThreshold < 1 {
+		config.FailoverThreshold = defaultFailoverThreshold
+	}
+	challengeAliases := make(map[string]string, len(config.ChallengeAliases))
+	for domain, alias := range config.ChallengeAliases {
+		challengeAliases[strings.ToLower(strings.TrimSuffix(domain, "."))] =
+			strings.TrimSuffix(alias, ".")
+	}
+	var lookupCNAME func(ctx context.Context, host string) (string, error)
+	if config.FollowChallengeCNAME {
+		lookupCNAME = net.DefaultResolver.LookupCNAME
+	}
+	var propagation *propagationChecker
+	if config.ChallengeType == "dns-01" && config.PropagationTimeout > 0 {
+		propagation = newPropagationChecker(config.PropagationNameservers,
+			config.PropagationTimeout, params.Logger)
+	}
+	var primaryAccount *accountManager
+	if len(accounts) > 0 {
+		primaryAccount = accounts[0]
+	}
+	var localCA *localCA
+	if config.LocalCA != nil {
+		localCA, err = newLocalCA(config.LocalCA, params.LocalCAStorer,
+			params.Logger)
+		if err != nil {
 			return nil, err
 		}
-		// Compute random number between 0.32 and 0.34.
-		renewBefore = 0.32 + 0.02*float64(randByte[0])/256.0
 	}
-	if responder == nil {
+	// Create the context last, so that no error path leaves it uncancelled.
+	ctx, cancel := context.WithCancel(params.Context)
+	return &CertificateManager{
+		account:             primaryAccount,
+		accounts:            accounts,
+		cancel:              cancel,
+		certFilename:        config.CertFilename,
+		challengeAliases:    challengeAliases,
+		challengeType:       config.ChallengeType,
+		ctx:                 ctx,
+		events:              events,
+		failoverThreshold:   config.FailoverThreshold,
+		keyFilename:         config.KeyFilename,
+		keyMaker:            keyMaker,
+		keyRotation:         config.KeyRotation,
+		keyRotationInterval: config.KeyRotationInterval,
+		keyType:             canonicalKeyType(config.KeyType),
+		localCA:             localCA,
+		lookupCNAME:         lookupCNAME,
+		locker:              params.Locker,
+		names:               config.Names,
+		preferredChain:      config.PreferredChain,
+		propagation:         propagation,
+		renewBefore:         config.RenewBefore,
+		responder:           params.Responder,
+		storer:              params.Storer,
+		logger:              params.Logger,
+		ocspWakeup:          make(chan struct{}, 1),
+		renewNow:            make(chan struct{}, 1),
+		writeNotifier:       writeNotifier,
+		revokedSerials:      make(map[string]struct{}),
+	}, nil
+}
+
+func newManager(config Config, params Params) (*CertificateManager, error) {
+	if config.LocalCA != nil {
+		cm, err := makeManager(config, params, nil, make(chan struct{}, 1),
+			newEventBroker(params.Events))
+		if err != nil {
+			return nil, err
+		}
+		cm.start()
+		return cm, nil
+	}
+	if config.ChallengeType == "" {
+		cert, err := loadCertificate(config.CertFilename, config.KeyFilename,
+			params.Logger)
+		if err != nil {
+			return nil, err
+		}
+		return &CertificateManager{
+			certificate: cert,
+			events:      newEventBroker(params.Events),
+		}, nil
+	}
+	if err := checkChallengeType(config.ChallengeType); err != nil {
+		return nil, err
+	}
+	if params.Responder == nil {
 		return nil, errors.New("no responder specified")
 	}
-	keyMaker := makeKeyECDSA
-	switch keyType {
-	case "", "EC":
-	case "RSA":
-		keyMaker = makeKeyRSA
-	default:
-		return nil, errors.New("unsupported key type: " + keyType)
-	}
-	cm := &CertificateManager{
-		caDirectoryURL: caDirectoryURL,
-		certFilename:   certFilename,
-		challengeType:  challengeType,
-		keyFilename:    keyFilename,
-		keyMaker:       keyMaker,
-		locker:         locker,
-		names:          names,
-		renewBefore:    renewBefore,
-		responder:      responder,
-		storer:         storer,
-		logger:         logger,
-		writeNotifier:  make(chan struct{}, 1),
+	var accountFilename string
+	if config.CertFilename != "" {
+		accountFilename = config.CertFilename + accountFileSuffix
 	}
-	go cm.begin()
+	accountStorer, _ := params.Storer.(AccountStorer)
+	accounts, err := newAccountManagers(config.CertificateAuthorities,
+		config.CaDirectoryURL, config.Contacts, config.EabKeyId,
+		config.EabHmacKey, accountFilename, accountStorer, params.Logger)
+	if err != nil {
+		return nil, err
+	}
+	cm, err := makeManager(config, params, accounts, make(chan struct{}, 1),
+		newEventBroker(params.Events))
+	if err != nil {
+		return nil, err
+	}
+	cm.start()
 	return cm, nil
 }
 
 func (cm *CertificateManager) authorise(ctx context.Context,
-	authoriseUrl string) error {
-	authorisation, err := cm.acmeClient.GetAuthorization(ctx, authoriseUrl)
+	account *accountManager, authoriseUrl string) error {
+	authorisation, err := account.client.GetAuthorization(ctx, authoriseUrl)
 	if err != nil {
 		return err
 	}
@@ -266,34 +432,58 @@ func (cm *CertificateManager) authorise(ctx context.Context,
 	domain := authorisation.Identifier.Value
 	switch cm.challengeType {
 	case "dns-01":
-		if err := cm.respondDNS(domain, challenge); err != nil {
+		err := cm.respondDNS(ctx, account.client, domain, challenge)
+		if err != nil {
 			return err
 		}
 	case "http-01":
-		if err := cm.respondHTTP(challenge); err != nil {
+		if err := cm.respondHTTP(account.client, challenge); err != nil {
+			return err
+		}
+	case "tls-alpn-01":
+		if err := cm.respondTLSALPN(account.client, domain,
+			challenge); err != nil {
 			return err
 		}
 	default:
 		return errors.New("unknown challenge type")
 	}
-	_, err = cm.acmeClient.Accept(ctx, challenge)
+	cm.publishEvent(EventChallengePublished, nil, []string{domain}, nil)
+	_, err = account.client.Accept(ctx, challenge)
 	if err != nil {
 		return err
 	}
-	_, err = cm.acmeClient.WaitAuthorization(ctx, authorisation.URI)
+	_, err = account.client.WaitAuthorization(ctx, authorisation.URI)
 	return err
 }
 
+// begin will load the certificate and then loop, renewing the certificate as
+// required, until the context is cancelled.
 func (cm *CertificateManager) begin() {
+	defer cm.waitGroup.Done()
 	if err := cm.fileLoad(); err != nil {
 		cm.logger.Println(err)
 	}
+	cm.waitGroup.Add(1)
+	go cm.maintainOCSP()
 	for {
 		wait := cm.checkRenew()
+		cm.rwMutex.Lock()
+		cm.nextCheck = time.Now().Add(wait)
+		cm.rwMutex.Unlock()
 		cm.logger.Printf(
 			"scheduling next certificate renewal check at: %s (in: %s)\n",
 			time.Now().Add(wait), format.Duration(wait))
-		time.Sleep(wait)
+		timer := time.NewTimer(wait)
+		select {
+		case <-timer.C:
+		case <-cm.renewNow:
+			timer.Stop()
+		case <-cm.ctx.Done():
+			timer.Stop()
+			cm.logger.Debugln(0, "certificate manager closed")
+			return
+		}
 	}
 }
 
@@ -303,43 +493,77 @@ func (cm *CertificateManager) checkRenew() time.Duration {
 	cm.rwMutex.RUnlock()
 	// First check if the current certificate needs to be renewed.
 	if cert != nil {
+		cert = cm.updateRenewalInfo(cert)
 		expires := cert.timeUntilRenewal(cm.renewBefore, cm.names, cm.logger)
 		if expires > 0 {
-			return expires
+			return cert.limitToNextPoll(expires)
 		}
 	}
 	if cm.storer != nil {
 		// Now try and get a certifcate from the remote store, save it and see
 		// if it needs to be renewed.
-		if cert, err := readCert(cm.storer); err != nil {
+		if cert, err := cm.readStoredCert(); err != nil {
 			cm.logger.Println(err)
 		} else { // Make use of newer certificate, even if expired, then rewnew.
 			cm.rwMutex.Lock()
 			if cm.certificate == nil ||
 				cert.notAfter.After(cm.certificate.notAfter) {
-				go cm.fileWrite(cert)
-				cm.certificate = cert
+				cm.waitGroup.Add(1)
+				go cm.fileWrite(cert, EventLoadedFromStorer)
+				cm.setCertificateWithLock(cert)
 			} else {
 				cm.logger.Printf(
 					"ignoring certificate which expires %s sooner\n",
 					cm.certificate.notAfter.Sub(cert.notAfter))
 			}
 			cm.rwMutex.Unlock()
+			cert = cm.updateRenewalInfo(cert)
 			exp := cert.timeUntilRenewal(cm.renewBefore, cm.names, cm.logger)
 			if exp > 0 {
-				return exp
+				return cert.limitToNextPoll(exp)
 			}
 		}
 	}
 	if err := cm.renew(); err != nil {
-		cm.logger.Println(err)
+		if cm.ctx.Err() == nil {
+			return cm.renewalFailed(err)
+		}
 		return jitteryHour()
 	}
-	expire := cm.certificate.timeUntilRenewal(cm.renewBefore, nil, cm.logger)
+	cm.renewalSucceeded()
+	cm.rwMutex.RLock()
+	cert = cm.certificate
+	cm.rwMutex.RUnlock()
+	cert = cm.updateRenewalInfo(cert)
+	expire := cert.timeUntilRenewal(cm.renewBefore, nil, cm.logger)
 	if expire < time.Hour {
 		expire = jitteryHour()
 	}
-	return expire
+	return cert.limitToNextPoll(expire)
+}
+
+// checkNearingExpiry will publish an EventNearingExpiry event if the current
+// certificate is overdue for renewal.
+func (cm *CertificateManager) checkNearingExpiry() {
+	cm.rwMutex.RLock()
+	cert := cm.certificate
+	cm.rwMutex.RUnlock()
+	if cert == nil || !cert.nearingExpiry(cm.renewBefore) {
+		return
+	}
+	cm.logger.Printf("certificate expires on: %s (in: %s)\n",
+		cert.notAfter.Local(), format.Duration(time.Until(cert.notAfter)))
+	cm.publishEvent(EventNearingExpiry, cert, cm.names, nil)
+}
+
+func (cm *CertificateManager) close() error {
+	if cm.cancel == nil {
+		return nil
+	}
+	cm.cancel()
+	cm.waitGroup.Wait()
+	cm.events.close()
+	return nil
 }
 
 func (cm *CertificateManager) fileLoad() error {
@@ -350,13 +574,16 @@ func (cm *CertificateManager) fileLoad() error {
 	if err != nil {
 		return err
 	}
-	cm.rwMutex.Lock()
-	defer cm.rwMutex.Unlock()
-	cm.certificate = cert
+	cm.setCertificate(cert)
 	return nil
 }
 
-func (cm *CertificateManager) fileWrite(cert *Certificate) {
+// fileWrite will write the certificate to the local cache files and will then
+// send notifications, including an event of the specified type. The caller
+// must call cm.waitGroup.Add(1) first.
+func (cm *CertificateManager) fileWrite(cert *Certificate,
+	eventType EventType) {
+	defer cm.waitGroup.Done()
 	if err := cm.fileWriteError(cert); err != nil {
 		cm.logger.Println(err)
 	}
@@ -365,6 +592,7 @@ func (cm *CertificateManager) fileWrite(cert *Certificate) {
 	default:
 	}
 	cm.logger.Printf("wrote certificate to: %s\n", cm.certFilename)
+	cm.publishEvent(eventType, cert, cm.names, nil)
 }
 
 func (cm *CertificateManager) fileWriteError(cert *Certificate) error {
@@ -390,11 +618,54 @@ func (cm *CertificateManager) fileWriteError(cert *Certificate) error {
 	if err := os.Rename(keyFilename, cm.keyFilename); err != nil {
 		return err
 	}
-	return nil
+	err = writeSideFile(cm.certFilename+issuerFileSuffix, cert.Issuer)
+	if err != nil {
+		return err
+	}
+	var keyUses string
+	if cert.KeyUses > 0 {
+		keyUses = strconv.FormatUint(uint64(cert.KeyUses), 10)
+	}
+	return writeSideFile(cm.certFilename+keyUsesFileSuffix, keyUses)
+}
+
+func (cm *CertificateManager) setCertificate(cert *Certificate) {
+	cm.rwMutex.Lock()
+	defer cm.rwMutex.Unlock()
+	cm.setCertificateWithLock(cert)
+}
+
+// setCertificateWithLock will set the current certificate. This must be called
+// with the lock held.
+func (cm *CertificateManager) setCertificateWithLock(cert *Certificate) {
+	cm.certificate = cert
+	select { // Non-blocking notify.
+	case cm.ocspWakeup <- struct{}{}:
+	default:
+	}
+}
+
+// start will start the background work.
+func (cm *CertificateManager) start() {
+	cm.waitGroup.Add(1)
+	go cm.begin()
+}
+
+// triggerRenewal will wake the renewal goroutine to check for renewal now.
+func (cm *CertificateManager) triggerRenewal() {
+	select { // Non-blocking notify.
+	case cm.renewNow <- struct{}{}:
+	default:
+	}
 }
 
 func (cm *CertificateManager) getCertificate(hello *tls.ClientHelloInfo) (
 	*tls.Certificate, error) {
+	if isAcmeTLSHello(hello) {
+		if responder, ok := cm.responder.(TLSResponder); ok {
+			return responder.GetChallengeCertificate(hello)
+		}
+	}
 	cm.rwMutex.RLock()
 	defer cm.rwMutex.RUnlock()
 	if cm.certificate == nil {
@@ -403,39 +674,22 @@ func (cm *CertificateManager) getCertificate(hello *tls.ClientHelloInfo) (
 	return &cm.certificate.tlsCert, nil
 }
 
-func (cm *CertificateManager) makeAcmeClient(ctx context.Context) error {
-	if cm.acmeClient != nil {
-		return nil
-	}
-	key, err := makeKeyECDSA()
-	if err != nil {
-		return err
-	}
-	acmeClient := &acme.Client{
-		Key:          key,
-		DirectoryURL: cm.caDirectoryURL,
-		UserAgent: filepath.Base(os.Args[0]) +
-			" using github.com/Cloud-Foundations/golib/pkg/crypto/certmanager",
-	}
-	_, err = acmeClient.Register(ctx, &acme.Account{}, acme.AcceptTOS)
-	if err != nil {
-		return err
-	}
-	cm.acmeClient = acmeClient
-	return nil
-}
-
-func (cm *CertificateManager) makeAcmeOrder(ctx context.Context) error {
-	if err := cm.makeAcmeClient(ctx); err != nil {
+// makeAcmeOrder will create an ACME order with the CA for account if there is
+// no current order for that CA. This must be called with the account locks
+// held (see lockAccount).
+func (cm *CertificateManager) makeAcmeOrder(ctx context.Context,
+	account *accountManager) error {
+	if err := account.makeClient(ctx); err != nil {
 		return err
 	}
 	if cm.acmeOrder != nil {
-		if time.Now().Before(cm.acmeOrder.Expires) {
+		if time.Now().Before(cm.acmeOrder.Expires) &&
+			cm.acmeOrderClient == account.client {
 			return nil
 		}
 		cm.acmeOrder = nil
 	}
-	acmeOrder, err := cm.acmeClient.AuthorizeOrder(ctx,
+	acmeOrder, err := account.client.AuthorizeOrder(ctx,
 		acme.DomainIDs(cm.names...))
 	if err != nil {
 		return err
@@ -444,17 +698,36 @@ func (cm *CertificateManager) makeAcmeOrder(ctx context.Context) error {
 		acmeOrder.Expires.Local(),
 		format.Duration(time.Until(acmeOrder.Expires)))
 	cm.acmeOrder = acmeOrder
+	cm.acmeOrderClient = account.client
 	return nil
 }
 
+// readStoredCert will read the certificate from the remote store. Revoked
+// certificates are rejected.
+func (cm *CertificateManager) readStoredCert() (*Certificate, error) {
+	cert, err := readCert(cm.storer)
+	if err != nil {
+		return nil, err
+	}
+	serial := cert.tlsCert.Leaf.SerialNumber.String()
+	cm.rwMutex.RLock()
+	_, revoked := cm.revokedSerials[serial]
+	cm.rwMutex.RUnlock()
+	if revoked {
+		return nil, fmt.Errorf("ignoring revoked certificate, serial: %s",
+			serial)
+	}
+	return cert, nil
+}
+
 // renew performs a locked ACME transaction.
 func (cm *CertificateManager) renew() error {
-	if err := cm.locker.Lock(); err != nil {
-		return err
+	if err := lockWithContext(cm.ctx, cm.locker); err != nil {
+		return &RenewalError{Class: ErrorClassStorage, Err: err}
 	}
 	defer cm.locker.Unlock()
 	if cm.storer != nil { // Check to see if someone else just renewed.
-		if cert, _ := readCert(cm.storer); cert != nil {
+		if cert, _ := cm.readStoredCert(); cert != nil {
 			var previousNotAfter time.Time
 			cm.rwMutex.RLock()
 			if cm.certificate != nil {
@@ -462,52 +735,76 @@ func (cm *CertificateManager) renew() error {
 			}
 			cm.rwMutex.RUnlock()
 			if cert.notAfter.After(previousNotAfter) {
-				cm.rwMutex.Lock()
-				cm.certificate = cert
-				cm.rwMutex.Unlock()
-				go cm.fileWrite(cert)
+				cm.setCertificate(cert)
+				cm.waitGroup.Add(1)
+				go cm.fileWrite(cert, EventLoadedFromStorer)
+				cm.returnToPrimary()
 				return nil
 			}
 		}
 	}
 	lostChannel := cm.locker.GetLostChannel()
-	cert, err := cm.request(context.Background())
+	cm.publishEvent(EventRenewalStarted, nil, cm.names, nil)
+	var cert *Certificate
+	var err error
+	if cm.localCA != nil {
+		cert, err = cm.issueLocal()
+	} else {
+		account := cm.currentAccount()
+		cm.lockAccount(account)
+		cert, err = cm.request(cm.ctx, account)
+		account.checkError(err)
+		cm.unlockAccount(account)
+		if err != nil && cm.ctx.Err() == nil {
+			cm.recordFailure(account, err)
+		}
+	}
 	if err != nil {
 		return err
 	}
-	cm.logger.Printf("certificate issued for %s, expires on: %s (in %s)\n",
-		cm.names[0], cert.notAfter.Local(),
+	cm.logger.Printf(
+		"certificate issued for %s by: %s, expires on: %s (in %s)\n",
+		cm.names[0], cert.Issuer, cert.notAfter.Local(),
 		format.Duration(time.Until(cert.notAfter)))
-	go cm.fileWrite(cert)
-	cm.rwMutex.Lock()
-	cm.certificate = cert
-	cm.rwMutex.Unlock()
+	cm.returnToPrimary()
+	cm.waitGroup.Add(1)
+	go cm.fileWrite(cert, EventIssued)
+	cm.setCertificate(cert)
 	// Write to remote storage if we kept the lock.
 	select {
 	case err := <-lostChannel:
-		return err
+		return &RenewalError{Class: ErrorClassStorage, Err: err}
 	default:
 	}
 	if cm.storer == nil {
 		return nil
 	}
-	return cm.storer.Write(cert)
+	if err := cm.storer.Write(cert); err != nil {
+		return &RenewalError{Class: ErrorClassStorage, Err: err}
+	}
+	return nil
 }
 
-// request performs an ACME request.
-func (cm *CertificateManager) request(ctx context.Context) (
-	*Certificate, error) {
-	if err := cm.makeAcmeOrder(ctx); err != nil {
+// request performs an ACME request with the CA for account.
+func (cm *CertificateManager) request(ctx context.Context,
+	account *accountManager) (*Certificate, error) {
+	if err := cm.makeAcmeOrder(ctx, account); err != nil {
 		return nil, err
 	}
+	defer cm.responder.Cleanup()
 	for _, authoriseUrl := range cm.acmeOrder.AuthzURLs {
-		if err := cm.authorise(ctx, authoriseUrl); err != nil {
+		if err := cm.authorise(ctx, account, authoriseUrl); err != nil {
+			if _, ok := err.(*acme.AuthorizationError); ok {
+				cm.acmeOrder = nil // The order is now invalid.
+			}
 			return nil, err
 		}
 	}
-	defer cm.responder.Cleanup()
-	acmeOrder, err := cm.acmeClient.WaitOrder(ctx, cm.acmeOrder.URI)
+	acmeOrder, err := account.client.WaitOrder(ctx, cm.acmeOrder.URI)
 	if err != nil {
+		if _, ok := err.(*acme.OrderError); ok {
+			cm.acmeOrder = nil
+		}
 		return nil, err
 	}
 	cm.logger.Debugln(0, "ACME order was authorised")
@@ -515,20 +812,28 @@ func (cm *CertificateManager) request(ctx context.Context) (
 		Subject:  pkix.Name{CommonName: cm.names[0]},
 		DNSNames: cm.names[1:],
 	}
-	if cm.key == nil {
-		cm.key, err = cm.keyMaker()
-		if err != nil {
-			return nil, err
-		}
+	key, err := cm.selectKey()
+	if err != nil {
+		return nil, err
 	}
-	csr, err := x509.CreateCertificateRequest(rand.Reader, req, cm.key)
+	csr, err := x509.CreateCertificateRequest(rand.Reader, req, key)
 	if err != nil {
 		return nil, err
 	}
-	chainDER, _, err := cm.acmeClient.CreateOrderCert(ctx,
+	chainDER, certURL, err := account.client.CreateOrderCert(ctx,
 		acmeOrder.FinalizeURL, csr, true)
+	cm.acmeOrder = nil // A finalised order cannot be re-used.
+	if err != nil {
+		return nil, err
+	}
+	chainDER = cm.selectChain(ctx, account.client, chainDER, certURL)
+	cm.keyUses++
+	cert, err := makeCert(chainDER, key)
 	if err != nil {
 		return nil, err
 	}
-	return makeCert(chainDER, cm.key)
+	cert.Issuer = account.directoryURL()
+	cert.KeyUses = cm.keyUses
+	cert.source = cert.Issuer
+	return cert, nil
 }
@@ -0,0 +1,500 @@
+package certmanager
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/x509"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/acme"
+
+	"github.com/Cloud-Foundations/golib/pkg/crypto/certmanager/acmetest"
+	cm_http "github.com/Cloud-Foundations/golib/pkg/crypto/certmanager/http"
+	"github.com/Cloud-Foundations/golib/pkg/log/testlogger"
+)
+
+// testDNSResponder publishes dns-01 responses which are looked up by the
+// test ACME server.
+type testDNSResponder struct {
+	mutex   sync.Mutex          // Protect everything below.
+	records map[string][]string // Key: FQDN.
+}
+
+// blockingLocker blocks in Lock until release is closed.
+type blockingLocker struct {
+	locking  chan struct{}
+	release  chan struct{}
+	unlocked chan struct{}
+}
+
+type testLocker struct {
+	mutex    sync.Mutex
+	numLocks int
+}
+
+type testResponder struct{}
+
+func (r *testDNSResponder) Cleanup() {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.records = make(map[string][]string)
+}
+
+func (r *testDNSResponder) LookupTXT(ctx context.Context, name string) (
+	[]string, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return r.records[name], nil
+}
+
+func (r *testDNSResponder) Respond(key, value string) error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.records[key] = append(r.records[key], value)
+	return nil
+}
+
+func (l *blockingLocker) GetLostChannel() <-chan error {
+	return nil
+}
+
+func (l *blockingLocker) Lock() error {
+	close(l.locking)
+	<-l.release
+	return nil
+}
+
+func (l *blockingLocker) Unlock() error {
+	close(l.unlocked)
+	return nil
+}
+
+func (l *testLocker) GetLostChannel() <-chan error {
+	return nil
+}
+
+func (l *testLocker) Lock() error {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.numLocks++
+	return nil
+}
+
+func (l *testLocker) Unlock() error {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.numLocks--
+	return nil
+}
+
+func (testResponder) Cleanup() {}
+
+func (testResponder) Respond(key, value string) error {
+	return nil
+}
+
+// makeBlockingCA returns a server which blocks all requests until they are
+// cancelled and a channel which receives a notification for each request.
+func makeBlockingCA() (*httptest.Server, <-chan struct{}) {
+	requests := make(chan struct{}, 1)
+	server := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, req *http.Request) {
+			select {
+			case requests <- struct{}{}:
+			default:
+			}
+			<-req.Context().Done()
+		}))
+	return server, requests
+}
+
+func makeTestACME(t *testing.T, config acmetest.Config) (
+	*acmetest.Server, *cm_http.Responder) {
+	responder, err := cm_http.NewHandler(nil, testlogger.New(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	httpServer := httptest.NewServer(responder)
+	t.Cleanup(httpServer.Close)
+	if config.HTTPAddress == "" {
+		config.HTTPAddress = httpServer.Listener.Addr().String()
+	}
+	server, err := acmetest.New(config, acmetest.Params{
+		Logger: testlogger.New(t),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(server.Close)
+	return server, responder
+}
+
+func makeTestACMEManager(t *testing.T, server *acmetest.Server,
+	config Config, params Params) *CertificateManager {
+	config.CaDirectoryURL = server.DirectoryURL()
+	if config.ChallengeType == "" {
+		config.ChallengeType = "http-01"
+	}
+	if len(config.Names) < 1 {
+		config.Names = []string{"www.example.com"}
+	}
+	params.Logger = testlogger.New(t)
+	cm, err := NewWithConfig(config, params)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { cm.Close() })
+	return cm
+}
+
+func testClose(t *testing.T, ctx context.Context,
+	closeFunc func(cm *CertificateManager)) {
+	server, requests := makeBlockingCA()
+	defer server.Close()
+	locker := &testLocker{}
+	cm, err := NewWithConfig(
+		Config{
+			CaDirectoryURL: server.URL,
+			ChallengeType:  "http-01",
+			Names:          []string{"www.example.com"},
+		},
+		Params{
+			Context:   ctx,
+			Locker:    locker,
+			Logger:    testlogger.New(t),
+			Responder: testResponder{},
+		})
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-requests:
+	case <-time.After(time.Second * 5):
+		t.Fatal("timed out waiting for ACME request")
+	}
+	closed := make(chan struct{})
+	go func() {
+		closeFunc(cm)
+		cm.close()
+		close(closed)
+	}()
+	select {
+	case <-closed:
+	case <-time.After(time.Second * 5):
+		t.Fatal("timed out waiting for close")
+	}
+	locker.mutex.Lock()
+	defer locker.mutex.Unlock()
+	if locker.numLocks != 0 {
+		t.Fatalf("locker not released, numLocks: %d", locker.numLocks)
+	}
+}
+
+func verifyTestACMECertificate(t *testing.T, server *acmetest.Server,
+	cert *Certificate) {
+	intermediates := x509.NewCertPool()
+	for _, x509Cert := range cert.Chain()[1:] {
+		intermediates.AddCert(x509Cert)
+	}
+	_, err := cert.tlsCert.Leaf.Verify(x509.VerifyOptions{
+		DNSName:       "www.example.com",
+		Intermediates: intermediates,
+		Roots:         server.Roots(),
+	})
+	if err != nil {
+		t.Error(err)
+	}
+	if cert.Issuer != server.DirectoryURL() {
+		t.Errorf("issuer: %s != %s", cert.Issuer, server.DirectoryURL())
+	}
+}
+
+func waitForRenewalError(t *testing.T,
+	cm *CertificateManager) *RenewalError {
+	timeout := time.After(10 * time.Second)
+	for {
+		cm.rwMutex.RLock()
+		err := cm.lastRenewalError
+		cm.rwMutex.RUnlock()
+		if err != nil {
+			return err
+		}
+		select {
+		case <-timeout:
+			t.Fatal("timed out waiting for renewal error")
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+}
+
+func TestClose(t *testing.T) {
+	testClose(t, context.Background(), func(cm *CertificateManager) { cm.Close() })
+}
+
+func TestContextCancel(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	testClose(t, ctx, func(cm *CertificateManager) { cancel() })
+}
+
+func TestCloseWhileLocking(t *testing.T) {
+	locker := &blockingLocker{
+		locking:  make(chan struct{}),
+		release:  make(chan struct{}),
+		unlocked: make(chan struct{}),
+	}
+	cm, err := NewWithConfig(
+		Config{
+			CaDirectoryURL: "http://localhost:1/directory",
+			ChallengeType:  "http-01",
+			Names:          []string{"www.example.com"},
+		},
+		Params{
+			Locker:    locker,
+			Logger:    testlogger.New(t),
+			Responder: testResponder{},
+		})
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-locker.locking:
+	case <-time.After(time.Second * 5):
+		t.Fatal("timed out waiting for Lock")
+	}
+	closed := make(chan struct{})
+	go func() {
+		cm.Close()
+		close(closed)
+	}()
+	select {
+	case <-closed:
+	case <-time.After(time.Second * 5):
+		t.Fatal("timed out waiting for close")
+	}
+	// A lock which is granted after closing must be released.
+	close(locker.release)
+	select {
+	case <-locker.unlocked:
+	case <-time.After(time.Second * 5):
+		t.Fatal("timed out waiting for Unlock")
+	}
+}
+
+func TestRenewChallengeFailure(t *testing.T) {
+	server, _ := makeTestACME(t, acmetest.Config{})
+	locker := &testLocker{}
+	// The testResponder does not publish responses.
+	cm := makeTestACMEManager(t, server, Config{},
+		Params{Locker: locker, Responder: testResponder{}})
+	err := waitForRenewalError(t, cm)
+	if err.Class != ErrorClassChallenge {
+		t.Errorf("error class: %s != %s", err.Class, ErrorClassChallenge)
+	}
+	if len(server.Issued()) > 0 {
+		t.Error("certificate issued")
+	}
+	locker.mutex.Lock()
+	defer locker.mutex.Unlock()
+	if locker.numLocks != 0 {
+		t.Errorf("locker not released, numLocks: %d", locker.numLocks)
+	}
+}
+
+func TestRenewDNS01(t *testing.T) {
+	responder := &testDNSResponder{records: make(map[string][]string)}
+	server, _ := makeTestACME(t, acmetest.Config{
+		ChallengeTypes: []string{"dns-01"},
+		LookupTXT:      responder.LookupTXT,
+	})
+	cm := makeTestACMEManager(t, server,
+		Config{
+			ChallengeType: "dns-01",
+			Names:         []string{"www.example.com", "*.example.com"},
+		},
+		Params{Responder: responder})
+	cert := waitForCertificate(t, cm)
+	verifyTestACMECertificate(t, server, cert)
+	if err := cert.tlsCert.Leaf.VerifyHostname("a.example.com"); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestRenewFileCache(t *testing.T) {
+	server, responder := makeTestACME(t, acmetest.Config{})
+	dir := t.TempDir()
+	config := Config{
+		CertFilename: filepath.Join(dir, "cert.pem"),
+		KeyFilename:  filepath.Join(dir, "key.pem"),
+	}
+	cm := makeTestACMEManager(t, server, config,
+		Params{Responder: responder})
+	cert := waitForCertificate(t, cm)
+	select {
+	case <-cm.GetWriteNotifier():
+	case <-time.After(10 * time.Second):
+		t.Fatal("timed out waiting for certificate to be written")
+	}
+	cm.Close()
+	// A new manager must use the cached certificate and account.
+	cm = makeTestACMEManager(t, server, config, Params{Responder: responder})
+	newCert := waitForCertificate(t, cm)
+	if newCert.tlsCert.Leaf.SerialNumber.Cmp(
+		cert.tlsCert.Leaf.SerialNumber) != 0 {
+		t.Error("cached certificate not used")
+	}
+	if newCert.Issuer != server.DirectoryURL() {
+		t.Errorf("issuer: %s not cached", newCert.Issuer)
+	}
+	if newCert.KeyUses != 1 {
+		t.Errorf("key uses: %d != 1", newCert.KeyUses)
+	}
+	if issued := len(server.Issued()); issued != 1 {
+		t.Errorf("issued: %d != 1", issued)
+	}
+	if count := server.RequestCount(acmetest.EndpointNewAccount); count != 1 {
+		t.Errorf("newAccount requests: %d != 1", count)
+	}
+}
+
+func TestRenewHTTP01(t *testing.T) {
+	server, responder := makeTestACME(t, acmetest.Config{
+		CertificateLifetime: time.Hour * 4,
+	})
+	locker := &testLocker{}
+	cm := makeTestACMEManager(t, server, Config{RenewBefore: 0.5},
+		Params{Locker: locker, Responder: responder})
+	cert := waitForCertificate(t, cm)
+	verifyTestACMECertificate(t, server, cert)
+	// Renewal should be scheduled half way through the lifetime.
+	timeout := time.After(10 * time.Second)
+	for {
+		cm.rwMutex.RLock()
+		nextCheck := cm.nextCheck
+		cm.rwMutex.RUnlock()
+		if !nextCheck.IsZero() {
+			if wait := time.Until(nextCheck); wait < time.Hour*3/2 ||
+				wait > time.Hour*5/2 {
+				t.Errorf("next check in: %s, expected 2h", wait)
+			}
+			break
+		}
+		select {
+		case <-timeout:
+			t.Fatal("timed out waiting for renewal to be scheduled")
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+	locker.mutex.Lock()
+	defer locker.mutex.Unlock()
+	if locker.numLocks != 0 {
+		t.Errorf("locker not released, numLocks: %d", locker.numLocks)
+	}
+}
+
+func TestRenewRateLimited(t *testing.T) {
+	server, responder := makeTestACME(t, acmetest.Config{})
+	server.InjectFault(acmetest.Fault{
+		Count:       1,
+		Endpoint:    acmetest.EndpointNewOrder,
+		ProblemType: "rateLimited",
+		RetryAfter:  time.Second,
+	})
+	cm := makeTestACMEManager(t, server, Config{},
+		Params{Responder: responder})
+	waitForCertificate(t, cm)
+	if count := server.RequestCount(acmetest.EndpointNewOrder); count != 2 {
+		t.Errorf("newOrder requests: %d != 2", count)
+	}
+}
+
+func TestRenewRejected(t *testing.T) {
+	server, responder := makeTestACME(t, acmetest.Config{})
+	server.InjectFault(acmetest.Fault{
+		Endpoint:    acmetest.EndpointNewOrder,
+		ProblemType: "rejectedIdentifier",
+	})
+	cm := makeTestACMEManager(t, server, Config{},
+		Params{Responder: responder})
+	err := waitForRenewalError(t, cm)
+	if err.Class != ErrorClassRejected {
+		t.Errorf("error class: %s != %s", err.Class, ErrorClassRejected)
+	}
+	if err.ProblemType != "urn:ietf:params:acme:error:rejectedIdentifier" {
+		t.Errorf("problem type: %s", err.ProblemType)
+	}
+}
+
+func TestRenewRevoked(t *testing.T) {
+	server, responder := makeTestACME(t, acmetest.Config{})
+	storer := &testCertStorer{}
+	cm := makeTestACMEManager(t, server, Config{},
+		Params{Responder: responder, Storer: storer})
+	cert := waitForCertificate(t, cm)
+	err := cm.Revoke(context.Background(), acme.CRLReasonKeyCompromise)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !server.IsRevoked(cert.tlsCert.Leaf) {
+		t.Fatal("certificate not revoked")
+	}
+	// The replacement is requested with a new order and a new key.
+	timeout := time.After(10 * time.Second)
+	for len(server.Issued()) < 2 {
+		select {
+		case <-timeout:
+			t.Fatal("timed out waiting for replacement certificate")
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+	newCert := waitForCertificate(t, cm)
+	for newCert.revoked {
+		select {
+		case <-timeout:
+			t.Fatal("timed out waiting for replacement certificate")
+		case <-time.After(10 * time.Millisecond):
+		}
+		newCert = waitForCertificate(t, cm)
+	}
+	if cert.tlsCert.Leaf.PublicKey.(*ecdsa.PublicKey).Equal(
+		newCert.tlsCert.Leaf.PublicKey) {
+		t.Error("replacement certificate has the revoked key")
+	}
+}
+
+func TestRenewStorerSharing(t *testing.T) {
+	server, responder := makeTestACME(t, acmetest.Config{})
+	storer := &testCertStorer{}
+	cm := makeTestACMEManager(t, server, Config{},
+		Params{Responder: responder, Storer: storer})
+	cert := waitForCertificate(t, cm)
+	timeout := time.After(10 * time.Second)
+	for {
+		if _, err := storer.Read(); err == nil {
+			break
+		}
+		select {
+		case <-timeout:
+			t.Fatal("timed out waiting for certificate to be stored")
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+	// Another instance must load the certificate from the Storer.
+	cm = makeTestACMEManager(t, server, Config{},
+		Params{Responder: responder, Storer: storer})
+	newCert := waitForCertificate(t, cm)
+	if newCert.tlsCert.Leaf.SerialNumber.Cmp(
+		cert.tlsCert.Leaf.SerialNumber) != 0 {
+		t.Error("stored certificate not used")
+	}
+	if newCert.Issuer != server.DirectoryURL() {
+		t.Errorf("issuer: %s not shared", newCert.Issuer)
+	}
+	if issued := len(server.Issued()); issued != 1 {
+		t.Errorf("issued: %d != 1", issued)
+	}
+}
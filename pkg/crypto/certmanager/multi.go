@@ -0,0 +1,203 @@
+package certmanager
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// mutexLocker serialises access to a Locker which is shared by multiple
+// certificate managers in the same process. The semaphore is used instead of
+// a sync.Mutex so that waiting may be abandoned.
+type mutexLocker struct {
+	locker    Locker
+	semaphore chan struct{}
+}
+
+func newMutexLocker(locker Locker) *mutexLocker {
+	return &mutexLocker{locker: locker, semaphore: make(chan struct{}, 1)}
+}
+
+func (l *mutexLocker) GetLostChannel() <-chan error {
+	return l.locker.GetLostChannel()
+}
+
+func (l *mutexLocker) Lock() error {
+	return l.LockWithContext(context.Background())
+}
+
+func (l *mutexLocker) LockWithContext(ctx context.Context) error {
+	select {
+	case l.semaphore <- struct{}{}:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	if err := lockWithContext(ctx, l.locker); err != nil {
+		<-l.semaphore
+		return err
+	}
+	return nil
+}
+
+func (l *mutexLocker) Unlock() error {
+	defer func() { <-l.semaphore }()
+	return l.locker.Unlock()
+}
+
+func normaliseServerName(name string) string {
+	return strings.ToLower(strings.TrimSuffix(name, "."))
+}
+
+func newMultiManager(config MultiConfig,
+	params MultiParams) (*MultiCertificateManager, error) {
+	if len(config.Certificates) < 1 {
+		return nil, errors.New("no certificates specified")
+	}
+	if err := checkChallengeType(config.ChallengeType); err != nil {
+		return nil, err
+	}
+	if params.Responder == nil {
+		return nil, errors.New("no responder specified")
+	}
+	accountFilename := config.AccountFilename
+	if accountFilename == "" && config.Certificates[0].CertFilename != "" {
+		accountFilename = config.Certificates[0].CertFilename +
+			accountFileSuffix
+	}
+	accounts, err := newAccountManagers(config.CertificateAuthorities,
+		config.CaDirectoryURL, config.Contacts, config.EabKeyId,
+		config.EabHmacKey, accountFilename, params.AccountStorer,
+		params.Logger)
+	if err != nil {
+		return nil, err
+	}
+	var locker Locker = nullLocker{}
+	if params.Locker != nil {
+		locker = params.Locker
+	}
+	mcm := &MultiCertificateManager{
+		events:        newEventBroker(params.Events),
+		managers:      make(map[string]*CertificateManager),
+		names:         make(map[string]*CertificateManager),
+		responder:     params.Responder,
+		writeNotifier: make(chan struct{}, 1),
+	}
+	locker = newMutexLocker(locker)
+	started := false
+	defer func() { // Release the managers if there is an error.
+		if !started {
+			for _, cm := range mcm.managers {
+				cm.cancel()
+			}
+		}
+	}()
+	for _, spec := range config.Certificates {
+		if spec.Name == "" {
+			return nil, errors.New("no name for certificate specification")
+		}
+		if _, ok := mcm.managers[spec.Name]; ok {
+			return nil, fmt.Errorf("duplicate certificate: %s", spec.Name)
+		}
+		cm, err := makeManager(
+			Config{
+				CertFilename:           spec.CertFilename,
+				ChallengeAliases:       config.ChallengeAliases,
+				ChallengeType:          config.ChallengeType,
+				FailoverThreshold:      config.FailoverThreshold,
+				FollowChallengeCNAME:   config.FollowChallengeCNAME,
+				KeyFilename:            spec.KeyFilename,
+				KeyRotation:            spec.KeyRotation,
+				KeyRotationInterval:    spec.KeyRotationInterval,
+				KeyType:                spec.KeyType,
+				Names:                  spec.Names,
+				PreferredChain:         config.PreferredChain,
+				PropagationNameservers: config.PropagationNameservers,
+				PropagationTimeout:     config.PropagationTimeout,
+				RenewBefore:            spec.RenewBefore,
+			},
+			Params{
+				Context:   params.Context,
+				Locker:    locker,
+				Logger:    params.Logger,
+				Responder: params.Responder,
+				Storer:    spec.Storer,
+			},
+			accounts, mcm.writeNotifier, mcm.events)
+		if err != nil {
+			return nil, fmt.Errorf("certificate: %s: %s", spec.Name, err)
+		}
+		mcm.managers[spec.Name] = cm
+		for _, name := range spec.Names {
+			name = normaliseServerName(name)
+			if _, ok := mcm.names[name]; !ok {
+				mcm.names[name] = cm
+			}
+		}
+	}
+	if config.DefaultCertificate != "" {
+		mcm.defaultManager = mcm.managers[config.DefaultCertificate]
+		if mcm.defaultManager == nil {
+			return nil, fmt.Errorf("unknown default certificate: %s",
+				config.DefaultCertificate)
+		}
+	}
+	started = true
+	for _, cm := range mcm.managers {
+		cm.start()
+	}
+	return mcm, nil
+}
+
+func (mcm *MultiCertificateManager) close() error {
+	for _, cm := range mcm.managers {
+		cm.cancel() // Cancel all first so that they stop concurrently.
+	}
+	for _, cm := range mcm.managers {
+		cm.close()
+	}
+	return nil
+}
+
+func (mcm *MultiCertificateManager) getCertificate(
+	hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	if isAcmeTLSHello(hello) {
+		if responder, ok := mcm.responder.(TLSResponder); ok {
+			return responder.GetChallengeCertificate(hello)
+		}
+	}
+	if cm := mcm.selectManager(hello.ServerName); cm != nil {
+		return cm.getCertificate(hello)
+	}
+	return nil, fmt.Errorf("no certificate for: %s", hello.ServerName)
+}
+
+// selectManager will select the certificate manager for the specified server
+// name. An exact match is preferred, followed by a wildcard match and then the
+// default certificate manager.
+func (mcm *MultiCertificateManager) selectManager(
+	serverName string) *CertificateManager {
+	serverName = normaliseServerName(serverName)
+	if serverName != "" {
+		if cm := mcm.names[serverName]; cm != nil {
+			return cm
+		}
+		if index := strings.IndexByte(serverName, '.'); index > 0 {
+			if cm := mcm.names["*"+serverName[index:]]; cm != nil {
+				return cm
+			}
+		}
+	}
+	return mcm.defaultManager
+}
+
+func (mcm *MultiCertificateManager) defaultOrAnyManager() *CertificateManager {
+	if mcm.defaultManager != nil {
+		return mcm.defaultManager
+	}
+	for _, cm := range mcm.managers {
+		return cm
+	}
+	return nil
+}
@@ -0,0 +1,41 @@
+package certmanager
+
+import (
+	"testing"
+)
+
+func TestSelectManager(t *testing.T) {
+	apex := &CertificateManager{}
+	wildcard := &CertificateManager{}
+	other := &CertificateManager{}
+	mcm := &MultiCertificateManager{
+		defaultManager: other,
+		names: map[string]*CertificateManager{
+			"example.com":     apex,
+			"www.example.com": apex,
+			"*.example.com":   wildcard,
+			"example.org":     other,
+		},
+	}
+	tests := []struct {
+		serverName string
+		expected   *CertificateManager
+	}{
+		{"example.com", apex},
+		{"WWW.Example.COM.", apex},
+		{"api.example.com", wildcard},
+		{"a.b.example.com", other},
+		{"example.org", other},
+		{"unknown.net", other},
+		{"", other},
+	}
+	for _, test := range tests {
+		if cm := mcm.selectManager(test.serverName); cm != test.expected {
+			t.Errorf("%s: wrong manager selected", test.serverName)
+		}
+	}
+	mcm.defaultManager = nil
+	if cm := mcm.selectManager("unknown.net"); cm != nil {
+		t.Error("unknown.net: expected no manager without default")
+	}
+}
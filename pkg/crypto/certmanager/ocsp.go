@@ -0,0 +1,236 @@
+package certmanager
+
+import (
+	"bytes"
+	"context"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"time"
+
+	"golang.org/x/crypto/ocsp"
+
+	"github.com/Cloud-Foundations/Dominator/lib/format"
+)
+
+const (
+	maxOCSPResponseSize = 1 << 20
+	minimumOCSPInterval = time.Minute
+	ocspRequestTimeout  = time.Second * 30
+	ocspRetryInterval   = time.Minute * 5
+)
+
+func fetchOCSP(ctx context.Context, leaf, issuer *x509.Certificate) (
+	[]byte, error) {
+	if len(leaf.OCSPServer) < 1 {
+		return nil, errors.New("no OCSP server in certificate")
+	}
+	request, err := ocsp.CreateRequest(leaf, issuer, nil)
+	if err != nil {
+		return nil, err
+	}
+	var lastError error
+	for _, url := range leaf.OCSPServer {
+		body, err := fetchOCSPFromServer(ctx, url, request)
+		if err != nil {
+			lastError = err
+			continue
+		}
+		return body, nil
+	}
+	return nil, lastError
+}
+
+// fetchOCSPFromServer will send the OCSP request to the OCSP responder at url.
+// The request is abandoned after ocspRequestTimeout.
+func fetchOCSPFromServer(ctx context.Context, url string, request []byte) (
+	[]byte, error) {
+	ctx, cancel := context.WithTimeout(ctx, ocspRequestTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, "POST", url,
+		bytes.NewReader(request))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/ocsp-request")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(
+		io.LimitReader(resp.Body, maxOCSPResponseSize))
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s: %s", url, resp.Status)
+	}
+	return body, nil
+}
+
+// ocspRefreshTime returns when an OCSP response should be refreshed, which is
+// half way through the validity interval of the response.
+func ocspRefreshTime(response *ocsp.Response) time.Time {
+	if response.NextUpdate.IsZero() {
+		return time.Now().Add(jitteryHour())
+	}
+	return response.ThisUpdate.Add(
+		response.NextUpdate.Sub(response.ThisUpdate) / 2)
+}
+
+func (cert *Certificate) getIssuer() (*x509.Certificate, error) {
+	if len(cert.tlsCert.Certificate) < 2 {
+		return nil, errors.New("no issuer certificate in chain")
+	}
+	return x509.ParseCertificate(cert.tlsCert.Certificate[1])
+}
+
+// parseOCSP will parse and verify an OCSP response for a certificate.
+func (cert *Certificate) parseOCSP(rawResponse []byte) (
+	*ocsp.Response, error) {
+	issuer, err := cert.getIssuer()
+	if err != nil {
+		return nil, err
+	}
+	response, err := ocsp.ParseResponseForCert(rawResponse, cert.tlsCert.Leaf,
+		issuer)
+	if err != nil {
+		return nil, err
+	}
+	if !response.NextUpdate.IsZero() && time.Now().After(response.NextUpdate) {
+		return nil, errors.New("OCSP response is stale")
+	}
+	return response, nil
+}
+
+// withOCSP returns a copy of the certificate with the OCSP response attached.
+// A certificate which is known to be revoked remains revoked.
+func (cert *Certificate) withOCSP(rawResponse []byte,
+	response *ocsp.Response) *Certificate {
+	newCert := *cert
+	newCert.tlsCert.OCSPStaple = rawResponse
+	newCert.ocspResponse = response
+	newCert.revoked = cert.revoked || response.Status == ocsp.Revoked
+	return &newCert
+}
+
+// maintainOCSP will periodically fetch OCSP responses for the current
+// certificate and attach them to the certificate. This runs until the context
+// is cancelled.
+func (cm *CertificateManager) maintainOCSP() {
+	defer cm.waitGroup.Done()
+	for {
+		wait := cm.refreshOCSP()
+		timer := time.NewTimer(wait)
+		select {
+		case <-timer.C:
+		case <-cm.ocspWakeup:
+			timer.Stop()
+		case <-cm.ctx.Done():
+			timer.Stop()
+			return
+		}
+	}
+}
+
+// readOCSP will read the OCSP response for the certificate from the remote
+// store. If the response is not for the certificate or is stale, an error is
+// returned.
+func (cm *CertificateManager) readOCSP(cert *Certificate) (
+	[]byte, *ocsp.Response, error) {
+	ocspStorer, ok := cm.storer.(OCSPStorer)
+	if !ok {
+		return nil, nil, nil
+	}
+	rawResponse, err := ocspStorer.ReadOCSP()
+	if err != nil {
+		return nil, nil, err
+	}
+	response, err := cert.parseOCSP(rawResponse)
+	if err != nil {
+		return nil, nil, err
+	}
+	return rawResponse, response, nil
+}
+
+// refreshOCSP will refresh the OCSP response for the current certificate if
+// required and returns the time until the next refresh.
+func (cm *CertificateManager) refreshOCSP() time.Duration {
+	cm.rwMutex.RLock()
+	cert := cm.certificate
+	cm.rwMutex.RUnlock()
+	if cert == nil || len(cert.tlsCert.Leaf.OCSPServer) < 1 {
+		return jitteryHour()
+	}
+	if cert.ocspResponse != nil {
+		if wait := time.Until(ocspRefreshTime(cert.ocspResponse)); wait > 0 {
+			return wait
+		}
+	}
+	rawResponse, response, err := cm.readOCSP(cert)
+	if err != nil {
+		cm.logger.Debugf(0, "unable to read OCSP response: %s\n", err)
+	}
+	if response != nil && time.Until(ocspRefreshTime(response)) <= 0 {
+		response = nil
+	}
+	if response == nil {
+		rawResponse, response, err = cm.requestOCSP(cert)
+		if err != nil {
+			cm.logger.Printf("error getting OCSP response: %s\n", err)
+			return ocspRetryInterval
+		}
+	}
+	cm.rwMutex.Lock()
+	if cm.certificate != cert {
+		cm.rwMutex.Unlock()
+		return 0 // Certificate was changed, try again.
+	}
+	cm.certificate = cert.withOCSP(rawResponse, response)
+	if response.Status == ocsp.Revoked {
+		cm.markRevokedWithLock(cert.tlsCert.Leaf.SerialNumber)
+	}
+	cm.rwMutex.Unlock()
+	if response.Status == ocsp.Revoked {
+		cm.logger.Printf(
+			"certificate serial: %s was revoked at: %s, renewing now\n",
+			cert.tlsCert.Leaf.SerialNumber, response.RevokedAt)
+		cm.triggerRenewal()
+	}
+	wait := time.Until(ocspRefreshTime(response))
+	if wait < minimumOCSPInterval {
+		wait = minimumOCSPInterval
+	}
+	cm.logger.Debugf(0,
+		"attached OCSP response, next refresh at: %s (in: %s)\n",
+		time.Now().Add(wait), format.Duration(wait))
+	return wait
+}
+
+// requestOCSP will fetch the OCSP response for the certificate from the OCSP
+// responder and will write it to the remote store.
+func (cm *CertificateManager) requestOCSP(cert *Certificate) (
+	[]byte, *ocsp.Response, error) {
+	issuer, err := cert.getIssuer()
+	if err != nil {
+		return nil, nil, err
+	}
+	rawResponse, err := fetchOCSP(cm.ctx, cert.tlsCert.Leaf, issuer)
+	if err != nil {
+		return nil, nil, err
+	}
+	response, err := cert.parseOCSP(rawResponse)
+	if err != nil {
+		return nil, nil, err
+	}
+	if ocspStorer, ok := cm.storer.(OCSPStorer); ok {
+		if err := ocspStorer.WriteOCSP(rawResponse); err != nil {
+			cm.logger.Printf("error writing OCSP response: %s\n", err)
+		}
+	}
+	return rawResponse, response, nil
+}
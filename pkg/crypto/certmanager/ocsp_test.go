@@ -0,0 +1,289 @@
+package certmanager
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ocsp"
+
+	"github.com/Cloud-Foundations/golib/pkg/log/testlogger"
+)
+
+type testCertStorer struct {
+	mutex sync.Mutex // Protect everything below.
+	cert  *Certificate
+}
+
+type testOCSPResponder struct {
+	issuer    *x509.Certificate
+	issuerKey crypto.Signer
+	mutex     sync.Mutex // Protect everything below.
+	numCalls  uint
+	status    int
+}
+
+type testOCSPStorer struct {
+	response []byte
+}
+
+func makeTestChain(t *testing.T, ocspServer string) (
+	*Certificate, *x509.Certificate, crypto.Signer) {
+	caKey, err := makeKeyECDSA()
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	caTemplate := &x509.Certificate{
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		NotAfter:              now.Add(time.Hour * 24),
+		NotBefore:             now.Add(-time.Hour),
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "Test CA"},
+	}
+	caDER, err := x509.CreateCertificate(rand.Reader, caTemplate, caTemplate,
+		caKey.Public(), caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caCert, err := x509.ParseCertificate(caDER)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leafKey, err := makeKeyECDSA()
+	if err != nil {
+		t.Fatal(err)
+	}
+	leafTemplate := &x509.Certificate{
+		DNSNames:     []string{"www.example.com"},
+		NotAfter:     now.Add(time.Hour * 12),
+		NotBefore:    now.Add(-time.Hour),
+		OCSPServer:   []string{ocspServer},
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: "www.example.com"},
+	}
+	leafDER, err := x509.CreateCertificate(rand.Reader, leafTemplate, caCert,
+		leafKey.Public(), caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := makeCert([][]byte{leafDER, caDER}, leafKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert, caCert, caKey
+}
+
+func makeTestManager(t *testing.T, storer Storer) *CertificateManager {
+	return &CertificateManager{
+		ctx:            context.Background(),
+		events:         newEventBroker(nil),
+		logger:         testlogger.New(t),
+		names:          []string{"www.example.com"},
+		ocspWakeup:     make(chan struct{}, 1),
+		renewNow:       make(chan struct{}, 1),
+		revokedSerials: make(map[string]struct{}),
+		storer:         storer,
+		writeNotifier:  make(chan struct{}, 1),
+	}
+}
+
+func (r *testOCSPResponder) ServeHTTP(w http.ResponseWriter,
+	req *http.Request) {
+	body, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	request, err := ocsp.ParseRequest(body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	r.mutex.Lock()
+	r.numCalls++
+	status := r.status
+	r.mutex.Unlock()
+	now := time.Now()
+	template := ocsp.Response{
+		NextUpdate:   now.Add(time.Hour),
+		SerialNumber: request.SerialNumber,
+		Status:       status,
+		ThisUpdate:   now.Add(-time.Minute),
+	}
+	if status == ocsp.Revoked {
+		template.RevokedAt = now.Add(-time.Minute)
+		template.RevocationReason = ocsp.KeyCompromise
+	}
+	response, err := ocsp.CreateResponse(r.issuer, r.issuer, template,
+		r.issuerKey)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/ocsp-response")
+	w.Write(response)
+}
+
+func (s *testCertStorer) Read() (*Certificate, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.cert == nil {
+		return nil, errors.New("no certificate stored")
+	}
+	return &Certificate{
+		CertPemBlock: s.cert.CertPemBlock,
+		KeyPemBlock:  s.cert.KeyPemBlock,
+		Issuer:       s.cert.Issuer,
+		KeyUses:      s.cert.KeyUses,
+	}, nil
+}
+
+func (s *testCertStorer) Write(cert *Certificate) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.cert = cert
+	return nil
+}
+
+func (s *testOCSPStorer) Read() (*Certificate, error) {
+	return nil, nil
+}
+
+func (s *testOCSPStorer) ReadOCSP() ([]byte, error) {
+	return s.response, nil
+}
+
+func (s *testOCSPStorer) Write(cert *Certificate) error {
+	return nil
+}
+
+func (s *testOCSPStorer) WriteOCSP(response []byte) error {
+	s.response = response
+	return nil
+}
+
+func TestOCSPStaple(t *testing.T) {
+	responder := &testOCSPResponder{status: ocsp.Good}
+	server := httptest.NewServer(responder)
+	defer server.Close()
+	cert, issuer, issuerKey := makeTestChain(t, server.URL)
+	responder.issuer = issuer
+	responder.issuerKey = issuerKey
+	storer := &testOCSPStorer{}
+	cm := makeTestManager(t, storer)
+	cm.setCertificate(cert)
+	if wait := cm.refreshOCSP(); wait <= 0 {
+		t.Fatalf("unexpected wait: %s", wait)
+	}
+	tlsCert, err := cm.getCertificate(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tlsCert.OCSPStaple) < 1 {
+		t.Fatal("no OCSP staple attached")
+	}
+	if len(storer.response) < 1 {
+		t.Fatal("OCSP response not written to storer")
+	}
+	// A second manager should use the shared OCSP response.
+	cm2 := makeTestManager(t, storer)
+	cm2.setCertificate(cert)
+	cm2.refreshOCSP()
+	if responder.numCalls != 1 {
+		t.Fatalf("OCSP responder called: %d times", responder.numCalls)
+	}
+	if tlsCert, _ := cm2.getCertificate(nil); len(tlsCert.OCSPStaple) < 1 {
+		t.Fatal("no shared OCSP staple attached")
+	}
+	select {
+	case <-cm.renewNow:
+		t.Fatal("renewal triggered for good certificate")
+	default:
+	}
+}
+
+func TestOCSPRevoked(t *testing.T) {
+	responder := &testOCSPResponder{status: ocsp.Revoked}
+	server := httptest.NewServer(responder)
+	defer server.Close()
+	cert, issuer, issuerKey := makeTestChain(t, server.URL)
+	responder.issuer = issuer
+	responder.issuerKey = issuerKey
+	cm := makeTestManager(t, nil)
+	cm.setCertificate(cert)
+	cm.refreshOCSP()
+	select {
+	case <-cm.renewNow:
+	default:
+		t.Fatal("renewal not triggered for revoked certificate")
+	}
+	cm.rwMutex.RLock()
+	current := cm.certificate
+	cm.rwMutex.RUnlock()
+	if wait := current.timeUntilRenewal(0.33, nil, cm.logger); wait > 0 {
+		t.Fatalf("revoked certificate not due for renewal, wait: %s", wait)
+	}
+	cm.storer = &testCertStorer{cert: cert}
+	if _, err := cm.readStoredCert(); err == nil {
+		t.Fatal("revoked certificate accepted from storer")
+	}
+}
+
+func TestRevokedCopy(t *testing.T) {
+	cert, _, _ := makeTestChain(t, "")
+	cm := makeTestManager(t, nil)
+	// The current certificate is a copy of the revoked certificate.
+	cm.setCertificate(cert.withRenewalInfo(&renewalInfo{}))
+	cm.rwMutex.Lock()
+	cm.markRevokedWithLock(cert.tlsCert.Leaf.SerialNumber)
+	current := cm.certificate
+	cm.rwMutex.Unlock()
+	if !current.revoked {
+		t.Fatal("copy of revoked certificate not marked as revoked")
+	}
+	if !current.withOCSP(nil, &ocsp.Response{Status: ocsp.Good}).revoked {
+		t.Fatal("revoked certificate not revoked after good OCSP response")
+	}
+}
+
+func TestRevokedReloaded(t *testing.T) {
+	cert, _, _ := makeTestChain(t, "")
+	// The current certificate was reloaded (i.e. from the Storer or a file),
+	// so it is a different object to the revoked certificate.
+	reloaded := &Certificate{
+		CertPemBlock: cert.CertPemBlock,
+		KeyPemBlock:  cert.KeyPemBlock,
+	}
+	if err := reloaded.parse(); err != nil {
+		t.Fatal(err)
+	}
+	cm := makeTestManager(t, nil)
+	cm.setCertificate(reloaded)
+	cm.rwMutex.Lock()
+	cm.markRevokedWithLock(cert.tlsCert.Leaf.SerialNumber)
+	current := cm.certificate
+	cm.rwMutex.Unlock()
+	if !current.revoked {
+		t.Fatal("reloaded revoked certificate not marked as revoked")
+	}
+	if wait := current.timeUntilRenewal(0.33, nil, cm.logger); wait > 0 {
+		t.Fatalf("revoked certificate not due for renewal, wait: %s", wait)
+	}
+	cm.storer = &testCertStorer{cert: reloaded}
+	if _, err := cm.readStoredCert(); err == nil {
+		t.Fatal("reloaded revoked certificate accepted from storer")
+	}
+}
@@ -0,0 +1,201 @@
+package certmanager
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+
+	"github.com/Cloud-Foundations/Dominator/lib/format"
+	"github.com/Cloud-Foundations/golib/pkg/log"
+)
+
+const (
+	propagationCheckInterval = time.Second * 5
+	propagationQueryTimeout  = time.Second * 5
+)
+
+type propagationChecker struct {
+	interval    time.Duration
+	logger      log.DebugLogger
+	lookupNS    func(ctx context.Context, name string) ([]*net.NS, error)
+	nameservers []string // host:port. If empty, use authoritative servers.
+	timeout     time.Duration
+}
+
+func newPropagationChecker(nameservers []string, timeout time.Duration,
+	logger log.DebugLogger) *propagationChecker {
+	checker := &propagationChecker{
+		interval: propagationCheckInterval,
+		logger:   logger,
+		lookupNS: net.DefaultResolver.LookupNS,
+		timeout:  timeout,
+	}
+	for _, nameserver := range nameservers {
+		if _, _, err := net.SplitHostPort(nameserver); err != nil {
+			nameserver = net.JoinHostPort(nameserver, "53")
+		}
+		checker.nameservers = append(checker.nameservers, nameserver)
+	}
+	return checker
+}
+
+// queryTXT will query the nameserver (host:port) for the TXT records for fqdn.
+// If recursive is true, recursion is requested.
+func queryTXT(ctx context.Context, nameserver, fqdn string,
+	recursive bool) ([]string, error) {
+	name, err := dnsmessage.NewName(strings.TrimSuffix(fqdn, ".") + ".")
+	if err != nil {
+		return nil, err
+	}
+	idBytes := make([]byte, 2)
+	if _, err := rand.Read(idBytes); err != nil {
+		return nil, err
+	}
+	query := dnsmessage.Message{
+		Header: dnsmessage.Header{
+			ID:               binary.BigEndian.Uint16(idBytes),
+			RecursionDesired: recursive,
+		},
+		Questions: []dnsmessage.Question{{
+			Name:  name,
+			Type:  dnsmessage.TypeTXT,
+			Class: dnsmessage.ClassINET,
+		}},
+	}
+	packedQuery, err := query.Pack()
+	if err != nil {
+		return nil, err
+	}
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "udp", nameserver)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	deadline := time.Now().Add(propagationQueryTimeout)
+	if ctxDeadline, ok := ctx.Deadline(); ok && ctxDeadline.Before(deadline) {
+		deadline = ctxDeadline
+	}
+	conn.SetDeadline(deadline)
+	if _, err := conn.Write(packedQuery); err != nil {
+		return nil, err
+	}
+	buffer := make([]byte, 4096)
+	for {
+		nRead, err := conn.Read(buffer)
+		if err != nil {
+			return nil, err
+		}
+		var response dnsmessage.Message
+		if err := response.Unpack(buffer[:nRead]); err != nil {
+			return nil, err
+		}
+		if !response.Header.Response || response.Header.ID != query.Header.ID {
+			continue // Ignore stray packets.
+		}
+		switch response.Header.RCode {
+		case dnsmessage.RCodeSuccess:
+		case dnsmessage.RCodeNameError:
+			return nil, nil
+		default:
+			return nil, fmt.Errorf("%s: %s", nameserver, response.Header.RCode)
+		}
+		var values []string
+		for _, answer := range response.Answers {
+			if !strings.EqualFold(answer.Header.Name.String(), name.String()) {
+				continue
+			}
+			if txt, ok := answer.Body.(*dnsmessage.TXTResource); ok {
+				values = append(values, strings.Join(txt.TXT, ""))
+			}
+		}
+		return values, nil
+	}
+}
+
+// findNameservers will find the authoritative nameservers for the zone
+// containing fqdn, by walking up the domain tree.
+func (c *propagationChecker) findNameservers(ctx context.Context,
+	fqdn string) ([]string, error) {
+	labels := strings.Split(strings.TrimSuffix(fqdn, "."), ".")
+	for index := range labels {
+		zone := strings.Join(labels[index:], ".")
+		records, err := c.lookupNS(ctx, zone)
+		if err != nil || len(records) < 1 {
+			continue
+		}
+		nameservers := make([]string, 0, len(records))
+		for _, record := range records {
+			nameservers = append(nameservers, net.JoinHostPort(
+				strings.TrimSuffix(record.Host, "."), "53"))
+		}
+		c.logger.Debugf(1, "authoritative nameservers for: %s: %v\n",
+			zone, nameservers)
+		return nameservers, nil
+	}
+	return nil, errors.New("no authoritative nameservers found for: " + fqdn)
+}
+
+// wait will wait until the TXT record for fqdn with the specified value is
+// visible on all the nameservers, or the timeout expires.
+func (c *propagationChecker) wait(ctx context.Context, fqdn,
+	value string) error {
+	startTime := time.Now()
+	ctx, cancel := context.WithTimeout(ctx, c.timeout)
+	defer cancel()
+	nameservers := c.nameservers
+	recursive := true
+	if len(nameservers) < 1 {
+		var err error
+		nameservers, err = c.findNameservers(ctx, fqdn)
+		if err != nil {
+			return err
+		}
+		recursive = false
+	}
+	pending := make(map[string]struct{}, len(nameservers))
+	for _, nameserver := range nameservers {
+		pending[nameserver] = struct{}{}
+	}
+	for {
+		for nameserver := range pending {
+			values, err := queryTXT(ctx, nameserver, fqdn, recursive)
+			if err != nil {
+				c.logger.Debugf(1, "error querying: %s for: %s: %s\n",
+					nameserver, fqdn, err)
+				continue
+			}
+			for _, found := range values {
+				if found == value {
+					delete(pending, nameserver)
+					break
+				}
+			}
+		}
+		if len(pending) < 1 {
+			c.logger.Debugf(0, "%s TXT record visible after: %s\n",
+				fqdn, format.Duration(time.Since(startTime)))
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			remaining := make([]string, 0, len(pending))
+			for nameserver := range pending {
+				remaining = append(remaining, nameserver)
+			}
+			sort.Strings(remaining)
+			return fmt.Errorf("%s TXT record not visible on: %s after: %s",
+				fqdn, strings.Join(remaining, ","),
+				format.Duration(time.Since(startTime)))
+		case <-time.After(c.interval):
+		}
+	}
+}
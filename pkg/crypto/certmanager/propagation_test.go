@@ -0,0 +1,173 @@
+package certmanager
+
+import (
+	"context"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+
+	"github.com/Cloud-Foundations/golib/pkg/log/testlogger"
+)
+
+// testNameserver is a minimal UDP DNS server which answers TXT queries.
+type testNameserver struct {
+	conn    net.PacketConn
+	mutex   sync.Mutex
+	records map[string][]string // Key: lower case FQDN with trailing dot.
+}
+
+func newTestNameserver(t *testing.T) *testNameserver {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ns := &testNameserver{conn: conn, records: make(map[string][]string)}
+	t.Cleanup(func() { conn.Close() })
+	go ns.serve()
+	return ns
+}
+
+func (ns *testNameserver) address() string {
+	return ns.conn.LocalAddr().String()
+}
+
+func (ns *testNameserver) respond(query *dnsmessage.Message) (
+	[]byte, error) {
+	response := dnsmessage.Message{
+		Header: dnsmessage.Header{
+			ID:            query.Header.ID,
+			Response:      true,
+			Authoritative: true,
+		},
+		Questions: query.Questions,
+	}
+	if len(query.Questions) != 1 ||
+		query.Questions[0].Type != dnsmessage.TypeTXT {
+		response.Header.RCode = dnsmessage.RCodeNotImplemented
+		return response.Pack()
+	}
+	question := query.Questions[0]
+	ns.mutex.Lock()
+	values, ok := ns.records[strings.ToLower(question.Name.String())]
+	ns.mutex.Unlock()
+	if !ok {
+		response.Header.RCode = dnsmessage.RCodeNameError
+		return response.Pack()
+	}
+	for _, value := range values {
+		response.Answers = append(response.Answers, dnsmessage.Resource{
+			Header: dnsmessage.ResourceHeader{
+				Name:  question.Name,
+				Type:  dnsmessage.TypeTXT,
+				Class: dnsmessage.ClassINET,
+				TTL:   15,
+			},
+			Body: &dnsmessage.TXTResource{TXT: []string{value}},
+		})
+	}
+	return response.Pack()
+}
+
+func (ns *testNameserver) serve() {
+	buffer := make([]byte, 512)
+	for {
+		nRead, addr, err := ns.conn.ReadFrom(buffer)
+		if err != nil {
+			return
+		}
+		var query dnsmessage.Message
+		if err := query.Unpack(buffer[:nRead]); err != nil {
+			continue
+		}
+		if response, err := ns.respond(&query); err == nil {
+			ns.conn.WriteTo(response, addr)
+		}
+	}
+}
+
+func (ns *testNameserver) setRecord(fqdn string, values ...string) {
+	ns.mutex.Lock()
+	defer ns.mutex.Unlock()
+	ns.records[strings.ToLower(fqdn)+"."] = values
+}
+
+func TestFindNameservers(t *testing.T) {
+	checker := newPropagationChecker(nil, time.Second, testlogger.New(t))
+	var lookups []string
+	checker.lookupNS = func(ctx context.Context, name string) (
+		[]*net.NS, error) {
+		lookups = append(lookups, name)
+		if name != "example.com" {
+			return nil, &net.DNSError{Err: "no such host", Name: name,
+				IsNotFound: true}
+		}
+		return []*net.NS{
+			{Host: "ns1.example.net."},
+			{Host: "ns2.example.net."},
+		}, nil
+	}
+	nameservers, err := checker.findNameservers(context.Background(),
+		"_acme-challenge.www.example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(lookups) != 3 {
+		t.Errorf("lookups: %v", lookups)
+	}
+	if len(nameservers) != 2 || nameservers[0] != "ns1.example.net:53" ||
+		nameservers[1] != "ns2.example.net:53" {
+		t.Errorf("nameservers: %v", nameservers)
+	}
+}
+
+func TestPropagationWait(t *testing.T) {
+	const fqdn = "_acme-challenge.www.example.com"
+	primary := newTestNameserver(t)
+	secondary := newTestNameserver(t)
+	primary.setRecord(fqdn, "old", "token")
+	checker := newPropagationChecker(
+		[]string{primary.address(), secondary.address()}, 5*time.Second,
+		testlogger.New(t))
+	checker.interval = 20 * time.Millisecond
+	timer := time.AfterFunc(100*time.Millisecond, func() {
+		secondary.setRecord(fqdn, "token")
+	})
+	defer timer.Stop()
+	if err := checker.wait(context.Background(), fqdn, "token"); err != nil {
+		t.Fatal(err)
+	}
+	checker.timeout = 200 * time.Millisecond
+	err := checker.wait(context.Background(), fqdn, "other")
+	if err == nil {
+		t.Fatal("no error for missing TXT record")
+	}
+	if !strings.Contains(err.Error(), primary.address()) ||
+		!strings.Contains(err.Error(), secondary.address()) {
+		t.Errorf("nameservers not reported: %s", err)
+	}
+}
+
+func TestQueryTXT(t *testing.T) {
+	ns := newTestNameserver(t)
+	ns.setRecord("_acme-challenge.example.com", "a", "b")
+	values, err := queryTXT(context.Background(), ns.address(),
+		"_ACME-challenge.example.com", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(values) != 2 || values[0] != "a" || values[1] != "b" {
+		t.Errorf("values: %v", values)
+	}
+	values, err = queryTXT(context.Background(), ns.address(),
+		"missing.example.com", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(values) != 0 {
+		t.Errorf("values for missing record: %v", values)
+	}
+}
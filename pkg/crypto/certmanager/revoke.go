@@ -0,0 +1,88 @@
+package certmanager
+
+import (
+	"context"
+	"errors"
+	"math/big"
+
+	"golang.org/x/crypto/acme"
+)
+
+// revokeCertificate will revoke the certificate using the certificate private
+// key.
+func revokeCertificate(ctx context.Context, caDirectoryURL string,
+	cert *Certificate, reason acme.CRLReasonCode) error {
+	if cert.tlsCert.Leaf == nil {
+		if err := cert.parse(); err != nil {
+			return err
+		}
+	}
+	signer, err := decodeKeyPEM(cert.KeyPemBlock)
+	if err != nil {
+		return err
+	}
+	client := &acme.Client{DirectoryURL: caDirectoryURL, Key: signer}
+	return client.RevokeCert(ctx, signer, cert.tlsCert.Certificate[0], reason)
+}
+
+// withRevoked returns a copy of the certificate marked as revoked.
+func (cert *Certificate) withRevoked() *Certificate {
+	newCert := *cert
+	newCert.revoked = true
+	return &newCert
+}
+
+func (cm *CertificateManager) revoke(ctx context.Context,
+	reason acme.CRLReasonCode) error {
+	if cm.account == nil {
+		return errAcmeNotEnabled
+	}
+	cm.rwMutex.RLock()
+	cert := cm.certificate
+	cm.rwMutex.RUnlock()
+	if cert == nil {
+		return errors.New("no certificate to revoke")
+	}
+	serial := cert.tlsCert.Leaf.SerialNumber
+	account := cm.issuerAccount(cert)
+	cm.lockAccount(account)
+	err := account.makeClient(ctx)
+	if err == nil {
+		err = account.client.RevokeCert(ctx, nil,
+			cert.tlsCert.Certificate[0], reason)
+		account.checkError(err)
+	}
+	if err != nil {
+		cm.logger.Printf(
+			"error revoking with account key: %s, trying certificate key\n",
+			err)
+		err = revokeCertificate(ctx, account.caDirectoryURL, cert, reason)
+	}
+	if err == nil {
+		cm.forceNewKey = true // The replacement must not use the same key.
+	}
+	cm.unlockAccount(account)
+	if err != nil {
+		return err
+	}
+	cm.logger.Printf("revoked certificate serial: %s, reason: %d\n",
+		serial, reason)
+	cm.rwMutex.Lock()
+	cm.markRevokedWithLock(serial)
+	cm.rwMutex.Unlock()
+	cm.triggerRenewal()
+	return nil
+}
+
+// markRevokedWithLock will record that the certificate with the serial number
+// was revoked. The current certificate may be a copy of the revoked
+// certificate (i.e. with an OCSP response attached), so it is matched by serial
+// number. This must be called with the lock held.
+func (cm *CertificateManager) markRevokedWithLock(serial *big.Int) {
+	cm.revokedSerials[serial.String()] = struct{}{}
+	cert := cm.certificate
+	if cert != nil && !cert.revoked &&
+		cert.tlsCert.Leaf.SerialNumber.Cmp(serial) == 0 {
+		cm.certificate = cert.withRevoked()
+	}
+}
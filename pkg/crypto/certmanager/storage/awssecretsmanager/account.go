@@ -0,0 +1,63 @@
+package awssecretsmanager
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/Cloud-Foundations/golib/pkg/crypto/certmanager"
+	"github.com/Cloud-Foundations/golib/pkg/crypto/certmanager/encoding"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/secretsmanager"
+)
+
+const accountVersionStage = "ACCOUNT"
+
+func (ls *LockingStorer) readAccount() (*certmanager.Account, error) {
+	input := secretsmanager.GetSecretValueInput{
+		SecretId:     aws.String(ls.secretId),
+		VersionStage: aws.String(accountVersionStage),
+	}
+	output, err := ls.awsService.GetSecretValue(&input)
+	if err != nil {
+		return nil,
+			fmt.Errorf("error calling secretsmanager:GetSecretValue: %s", err)
+	}
+	if output.SecretString == nil {
+		return nil, fmt.Errorf("no SecretString in SecretId: %s label: %s",
+			ls.secretId, accountVersionStage)
+	}
+	account, err := encoding.DecodeAccount(*output.SecretString)
+	if err != nil {
+		return nil, err
+	}
+	ls.logger.Printf(
+		"read ACME account from AWS Secrets Manager, SecretId: %s\n",
+		ls.secretId)
+	return account, nil
+}
+
+func (ls *LockingStorer) writeAccount(account *certmanager.Account) error {
+	secret, err := encoding.EncodeAccount(account)
+	if err != nil {
+		return err
+	}
+	input := secretsmanager.PutSecretValueInput{
+		SecretId:      aws.String(ls.secretId),
+		SecretString:  aws.String(secret),
+		VersionStages: aws.StringSlice([]string{accountVersionStage}),
+	}
+	output, err := ls.awsService.PutSecretValue(&input)
+	if err != nil {
+		return fmt.Errorf("error calling secretsmanager:PutSecretValue: %s",
+			err)
+	}
+	for _, versionStage := range output.VersionStages {
+		if *versionStage == accountVersionStage {
+			ls.logger.Printf(
+				"wrote ACME account to AWS Secrets Manager, SecretId: %s\n",
+				ls.secretId)
+			return nil
+		}
+	}
+	return errors.New("no ACCOUNT version stage associated")
+}
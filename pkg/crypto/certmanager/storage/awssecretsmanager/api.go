@@ -1,11 +1,15 @@
 /*
-Package awssecretsmanager implements the Locker and Storer interfaces using
-AWS Secrets Manager.
+Package awssecretsmanager implements the Locker, Storer, AccountStorer and
+OCSPStorer interfaces using AWS Secrets Manager.
+
+The ACME account and OCSP response are stored in the same secret, in versions
+labelled with the ACCOUNT and OCSP version stages, respectively.
 */
 
 package awssecretsmanager
 
 import (
+	"context"
 	"sync"
 
 	"github.com/aws/aws-sdk-go/service/secretsmanager"
@@ -22,6 +26,13 @@ type LockingStorer struct {
 	lockVersion *string
 }
 
+// Interface checks.
+var _ certmanager.AccountStorer = (*LockingStorer)(nil)
+var _ certmanager.ContextLocker = (*LockingStorer)(nil)
+var _ certmanager.Locker = (*LockingStorer)(nil)
+var _ certmanager.OCSPStorer = (*LockingStorer)(nil)
+var _ certmanager.Storer = (*LockingStorer)(nil)
+
 func New(secretId string, logger log.DebugLogger) (*LockingStorer, error) {
 	return newLS(secretId, logger)
 }
@@ -31,13 +42,25 @@ func (ls *LockingStorer) GetLostChannel() <-chan error {
 }
 
 func (ls *LockingStorer) Lock() error {
-	return ls.lock()
+	return ls.lock(context.Background())
+}
+
+func (ls *LockingStorer) LockWithContext(ctx context.Context) error {
+	return ls.lock(ctx)
 }
 
 func (ls *LockingStorer) Read() (*certmanager.Certificate, error) {
 	return ls.read()
 }
 
+func (ls *LockingStorer) ReadAccount() (*certmanager.Account, error) {
+	return ls.readAccount()
+}
+
+func (ls *LockingStorer) ReadOCSP() ([]byte, error) {
+	return ls.readOCSP()
+}
+
 func (ls *LockingStorer) Unlock() error {
 	return ls.unlock()
 }
@@ -45,3 +68,11 @@ func (ls *LockingStorer) Unlock() error {
 func (ls *LockingStorer) Write(cert *certmanager.Certificate) error {
 	return ls.write(cert)
 }
+
+func (ls *LockingStorer) WriteAccount(account *certmanager.Account) error {
+	return ls.writeAccount(account)
+}
+
+func (ls *LockingStorer) WriteOCSP(response []byte) error {
+	return ls.writeOCSP(response)
+}
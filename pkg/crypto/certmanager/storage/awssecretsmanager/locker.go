@@ -1,6 +1,7 @@
 package awssecretsmanager
 
 import (
+	"context"
 	"crypto/rand"
 	"fmt"
 	"strconv"
@@ -10,11 +11,20 @@ import (
 	"github.com/aws/aws-sdk-go/service/secretsmanager"
 )
 
-func sleep() {
+// sleep will sleep for a while. If ctx is done first, the context error is
+// returned.
+func sleep(ctx context.Context) error {
 	randByte := make([]byte, 1)
 	rand.Read(randByte)
-	time.Sleep(time.Second*15 + time.Millisecond*10*time.Duration(randByte[0]))
-
+	timer := time.NewTimer(
+		time.Second*15 + time.Millisecond*10*time.Duration(randByte[0]))
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		timer.Stop()
+		return ctx.Err()
+	}
 }
 
 // This must be called with the lock held.
@@ -57,7 +67,7 @@ func (ls *LockingStorer) breakLock() error {
 	return nil
 }
 
-func (ls *LockingStorer) lock() error {
+func (ls *LockingStorer) lock(ctx context.Context) error {
 	ls.mutex.Lock()
 	defer ls.mutex.Unlock()
 	if ls.lockVersion != nil {
@@ -88,23 +98,31 @@ func (ls *LockingStorer) lock() error {
 		ls.logger.Debugf(0,
 			"error grabbing lock for SecretId: %s, waiting: %s\n",
 			ls.secretId, err)
-		sleep()
+		if err := sleep(ctx); err != nil {
+			ls.removeDummyLabel(putOutput.VersionId)
+			return err
+		}
 		if err := ls.breakLock(); err != nil {
 			ls.logger.Println(err)
 		}
 	}
-	updateInput = secretsmanager.UpdateSecretVersionStageInput{
-		RemoveFromVersionId: putOutput.VersionId,
+	ls.removeDummyLabel(putOutput.VersionId)
+	ls.logger.Printf("locked AWS Secrets Manager, SecretId: %s\n", ls.secretId)
+	return nil
+}
+
+// removeDummyLabel will remove the DUMMY label from the lock version.
+func (ls *LockingStorer) removeDummyLabel(versionId *string) {
+	updateInput := secretsmanager.UpdateSecretVersionStageInput{
+		RemoveFromVersionId: versionId,
 		SecretId:            aws.String(ls.secretId),
 		VersionStage:        aws.String("DUMMY"),
 	}
-	_, err = ls.awsService.UpdateSecretVersionStage(&updateInput)
+	_, err := ls.awsService.UpdateSecretVersionStage(&updateInput)
 	if err != nil {
 		ls.logger.Printf("unable to remove DUMMY label for SecretId: %s\n",
 			ls.secretId)
 	}
-	ls.logger.Printf("locked AWS Secrets Manager, SecretId: %s\n", ls.secretId)
-	return nil
 }
 
 func (ls *LockingStorer) unlock() error {
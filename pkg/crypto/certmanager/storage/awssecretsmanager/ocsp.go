@@ -0,0 +1,53 @@
+package awssecretsmanager
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/secretsmanager"
+)
+
+const ocspVersionStage = "OCSP"
+
+func (ls *LockingStorer) readOCSP() ([]byte, error) {
+	input := secretsmanager.GetSecretValueInput{
+		SecretId:     aws.String(ls.secretId),
+		VersionStage: aws.String(ocspVersionStage),
+	}
+	output, err := ls.awsService.GetSecretValue(&input)
+	if err != nil {
+		return nil,
+			fmt.Errorf("error calling secretsmanager:GetSecretValue: %s", err)
+	}
+	if len(output.SecretBinary) < 1 {
+		return nil, fmt.Errorf("no SecretBinary in SecretId: %s label: %s",
+			ls.secretId, ocspVersionStage)
+	}
+	ls.logger.Debugf(0,
+		"read OCSP response from AWS Secrets Manager, SecretId: %s\n",
+		ls.secretId)
+	return output.SecretBinary, nil
+}
+
+func (ls *LockingStorer) writeOCSP(response []byte) error {
+	input := secretsmanager.PutSecretValueInput{
+		SecretBinary:  response,
+		SecretId:      aws.String(ls.secretId),
+		VersionStages: aws.StringSlice([]string{ocspVersionStage}),
+	}
+	output, err := ls.awsService.PutSecretValue(&input)
+	if err != nil {
+		return fmt.Errorf("error calling secretsmanager:PutSecretValue: %s",
+			err)
+	}
+	for _, versionStage := range output.VersionStages {
+		if *versionStage == ocspVersionStage {
+			ls.logger.Debugf(0,
+				"wrote OCSP response to AWS Secrets Manager, SecretId: %s\n",
+				ls.secretId)
+			return nil
+		}
+	}
+	return errors.New("no OCSP version stage associated")
+}
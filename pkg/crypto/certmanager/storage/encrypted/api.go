@@ -0,0 +1,94 @@
+/*
+Package encrypted implements a Storer which wraps another Storer and encrypts
+private keys before they are written to the remote store.
+
+Envelope encryption is used: each private key is encrypted with a new random
+data key using AES-256-GCM, and the data key is encrypted with a
+key-encryption key (KEK) provided by a KeyProvider. The KeyProvider may use a
+local key file or a key management service. The encrypted key is stored in
+place of the PEM private key, in a PEM block with the type
+"CERTMANAGER-ENCRYPTED PRIVATE KEY", so that the wrapped Storer does not need
+to know about the encryption.
+
+Key-encryption key rotation is supported: new private keys are always encrypted
+with the current KEK, and private keys encrypted with older KEKs can be
+decrypted as long as the KeyProvider still has those KEKs. The Rewrap function
+may be used to re-encrypt the stored private keys with the current KEK, after
+which older KEKs may be retired. Private keys which were stored without
+encryption are passed through on read, and are encrypted by Rewrap.
+
+If the wrapped Storer also implements the AccountStorer interface, the ACME
+account key is also encrypted. The AccountDeleter and OCSPStorer interfaces
+and the ChallengeStorer interface of the http package are passed through.
+*/
+package encrypted
+
+import (
+	"github.com/Cloud-Foundations/golib/pkg/crypto/certmanager"
+	"github.com/Cloud-Foundations/golib/pkg/log"
+)
+
+// DataKey contains a data key, in plaintext and encrypted form.
+type DataKey struct {
+	EncryptedKey []byte // The data key encrypted with the KEK.
+	KeyId        string // The identifier of the KEK.
+	Plaintext    []byte // The data key (32 bytes for AES-256).
+}
+
+// KeyProvider is the interface to a source of key-encryption keys (KEKs).
+type KeyProvider interface {
+	// DecryptDataKey will decrypt a data key which was encrypted with the KEK
+	// identified by keyId.
+	DecryptDataKey(keyId string, encryptedKey []byte) ([]byte, error)
+
+	// GenerateDataKey will generate a new 256 bit data key, encrypted with the
+	// current KEK.
+	GenerateDataKey() (*DataKey, error)
+}
+
+// KeyfileProvider implements the KeyProvider interface using KEKs read from a
+// local file.
+type KeyfileProvider struct {
+	currentKeyId string
+	keys         map[string][]byte
+}
+
+var _ KeyProvider = (*KeyfileProvider)(nil)
+
+// New will create a Storer which wraps storer, encrypting private keys using
+// data keys from keyProvider. The returned Storer implements the AccountStorer
+// (and AccountDeleter), OCSPStorer and cm_http.ChallengeStorer interfaces if
+// storer does.
+func New(storer certmanager.Storer, keyProvider KeyProvider,
+	logger log.DebugLogger) (certmanager.Storer, error) {
+	return newStorer(storer, keyProvider, logger)
+}
+
+// NewKeyfileProvider will create a *KeyfileProvider, reading KEKs from the
+// specified file. Each line of the file contains a key identifier and a
+// Base64-encoded 256 bit key, separated by whitespace. Empty lines and lines
+// starting with '#' are ignored. The first key is the current KEK, which is
+// used to encrypt new data keys. The remaining keys are used to decrypt data
+// keys which were encrypted with older KEKs. To rotate the KEK, add a new key
+// at the start of the file.
+func NewKeyfileProvider(filename string) (*KeyfileProvider, error) {
+	return newKeyfileProvider(filename)
+}
+
+// Rewrap will read the certificate (and ACME account, if supported) from
+// storer, re-encrypt the private keys with the current KEK and write them back
+// to storer. Unencrypted private keys are encrypted. The caller should hold
+// the lock for storer.
+func Rewrap(storer certmanager.Storer, keyProvider KeyProvider,
+	logger log.DebugLogger) error {
+	return rewrap(storer, keyProvider, logger)
+}
+
+func (p *KeyfileProvider) DecryptDataKey(keyId string,
+	encryptedKey []byte) ([]byte, error) {
+	return p.decryptDataKey(keyId, encryptedKey)
+}
+
+func (p *KeyfileProvider) GenerateDataKey() (*DataKey, error) {
+	return p.generateDataKey()
+}
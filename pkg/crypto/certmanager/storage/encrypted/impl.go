@@ -0,0 +1,425 @@
+package encrypted
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+
+	"github.com/Cloud-Foundations/golib/pkg/crypto/certmanager"
+	cm_http "github.com/Cloud-Foundations/golib/pkg/crypto/certmanager/http"
+	"github.com/Cloud-Foundations/golib/pkg/log"
+)
+
+const (
+	envelopeVersion = 1
+	pemBlockType    = "CERTMANAGER-ENCRYPTED PRIVATE KEY"
+)
+
+// accountMethods implements the certmanager.AccountStorer and
+// certmanager.AccountDeleter interfaces.
+type accountMethods struct {
+	*storer
+}
+
+type accountChallengeStorer struct {
+	*storer
+	accountMethods
+	challengeMethods
+}
+
+type accountOCSPChallengeStorer struct {
+	*storer
+	accountMethods
+	challengeMethods
+	ocspMethods
+}
+
+type accountOCSPStorer struct {
+	*storer
+	accountMethods
+	ocspMethods
+}
+
+type accountStorer struct {
+	*storer
+	accountMethods
+}
+
+// challengeMethods implements the cm_http.ChallengeStorer interface. Challenge
+// responses are not secret, so they are passed through.
+type challengeMethods struct {
+	*storer
+}
+
+type challengeStorer struct {
+	*storer
+	challengeMethods
+}
+
+// envelope contains an encrypted private key (in PEM format) and the
+// encrypted data key which was used to encrypt it.
+type envelope struct {
+	Ciphertext   []byte
+	EncryptedKey []byte
+	KeyId        string
+	Nonce        []byte
+	Version      int
+}
+
+type ocspChallengeStorer struct {
+	*storer
+	challengeMethods
+	ocspMethods
+}
+
+// ocspMethods implements the certmanager.OCSPStorer interface. OCSP responses
+// are not secret, so they are passed through.
+type ocspMethods struct {
+	*storer
+}
+
+type ocspStorer struct {
+	*storer
+	ocspMethods
+}
+
+type storer struct {
+	keyProvider KeyProvider
+	logger      log.DebugLogger
+	storer      certmanager.Storer
+}
+
+var _ certmanager.AccountDeleter = (*accountChallengeStorer)(nil)
+var _ certmanager.AccountDeleter = (*accountOCSPChallengeStorer)(nil)
+var _ certmanager.AccountDeleter = (*accountOCSPStorer)(nil)
+var _ certmanager.AccountDeleter = (*accountStorer)(nil)
+var _ certmanager.AccountStorer = (*accountChallengeStorer)(nil)
+var _ certmanager.AccountStorer = (*accountOCSPChallengeStorer)(nil)
+var _ certmanager.AccountStorer = (*accountOCSPStorer)(nil)
+var _ certmanager.AccountStorer = (*accountStorer)(nil)
+var _ certmanager.OCSPStorer = (*accountOCSPChallengeStorer)(nil)
+var _ certmanager.OCSPStorer = (*accountOCSPStorer)(nil)
+var _ certmanager.OCSPStorer = (*ocspChallengeStorer)(nil)
+var _ certmanager.OCSPStorer = (*ocspStorer)(nil)
+var _ cm_http.ChallengeStorer = (*accountChallengeStorer)(nil)
+var _ cm_http.ChallengeStorer = (*accountOCSPChallengeStorer)(nil)
+var _ cm_http.ChallengeStorer = (*challengeStorer)(nil)
+var _ cm_http.ChallengeStorer = (*ocspChallengeStorer)(nil)
+
+// decrypt will decrypt ciphertext using AES-256-GCM.
+func decrypt(key, nonce, ciphertext, additionalData []byte) ([]byte, error) {
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(nonce) != aead.NonceSize() {
+		return nil, fmt.Errorf("bad nonce length: %d", len(nonce))
+	}
+	return aead.Open(nil, nonce, ciphertext, additionalData)
+}
+
+// decryptKey will decrypt an encrypted PEM private key. If the private key is
+// not encrypted, it is returned unchanged. The identifier of the KEK is
+// returned, which is empty if the private key was not encrypted.
+func decryptKey(keyProvider KeyProvider, keyPemBlock []byte) (
+	[]byte, string, error) {
+	block, _ := pem.Decode(keyPemBlock)
+	if block == nil {
+		return nil, "", errors.New("unable to decode PEM private key")
+	}
+	if block.Type != pemBlockType {
+		return keyPemBlock, "", nil
+	}
+	var env envelope
+	if err := json.Unmarshal(block.Bytes, &env); err != nil {
+		return nil, "", fmt.Errorf("error decoding envelope: %s", err)
+	}
+	if env.Version != envelopeVersion {
+		return nil, "", fmt.Errorf("unsupported envelope version: %d",
+			env.Version)
+	}
+	dataKey, err := keyProvider.DecryptDataKey(env.KeyId, env.EncryptedKey)
+	if err != nil {
+		return nil, "", fmt.Errorf("error decrypting data key: %s", err)
+	}
+	plaintext, err := decrypt(dataKey, env.Nonce, env.Ciphertext,
+		[]byte(pemBlockType))
+	if err != nil {
+		return nil, "", fmt.Errorf("error decrypting private key: %s", err)
+	}
+	return plaintext, env.KeyId, nil
+}
+
+// encrypt will encrypt plaintext using AES-256-GCM, returning the nonce and
+// the ciphertext.
+func encrypt(key, plaintext, additionalData []byte) ([]byte, []byte, error) {
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, nil, err
+	}
+	return nonce, aead.Seal(nil, nonce, plaintext, additionalData), nil
+}
+
+// encryptKey will encrypt a PEM private key with a new data key, returning
+// the encrypted private key in PEM format.
+func encryptKey(keyProvider KeyProvider, keyPemBlock []byte) ([]byte, error) {
+	if block, _ := pem.Decode(keyPemBlock); block == nil {
+		return nil, errors.New("unable to decode PEM private key")
+	} else if block.Type == pemBlockType {
+		return nil, errors.New("private key already encrypted")
+	}
+	dataKey, err := keyProvider.GenerateDataKey()
+	if err != nil {
+		return nil, fmt.Errorf("error generating data key: %s", err)
+	}
+	nonce, ciphertext, err := encrypt(dataKey.Plaintext, keyPemBlock,
+		[]byte(pemBlockType))
+	if err != nil {
+		return nil, err
+	}
+	data, err := json.Marshal(envelope{
+		Ciphertext:   ciphertext,
+		EncryptedKey: dataKey.EncryptedKey,
+		KeyId:        dataKey.KeyId,
+		Nonce:        nonce,
+		Version:      envelopeVersion,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: pemBlockType, Bytes: data}),
+		nil
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	if len(key) != 32 {
+		return nil, fmt.Errorf("bad key length: %d", len(key))
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func newStorer(inner certmanager.Storer, keyProvider KeyProvider,
+	logger log.DebugLogger) (certmanager.Storer, error) {
+	if inner == nil {
+		return nil, errors.New("no Storer specified")
+	}
+	if keyProvider == nil {
+		return nil, errors.New("no KeyProvider specified")
+	}
+	s := &storer{keyProvider: keyProvider, logger: logger, storer: inner}
+	_, isAccountStorer := inner.(certmanager.AccountStorer)
+	_, isChallengeStorer := inner.(cm_http.ChallengeStorer)
+	_, isOCSPStorer := inner.(certmanager.OCSPStorer)
+	account := accountMethods{s}
+	challenge := challengeMethods{s}
+	ocsp := ocspMethods{s}
+	switch {
+	case isAccountStorer && isOCSPStorer && isChallengeStorer:
+		return &accountOCSPChallengeStorer{s, account, challenge, ocsp}, nil
+	case isAccountStorer && isOCSPStorer:
+		return &accountOCSPStorer{s, account, ocsp}, nil
+	case isAccountStorer && isChallengeStorer:
+		return &accountChallengeStorer{s, account, challenge}, nil
+	case isAccountStorer:
+		return &accountStorer{s, account}, nil
+	case isOCSPStorer && isChallengeStorer:
+		return &ocspChallengeStorer{s, challenge, ocsp}, nil
+	case isOCSPStorer:
+		return &ocspStorer{s, ocsp}, nil
+	case isChallengeStorer:
+		return &challengeStorer{s, challenge}, nil
+	default:
+		return s, nil
+	}
+}
+
+func rewrap(inner certmanager.Storer, keyProvider KeyProvider,
+	logger log.DebugLogger) error {
+	cert, err := inner.Read()
+	if err != nil {
+		return err
+	}
+	keyPemBlock, keyId, err := decryptKey(keyProvider, cert.KeyPemBlock)
+	if err != nil {
+		return err
+	}
+	if keyPemBlock, err = encryptKey(keyProvider, keyPemBlock); err != nil {
+		return err
+	}
+	err = inner.Write(&certmanager.Certificate{
+		CertPemBlock: cert.CertPemBlock,
+		KeyPemBlock:  keyPemBlock,
+		Issuer:       cert.Issuer,
+		KeyUses:      cert.KeyUses,
+	})
+	if err != nil {
+		return err
+	}
+	logger.Printf("re-encrypted certificate private key (was KEK: %q)\n",
+		keyId)
+	accountStorer, ok := inner.(certmanager.AccountStorer)
+	if !ok {
+		return nil
+	}
+	account, err := accountStorer.ReadAccount()
+	if err != nil {
+		logger.Printf("not re-encrypting ACME account: %s\n", err)
+		return nil
+	}
+	keyPemBlock, keyId, err = decryptKey(keyProvider, account.KeyPemBlock)
+	if err != nil {
+		return err
+	}
+	if keyPemBlock, err = encryptKey(keyProvider, keyPemBlock); err != nil {
+		return err
+	}
+	err = accountStorer.WriteAccount(&certmanager.Account{
+		KeyPemBlock: keyPemBlock,
+		URL:         account.URL,
+	})
+	if err != nil {
+		return err
+	}
+	logger.Printf("re-encrypted ACME account private key (was KEK: %q)\n",
+		keyId)
+	return nil
+}
+
+func (s *storer) Read() (*certmanager.Certificate, error) {
+	cert, err := s.storer.Read()
+	if err != nil {
+		return nil, err
+	}
+	keyPemBlock, keyId, err := decryptKey(s.keyProvider, cert.KeyPemBlock)
+	if err != nil {
+		return nil, err
+	}
+	if keyId == "" {
+		s.logger.Println("read unencrypted certificate private key")
+	} else {
+		s.logger.Debugf(1, "decrypted certificate private key with KEK: %s\n",
+			keyId)
+	}
+	return &certmanager.Certificate{
+		CertPemBlock: cert.CertPemBlock,
+		KeyPemBlock:  keyPemBlock,
+		Issuer:       cert.Issuer,
+		KeyUses:      cert.KeyUses,
+	}, nil
+}
+
+func (s *storer) Write(cert *certmanager.Certificate) error {
+	keyPemBlock, err := encryptKey(s.keyProvider, cert.KeyPemBlock)
+	if err != nil {
+		return err
+	}
+	return s.storer.Write(&certmanager.Certificate{
+		CertPemBlock: cert.CertPemBlock,
+		KeyPemBlock:  keyPemBlock,
+		Issuer:       cert.Issuer,
+		KeyUses:      cert.KeyUses,
+	})
+}
+
+// deleteAccount will delete the ACME account if the wrapped Storer supports
+// it, otherwise the account is left in place.
+func (s *storer) deleteAccount() error {
+	deleter, ok := s.storer.(certmanager.AccountDeleter)
+	if !ok {
+		s.logger.Println(
+			"wrapped storer cannot delete the ACME account, it will be replaced")
+		return nil
+	}
+	return deleter.DeleteAccount()
+}
+
+func (s *storer) deleteChallengeResponse(token string) error {
+	return s.storer.(cm_http.ChallengeStorer).DeleteChallengeResponse(token)
+}
+
+func (s *storer) readAccount() (*certmanager.Account, error) {
+	account, err := s.storer.(certmanager.AccountStorer).ReadAccount()
+	if err != nil {
+		return nil, err
+	}
+	keyPemBlock, keyId, err := decryptKey(s.keyProvider, account.KeyPemBlock)
+	if err != nil {
+		return nil, err
+	}
+	if keyId == "" {
+		s.logger.Println("read unencrypted ACME account private key")
+	}
+	return &certmanager.Account{KeyPemBlock: keyPemBlock, URL: account.URL},
+		nil
+}
+
+func (s *storer) readChallengeResponse(token string) (string, error) {
+	return s.storer.(cm_http.ChallengeStorer).ReadChallengeResponse(token)
+}
+
+func (s *storer) readOCSP() ([]byte, error) {
+	return s.storer.(certmanager.OCSPStorer).ReadOCSP()
+}
+
+func (s *storer) writeAccount(account *certmanager.Account) error {
+	keyPemBlock, err := encryptKey(s.keyProvider, account.KeyPemBlock)
+	if err != nil {
+		return err
+	}
+	return s.storer.(certmanager.AccountStorer).WriteAccount(
+		&certmanager.Account{KeyPemBlock: keyPemBlock, URL: account.URL})
+}
+
+func (s *storer) writeChallengeResponse(token, response string) error {
+	return s.storer.(cm_http.ChallengeStorer).WriteChallengeResponse(token,
+		response)
+}
+
+func (s *storer) writeOCSP(response []byte) error {
+	return s.storer.(certmanager.OCSPStorer).WriteOCSP(response)
+}
+
+func (s accountMethods) DeleteAccount() error {
+	return s.deleteAccount()
+}
+
+func (s accountMethods) ReadAccount() (*certmanager.Account, error) {
+	return s.readAccount()
+}
+
+func (s accountMethods) WriteAccount(account *certmanager.Account) error {
+	return s.writeAccount(account)
+}
+
+func (s challengeMethods) DeleteChallengeResponse(token string) error {
+	return s.deleteChallengeResponse(token)
+}
+
+func (s challengeMethods) ReadChallengeResponse(token string) (string, error) {
+	return s.readChallengeResponse(token)
+}
+
+func (s challengeMethods) WriteChallengeResponse(token,
+	response string) error {
+	return s.writeChallengeResponse(token, response)
+}
+
+func (s ocspMethods) ReadOCSP() ([]byte, error) {
+	return s.readOCSP()
+}
+
+func (s ocspMethods) WriteOCSP(response []byte) error {
+	return s.writeOCSP(response)
+}
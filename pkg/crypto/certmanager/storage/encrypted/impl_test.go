@@ -0,0 +1,272 @@
+package encrypted
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Cloud-Foundations/golib/pkg/crypto/certmanager"
+	cm_http "github.com/Cloud-Foundations/golib/pkg/crypto/certmanager/http"
+	"github.com/Cloud-Foundations/golib/pkg/crypto/certmanager/storage/filesystem"
+	"github.com/Cloud-Foundations/golib/pkg/log/testlogger"
+)
+
+type testStorer struct {
+	cert *certmanager.Certificate
+}
+
+func makeKeyfile(t *testing.T, keyIds ...string) string {
+	var lines []string
+	lines = append(lines, "# Test KEKs.")
+	for _, keyId := range keyIds {
+		key := make([]byte, 32)
+		copy(key, keyId) // Deterministic, so that keys match across files.
+		lines = append(lines, fmt.Sprintf("%s %s",
+			keyId, base64.StdEncoding.EncodeToString(key)))
+	}
+	filename := filepath.Join(t.TempDir(), "keys")
+	err := ioutil.WriteFile(filename, []byte(strings.Join(lines, "\n")), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return filename
+}
+
+func makeKeyProvider(t *testing.T, keyIds ...string) KeyProvider {
+	keyProvider, err := NewKeyfileProvider(makeKeyfile(t, keyIds...))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return keyProvider
+}
+
+func makeTestCert(t *testing.T) *certmanager.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		DNSNames:     []string{"www.example.com"},
+		NotAfter:     time.Now().Add(time.Hour),
+		NotBefore:    time.Now().Add(-time.Hour),
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "www.example.com"},
+	}
+	certDER, err := x509.CreateCertificate(rand.Reader, template, template,
+		key.Public(), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &certmanager.Certificate{
+		CertPemBlock: pem.EncodeToMemory(
+			&pem.Block{Type: "CERTIFICATE", Bytes: certDER}),
+		KeyPemBlock: pem.EncodeToMemory(
+			&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}),
+		Issuer:  "https://ca.example.com/directory",
+		KeyUses: 2,
+	}
+}
+
+func makeTestStorer(t *testing.T) *filesystem.LockingStorer {
+	ls, err := filesystem.New(t.TempDir(), testlogger.New(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ls
+}
+
+func readKeyType(t *testing.T, storer certmanager.Storer) string {
+	cert, err := storer.Read()
+	if err != nil {
+		t.Fatal(err)
+	}
+	block, _ := pem.Decode(cert.KeyPemBlock)
+	if block == nil {
+		t.Fatal("unable to decode PEM private key")
+	}
+	return block.Type
+}
+
+func (s *testStorer) Read() (*certmanager.Certificate, error) {
+	return s.cert, nil
+}
+
+func (s *testStorer) Write(cert *certmanager.Certificate) error {
+	s.cert = cert
+	return nil
+}
+
+func TestEncryptDecrypt(t *testing.T) {
+	logger := testlogger.New(t)
+	inner := makeTestStorer(t)
+	storer, err := New(inner, makeKeyProvider(t, "kek1"), logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert := makeTestCert(t)
+	if err := storer.Write(cert); err != nil {
+		t.Fatal(err)
+	}
+	if keyType := readKeyType(t, inner); keyType != pemBlockType {
+		t.Fatalf("stored key type: %s", keyType)
+	}
+	readCert, err := storer.Read()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(readCert.KeyPemBlock) != string(cert.KeyPemBlock) {
+		t.Fatal("private key mismatch")
+	}
+	if string(readCert.CertPemBlock) != string(cert.CertPemBlock) {
+		t.Fatal("certificate mismatch")
+	}
+	if readCert.Issuer != cert.Issuer || readCert.KeyUses != cert.KeyUses {
+		t.Fatalf("issuer: %s != %s or key uses: %d != %d",
+			readCert.Issuer, cert.Issuer, readCert.KeyUses, cert.KeyUses)
+	}
+	accountStorer, ok := storer.(certmanager.AccountStorer)
+	if !ok {
+		t.Fatal("AccountStorer not implemented")
+	}
+	if _, ok := storer.(certmanager.OCSPStorer); !ok {
+		t.Fatal("OCSPStorer not implemented")
+	}
+	account := &certmanager.Account{
+		KeyPemBlock: cert.KeyPemBlock,
+		URL:         "https://ca.example.com/acct/1",
+	}
+	if err := accountStorer.WriteAccount(account); err != nil {
+		t.Fatal(err)
+	}
+	if rawAccount, err := inner.ReadAccount(); err != nil {
+		t.Fatal(err)
+	} else if string(rawAccount.KeyPemBlock) == string(account.KeyPemBlock) {
+		t.Fatal("account key stored in plaintext")
+	}
+	if readAccount, err := accountStorer.ReadAccount(); err != nil {
+		t.Fatal(err)
+	} else if string(readAccount.KeyPemBlock) != string(account.KeyPemBlock) {
+		t.Fatal("account key mismatch")
+	}
+	// A different KEK must not decrypt the private key.
+	storer, err = New(inner, makeKeyProvider(t, "other"), logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := storer.Read(); err == nil {
+		t.Fatal("no error decrypting with unknown KEK")
+	}
+}
+
+func TestOptionalInterfaces(t *testing.T) {
+	storer, err := New(&testStorer{}, makeKeyProvider(t, "kek1"),
+		testlogger.New(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := storer.(certmanager.AccountStorer); ok {
+		t.Fatal("AccountStorer implemented")
+	}
+	if _, ok := storer.(certmanager.OCSPStorer); ok {
+		t.Fatal("OCSPStorer implemented")
+	}
+	if _, ok := storer.(cm_http.ChallengeStorer); ok {
+		t.Fatal("ChallengeStorer implemented")
+	}
+	storer, err = New(makeTestStorer(t), makeKeyProvider(t, "kek1"),
+		testlogger.New(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := storer.(certmanager.AccountDeleter); !ok {
+		t.Fatal("AccountDeleter not implemented")
+	}
+	if _, ok := storer.(certmanager.OCSPStorer); !ok {
+		t.Fatal("OCSPStorer not implemented")
+	}
+	challengeStorer, ok := storer.(cm_http.ChallengeStorer)
+	if !ok {
+		t.Fatal("ChallengeStorer not implemented")
+	}
+	if err := challengeStorer.WriteChallengeResponse("token",
+		"token.thumbprint"); err != nil {
+		t.Fatal(err)
+	}
+	response, err := challengeStorer.ReadChallengeResponse("token")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if response != "token.thumbprint" {
+		t.Errorf("challenge response: %s != token.thumbprint", response)
+	}
+}
+
+func TestRotation(t *testing.T) {
+	logger := testlogger.New(t)
+	inner := makeTestStorer(t)
+	cert := makeTestCert(t)
+	// Unencrypted private keys are passed through.
+	if err := inner.Write(cert); err != nil {
+		t.Fatal(err)
+	}
+	oldKeyProvider := makeKeyProvider(t, "kek1")
+	storer, err := New(inner, oldKeyProvider, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if readCert, err := storer.Read(); err != nil {
+		t.Fatal(err)
+	} else if string(readCert.KeyPemBlock) != string(cert.KeyPemBlock) {
+		t.Fatal("private key mismatch")
+	}
+	if err := Rewrap(inner, oldKeyProvider, logger); err != nil {
+		t.Fatal(err)
+	}
+	if keyType := readKeyType(t, inner); keyType != pemBlockType {
+		t.Fatalf("stored key type: %s", keyType)
+	}
+	// Rotate: the new KEK is first, the old KEK is still available.
+	rotatedKeyProvider := makeKeyProvider(t, "kek2", "kek1")
+	storer, err = New(inner, rotatedKeyProvider, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := storer.Read(); err != nil {
+		t.Fatal(err)
+	}
+	if err := Rewrap(inner, rotatedKeyProvider, logger); err != nil {
+		t.Fatal(err)
+	}
+	// The old KEK may now be retired.
+	storer, err = New(inner, makeKeyProvider(t, "kek2"), logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if readCert, err := storer.Read(); err != nil {
+		t.Fatal(err)
+	} else if string(readCert.KeyPemBlock) != string(cert.KeyPemBlock) {
+		t.Fatal("private key mismatch")
+	}
+	storer, err = New(inner, oldKeyProvider, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := storer.Read(); err == nil {
+		t.Fatal("no error decrypting with retired KEK")
+	}
+}
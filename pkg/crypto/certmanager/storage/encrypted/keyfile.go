@@ -0,0 +1,86 @@
+package encrypted
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+)
+
+func newKeyfileProvider(filename string) (*KeyfileProvider, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	p := &KeyfileProvider{keys: make(map[string][]byte)}
+	scanner := bufio.NewScanner(file)
+	for lineNumber := 1; scanner.Scan(); lineNumber++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("%s:%d: expected key ID and key",
+				filename, lineNumber)
+		}
+		key, err := base64.StdEncoding.DecodeString(fields[1])
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %s", filename, lineNumber, err)
+		}
+		if len(key) != 32 {
+			return nil, fmt.Errorf("%s:%d: key length: %d != 32",
+				filename, lineNumber, len(key))
+		}
+		if _, ok := p.keys[fields[0]]; ok {
+			return nil, fmt.Errorf("%s:%d: duplicate key ID: %s",
+				filename, lineNumber, fields[0])
+		}
+		p.keys[fields[0]] = key
+		if p.currentKeyId == "" {
+			p.currentKeyId = fields[0]
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if p.currentKeyId == "" {
+		return nil, fmt.Errorf("no keys in: %s", filename)
+	}
+	return p, nil
+}
+
+func (p *KeyfileProvider) decryptDataKey(keyId string,
+	encryptedKey []byte) ([]byte, error) {
+	kek, ok := p.keys[keyId]
+	if !ok {
+		return nil, fmt.Errorf("unknown KEK: %s", keyId)
+	}
+	if len(encryptedKey) < 12 {
+		return nil, errors.New("encrypted data key too short")
+	}
+	return decrypt(kek, encryptedKey[:12], encryptedKey[12:], []byte(keyId))
+}
+
+// generateDataKey will generate a new data key and encrypt it with the
+// current KEK. The encrypted data key is the nonce followed by the ciphertext.
+func (p *KeyfileProvider) generateDataKey() (*DataKey, error) {
+	plaintext := make([]byte, 32)
+	if _, err := rand.Read(plaintext); err != nil {
+		return nil, err
+	}
+	nonce, ciphertext, err := encrypt(p.keys[p.currentKeyId], plaintext,
+		[]byte(p.currentKeyId))
+	if err != nil {
+		return nil, err
+	}
+	return &DataKey{
+		EncryptedKey: append(nonce, ciphertext...),
+		KeyId:        p.currentKeyId,
+		Plaintext:    plaintext,
+	}, nil
+}
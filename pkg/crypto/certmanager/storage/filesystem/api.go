@@ -0,0 +1,134 @@
+/*
+Package filesystem implements the Locker, Storer, AccountStorer,
+AccountDeleter and OCSPStorer interfaces using a directory, which may be on a
+shared filesystem (such as NFS or EFS) or on a single host running multiple
+processes. The ChallengeStorer interface of the http package is also
+implemented, so that http-01 challenge responses may be shared.
+
+The certificate and ACME account are stored in the format used by the encoding
+package, in the "certificate" and "account" files, respectively. The
+DER-encoded OCSP response is stored in the "ocsp" file. Challenge responses
+are stored in the "challenges" directory, in files named after the tokens.
+Files are written atomically by writing a temporary file and renaming it.
+
+Locking uses a lease which is recorded in the "lease" file. The lease file is
+updated while holding an exclusive flock(2) (LockFileEx on Windows) on the
+"lock" file. The lease is extended periodically while the lock is held. If the
+lease expires (for example, if the process was suspended), another instance may
+take the lock and a notification is sent to the channel returned by
+GetLostChannel.
+*/
+package filesystem
+
+import (
+	"context"
+	"time"
+
+	"github.com/Cloud-Foundations/golib/pkg/crypto/certmanager"
+	cm_http "github.com/Cloud-Foundations/golib/pkg/crypto/certmanager/http"
+	"github.com/Cloud-Foundations/golib/pkg/crypto/certmanager/storage/internal/leaselocker"
+	"github.com/Cloud-Foundations/golib/pkg/log"
+)
+
+// Config contains the configuration for a LockingStorer.
+type Config struct {
+	// Directory specifies where the files are stored. Required.
+	Directory string
+
+	// LeaseDuration specifies how long the lock lease is valid for before it
+	// must be extended. The default is 15 minutes.
+	LeaseDuration time.Duration
+
+	// PollInterval specifies how often to check if the lock is available when
+	// waiting for the lock. The default is 15 seconds.
+	PollInterval time.Duration
+}
+
+type LockingStorer struct {
+	directory     string
+	leaseDuration time.Duration
+	locker        *leaselocker.Locker
+	logger        log.DebugLogger
+}
+
+// Params contains the parameters for a LockingStorer.
+type Params struct {
+	Logger log.DebugLogger
+}
+
+// Interface checks.
+var _ certmanager.AccountDeleter = (*LockingStorer)(nil)
+var _ certmanager.AccountStorer = (*LockingStorer)(nil)
+var _ certmanager.ContextLocker = (*LockingStorer)(nil)
+var _ certmanager.Locker = (*LockingStorer)(nil)
+var _ certmanager.OCSPStorer = (*LockingStorer)(nil)
+var _ certmanager.Storer = (*LockingStorer)(nil)
+var _ cm_http.ChallengeStorer = (*LockingStorer)(nil)
+
+// New creates a *LockingStorer using the specified directory, which is created
+// if it does not exist.
+func New(directory string, logger log.DebugLogger) (*LockingStorer, error) {
+	return newLS(Config{Directory: directory}, Params{Logger: logger})
+}
+
+// NewWithConfig creates a *LockingStorer using the provided configuration.
+func NewWithConfig(config Config, params Params) (*LockingStorer, error) {
+	return newLS(config, params)
+}
+
+func (ls *LockingStorer) DeleteAccount() error {
+	return ls.deleteAccount()
+}
+
+func (ls *LockingStorer) DeleteChallengeResponse(token string) error {
+	return ls.deleteChallengeResponse(token)
+}
+
+func (ls *LockingStorer) GetLostChannel() <-chan error {
+	return ls.locker.GetLostChannel()
+}
+
+func (ls *LockingStorer) Lock() error {
+	return ls.locker.Lock()
+}
+
+func (ls *LockingStorer) LockWithContext(ctx context.Context) error {
+	return ls.locker.LockWithContext(ctx)
+}
+
+func (ls *LockingStorer) Read() (*certmanager.Certificate, error) {
+	return ls.read()
+}
+
+func (ls *LockingStorer) ReadAccount() (*certmanager.Account, error) {
+	return ls.readAccount()
+}
+
+func (ls *LockingStorer) ReadChallengeResponse(token string) (string, error) {
+	return ls.readChallengeResponse(token)
+}
+
+func (ls *LockingStorer) ReadOCSP() ([]byte, error) {
+	return ls.readOCSP()
+}
+
+func (ls *LockingStorer) Unlock() error {
+	return ls.locker.Unlock()
+}
+
+func (ls *LockingStorer) Write(cert *certmanager.Certificate) error {
+	return ls.write(cert)
+}
+
+func (ls *LockingStorer) WriteAccount(account *certmanager.Account) error {
+	return ls.writeAccount(account)
+}
+
+func (ls *LockingStorer) WriteChallengeResponse(token,
+	response string) error {
+	return ls.writeChallengeResponse(token, response)
+}
+
+func (ls *LockingStorer) WriteOCSP(response []byte) error {
+	return ls.writeOCSP(response)
+}
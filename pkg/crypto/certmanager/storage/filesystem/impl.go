@@ -0,0 +1,217 @@
+package filesystem
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/Cloud-Foundations/golib/pkg/crypto/certmanager"
+	"github.com/Cloud-Foundations/golib/pkg/crypto/certmanager/encoding"
+	"github.com/Cloud-Foundations/golib/pkg/crypto/certmanager/storage/internal/leaselocker"
+)
+
+const (
+	accountFilename    = "account"
+	certFilename       = "certificate"
+	challengeDirectory = "challenges"
+	ocspFilename       = "ocsp"
+
+	defaultLeaseDuration = time.Minute * 15
+	defaultPollInterval  = time.Second * 15
+)
+
+func newLS(config Config, params Params) (*LockingStorer, error) {
+	if config.Directory == "" {
+		return nil, errors.New("no directory specified")
+	}
+	if config.LeaseDuration <= 0 {
+		config.LeaseDuration = defaultLeaseDuration
+	}
+	if config.PollInterval <= 0 {
+		config.PollInterval = defaultPollInterval
+	}
+	if err := os.MkdirAll(config.Directory, 0700); err != nil {
+		return nil, err
+	}
+	ls := &LockingStorer{
+		directory:     config.Directory,
+		leaseDuration: config.LeaseDuration,
+		logger:        params.Logger,
+	}
+	locker, err := leaselocker.New(
+		leaselocker.Config{
+			LeaseDuration: config.LeaseDuration,
+			Name:          config.Directory,
+			PollInterval:  config.PollInterval,
+		},
+		leaselocker.Params{
+			Backend: leaseBackend{ls},
+			Logger:  params.Logger,
+		})
+	if err != nil {
+		return nil, err
+	}
+	ls.locker = locker
+	return ls, nil
+}
+
+// writeFile will atomically write data to a file, by writing to a temporary
+// file in the same directory and then renaming it.
+func writeFile(filename string, data []byte) error {
+	file, err := ioutil.TempFile(filepath.Dir(filename),
+		"."+filepath.Base(filename)+"~")
+	if err != nil {
+		return err
+	}
+	tmpFilename := file.Name()
+	defer os.Remove(tmpFilename)
+	if _, err := file.Write(data); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmpFilename, filename)
+}
+
+// challengePath returns the path of the file for the challenge token. Tokens
+// which could refer to a file outside the challenge directory are rejected.
+func (ls *LockingStorer) challengePath(token string) (string, error) {
+	if token == "" || token[0] == '.' || strings.ContainsAny(token, `/\`) {
+		return "", fmt.Errorf("invalid challenge token: %s", token)
+	}
+	return filepath.Join(ls.directory, challengeDirectory, token), nil
+}
+
+func (ls *LockingStorer) deleteAccount() error {
+	err := os.Remove(ls.path(accountFilename))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	ls.logger.Printf("deleted ACME account from: %s\n", ls.directory)
+	return nil
+}
+
+func (ls *LockingStorer) deleteChallengeResponse(token string) error {
+	filename, err := ls.challengePath(token)
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(filename); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	ls.logger.Debugf(0, "deleted challenge response from: %s\n",
+		ls.directory)
+	return nil
+}
+
+func (ls *LockingStorer) path(filename string) string {
+	return filepath.Join(ls.directory, filename)
+}
+
+func (ls *LockingStorer) read() (*certmanager.Certificate, error) {
+	data, err := ioutil.ReadFile(ls.path(certFilename))
+	if err != nil {
+		return nil, err
+	}
+	cert, err := encoding.DecodeCert(string(data))
+	if err != nil {
+		return nil, err
+	}
+	ls.logger.Printf("read certificate from: %s\n", ls.directory)
+	return cert, nil
+}
+
+func (ls *LockingStorer) readAccount() (*certmanager.Account, error) {
+	data, err := ioutil.ReadFile(ls.path(accountFilename))
+	if err != nil {
+		return nil, err
+	}
+	account, err := encoding.DecodeAccount(string(data))
+	if err != nil {
+		return nil, err
+	}
+	ls.logger.Printf("read ACME account from: %s\n", ls.directory)
+	return account, nil
+}
+
+func (ls *LockingStorer) readChallengeResponse(token string) (string, error) {
+	filename, err := ls.challengePath(token)
+	if err != nil {
+		return "", err
+	}
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return "", err
+	}
+	ls.logger.Debugf(1, "read challenge response from: %s\n", ls.directory)
+	return string(data), nil
+}
+
+func (ls *LockingStorer) readOCSP() ([]byte, error) {
+	data, err := ioutil.ReadFile(ls.path(ocspFilename))
+	if err != nil {
+		return nil, err
+	}
+	if len(data) < 1 {
+		return nil, fmt.Errorf("empty OCSP response in: %s", ls.directory)
+	}
+	ls.logger.Debugf(0, "read OCSP response from: %s\n", ls.directory)
+	return data, nil
+}
+
+func (ls *LockingStorer) write(cert *certmanager.Certificate) error {
+	data, err := encoding.EncodeCert(cert)
+	if err != nil {
+		return err
+	}
+	if err := writeFile(ls.path(certFilename), []byte(data)); err != nil {
+		return err
+	}
+	ls.logger.Printf("wrote certificate to: %s\n", ls.directory)
+	return nil
+}
+
+func (ls *LockingStorer) writeAccount(account *certmanager.Account) error {
+	data, err := encoding.EncodeAccount(account)
+	if err != nil {
+		return err
+	}
+	if err := writeFile(ls.path(accountFilename), []byte(data)); err != nil {
+		return err
+	}
+	ls.logger.Printf("wrote ACME account to: %s\n", ls.directory)
+	return nil
+}
+
+func (ls *LockingStorer) writeChallengeResponse(token, response string) error {
+	filename, err := ls.challengePath(token)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(filename), 0700); err != nil {
+		return err
+	}
+	if err := writeFile(filename, []byte(response)); err != nil {
+		return err
+	}
+	ls.logger.Debugf(0, "wrote challenge response to: %s\n", ls.directory)
+	return nil
+}
+
+func (ls *LockingStorer) writeOCSP(response []byte) error {
+	if err := writeFile(ls.path(ocspFilename), response); err != nil {
+		return err
+	}
+	ls.logger.Debugf(0, "wrote OCSP response to: %s\n", ls.directory)
+	return nil
+}
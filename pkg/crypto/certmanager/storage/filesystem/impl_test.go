@@ -0,0 +1,220 @@
+package filesystem
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/Cloud-Foundations/golib/pkg/constants"
+	"github.com/Cloud-Foundations/golib/pkg/crypto/certmanager"
+	"github.com/Cloud-Foundations/golib/pkg/crypto/certmanager/encoding"
+	cm_http "github.com/Cloud-Foundations/golib/pkg/crypto/certmanager/http"
+	"github.com/Cloud-Foundations/golib/pkg/crypto/certmanager/storage/internal/leaselocker"
+	"github.com/Cloud-Foundations/golib/pkg/log/testlogger"
+)
+
+func makeTestCert(t *testing.T) *certmanager.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		DNSNames:     []string{"www.example.com"},
+		NotAfter:     time.Now().Add(time.Hour),
+		NotBefore:    time.Now().Add(-time.Hour),
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "www.example.com"},
+	}
+	certDER, err := x509.CreateCertificate(rand.Reader, template, template,
+		key.Public(), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &certmanager.Certificate{
+		CertPemBlock: pem.EncodeToMemory(
+			&pem.Block{Type: "CERTIFICATE", Bytes: certDER}),
+		KeyPemBlock: pem.EncodeToMemory(
+			&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}),
+	}
+}
+
+func makeTestStorer(t *testing.T, directory string) *LockingStorer {
+	ls, err := NewWithConfig(
+		Config{
+			Directory:     directory,
+			LeaseDuration: time.Millisecond * 300,
+			PollInterval:  time.Millisecond * 10,
+		},
+		Params{Logger: testlogger.New(t)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ls
+}
+
+func TestReadWrite(t *testing.T) {
+	directory := t.TempDir()
+	ls := makeTestStorer(t, directory)
+	if _, err := ls.Read(); err == nil {
+		t.Fatal("no error reading missing certificate")
+	}
+	cert := makeTestCert(t)
+	if err := ls.Write(cert); err != nil {
+		t.Fatal(err)
+	}
+	readCert, err := ls.Read()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(readCert.CertPemBlock) != string(cert.CertPemBlock) {
+		t.Fatal("certificate PEM mismatch")
+	}
+	// The file should be readable with the encoding package.
+	data, err := ioutil.ReadFile(filepath.Join(directory, certFilename))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := encoding.DecodeCert(string(data)); err != nil {
+		t.Fatal(err)
+	}
+	account := &certmanager.Account{
+		KeyPemBlock: cert.KeyPemBlock,
+		URL:         "https://ca.example.com/acct/1",
+	}
+	if err := ls.WriteAccount(account); err != nil {
+		t.Fatal(err)
+	}
+	if readAccount, err := ls.ReadAccount(); err != nil {
+		t.Fatal(err)
+	} else if readAccount.URL != account.URL {
+		t.Fatalf("account URL: %s != %s", readAccount.URL, account.URL)
+	}
+	if err := ls.WriteOCSP([]byte("response")); err != nil {
+		t.Fatal(err)
+	}
+	if response, err := ls.ReadOCSP(); err != nil {
+		t.Fatal(err)
+	} else if string(response) != "response" {
+		t.Fatalf("OCSP response: %s", string(response))
+	}
+}
+
+func TestLock(t *testing.T) {
+	directory := t.TempDir()
+	ls1 := makeTestStorer(t, directory)
+	ls2 := makeTestStorer(t, directory)
+	if err := ls1.Lock(); err != nil {
+		t.Fatal(err)
+	}
+	if err := ls1.Lock(); err == nil {
+		t.Fatal("no error locking twice")
+	}
+	locked := make(chan error, 1)
+	go func() { locked <- ls2.Lock() }()
+	// The lease is extended, so the lock should not be taken.
+	select {
+	case <-locked:
+		t.Fatal("lock taken while held")
+	case <-time.After(time.Second):
+	}
+	if err := ls1.Unlock(); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case err := <-locked:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(time.Second * 5):
+		t.Fatal("timed out waiting for lock")
+	}
+	if err := ls2.Unlock(); err != nil {
+		t.Fatal(err)
+	}
+	if err := ls2.Unlock(); err == nil {
+		t.Fatal("no error unlocking twice")
+	}
+}
+
+func TestLostLock(t *testing.T) {
+	directory := t.TempDir()
+	ls := makeTestStorer(t, directory)
+	if err := ls.Lock(); err != nil {
+		t.Fatal(err)
+	}
+	lostChannel := ls.GetLostChannel()
+	// Simulate another instance taking over an expired lease.
+	data, err := json.Marshal(leaselocker.Lease{
+		Expires: time.Now().Add(time.Hour),
+		Owner:   "another-instance",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = writeFile(filepath.Join(directory, leaseFilename), data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case err := <-lostChannel:
+		if err == nil {
+			t.Fatal("nil error on lost channel")
+		}
+	case <-time.After(time.Second * 5):
+		t.Fatal("timed out waiting for lost lock notification")
+	}
+	if err := ls.Unlock(); err == nil {
+		t.Fatal("no error unlocking lost lock")
+	}
+}
+
+func TestSharedChallenge(t *testing.T) {
+	directory := t.TempDir()
+	publisher, err := cm_http.NewSharedHandler(nil,
+		makeTestStorer(t, directory), testlogger.New(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, err := cm_http.NewSharedHandler(nil,
+		makeTestStorer(t, directory), testlogger.New(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := constants.AcmePath + "/token_1-A"
+	get := func() *httptest.ResponseRecorder {
+		recorder := httptest.NewRecorder()
+		server.ServeHTTP(recorder, httptest.NewRequest("GET", path, nil))
+		return recorder
+	}
+	if err := publisher.Respond(path, "token_1-A.thumbprint"); err != nil {
+		t.Fatal(err)
+	}
+	if recorder := get(); recorder.Code != http.StatusOK {
+		t.Fatalf("status: %d", recorder.Code)
+	} else if body := recorder.Body.String(); body != "token_1-A.thumbprint" {
+		t.Fatalf("response: %s", body)
+	}
+	publisher.Cleanup()
+	if recorder := get(); recorder.Code != http.StatusNotFound {
+		t.Fatalf("status: %d after cleanup", recorder.Code)
+	}
+	ls := makeTestStorer(t, directory)
+	if err := ls.WriteChallengeResponse("../certificate", "x"); err == nil {
+		t.Fatal("no error writing invalid token")
+	}
+}
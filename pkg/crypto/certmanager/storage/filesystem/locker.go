@@ -0,0 +1,132 @@
+package filesystem
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"time"
+
+	"github.com/Cloud-Foundations/Dominator/lib/format"
+	"github.com/Cloud-Foundations/golib/pkg/crypto/certmanager/storage/internal/leaselocker"
+)
+
+const (
+	leaseFilename = "lease"
+	lockFilename  = "lock"
+)
+
+// leaseBackend implements the leaselocker.Backend interface.
+type leaseBackend struct {
+	*LockingStorer
+}
+
+func (b leaseBackend) ExtendLease() (string, error) {
+	lease, err := b.updateLease(true)
+	if err != nil {
+		return "", err
+	}
+	return lease.Owner, nil
+}
+
+func (b leaseBackend) ReleaseLease() error {
+	return b.withFlock(func() error {
+		lease, err := b.readLease()
+		if err != nil {
+			return err
+		}
+		if lease == nil || lease.Owner != b.locker.Owner() {
+			return fmt.Errorf("lock: %s was lost", b.directory)
+		}
+		return os.Remove(b.path(leaseFilename))
+	})
+}
+
+func (b leaseBackend) TryLease() (bool, error) {
+	lease, err := b.updateLease(false)
+	if err != nil {
+		return false, err
+	}
+	if lease.Owner == b.locker.Owner() {
+		return true, nil
+	}
+	b.logger.Debugf(0, "lock: %s held by: %s for: %s, waiting\n",
+		b.directory, lease.Owner, format.Duration(time.Until(lease.Expires)))
+	return false, nil
+}
+
+// readLease reads the lease. If there is no lease, nil is returned. This must
+// be called with the flock held.
+func (ls *LockingStorer) readLease() (*leaselocker.Lease, error) {
+	data, err := ioutil.ReadFile(ls.path(leaseFilename))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var lease leaselocker.Lease
+	if err := json.Unmarshal(data, &lease); err != nil {
+		ls.logger.Printf("ignoring corrupt lease: %s\n", err)
+		return nil, nil
+	}
+	return &lease, nil
+}
+
+// updateLease will take or extend the lease if it is available. If extend is
+// true, the lease is only extended if it is currently held. The current lease
+// is returned.
+func (ls *LockingStorer) updateLease(extend bool) (*leaselocker.Lease, error) {
+	owner := ls.locker.Owner()
+	var result *leaselocker.Lease
+	err := ls.withFlock(func() error {
+		lease, err := ls.readLease()
+		if err != nil {
+			return err
+		}
+		if lease != nil && lease.Owner != owner &&
+			time.Now().Before(lease.Expires) {
+			result = lease
+			return nil
+		}
+		if extend && (lease == nil || lease.Owner != owner) {
+			if lease == nil {
+				lease = &leaselocker.Lease{Owner: "nobody"}
+			}
+			result = lease
+			return nil
+		}
+		newLease := leaselocker.Lease{
+			Expires: time.Now().Add(ls.leaseDuration),
+			Owner:   owner,
+		}
+		data, err := json.Marshal(newLease)
+		if err != nil {
+			return err
+		}
+		if err := writeFile(ls.path(leaseFilename), data); err != nil {
+			return err
+		}
+		result = &newLease
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// withFlock will call fn while holding an exclusive lock on the lock file.
+func (ls *LockingStorer) withFlock(fn func() error) error {
+	file, err := os.OpenFile(ls.path(lockFilename), os.O_RDWR|os.O_CREATE,
+		0600)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	if err := lockFile(file); err != nil {
+		return fmt.Errorf("error locking: %s: %s", file.Name(), err)
+	}
+	defer unlockFile(file)
+	return fn()
+}
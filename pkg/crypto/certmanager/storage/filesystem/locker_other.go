@@ -0,0 +1,16 @@
+//go:build !unix && !windows
+
+package filesystem
+
+import (
+	"errors"
+	"os"
+)
+
+func lockFile(file *os.File) error {
+	return errors.New("file locking not supported on this platform")
+}
+
+func unlockFile(file *os.File) error {
+	return errors.New("file locking not supported on this platform")
+}
@@ -0,0 +1,97 @@
+/*
+Package leaselocker implements the locking logic which is shared by the storage
+backends which use a lease: taking the lease (waiting if it is held by another
+instance), extending it periodically while the lock is held and sending a
+notification if it was lost. The backends implement the Backend interface to
+read and write the lease.
+*/
+package leaselocker
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/Cloud-Foundations/golib/pkg/log"
+)
+
+// Backend is the interface to the lease in a storage backend. The methods are
+// called with the Locker lock held, so they are not called concurrently.
+type Backend interface {
+	// ExtendLease will extend the lease if it is still held. If the lease was
+	// lost, the new owner is returned.
+	ExtendLease() (string, error)
+
+	// ReleaseLease will release the lease. If the lease was lost, an error is
+	// returned.
+	ReleaseLease() error
+
+	// TryLease will try to take the lease, returning true if it was taken.
+	TryLease() (bool, error)
+}
+
+// Config contains the configuration for a Locker.
+type Config struct {
+	// LeaseDuration specifies how long the lease is valid for before it must
+	// be extended. Required.
+	LeaseDuration time.Duration
+
+	// Name specifies the name of the lock, which is used in messages.
+	Name string
+
+	// PollInterval specifies how often to try to take the lease when waiting
+	// for the lock. Required.
+	PollInterval time.Duration
+}
+
+// Lease contains the lease information recorded by a backend.
+type Lease struct {
+	Expires time.Time
+	Owner   string
+}
+
+// Locker implements the certmanager.Locker interface using a Backend.
+type Locker struct {
+	backend       Backend
+	leaseDuration time.Duration
+	logger        log.DebugLogger
+	name          string
+	owner         string
+	pollInterval  time.Duration
+	mutex         sync.Mutex // Protect everything below.
+	lostChannel   chan error
+	stopRenewal   chan struct{}
+}
+
+// Params contains the parameters for a Locker.
+type Params struct {
+	Backend Backend
+	Logger  log.DebugLogger
+}
+
+// New creates a *Locker with a unique owner identifier.
+func New(config Config, params Params) (*Locker, error) {
+	return newLocker(config, params)
+}
+
+func (l *Locker) GetLostChannel() <-chan error {
+	return l.getLostChannel()
+}
+
+func (l *Locker) Lock() error {
+	return l.lock(context.Background())
+}
+
+func (l *Locker) LockWithContext(ctx context.Context) error {
+	return l.lock(ctx)
+}
+
+// Owner returns the unique identifier of the Locker, which the Backend should
+// record as the owner of the lease.
+func (l *Locker) Owner() string {
+	return l.owner
+}
+
+func (l *Locker) Unlock() error {
+	return l.unlock()
+}
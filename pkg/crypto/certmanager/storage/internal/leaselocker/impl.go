@@ -0,0 +1,127 @@
+package leaselocker
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"time"
+)
+
+// makeOwner returns a unique identifier for the lock owner.
+func makeOwner() (string, error) {
+	hostname, err := os.Hostname()
+	if err != nil {
+		return "", err
+	}
+	randBytes := make([]byte, 8)
+	if _, err := rand.Read(randBytes); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%s:%d:%s",
+		hostname, os.Getpid(), hex.EncodeToString(randBytes)), nil
+}
+
+func newLocker(config Config, params Params) (*Locker, error) {
+	owner, err := makeOwner()
+	if err != nil {
+		return nil, err
+	}
+	return &Locker{
+		backend:       params.Backend,
+		leaseDuration: config.LeaseDuration,
+		logger:        params.Logger,
+		name:          config.Name,
+		owner:         owner,
+		pollInterval:  config.PollInterval,
+	}, nil
+}
+
+// extendLease will extend the lease if it is still held. If the lease was
+// lost, the new owner is returned.
+func (l *Locker) extendLease(stopChannel <-chan struct{}) (string, error) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	select {
+	case <-stopChannel:
+		return l.owner, nil
+	default:
+	}
+	return l.backend.ExtendLease()
+}
+
+func (l *Locker) getLostChannel() <-chan error {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	return l.lostChannel
+}
+
+func (l *Locker) lock(ctx context.Context) error {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if l.stopRenewal != nil {
+		return fmt.Errorf("already locked: %s", l.name)
+	}
+	for {
+		locked, err := l.backend.TryLease()
+		if err != nil {
+			return err
+		}
+		if locked {
+			break
+		}
+		timer := time.NewTimer(l.pollInterval)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		}
+	}
+	l.lostChannel = make(chan error, 1)
+	l.stopRenewal = make(chan struct{})
+	go l.maintainLease(l.stopRenewal, l.lostChannel)
+	l.logger.Printf("locked: %s\n", l.name)
+	return nil
+}
+
+// maintainLease will periodically extend the lease until stopped. If the lease
+// was lost, an error is sent to lostChannel.
+func (l *Locker) maintainLease(stopChannel <-chan struct{},
+	lostChannel chan<- error) {
+	ticker := time.NewTicker(l.leaseDuration / 3)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stopChannel:
+			return
+		case <-ticker.C:
+		}
+		owner, err := l.extendLease(stopChannel)
+		if err != nil {
+			l.logger.Printf("error extending lease: %s\n", err)
+			continue
+		}
+		if owner != l.owner {
+			lostChannel <- fmt.Errorf("lost lock: %s to: %s", l.name, owner)
+			return
+		}
+	}
+}
+
+func (l *Locker) unlock() error {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if l.stopRenewal == nil {
+		return fmt.Errorf("already unlocked: %s", l.name)
+	}
+	close(l.stopRenewal)
+	l.stopRenewal = nil
+	l.lostChannel = nil
+	if err := l.backend.ReleaseLease(); err != nil {
+		return err
+	}
+	l.logger.Printf("unlocked: %s\n", l.name)
+	return nil
+}
@@ -0,0 +1,151 @@
+package leaselocker
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Cloud-Foundations/golib/pkg/log/testlogger"
+)
+
+// testBackend is a lease which is shared by the Lockers using it.
+type testBackend struct {
+	mutex  *sync.Mutex // Protect the lease.
+	lease  *Lease
+	locker *Locker
+}
+
+func (b *testBackend) ExtendLease() (string, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if b.lease.Owner != b.locker.Owner() {
+		return b.lease.Owner, nil
+	}
+	b.lease.Expires = time.Now().Add(b.locker.leaseDuration)
+	return b.locker.Owner(), nil
+}
+
+func (b *testBackend) ReleaseLease() error {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if b.lease.Owner != b.locker.Owner() {
+		return errors.New("lease was lost")
+	}
+	b.lease.Owner = ""
+	return nil
+}
+
+func (b *testBackend) TryLease() (bool, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if b.lease.Owner != "" && time.Now().Before(b.lease.Expires) {
+		return false, nil
+	}
+	b.lease.Expires = time.Now().Add(b.locker.leaseDuration)
+	b.lease.Owner = b.locker.Owner()
+	return true, nil
+}
+
+func makeTestLocker(t *testing.T, mutex *sync.Mutex, lease *Lease) *Locker {
+	backend := &testBackend{lease: lease, mutex: mutex}
+	locker, err := New(
+		Config{
+			LeaseDuration: time.Millisecond * 300,
+			Name:          "test",
+			PollInterval:  time.Millisecond * 10,
+		},
+		Params{Backend: backend, Logger: testlogger.New(t)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	backend.locker = locker
+	return locker
+}
+
+func TestLock(t *testing.T) {
+	var mutex sync.Mutex
+	lease := &Lease{}
+	l1 := makeTestLocker(t, &mutex, lease)
+	l2 := makeTestLocker(t, &mutex, lease)
+	if l1.Owner() == l2.Owner() {
+		t.Fatal("owners are not unique")
+	}
+	if err := l1.Lock(); err != nil {
+		t.Fatal(err)
+	}
+	if err := l1.Lock(); err == nil {
+		t.Fatal("no error locking twice")
+	}
+	locked := make(chan error, 1)
+	go func() { locked <- l2.Lock() }()
+	// The lease is extended, so the lock should not be taken.
+	select {
+	case <-locked:
+		t.Fatal("lock taken while held")
+	case <-time.After(time.Second):
+	}
+	if err := l1.Unlock(); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case err := <-locked:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(time.Second * 5):
+		t.Fatal("timed out waiting for lock")
+	}
+	if err := l2.Unlock(); err != nil {
+		t.Fatal(err)
+	}
+	if err := l2.Unlock(); err == nil {
+		t.Fatal("no error unlocking twice")
+	}
+}
+
+func TestLostLock(t *testing.T) {
+	var mutex sync.Mutex
+	lease := &Lease{}
+	locker := makeTestLocker(t, &mutex, lease)
+	if err := locker.Lock(); err != nil {
+		t.Fatal(err)
+	}
+	lostChannel := locker.GetLostChannel()
+	// Simulate another instance taking over an expired lease.
+	mutex.Lock()
+	lease.Owner = "another-instance"
+	mutex.Unlock()
+	select {
+	case err := <-lostChannel:
+		if err == nil {
+			t.Fatal("nil error on lost channel")
+		}
+	case <-time.After(time.Second * 5):
+		t.Fatal("timed out waiting for lost lock notification")
+	}
+	if err := locker.Unlock(); err == nil {
+		t.Fatal("no error unlocking lost lock")
+	}
+}
+
+func TestLockCancel(t *testing.T) {
+	var mutex sync.Mutex
+	lease := &Lease{}
+	l1 := makeTestLocker(t, &mutex, lease)
+	l2 := makeTestLocker(t, &mutex, lease)
+	if err := l1.Lock(); err != nil {
+		t.Fatal(err)
+	}
+	defer l1.Unlock()
+	ctx, cancel := context.WithTimeout(context.Background(),
+		time.Millisecond*100)
+	defer cancel()
+	if err := l2.LockWithContext(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("error: %v != %v", err, context.DeadlineExceeded)
+	}
+	if err := l2.Unlock(); err == nil {
+		t.Fatal("no error unlocking after cancelled lock")
+	}
+}
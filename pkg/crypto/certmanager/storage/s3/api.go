@@ -0,0 +1,154 @@
+/*
+Package s3 implements the Locker, Storer, AccountStorer, AccountDeleter and
+OCSPStorer interfaces using AWS S3 or S3-compatible object storage. The
+ChallengeStorer interface of the http package is also implemented.
+
+The certificate and ACME account are stored in the format used by the encoding
+package, in the "certificate" and "account" objects, respectively. The
+DER-encoded OCSP response is stored in the "ocsp" object. Challenge responses
+are stored in "challenges/<token>" objects. Object keys may be placed under a
+prefix, for example one prefix per set of domain names.
+
+Locking uses conditional writes. The "lock" object is created with
+If-None-Match: * and contains a lease, which is extended with If-Match (using
+the ETag of the lock object) while the lock is held. If the lease expires,
+another instance may delete the lock object (again using If-Match) and take the
+lock. If the lease could not be extended because the lock object was changed, a
+notification is sent to the channel returned by GetLostChannel.
+*/
+package s3
+
+import (
+	"context"
+	"time"
+
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+
+	"github.com/Cloud-Foundations/golib/pkg/crypto/certmanager"
+	cm_http "github.com/Cloud-Foundations/golib/pkg/crypto/certmanager/http"
+	"github.com/Cloud-Foundations/golib/pkg/crypto/certmanager/storage/internal/leaselocker"
+	"github.com/Cloud-Foundations/golib/pkg/log"
+)
+
+// Config contains the configuration for a LockingStorer.
+type Config struct {
+	// Bucket specifies the bucket name. Required.
+	Bucket string
+
+	// Endpoint specifies the endpoint URL for S3-compatible object storage.
+	// If specified, path-style addressing is used. Optional.
+	Endpoint string
+
+	// LeaseDuration specifies how long the lock lease is valid for before it
+	// must be extended. The default is 15 minutes.
+	LeaseDuration time.Duration
+
+	// PollInterval specifies how often to check if the lock is available when
+	// waiting for the lock. The default is 15 seconds.
+	PollInterval time.Duration
+
+	// Prefix specifies the prefix for the object keys (i.e. "example.com/").
+	// Optional.
+	Prefix string
+
+	// Region specifies the region. If empty and Endpoint is not specified,
+	// the region of the instance is used.
+	Region string
+}
+
+type LockingStorer struct {
+	bucket        string
+	client        s3iface.S3API
+	leaseDuration time.Duration
+	locker        *leaselocker.Locker
+	logger        log.DebugLogger
+	prefix        string
+	lockETag      string // Protected by the locker.
+}
+
+// Params contains the parameters for a LockingStorer.
+type Params struct {
+	// Client specifies the S3 client to use. If nil, a client is created using
+	// the default credentials. Optional.
+	Client s3iface.S3API
+
+	Logger log.DebugLogger
+}
+
+// Interface checks.
+var _ certmanager.AccountDeleter = (*LockingStorer)(nil)
+var _ certmanager.AccountStorer = (*LockingStorer)(nil)
+var _ certmanager.ContextLocker = (*LockingStorer)(nil)
+var _ certmanager.Locker = (*LockingStorer)(nil)
+var _ certmanager.OCSPStorer = (*LockingStorer)(nil)
+var _ certmanager.Storer = (*LockingStorer)(nil)
+var _ cm_http.ChallengeStorer = (*LockingStorer)(nil)
+
+// New creates a *LockingStorer using the specified bucket and key prefix.
+func New(bucket, prefix string, logger log.DebugLogger) (
+	*LockingStorer, error) {
+	return newLS(Config{Bucket: bucket, Prefix: prefix},
+		Params{Logger: logger})
+}
+
+// NewWithConfig creates a *LockingStorer using the provided configuration.
+func NewWithConfig(config Config, params Params) (*LockingStorer, error) {
+	return newLS(config, params)
+}
+
+func (ls *LockingStorer) DeleteAccount() error {
+	return ls.deleteAccount()
+}
+
+func (ls *LockingStorer) DeleteChallengeResponse(token string) error {
+	return ls.deleteChallengeResponse(token)
+}
+
+func (ls *LockingStorer) GetLostChannel() <-chan error {
+	return ls.locker.GetLostChannel()
+}
+
+func (ls *LockingStorer) Lock() error {
+	return ls.locker.Lock()
+}
+
+func (ls *LockingStorer) LockWithContext(ctx context.Context) error {
+	return ls.locker.LockWithContext(ctx)
+}
+
+func (ls *LockingStorer) Read() (*certmanager.Certificate, error) {
+	return ls.read()
+}
+
+func (ls *LockingStorer) ReadAccount() (*certmanager.Account, error) {
+	return ls.readAccount()
+}
+
+func (ls *LockingStorer) ReadChallengeResponse(token string) (string, error) {
+	return ls.readChallengeResponse(token)
+}
+
+func (ls *LockingStorer) ReadOCSP() ([]byte, error) {
+	return ls.readOCSP()
+}
+
+func (ls *LockingStorer) Unlock() error {
+	return ls.locker.Unlock()
+}
+
+func (ls *LockingStorer) Write(cert *certmanager.Certificate) error {
+	return ls.write(cert)
+}
+
+func (ls *LockingStorer) WriteAccount(account *certmanager.Account) error {
+	return ls.writeAccount(account)
+}
+
+func (ls *LockingStorer) WriteChallengeResponse(token,
+	response string) error {
+	return ls.writeChallengeResponse(token, response)
+}
+
+func (ls *LockingStorer) WriteOCSP(response []byte) error {
+	return ls.writeOCSP(response)
+}
@@ -0,0 +1,251 @@
+package s3
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+
+	"github.com/Cloud-Foundations/golib/pkg/awsutil/metadata"
+	"github.com/Cloud-Foundations/golib/pkg/crypto/certmanager"
+	"github.com/Cloud-Foundations/golib/pkg/crypto/certmanager/encoding"
+	"github.com/Cloud-Foundations/golib/pkg/crypto/certmanager/storage/internal/leaselocker"
+)
+
+const (
+	accountKey      = "account"
+	certKey         = "certificate"
+	challengePrefix = "challenges/"
+	lockKey         = "lock"
+	ocspKey         = "ocsp"
+
+	defaultLeaseDuration = time.Minute * 15
+	defaultPollInterval  = time.Second * 15
+	maxObjectSize        = 1 << 20
+)
+
+func makeClient(config Config) (*s3.S3, error) {
+	awsConfig := &aws.Config{}
+	if config.Endpoint != "" {
+		awsConfig.Endpoint = aws.String(config.Endpoint)
+		awsConfig.S3ForcePathStyle = aws.Bool(true)
+		if config.Region == "" {
+			config.Region = "us-east-1"
+		}
+	}
+	if config.Region == "" {
+		metadataClient, err := metadata.GetMetadataClient()
+		if err != nil {
+			return nil, err
+		}
+		config.Region, err = metadataClient.Region()
+		if err != nil {
+			return nil, err
+		}
+	}
+	awsConfig.Region = aws.String(config.Region)
+	awsSession, err := session.NewSession(awsConfig)
+	if err != nil {
+		return nil, fmt.Errorf("error creating session: %s", err)
+	}
+	return s3.New(awsSession), nil
+}
+
+func newLS(config Config, params Params) (*LockingStorer, error) {
+	if config.Bucket == "" {
+		return nil, errors.New("no bucket specified")
+	}
+	if config.LeaseDuration <= 0 {
+		config.LeaseDuration = defaultLeaseDuration
+	}
+	if config.PollInterval <= 0 {
+		config.PollInterval = defaultPollInterval
+	}
+	ls := &LockingStorer{
+		bucket:        config.Bucket,
+		client:        params.Client,
+		leaseDuration: config.LeaseDuration,
+		logger:        params.Logger,
+		prefix:        config.Prefix,
+	}
+	var err error
+	ls.locker, err = leaselocker.New(
+		leaselocker.Config{
+			LeaseDuration: config.LeaseDuration,
+			Name:          config.Bucket + "/" + config.Prefix,
+			PollInterval:  config.PollInterval,
+		},
+		leaselocker.Params{
+			Backend: leaseBackend{ls},
+			Logger:  params.Logger,
+		})
+	if err != nil {
+		return nil, err
+	}
+	if ls.client == nil {
+		if ls.client, err = makeClient(config); err != nil {
+			return nil, err
+		}
+	}
+	return ls, nil
+}
+
+func (ls *LockingStorer) deleteAccount() error {
+	if err := ls.deleteObject(accountKey, ""); err != nil {
+		return fmt.Errorf("error calling s3:DeleteObject: %s", err)
+	}
+	ls.logger.Printf("deleted ACME account from S3: %s/%s%s\n",
+		ls.bucket, ls.prefix, accountKey)
+	return nil
+}
+
+func (ls *LockingStorer) deleteChallengeResponse(token string) error {
+	if err := ls.deleteObject(challengePrefix+token, ""); err != nil {
+		return fmt.Errorf("error calling s3:DeleteObject: %s", err)
+	}
+	ls.logger.Debugf(0, "deleted challenge response from S3: %s/%s%s%s\n",
+		ls.bucket, ls.prefix, challengePrefix, token)
+	return nil
+}
+
+// getObject will read an object, returning the data and the ETag. Errors from
+// the client are returned unwrapped, so that the status can be checked.
+func (ls *LockingStorer) getObject(key string) ([]byte, string, error) {
+	output, err := ls.client.GetObject(&s3.GetObjectInput{
+		Bucket: aws.String(ls.bucket),
+		Key:    aws.String(ls.prefix + key),
+	})
+	if err != nil {
+		return nil, "", err
+	}
+	defer output.Body.Close()
+	data, err := ioutil.ReadAll(io.LimitReader(output.Body, maxObjectSize))
+	if err != nil {
+		return nil, "", err
+	}
+	return data, aws.StringValue(output.ETag), nil
+}
+
+// putObject will write an object. If ifMatch is not empty, the object is only
+// written if the existing object has a matching ETag ("*" matches any
+// existing object). If ifNoneMatch is "*", the object is only written if it
+// does not already exist. The new ETag is returned.
+func (ls *LockingStorer) putObject(key string, data []byte,
+	ifMatch, ifNoneMatch string) (string, error) {
+	req, output := ls.client.PutObjectRequest(&s3.PutObjectInput{
+		Body:   bytes.NewReader(data),
+		Bucket: aws.String(ls.bucket),
+		Key:    aws.String(ls.prefix + key),
+	})
+	// Set the conditional headers directly, for compatibility with older
+	// S3-compatible implementations and SDK versions.
+	if ifMatch != "" {
+		req.HTTPRequest.Header.Set("If-Match", ifMatch)
+	}
+	if ifNoneMatch != "" {
+		req.HTTPRequest.Header.Set("If-None-Match", ifNoneMatch)
+	}
+	if err := req.Send(); err != nil {
+		return "", err
+	}
+	return aws.StringValue(output.ETag), nil
+}
+
+func (ls *LockingStorer) read() (*certmanager.Certificate, error) {
+	data, _, err := ls.getObject(certKey)
+	if err != nil {
+		return nil, fmt.Errorf("error calling s3:GetObject: %s", err)
+	}
+	cert, err := encoding.DecodeCert(string(data))
+	if err != nil {
+		return nil, err
+	}
+	ls.logger.Printf("read certificate from S3: %s/%s%s\n",
+		ls.bucket, ls.prefix, certKey)
+	return cert, nil
+}
+
+func (ls *LockingStorer) readAccount() (*certmanager.Account, error) {
+	data, _, err := ls.getObject(accountKey)
+	if err != nil {
+		return nil, fmt.Errorf("error calling s3:GetObject: %s", err)
+	}
+	account, err := encoding.DecodeAccount(string(data))
+	if err != nil {
+		return nil, err
+	}
+	ls.logger.Printf("read ACME account from S3: %s/%s%s\n",
+		ls.bucket, ls.prefix, accountKey)
+	return account, nil
+}
+
+func (ls *LockingStorer) readChallengeResponse(token string) (string, error) {
+	data, _, err := ls.getObject(challengePrefix + token)
+	if err != nil {
+		return "", fmt.Errorf("error calling s3:GetObject: %s", err)
+	}
+	ls.logger.Debugf(1, "read challenge response from S3: %s/%s%s%s\n",
+		ls.bucket, ls.prefix, challengePrefix, token)
+	return string(data), nil
+}
+
+func (ls *LockingStorer) readOCSP() ([]byte, error) {
+	data, _, err := ls.getObject(ocspKey)
+	if err != nil {
+		return nil, fmt.Errorf("error calling s3:GetObject: %s", err)
+	}
+	ls.logger.Debugf(0, "read OCSP response from S3: %s/%s%s\n",
+		ls.bucket, ls.prefix, ocspKey)
+	return data, nil
+}
+
+func (ls *LockingStorer) write(cert *certmanager.Certificate) error {
+	data, err := encoding.EncodeCert(cert)
+	if err != nil {
+		return err
+	}
+	if _, err := ls.putObject(certKey, []byte(data), "", ""); err != nil {
+		return fmt.Errorf("error calling s3:PutObject: %s", err)
+	}
+	ls.logger.Printf("wrote certificate to S3: %s/%s%s\n",
+		ls.bucket, ls.prefix, certKey)
+	return nil
+}
+
+func (ls *LockingStorer) writeAccount(account *certmanager.Account) error {
+	data, err := encoding.EncodeAccount(account)
+	if err != nil {
+		return err
+	}
+	if _, err := ls.putObject(accountKey, []byte(data), "", ""); err != nil {
+		return fmt.Errorf("error calling s3:PutObject: %s", err)
+	}
+	ls.logger.Printf("wrote ACME account to S3: %s/%s%s\n",
+		ls.bucket, ls.prefix, accountKey)
+	return nil
+}
+
+func (ls *LockingStorer) writeChallengeResponse(token, response string) error {
+	_, err := ls.putObject(challengePrefix+token, []byte(response), "", "")
+	if err != nil {
+		return fmt.Errorf("error calling s3:PutObject: %s", err)
+	}
+	ls.logger.Debugf(0, "wrote challenge response to S3: %s/%s%s%s\n",
+		ls.bucket, ls.prefix, challengePrefix, token)
+	return nil
+}
+
+func (ls *LockingStorer) writeOCSP(response []byte) error {
+	if _, err := ls.putObject(ocspKey, response, "", ""); err != nil {
+		return fmt.Errorf("error calling s3:PutObject: %s", err)
+	}
+	ls.logger.Debugf(0, "wrote OCSP response to S3: %s/%s%s\n",
+		ls.bucket, ls.prefix, ocspKey)
+	return nil
+}
@@ -0,0 +1,328 @@
+package s3
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+
+	"github.com/Cloud-Foundations/golib/pkg/crypto/certmanager"
+	"github.com/Cloud-Foundations/golib/pkg/crypto/certmanager/encoding"
+	"github.com/Cloud-Foundations/golib/pkg/crypto/certmanager/storage/internal/leaselocker"
+	"github.com/Cloud-Foundations/golib/pkg/log/testlogger"
+)
+
+const testBucket = "test-bucket"
+
+type testObject struct {
+	data []byte
+	etag string
+}
+
+// testServer is a minimal S3-compatible stand-in, supporting path-style GET,
+// PUT and DELETE with conditional requests.
+type testServer struct {
+	mutex   sync.Mutex
+	objects map[string]testObject
+	version uint64
+}
+
+func TestExpiredLease(t *testing.T) {
+	ts, endpoint := makeTestServer(t)
+	ls := makeTestStorer(t, endpoint)
+	// Simulate an instance which died while holding the lock.
+	data, err := json.Marshal(leaselocker.Lease{
+		Expires: time.Now().Add(-time.Minute),
+		Owner:   "dead-instance",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts.put("/"+testBucket+"/www.example.com/"+lockKey, data)
+	locked := make(chan error, 1)
+	go func() { locked <- ls.Lock() }()
+	select {
+	case err := <-locked:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(time.Second * 5):
+		t.Fatal("timed out waiting for lock")
+	}
+	if err := ls.Unlock(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLock(t *testing.T) {
+	_, endpoint := makeTestServer(t)
+	ls1 := makeTestStorer(t, endpoint)
+	ls2 := makeTestStorer(t, endpoint)
+	if err := ls1.Lock(); err != nil {
+		t.Fatal(err)
+	}
+	if err := ls1.Lock(); err == nil {
+		t.Fatal("no error locking twice")
+	}
+	locked := make(chan error, 1)
+	go func() { locked <- ls2.Lock() }()
+	// The lease is extended, so the lock should not be taken.
+	select {
+	case <-locked:
+		t.Fatal("lock taken while held")
+	case <-time.After(time.Second):
+	}
+	if err := ls1.Unlock(); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case err := <-locked:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(time.Second * 5):
+		t.Fatal("timed out waiting for lock")
+	}
+	if err := ls2.Unlock(); err != nil {
+		t.Fatal(err)
+	}
+	if err := ls2.Unlock(); err == nil {
+		t.Fatal("no error unlocking twice")
+	}
+}
+
+func TestLostLock(t *testing.T) {
+	ts, endpoint := makeTestServer(t)
+	ls := makeTestStorer(t, endpoint)
+	if err := ls.Lock(); err != nil {
+		t.Fatal(err)
+	}
+	lostChannel := ls.GetLostChannel()
+	// Simulate another instance taking over an expired lease.
+	data, err := json.Marshal(leaselocker.Lease{
+		Expires: time.Now().Add(time.Hour),
+		Owner:   "another-instance",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts.put("/"+testBucket+"/www.example.com/"+lockKey, data)
+	select {
+	case err := <-lostChannel:
+		if err == nil {
+			t.Fatal("nil error on lost channel")
+		}
+	case <-time.After(time.Second * 5):
+		t.Fatal("timed out waiting for lost lock notification")
+	}
+	if err := ls.Unlock(); err == nil {
+		t.Fatal("no error unlocking lost lock")
+	}
+}
+
+func TestReadWrite(t *testing.T) {
+	ts, endpoint := makeTestServer(t)
+	ls := makeTestStorer(t, endpoint)
+	if _, err := ls.Read(); err == nil {
+		t.Fatal("no error reading missing certificate")
+	}
+	cert := makeTestCert(t)
+	if err := ls.Write(cert); err != nil {
+		t.Fatal(err)
+	}
+	readCert, err := ls.Read()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(readCert.CertPemBlock) != string(cert.CertPemBlock) {
+		t.Fatal("certificate PEM mismatch")
+	}
+	// The object should be under the prefix and readable with the encoding
+	// package.
+	object := ts.get("/" + testBucket + "/www.example.com/" + certKey)
+	if _, err := encoding.DecodeCert(string(object.data)); err != nil {
+		t.Fatal(err)
+	}
+	account := &certmanager.Account{
+		KeyPemBlock: cert.KeyPemBlock,
+		URL:         "https://ca.example.com/acct/1",
+	}
+	if err := ls.WriteAccount(account); err != nil {
+		t.Fatal(err)
+	}
+	if readAccount, err := ls.ReadAccount(); err != nil {
+		t.Fatal(err)
+	} else if readAccount.URL != account.URL {
+		t.Fatalf("account URL: %s != %s", readAccount.URL, account.URL)
+	}
+	if err := ls.WriteOCSP([]byte("response")); err != nil {
+		t.Fatal(err)
+	}
+	if response, err := ls.ReadOCSP(); err != nil {
+		t.Fatal(err)
+	} else if string(response) != "response" {
+		t.Fatalf("OCSP response: %s", string(response))
+	}
+	if err := ls.WriteChallengeResponse("token", "token.key"); err != nil {
+		t.Fatal(err)
+	}
+	if response, err := ls.ReadChallengeResponse("token"); err != nil {
+		t.Fatal(err)
+	} else if response != "token.key" {
+		t.Fatalf("challenge response: %s", response)
+	}
+	if err := ls.DeleteChallengeResponse("token"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ls.ReadChallengeResponse("token"); err == nil {
+		t.Fatal("no error reading deleted challenge response")
+	}
+}
+
+func makeTestCert(t *testing.T) *certmanager.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		DNSNames:     []string{"www.example.com"},
+		NotAfter:     time.Now().Add(time.Hour),
+		NotBefore:    time.Now().Add(-time.Hour),
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "www.example.com"},
+	}
+	certDER, err := x509.CreateCertificate(rand.Reader, template, template,
+		key.Public(), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &certmanager.Certificate{
+		CertPemBlock: pem.EncodeToMemory(
+			&pem.Block{Type: "CERTIFICATE", Bytes: certDER}),
+		KeyPemBlock: pem.EncodeToMemory(
+			&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}),
+	}
+}
+
+func makeTestServer(t *testing.T) (*testServer, string) {
+	ts := &testServer{objects: make(map[string]testObject)}
+	server := httptest.NewServer(ts)
+	t.Cleanup(server.Close)
+	return ts, server.URL
+}
+
+func makeTestStorer(t *testing.T, endpoint string) *LockingStorer {
+	awsSession, err := session.NewSession(&aws.Config{
+		Credentials:      credentials.NewStaticCredentials("id", "secret", ""),
+		Endpoint:         aws.String(endpoint),
+		Region:           aws.String("us-east-1"),
+		S3ForcePathStyle: aws.Bool(true),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ls, err := NewWithConfig(
+		Config{
+			Bucket:        testBucket,
+			LeaseDuration: time.Millisecond * 300,
+			PollInterval:  time.Millisecond * 10,
+			Prefix:        "www.example.com/",
+		},
+		Params{
+			Client: s3.New(awsSession),
+			Logger: testlogger.New(t),
+		})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ls
+}
+
+func writeError(w http.ResponseWriter, status int, code string) {
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(status)
+	fmt.Fprintf(w, "<Error><Code>%s</Code><Message>%s</Message></Error>",
+		code, code)
+}
+
+func (ts *testServer) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	ts.mutex.Lock()
+	defer ts.mutex.Unlock()
+	key := req.URL.Path
+	object, ok := ts.objects[key]
+	if ifMatch := req.Header.Get("If-Match"); ifMatch != "" {
+		if !ok {
+			writeError(w, http.StatusNotFound, "NoSuchKey")
+			return
+		}
+		if ifMatch != object.etag {
+			writeError(w, http.StatusPreconditionFailed, "PreconditionFailed")
+			return
+		}
+	}
+	if req.Header.Get("If-None-Match") == "*" && ok {
+		writeError(w, http.StatusPreconditionFailed, "PreconditionFailed")
+		return
+	}
+	switch req.Method {
+	case http.MethodDelete:
+		delete(ts.objects, key)
+		w.WriteHeader(http.StatusNoContent)
+	case http.MethodGet:
+		if !ok {
+			writeError(w, http.StatusNotFound, "NoSuchKey")
+			return
+		}
+		w.Header().Set("ETag", object.etag)
+		w.Write(object.data)
+	case http.MethodPut:
+		data, err := ioutil.ReadAll(req.Body)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "IncompleteBody")
+			return
+		}
+		w.Header().Set("ETag", ts.store(key, data).etag)
+	default:
+		writeError(w, http.StatusMethodNotAllowed, "MethodNotAllowed")
+	}
+}
+
+func (ts *testServer) get(key string) testObject {
+	ts.mutex.Lock()
+	defer ts.mutex.Unlock()
+	return ts.objects[key]
+}
+
+func (ts *testServer) put(key string, data []byte) {
+	ts.mutex.Lock()
+	defer ts.mutex.Unlock()
+	ts.store(key, data)
+}
+
+// store must be called with the lock held.
+func (ts *testServer) store(key string, data []byte) testObject {
+	ts.version++
+	object := testObject{data, fmt.Sprintf("\"%d\"", ts.version)}
+	ts.objects[key] = object
+	return object
+}
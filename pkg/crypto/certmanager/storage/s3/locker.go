@@ -0,0 +1,179 @@
+package s3
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/s3"
+
+	"github.com/Cloud-Foundations/Dominator/lib/format"
+	"github.com/Cloud-Foundations/golib/pkg/crypto/certmanager/storage/internal/leaselocker"
+)
+
+// leaseBackend implements the leaselocker.Backend interface.
+type leaseBackend struct {
+	*LockingStorer
+}
+
+// isConditionFailed returns true if err was caused by a failed conditional
+// request, such as a conflicting write.
+func isConditionFailed(err error) bool {
+	if reqErr, ok := err.(awserr.RequestFailure); ok {
+		switch reqErr.StatusCode() {
+		case http.StatusConflict, http.StatusPreconditionFailed:
+			return true
+		}
+	}
+	return false
+}
+
+// isNotFound returns true if err was caused by a missing object.
+func isNotFound(err error) bool {
+	if reqErr, ok := err.(awserr.RequestFailure); ok {
+		return reqErr.StatusCode() == http.StatusNotFound
+	}
+	return false
+}
+
+func (b leaseBackend) ExtendLease() (string, error) {
+	data, err := b.makeLease()
+	if err != nil {
+		return "", err
+	}
+	etag, err := b.putObject(lockKey, data, b.lockETag, "")
+	if err == nil {
+		b.lockETag = etag
+		return b.locker.Owner(), nil
+	}
+	if !isConditionFailed(err) && !isNotFound(err) {
+		return "", err
+	}
+	if lease, _, err := b.readLease(); err != nil {
+		return "unknown", nil
+	} else if lease == nil {
+		return "nobody", nil
+	} else {
+		return lease.Owner, nil
+	}
+}
+
+func (b leaseBackend) ReleaseLease() error {
+	etag := b.lockETag
+	b.lockETag = ""
+	// Check the owner as well as using a conditional delete, since not all
+	// S3-compatible implementations support conditional deletes.
+	lease, _, err := b.readLease()
+	if err != nil {
+		return err
+	}
+	if lease == nil || lease.Owner != b.locker.Owner() {
+		return fmt.Errorf("lock: %s/%s was lost", b.bucket, b.prefix)
+	}
+	if err := b.deleteObject(lockKey, etag); err != nil {
+		if isConditionFailed(err) || isNotFound(err) {
+			return fmt.Errorf("lock: %s/%s was lost", b.bucket, b.prefix)
+		}
+		return fmt.Errorf("error calling s3:DeleteObject: %s", err)
+	}
+	return nil
+}
+
+func (b leaseBackend) TryLease() (bool, error) {
+	etag, err := b.tryLock()
+	if err != nil || etag == "" {
+		return false, err
+	}
+	b.lockETag = etag
+	return true, nil
+}
+
+// createLock will create the lock object if it does not exist. If the lock
+// object was created, the ETag is returned, otherwise an empty string is
+// returned.
+func (ls *LockingStorer) createLock() (string, error) {
+	data, err := ls.makeLease()
+	if err != nil {
+		return "", err
+	}
+	etag, err := ls.putObject(lockKey, data, "", "*")
+	if err == nil {
+		return etag, nil
+	}
+	if isConditionFailed(err) {
+		return "", nil
+	}
+	return "", fmt.Errorf("error calling s3:PutObject: %s", err)
+}
+
+// deleteObject will delete an object. If ifMatch is not empty, the object is
+// only deleted if the existing object has a matching ETag.
+func (ls *LockingStorer) deleteObject(key, ifMatch string) error {
+	req, _ := ls.client.DeleteObjectRequest(&s3.DeleteObjectInput{
+		Bucket: aws.String(ls.bucket),
+		Key:    aws.String(ls.prefix + key),
+	})
+	if ifMatch != "" {
+		req.HTTPRequest.Header.Set("If-Match", ifMatch)
+	}
+	return req.Send()
+}
+
+func (ls *LockingStorer) makeLease() ([]byte, error) {
+	return json.Marshal(leaselocker.Lease{
+		Expires: time.Now().Add(ls.leaseDuration),
+		Owner:   ls.locker.Owner(),
+	})
+}
+
+// readLease reads the lease, returning the lease and the ETag of the lock
+// object. If there is no lease, nil is returned.
+func (ls *LockingStorer) readLease() (*leaselocker.Lease, string, error) {
+	data, etag, err := ls.getObject(lockKey)
+	if err != nil {
+		if isNotFound(err) {
+			return nil, "", nil
+		}
+		return nil, "", err
+	}
+	var lease leaselocker.Lease
+	if err := json.Unmarshal(data, &lease); err != nil {
+		ls.logger.Printf("ignoring corrupt lease: %s\n", err)
+		return &leaselocker.Lease{}, etag, nil
+	}
+	return &lease, etag, nil
+}
+
+// tryLock will try to take the lock. If the lock was taken, the ETag of the
+// lock object is returned, otherwise an empty string is returned.
+func (ls *LockingStorer) tryLock() (string, error) {
+	if etag, err := ls.createLock(); err != nil || etag != "" {
+		return etag, err
+	}
+	lease, etag, err := ls.readLease()
+	if err != nil {
+		return "", err
+	}
+	if lease == nil { // Deleted in the meantime: try again.
+		return "", nil
+	}
+	if time.Now().Before(lease.Expires) {
+		ls.logger.Debugf(0, "lock: %s/%s held by: %s for: %s, waiting\n",
+			ls.bucket, ls.prefix, lease.Owner,
+			format.Duration(time.Until(lease.Expires)))
+		return "", nil
+	}
+	// The lease has expired. Only delete the lock object if it has not been
+	// changed since it was read, so that the lock will not be stolen from an
+	// instance which has just taken it.
+	ls.logger.Printf("lock: %s/%s lease held by: %s expired, breaking\n",
+		ls.bucket, ls.prefix, lease.Owner)
+	err = ls.deleteObject(lockKey, etag)
+	if err != nil && !isConditionFailed(err) && !isNotFound(err) {
+		return "", fmt.Errorf("error calling s3:DeleteObject: %s", err)
+	}
+	return ls.createLock()
+}
@@ -0,0 +1,180 @@
+/*
+Package vault implements the Locker, Storer, AccountStorer, AccountDeleter and
+OCSPStorer interfaces using the HashiCorp Vault KV (version 2) secrets engine.
+The ChallengeStorer interface of the http package is also implemented.
+
+The certificate and ACME account are stored in the format used by the encoding
+package, in the "certificate" and "account" secrets under the configured path,
+respectively. The OCSP response is stored in the "ocsp" secret. Challenge
+responses are stored in "challenges/<token>" secrets, which are deleted
+(including all versions) after use.
+
+Locking uses the "lock" secret. The lock is taken by writing a new version of
+the secret using check-and-set (CAS), so that only one instance can take the
+lock. The lease expiry is recorded in the custom metadata of the secret and is
+extended (again using CAS) while the lock is held. If the lease expires, another
+instance may take the lock. If the lease could not be extended because another
+instance took the lock, a notification is sent to the channel returned by
+GetLostChannel.
+
+Vault token and AppRole authentication are supported.
+*/
+package vault
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/Cloud-Foundations/golib/pkg/crypto/certmanager"
+	cm_http "github.com/Cloud-Foundations/golib/pkg/crypto/certmanager/http"
+	"github.com/Cloud-Foundations/golib/pkg/crypto/certmanager/storage/internal/leaselocker"
+	"github.com/Cloud-Foundations/golib/pkg/log"
+)
+
+// Config contains the configuration for a LockingStorer.
+type Config struct {
+	// Address specifies the address of the Vault server. The default is the
+	// value of the VAULT_ADDR environment variable.
+	Address string
+
+	// AppRoleId specifies the role ID for AppRole authentication. If
+	// specified, AppRole authentication is used instead of Token. Optional.
+	AppRoleId string
+
+	// AppRoleMountPath specifies the mount path of the AppRole auth method.
+	// The default is "approle".
+	AppRoleMountPath string
+
+	// AppRoleSecretId specifies the secret ID for AppRole authentication.
+	AppRoleSecretId string
+
+	// LeaseDuration specifies how long the lock lease is valid for before it
+	// must be extended. The default is 15 minutes.
+	LeaseDuration time.Duration
+
+	// MountPath specifies the mount path of the KV secrets engine. The
+	// default is "secret".
+	MountPath string
+
+	// Namespace specifies the Vault Enterprise namespace. Optional.
+	Namespace string
+
+	// Path specifies the path (within the KV secrets engine) under which the
+	// secrets are stored (i.e. "certmanager/example.com"). Required.
+	Path string
+
+	// PollInterval specifies how often to check if the lock is available when
+	// waiting for the lock. The default is 15 seconds.
+	PollInterval time.Duration
+
+	// Token specifies the Vault token. The default is the value of the
+	// VAULT_TOKEN environment variable.
+	Token string
+}
+
+type LockingStorer struct {
+	address          string
+	appRoleId        string
+	appRoleMountPath string
+	appRoleSecretId  string
+	httpClient       *http.Client
+	leaseDuration    time.Duration
+	locker           *leaselocker.Locker
+	logger           log.DebugLogger
+	mountPath        string
+	namespace        string
+	path             string
+	lockVersion      uint64     // Protected by the locker.
+	tokenMutex       sync.Mutex // Protect token and tokenExpires.
+	token            string
+	tokenExpires     time.Time
+}
+
+// Params contains the parameters for a LockingStorer.
+type Params struct {
+	// HttpClient specifies the HTTP client to use. The default is a client
+	// with a 30 second timeout. Optional.
+	HttpClient *http.Client
+
+	Logger log.DebugLogger
+}
+
+// Interface checks.
+var _ certmanager.AccountDeleter = (*LockingStorer)(nil)
+var _ certmanager.AccountStorer = (*LockingStorer)(nil)
+var _ certmanager.ContextLocker = (*LockingStorer)(nil)
+var _ certmanager.Locker = (*LockingStorer)(nil)
+var _ certmanager.OCSPStorer = (*LockingStorer)(nil)
+var _ certmanager.Storer = (*LockingStorer)(nil)
+var _ cm_http.ChallengeStorer = (*LockingStorer)(nil)
+
+// New creates a *LockingStorer using the specified path in the default KV
+// secrets engine. The Vault address and token are read from the VAULT_ADDR
+// and VAULT_TOKEN environment variables.
+func New(path string, logger log.DebugLogger) (*LockingStorer, error) {
+	return newLS(Config{Path: path}, Params{Logger: logger})
+}
+
+// NewWithConfig creates a *LockingStorer using the provided configuration.
+func NewWithConfig(config Config, params Params) (*LockingStorer, error) {
+	return newLS(config, params)
+}
+
+func (ls *LockingStorer) DeleteAccount() error {
+	return ls.deleteAccount()
+}
+
+func (ls *LockingStorer) DeleteChallengeResponse(token string) error {
+	return ls.deleteChallengeResponse(token)
+}
+
+func (ls *LockingStorer) GetLostChannel() <-chan error {
+	return ls.locker.GetLostChannel()
+}
+
+func (ls *LockingStorer) Lock() error {
+	return ls.locker.Lock()
+}
+
+func (ls *LockingStorer) LockWithContext(ctx context.Context) error {
+	return ls.locker.LockWithContext(ctx)
+}
+
+func (ls *LockingStorer) Read() (*certmanager.Certificate, error) {
+	return ls.read()
+}
+
+func (ls *LockingStorer) ReadAccount() (*certmanager.Account, error) {
+	return ls.readAccount()
+}
+
+func (ls *LockingStorer) ReadChallengeResponse(token string) (string, error) {
+	return ls.readChallengeResponse(token)
+}
+
+func (ls *LockingStorer) ReadOCSP() ([]byte, error) {
+	return ls.readOCSP()
+}
+
+func (ls *LockingStorer) Unlock() error {
+	return ls.locker.Unlock()
+}
+
+func (ls *LockingStorer) Write(cert *certmanager.Certificate) error {
+	return ls.write(cert)
+}
+
+func (ls *LockingStorer) WriteAccount(account *certmanager.Account) error {
+	return ls.writeAccount(account)
+}
+
+func (ls *LockingStorer) WriteChallengeResponse(token,
+	response string) error {
+	return ls.writeChallengeResponse(token, response)
+}
+
+func (ls *LockingStorer) WriteOCSP(response []byte) error {
+	return ls.writeOCSP(response)
+}
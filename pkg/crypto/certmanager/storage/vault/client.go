@@ -0,0 +1,164 @@
+package vault
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const maxResponseSize = 1 << 20
+
+type loginRequest struct {
+	RoleId   string `json:"role_id"`
+	SecretId string `json:"secret_id"`
+}
+
+type loginResponse struct {
+	Auth struct {
+		ClientToken   string `json:"client_token"`
+		LeaseDuration int64  `json:"lease_duration"`
+	} `json:"auth"`
+}
+
+// vaultError is returned when the Vault server responds with an error status.
+type vaultError struct {
+	errors     []string
+	statusCode int
+}
+
+// isCASFailure returns true if err was caused by a check-and-set mismatch.
+func isCASFailure(err error) bool {
+	if vErr, ok := err.(*vaultError); ok {
+		return vErr.statusCode == http.StatusBadRequest &&
+			strings.Contains(strings.Join(vErr.errors, " "), "check-and-set")
+	}
+	return false
+}
+
+// isNotFound returns true if err was caused by a missing secret.
+func isNotFound(err error) bool {
+	if vErr, ok := err.(*vaultError); ok {
+		return vErr.statusCode == http.StatusNotFound
+	}
+	return false
+}
+
+// doRequest will send a request to the Vault API. If body is not nil, it is
+// sent as JSON. If result is not nil, the response is decoded into it.
+func (ls *LockingStorer) doRequest(method, path string, body,
+	result interface{}) error {
+	err := ls.doRequestOnce(method, path, body, result)
+	if vErr, ok := err.(*vaultError); ok &&
+		vErr.statusCode == http.StatusForbidden && ls.appRoleId != "" {
+		// The token may have been revoked: log in again.
+		ls.tokenMutex.Lock()
+		ls.token = ""
+		ls.tokenMutex.Unlock()
+		err = ls.doRequestOnce(method, path, body, result)
+	}
+	return err
+}
+
+func (ls *LockingStorer) doRequestOnce(method, path string, body,
+	result interface{}) error {
+	token, err := ls.getToken()
+	if err != nil {
+		return err
+	}
+	return ls.sendRequest(method, path, token, body, result)
+}
+
+// getToken will return the Vault token, logging in with AppRole if required.
+func (ls *LockingStorer) getToken() (string, error) {
+	ls.tokenMutex.Lock()
+	defer ls.tokenMutex.Unlock()
+	if ls.appRoleId == "" {
+		return ls.token, nil
+	}
+	if ls.token != "" && (ls.tokenExpires.IsZero() ||
+		time.Until(ls.tokenExpires) > time.Minute) {
+		return ls.token, nil
+	}
+	var response loginResponse
+	err := ls.sendRequest(http.MethodPost,
+		"auth/"+ls.appRoleMountPath+"/login", "",
+		loginRequest{RoleId: ls.appRoleId, SecretId: ls.appRoleSecretId},
+		&response)
+	if err != nil {
+		return "", fmt.Errorf("error logging in with AppRole: %s", err)
+	}
+	if response.Auth.ClientToken == "" {
+		return "", errors.New("no token from AppRole login")
+	}
+	ls.token = response.Auth.ClientToken
+	if response.Auth.LeaseDuration > 0 {
+		ls.tokenExpires = time.Now().Add(
+			time.Duration(response.Auth.LeaseDuration) * time.Second)
+	} else {
+		ls.tokenExpires = time.Time{}
+	}
+	ls.logger.Debugf(0, "logged in to Vault with AppRole: %s\n", ls.appRoleId)
+	return ls.token, nil
+}
+
+func (ls *LockingStorer) sendRequest(method, path, token string, body,
+	result interface{}) error {
+	var reader io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reader = bytes.NewReader(data)
+	}
+	req, err := http.NewRequest(method, ls.address+"/v1/"+path, reader)
+	if err != nil {
+		return err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if token != "" {
+		req.Header.Set("X-Vault-Token", token)
+	}
+	if ls.namespace != "" {
+		req.Header.Set("X-Vault-Namespace", ls.namespace)
+	}
+	resp, err := ls.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxResponseSize))
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode >= 400 {
+		vErr := &vaultError{statusCode: resp.StatusCode}
+		var errorResponse struct {
+			Errors []string `json:"errors"`
+		}
+		if json.Unmarshal(data, &errorResponse) == nil {
+			vErr.errors = errorResponse.Errors
+		}
+		return vErr
+	}
+	if result == nil || len(data) < 1 {
+		return nil
+	}
+	return json.Unmarshal(data, result)
+}
+
+func (e *vaultError) Error() string {
+	if len(e.errors) < 1 {
+		return fmt.Sprintf("Vault error: %s", http.StatusText(e.statusCode))
+	}
+	return fmt.Sprintf("Vault error: %s: %s",
+		http.StatusText(e.statusCode), strings.Join(e.errors, ", "))
+}
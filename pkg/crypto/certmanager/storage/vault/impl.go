@@ -0,0 +1,303 @@
+package vault
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/Cloud-Foundations/golib/pkg/crypto/certmanager"
+	"github.com/Cloud-Foundations/golib/pkg/crypto/certmanager/encoding"
+	"github.com/Cloud-Foundations/golib/pkg/crypto/certmanager/storage/internal/leaselocker"
+)
+
+const (
+	accountSecret    = "account"
+	certSecret       = "certificate"
+	challengesSecret = "challenges"
+	lockSecret       = "lock"
+	ocspSecret       = "ocsp"
+	valueKey         = "value"
+
+	defaultAppRoleMountPath = "approle"
+	defaultLeaseDuration    = time.Minute * 15
+	defaultMountPath        = "secret"
+	defaultPollInterval     = time.Second * 15
+)
+
+type readSecretResponse struct {
+	Data struct {
+		Data map[string]string `json:"data"`
+	} `json:"data"`
+}
+
+type writeSecretOptions struct {
+	Cas *uint64 `json:"cas,omitempty"`
+}
+
+type writeSecretRequest struct {
+	Data    map[string]string  `json:"data"`
+	Options writeSecretOptions `json:"options"`
+}
+
+type writeSecretResponse struct {
+	Data struct {
+		Version uint64 `json:"version"`
+	} `json:"data"`
+}
+
+func newLS(config Config, params Params) (*LockingStorer, error) {
+	if config.Path == "" {
+		return nil, errors.New("no path specified")
+	}
+	if config.Address == "" {
+		config.Address = os.Getenv("VAULT_ADDR")
+		if config.Address == "" {
+			return nil, errors.New("no Vault address specified")
+		}
+	}
+	if config.AppRoleMountPath == "" {
+		config.AppRoleMountPath = defaultAppRoleMountPath
+	}
+	if config.LeaseDuration <= 0 {
+		config.LeaseDuration = defaultLeaseDuration
+	}
+	if config.MountPath == "" {
+		config.MountPath = defaultMountPath
+	}
+	if config.PollInterval <= 0 {
+		config.PollInterval = defaultPollInterval
+	}
+	if config.AppRoleId == "" && config.Token == "" {
+		config.Token = os.Getenv("VAULT_TOKEN")
+		if config.Token == "" {
+			return nil, errors.New("no Vault token or AppRole specified")
+		}
+	}
+	if params.HttpClient == nil {
+		params.HttpClient = &http.Client{Timeout: time.Second * 30}
+	}
+	ls := &LockingStorer{
+		address:          strings.TrimSuffix(config.Address, "/"),
+		appRoleId:        config.AppRoleId,
+		appRoleMountPath: strings.Trim(config.AppRoleMountPath, "/"),
+		appRoleSecretId:  config.AppRoleSecretId,
+		httpClient:       params.HttpClient,
+		leaseDuration:    config.LeaseDuration,
+		logger:           params.Logger,
+		mountPath:        strings.Trim(config.MountPath, "/"),
+		namespace:        config.Namespace,
+		path:             strings.Trim(config.Path, "/"),
+		token:            config.Token,
+	}
+	locker, err := leaselocker.New(
+		leaselocker.Config{
+			LeaseDuration: config.LeaseDuration,
+			Name:          ls.path,
+			PollInterval:  config.PollInterval,
+		},
+		leaselocker.Params{
+			Backend: leaseBackend{ls},
+			Logger:  params.Logger,
+		})
+	if err != nil {
+		return nil, err
+	}
+	ls.locker = locker
+	return ls, nil
+}
+
+// challengeSecret returns the name of the secret for the challenge token.
+func challengeSecret(token string) (string, error) {
+	if token == "" || strings.ContainsAny(token, "./") {
+		return "", fmt.Errorf("invalid challenge token: %s", token)
+	}
+	return challengesSecret + "/" + token, nil
+}
+
+func (ls *LockingStorer) dataPath(name string) string {
+	return ls.mountPath + "/data/" + ls.path + "/" + name
+}
+
+// deleteAccount will delete all versions of the secret for the ACME account.
+func (ls *LockingStorer) deleteAccount() error {
+	err := ls.doRequest(http.MethodDelete, ls.metadataPath(accountSecret),
+		nil, nil)
+	if err != nil {
+		return fmt.Errorf("error deleting secret: %s/%s: %s",
+			ls.path, accountSecret, err)
+	}
+	ls.logger.Printf("deleted ACME account from Vault: %s\n", ls.path)
+	return nil
+}
+
+// deleteChallengeResponse will delete all versions of the secret for the
+// challenge token.
+func (ls *LockingStorer) deleteChallengeResponse(token string) error {
+	name, err := challengeSecret(token)
+	if err != nil {
+		return err
+	}
+	err = ls.doRequest(http.MethodDelete, ls.metadataPath(name), nil, nil)
+	if err != nil {
+		return fmt.Errorf("error deleting secret: %s/%s: %s",
+			ls.path, name, err)
+	}
+	ls.logger.Debugf(0, "deleted challenge response from Vault: %s\n",
+		ls.path)
+	return nil
+}
+
+func (ls *LockingStorer) metadataPath(name string) string {
+	return ls.mountPath + "/metadata/" + ls.path + "/" + name
+}
+
+func (ls *LockingStorer) read() (*certmanager.Certificate, error) {
+	value, err := ls.readValue(certSecret)
+	if err != nil {
+		return nil, err
+	}
+	cert, err := encoding.DecodeCert(value)
+	if err != nil {
+		return nil, err
+	}
+	ls.logger.Printf("read certificate from Vault: %s\n", ls.path)
+	return cert, nil
+}
+
+func (ls *LockingStorer) readAccount() (*certmanager.Account, error) {
+	value, err := ls.readValue(accountSecret)
+	if err != nil {
+		return nil, err
+	}
+	account, err := encoding.DecodeAccount(value)
+	if err != nil {
+		return nil, err
+	}
+	ls.logger.Printf("read ACME account from Vault: %s\n", ls.path)
+	return account, nil
+}
+
+func (ls *LockingStorer) readChallengeResponse(token string) (string, error) {
+	name, err := challengeSecret(token)
+	if err != nil {
+		return "", err
+	}
+	response, err := ls.readValue(name)
+	if err != nil {
+		return "", err
+	}
+	ls.logger.Debugf(1, "read challenge response from Vault: %s\n", ls.path)
+	return response, nil
+}
+
+func (ls *LockingStorer) readOCSP() ([]byte, error) {
+	value, err := ls.readValue(ocspSecret)
+	if err != nil {
+		return nil, err
+	}
+	response, err := base64.StdEncoding.DecodeString(value)
+	if err != nil {
+		return nil, err
+	}
+	ls.logger.Debugf(0, "read OCSP response from Vault: %s\n", ls.path)
+	return response, nil
+}
+
+// readSecret will read the latest version of a secret.
+func (ls *LockingStorer) readSecret(name string) (map[string]string, error) {
+	var response readSecretResponse
+	err := ls.doRequest(http.MethodGet, ls.dataPath(name), nil, &response)
+	if err != nil {
+		return nil, err
+	}
+	if response.Data.Data == nil { // The latest version was deleted.
+		return nil, &vaultError{statusCode: http.StatusNotFound}
+	}
+	return response.Data.Data, nil
+}
+
+func (ls *LockingStorer) readValue(name string) (string, error) {
+	data, err := ls.readSecret(name)
+	if err != nil {
+		return "", fmt.Errorf("error reading secret: %s/%s: %s",
+			ls.path, name, err)
+	}
+	value, ok := data[valueKey]
+	if !ok {
+		return "", fmt.Errorf("no %s in secret: %s/%s", valueKey, ls.path, name)
+	}
+	return value, nil
+}
+
+func (ls *LockingStorer) write(cert *certmanager.Certificate) error {
+	value, err := encoding.EncodeCert(cert)
+	if err != nil {
+		return err
+	}
+	if err := ls.writeValue(certSecret, value); err != nil {
+		return err
+	}
+	ls.logger.Printf("wrote certificate to Vault: %s\n", ls.path)
+	return nil
+}
+
+func (ls *LockingStorer) writeAccount(account *certmanager.Account) error {
+	value, err := encoding.EncodeAccount(account)
+	if err != nil {
+		return err
+	}
+	if err := ls.writeValue(accountSecret, value); err != nil {
+		return err
+	}
+	ls.logger.Printf("wrote ACME account to Vault: %s\n", ls.path)
+	return nil
+}
+
+func (ls *LockingStorer) writeChallengeResponse(token, response string) error {
+	name, err := challengeSecret(token)
+	if err != nil {
+		return err
+	}
+	if err := ls.writeValue(name, response); err != nil {
+		return err
+	}
+	ls.logger.Debugf(0, "wrote challenge response to Vault: %s\n", ls.path)
+	return nil
+}
+
+func (ls *LockingStorer) writeOCSP(response []byte) error {
+	err := ls.writeValue(ocspSecret,
+		base64.StdEncoding.EncodeToString(response))
+	if err != nil {
+		return err
+	}
+	ls.logger.Debugf(0, "wrote OCSP response to Vault: %s\n", ls.path)
+	return nil
+}
+
+// writeSecret will write a new version of a secret. If cas is not nil, the
+// secret is only written if the current version matches (0 if the secret does
+// not exist). The new version is returned.
+func (ls *LockingStorer) writeSecret(name string, data map[string]string,
+	cas *uint64) (uint64, error) {
+	var response writeSecretResponse
+	err := ls.doRequest(http.MethodPost, ls.dataPath(name),
+		writeSecretRequest{Data: data, Options: writeSecretOptions{Cas: cas}},
+		&response)
+	if err != nil {
+		return 0, err
+	}
+	return response.Data.Version, nil
+}
+
+func (ls *LockingStorer) writeValue(name, value string) error {
+	_, err := ls.writeSecret(name, map[string]string{valueKey: value}, nil)
+	if err != nil {
+		return fmt.Errorf("error writing secret: %s/%s: %s", ls.path, name, err)
+	}
+	return nil
+}
@@ -0,0 +1,416 @@
+package vault
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Cloud-Foundations/golib/pkg/crypto/certmanager"
+	"github.com/Cloud-Foundations/golib/pkg/log/testlogger"
+)
+
+const (
+	testRoleId   = "test-role"
+	testSecretId = "test-secret"
+	testToken    = "test-token"
+)
+
+type testSecret struct {
+	customMetadata map[string]string
+	versions       []testVersion
+}
+
+// testServer is a minimal stand-in for a Vault server with the KV version 2
+// secrets engine mounted at "secret" and the AppRole auth method.
+type testServer struct {
+	mutex   sync.Mutex
+	logins  uint
+	secrets map[string]*testSecret
+}
+
+type testVersion struct {
+	createdTime time.Time
+	data        map[string]string
+}
+
+func makeTestCert(t *testing.T) *certmanager.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		DNSNames:     []string{"www.example.com"},
+		NotAfter:     time.Now().Add(time.Hour),
+		NotBefore:    time.Now().Add(-time.Hour),
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "www.example.com"},
+	}
+	certDER, err := x509.CreateCertificate(rand.Reader, template, template,
+		key.Public(), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &certmanager.Certificate{
+		CertPemBlock: pem.EncodeToMemory(
+			&pem.Block{Type: "CERTIFICATE", Bytes: certDER}),
+		KeyPemBlock: pem.EncodeToMemory(
+			&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}),
+	}
+}
+
+func makeTestServer(t *testing.T) (*testServer, string) {
+	ts := &testServer{secrets: make(map[string]*testSecret)}
+	server := httptest.NewServer(ts)
+	t.Cleanup(server.Close)
+	return ts, server.URL
+}
+
+func makeTestStorer(t *testing.T, address string) *LockingStorer {
+	ls, err := NewWithConfig(
+		Config{
+			Address:       address,
+			LeaseDuration: time.Millisecond * 300,
+			Path:          "certmanager/www.example.com",
+			PollInterval:  time.Millisecond * 10,
+			Token:         testToken,
+		},
+		Params{Logger: testlogger.New(t)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ls
+}
+
+func writeErrors(w http.ResponseWriter, status int, errors ...string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string][]string{"errors": errors})
+}
+
+func writeJSON(w http.ResponseWriter, value interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(value)
+}
+
+func (ts *testServer) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	ts.mutex.Lock()
+	defer ts.mutex.Unlock()
+	if req.URL.Path == "/v1/auth/approle/login" {
+		var request loginRequest
+		if err := json.NewDecoder(req.Body).Decode(&request); err != nil {
+			writeErrors(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		if request.RoleId != testRoleId || request.SecretId != testSecretId {
+			writeErrors(w, http.StatusBadRequest, "invalid role or secret ID")
+			return
+		}
+		ts.logins++
+		writeJSON(w, map[string]interface{}{
+			"auth": map[string]interface{}{
+				"client_token":   testToken,
+				"lease_duration": 3600,
+			},
+		})
+		return
+	}
+	if req.Header.Get("X-Vault-Token") != testToken {
+		writeErrors(w, http.StatusForbidden, "permission denied")
+		return
+	}
+	const dataPrefix = "/v1/secret/data/"
+	const metadataPrefix = "/v1/secret/metadata/"
+	switch {
+	case strings.HasPrefix(req.URL.Path, dataPrefix):
+		ts.handleData(w, req, req.URL.Path[len(dataPrefix):])
+	case strings.HasPrefix(req.URL.Path, metadataPrefix):
+		ts.handleMetadata(w, req, req.URL.Path[len(metadataPrefix):])
+	default:
+		writeErrors(w, http.StatusNotFound)
+	}
+}
+
+func (ts *testServer) handleData(w http.ResponseWriter, req *http.Request,
+	path string) {
+	secret := ts.secrets[path]
+	switch req.Method {
+	case http.MethodGet:
+		if secret == nil {
+			writeErrors(w, http.StatusNotFound)
+			return
+		}
+		version := secret.versions[len(secret.versions)-1]
+		writeJSON(w, map[string]interface{}{
+			"data": map[string]interface{}{"data": version.data},
+		})
+	case http.MethodPost:
+		var request writeSecretRequest
+		if err := json.NewDecoder(req.Body).Decode(&request); err != nil {
+			writeErrors(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		if secret == nil {
+			secret = &testSecret{}
+		}
+		if request.Options.Cas != nil &&
+			*request.Options.Cas != uint64(len(secret.versions)) {
+			writeErrors(w, http.StatusBadRequest,
+				"check-and-set parameter did not match the current version")
+			return
+		}
+		secret.versions = append(secret.versions, testVersion{
+			createdTime: time.Now(),
+			data:        request.Data,
+		})
+		ts.secrets[path] = secret
+		writeJSON(w, map[string]interface{}{
+			"data": map[string]interface{}{"version": len(secret.versions)},
+		})
+	default:
+		writeErrors(w, http.StatusMethodNotAllowed)
+	}
+}
+
+func (ts *testServer) handleMetadata(w http.ResponseWriter, req *http.Request,
+	path string) {
+	secret := ts.secrets[path]
+	switch req.Method {
+	case http.MethodGet:
+		if secret == nil {
+			writeErrors(w, http.StatusNotFound)
+			return
+		}
+		versions := make(map[string]interface{})
+		for index, version := range secret.versions {
+			versions[strconv.Itoa(index+1)] = map[string]interface{}{
+				"created_time": version.createdTime,
+			}
+		}
+		writeJSON(w, map[string]interface{}{
+			"data": map[string]interface{}{
+				"current_version": len(secret.versions),
+				"custom_metadata": secret.customMetadata,
+				"versions":        versions,
+			},
+		})
+	case http.MethodPost:
+		var request metadataRequest
+		if err := json.NewDecoder(req.Body).Decode(&request); err != nil {
+			writeErrors(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		if secret == nil {
+			secret = &testSecret{}
+			ts.secrets[path] = secret
+		}
+		secret.customMetadata = request.CustomMetadata
+		w.WriteHeader(http.StatusNoContent)
+	case http.MethodDelete:
+		delete(ts.secrets, path)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		writeErrors(w, http.StatusMethodNotAllowed)
+	}
+}
+
+func (ts *testServer) setMetadata(path string, metadata map[string]string) {
+	ts.mutex.Lock()
+	defer ts.mutex.Unlock()
+	ts.secrets[path].customMetadata = metadata
+}
+
+func (ts *testServer) writeSecret(path string, data map[string]string) uint64 {
+	ts.mutex.Lock()
+	defer ts.mutex.Unlock()
+	secret := ts.secrets[path]
+	if secret == nil {
+		secret = &testSecret{}
+		ts.secrets[path] = secret
+	}
+	secret.versions = append(secret.versions, testVersion{
+		createdTime: time.Now(),
+		data:        data,
+	})
+	return uint64(len(secret.versions))
+}
+
+func TestAppRole(t *testing.T) {
+	ts, address := makeTestServer(t)
+	ls, err := NewWithConfig(
+		Config{
+			Address:         address,
+			AppRoleId:       testRoleId,
+			AppRoleSecretId: testSecretId,
+			Path:            "certmanager/www.example.com",
+		},
+		Params{Logger: testlogger.New(t)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ls.WriteOCSP([]byte("response")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ls.ReadOCSP(); err != nil {
+		t.Fatal(err)
+	}
+	ts.mutex.Lock()
+	defer ts.mutex.Unlock()
+	if ts.logins != 1 {
+		t.Fatalf("logins: %d != 1", ts.logins)
+	}
+}
+
+func TestExpiredLease(t *testing.T) {
+	ts, address := makeTestServer(t)
+	ls := makeTestStorer(t, address)
+	// Simulate an instance which died while holding the lock.
+	path := "certmanager/www.example.com/" + lockSecret
+	version := ts.writeSecret(path, map[string]string{ownerKey: "dead"})
+	ts.setMetadata(path, map[string]string{
+		expiresKey: time.Now().Add(-time.Minute).Format(time.RFC3339Nano),
+		ownerKey:   "dead",
+		versionKey: strconv.FormatUint(version, 10),
+	})
+	locked := make(chan error, 1)
+	go func() { locked <- ls.Lock() }()
+	select {
+	case err := <-locked:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(time.Second * 5):
+		t.Fatal("timed out waiting for lock")
+	}
+	if err := ls.Unlock(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLock(t *testing.T) {
+	_, address := makeTestServer(t)
+	ls1 := makeTestStorer(t, address)
+	ls2 := makeTestStorer(t, address)
+	if err := ls1.Lock(); err != nil {
+		t.Fatal(err)
+	}
+	if err := ls1.Lock(); err == nil {
+		t.Fatal("no error locking twice")
+	}
+	locked := make(chan error, 1)
+	go func() { locked <- ls2.Lock() }()
+	// The lease is extended, so the lock should not be taken.
+	select {
+	case <-locked:
+		t.Fatal("lock taken while held")
+	case <-time.After(time.Second):
+	}
+	if err := ls1.Unlock(); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case err := <-locked:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(time.Second * 5):
+		t.Fatal("timed out waiting for lock")
+	}
+	if err := ls2.Unlock(); err != nil {
+		t.Fatal(err)
+	}
+	if err := ls2.Unlock(); err == nil {
+		t.Fatal("no error unlocking twice")
+	}
+}
+
+func TestLostLock(t *testing.T) {
+	ts, address := makeTestServer(t)
+	ls := makeTestStorer(t, address)
+	if err := ls.Lock(); err != nil {
+		t.Fatal(err)
+	}
+	lostChannel := ls.GetLostChannel()
+	// Simulate another instance taking over an expired lease.
+	ts.writeSecret("certmanager/www.example.com/"+lockSecret,
+		map[string]string{ownerKey: "another-instance"})
+	select {
+	case err := <-lostChannel:
+		if err == nil {
+			t.Fatal("nil error on lost channel")
+		}
+	case <-time.After(time.Second * 5):
+		t.Fatal("timed out waiting for lost lock notification")
+	}
+	if err := ls.Unlock(); err == nil {
+		t.Fatal("no error unlocking lost lock")
+	}
+}
+
+func TestReadWrite(t *testing.T) {
+	_, address := makeTestServer(t)
+	ls := makeTestStorer(t, address)
+	if _, err := ls.Read(); err == nil {
+		t.Fatal("no error reading missing certificate")
+	}
+	cert := makeTestCert(t)
+	if err := ls.Write(cert); err != nil {
+		t.Fatal(err)
+	}
+	readCert, err := ls.Read()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(readCert.CertPemBlock) != string(cert.CertPemBlock) {
+		t.Fatal("certificate PEM mismatch")
+	}
+	account := &certmanager.Account{
+		KeyPemBlock: cert.KeyPemBlock,
+		URL:         "https://ca.example.com/acct/1",
+	}
+	if err := ls.WriteAccount(account); err != nil {
+		t.Fatal(err)
+	}
+	if readAccount, err := ls.ReadAccount(); err != nil {
+		t.Fatal(err)
+	} else if readAccount.URL != account.URL {
+		t.Fatalf("account URL: %s != %s", readAccount.URL, account.URL)
+	}
+	if err := ls.WriteOCSP([]byte("response")); err != nil {
+		t.Fatal(err)
+	}
+	if response, err := ls.ReadOCSP(); err != nil {
+		t.Fatal(err)
+	} else if string(response) != "response" {
+		t.Fatalf("OCSP response: %s", string(response))
+	}
+	if err := ls.WriteChallengeResponse("token", "token.key"); err != nil {
+		t.Fatal(err)
+	}
+	if response, err := ls.ReadChallengeResponse("token"); err != nil {
+		t.Fatal(err)
+	} else if response != "token.key" {
+		t.Fatalf("challenge response: %s", response)
+	}
+	if err := ls.DeleteChallengeResponse("token"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ls.ReadChallengeResponse("token"); err == nil {
+		t.Fatal("no error reading deleted challenge response")
+	}
+}
@@ -0,0 +1,169 @@
+package vault
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/Cloud-Foundations/Dominator/lib/format"
+	"github.com/Cloud-Foundations/golib/pkg/crypto/certmanager/storage/internal/leaselocker"
+)
+
+const (
+	expiresKey = "expires"
+	ownerKey   = "owner"
+	versionKey = "version"
+)
+
+// leaseBackend implements the leaselocker.Backend interface.
+type leaseBackend struct {
+	*LockingStorer
+}
+
+type metadataRequest struct {
+	CustomMetadata map[string]string `json:"custom_metadata"`
+}
+
+type metadataResponse struct {
+	Data struct {
+		CurrentVersion uint64            `json:"current_version"`
+		CustomMetadata map[string]string `json:"custom_metadata"`
+		Versions       map[string]struct {
+			CreatedTime time.Time `json:"created_time"`
+		} `json:"versions"`
+	} `json:"data"`
+}
+
+func (b leaseBackend) ExtendLease() (string, error) {
+	owner := b.locker.Owner()
+	version, err := b.writeLockSecret(owner, b.lockVersion)
+	if err != nil {
+		if !isCASFailure(err) {
+			return "", err
+		}
+		if lease, _, err := b.readLease(); err != nil {
+			return "unknown", nil
+		} else if lease == nil || lease.Owner == "" {
+			return "nobody", nil
+		} else {
+			return lease.Owner, nil
+		}
+	}
+	b.lockVersion = version
+	return owner, nil
+}
+
+func (b leaseBackend) ReleaseLease() error {
+	_, err := b.writeLockSecret("", b.lockVersion)
+	b.lockVersion = 0
+	if err != nil {
+		if isCASFailure(err) {
+			return fmt.Errorf("lock: %s was lost", b.path)
+		}
+		return fmt.Errorf("error writing lock: %s: %s", b.path, err)
+	}
+	return nil
+}
+
+func (b leaseBackend) TryLease() (bool, error) {
+	version, err := b.tryLock()
+	if err != nil || version < 1 {
+		return false, err
+	}
+	b.lockVersion = version
+	return true, nil
+}
+
+// readLease reads the lease, returning the lease and the current version of
+// the lock secret. If there is no lock secret, nil is returned. An empty Owner
+// indicates that the lock is not held.
+func (ls *LockingStorer) readLease() (*leaselocker.Lease, uint64, error) {
+	var response metadataResponse
+	err := ls.doRequest(http.MethodGet, ls.metadataPath(lockSecret), nil,
+		&response)
+	if err != nil {
+		if isNotFound(err) {
+			return nil, 0, nil
+		}
+		return nil, 0, err
+	}
+	currentVersion := response.Data.CurrentVersion
+	metadata := response.Data.CustomMetadata
+	if metadata[versionKey] == strconv.FormatUint(currentVersion, 10) {
+		lease := &leaselocker.Lease{Owner: metadata[ownerKey]}
+		if lease.Owner != "" {
+			lease.Expires, err = time.Parse(time.RFC3339Nano,
+				metadata[expiresKey])
+			if err != nil {
+				ls.logger.Printf("ignoring corrupt lease: %s\n", err)
+			}
+		}
+		return lease, currentVersion, nil
+	}
+	// The metadata have not (yet) been updated for the current version, so
+	// use the creation time of the version to compute the lease expiry.
+	data, err := ls.readSecret(lockSecret)
+	if err != nil {
+		if isNotFound(err) {
+			return nil, currentVersion, nil
+		}
+		return nil, 0, err
+	}
+	lease := &leaselocker.Lease{Owner: data[ownerKey]}
+	versionName := strconv.FormatUint(currentVersion, 10)
+	if version, ok := response.Data.Versions[versionName]; ok {
+		lease.Expires = version.CreatedTime.Add(ls.leaseDuration)
+	}
+	return lease, currentVersion, nil
+}
+
+// tryLock will try to take the lock. If the lock was taken, the new version
+// of the lock secret is returned, otherwise 0 is returned.
+func (ls *LockingStorer) tryLock() (uint64, error) {
+	lease, currentVersion, err := ls.readLease()
+	if err != nil {
+		return 0, fmt.Errorf("error reading lease: %s: %s", ls.path, err)
+	}
+	if lease != nil && lease.Owner != "" && time.Now().Before(lease.Expires) {
+		ls.logger.Debugf(0, "lock: %s held by: %s for: %s, waiting\n",
+			ls.path, lease.Owner, format.Duration(time.Until(lease.Expires)))
+		return 0, nil
+	}
+	version, err := ls.writeLockSecret(ls.locker.Owner(), currentVersion)
+	if err != nil {
+		if isCASFailure(err) {
+			return 0, nil
+		}
+		return 0, fmt.Errorf("error writing lock: %s: %s", ls.path, err)
+	}
+	return version, nil
+}
+
+// writeLockSecret will write a new version of the lock secret using
+// check-and-set and then record the lease in the metadata. If owner is empty,
+// the lock is released. The new version is returned.
+func (ls *LockingStorer) writeLockSecret(owner string, cas uint64) (
+	uint64, error) {
+	version, err := ls.writeSecret(lockSecret,
+		map[string]string{ownerKey: owner}, &cas)
+	if err != nil {
+		return 0, err
+	}
+	metadata := map[string]string{
+		ownerKey:   owner,
+		versionKey: strconv.FormatUint(version, 10),
+	}
+	if owner != "" {
+		metadata[expiresKey] = time.Now().Add(ls.leaseDuration).Format(
+			time.RFC3339Nano)
+	}
+	// Failure to write the metadata is not fatal, since the lease expiry will
+	// be computed from the creation time of the version.
+	err = ls.doRequest(http.MethodPost, ls.metadataPath(lockSecret),
+		metadataRequest{CustomMetadata: metadata}, nil)
+	if err != nil {
+		ls.logger.Printf("error writing lease metadata: %s: %s\n", ls.path, err)
+	}
+	return version, nil
+}
@@ -0,0 +1,22 @@
+package certmanager
+
+import (
+	"crypto/tls"
+
+	"golang.org/x/crypto/acme"
+)
+
+func isAcmeTLSHello(hello *tls.ClientHelloInfo) bool {
+	return hello != nil && len(hello.SupportedProtos) == 1 &&
+		hello.SupportedProtos[0] == acme.ALPNProto
+}
+
+func (cm *CertificateManager) respondTLSALPN(client *acme.Client,
+	domain string, challenge *acme.Challenge) error {
+	// The key authorisation is the same as the http-01 response.
+	keyAuthorisation, err := client.HTTP01ChallengeResponse(challenge.Token)
+	if err != nil {
+		return err
+	}
+	return cm.responder.Respond(domain, keyAuthorisation)
+}
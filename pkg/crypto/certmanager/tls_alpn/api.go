@@ -0,0 +1,67 @@
+/*
+Package tls_alpn implements a tls-alpn-01 ACME protocol responder.
+
+The responder answers TLS handshakes which negotiate the "acme-tls/1"
+application protocol with a challenge certificate. It may be used with the
+listener which serves normal HTTPS traffic by using the
+certmanager.CertificateManager.GetCertificate method (which will consult the
+responder) and adding "acme-tls/1" to the crypto/tls.Config.NextProtos field.
+Alternatively, a dedicated server may be created with NewServer.
+*/
+package tls_alpn
+
+import (
+	"crypto/tls"
+	"sync"
+
+	"github.com/Cloud-Foundations/golib/pkg/crypto/certmanager"
+	"github.com/Cloud-Foundations/golib/pkg/log"
+)
+
+// ProtocolName is the ALPN protocol name used for tls-alpn-01 challenges.
+const ProtocolName = "acme-tls/1"
+
+type Responder struct {
+	logger       log.DebugLogger
+	rwMutex      sync.RWMutex                // Protect everything below.
+	certificates map[string]*tls.Certificate // Key: domain.
+}
+
+// Interface checks.
+var _ certmanager.TLSResponder = (*Responder)(nil)
+
+// New creates a *Responder for ACME "tls-alpn-01" challenges. The
+// GetCertificate method must be called from the TLS listener that serves the
+// domain(s) (typically on port 443).
+// The logger is used for logging messages.
+func New(logger log.DebugLogger) (*Responder, error) {
+	return newResponder(logger)
+}
+
+// NewServer creates a TLS server on port number portNum which only responds
+// to ACME "tls-alpn-01" challenges. This should normally be 443, unless your
+// firewall is configured to DNAT from port 443 on a public IP to portNum.
+// All other connections are rejected during the TLS handshake.
+// The logger is used for logging messages.
+func NewServer(portNum uint16, logger log.DebugLogger) (*Responder, error) {
+	return newServer(portNum, logger)
+}
+
+func (r *Responder) Cleanup() {
+	r.cleanup()
+}
+
+// GetChallengeCertificate will return the challenge certificate for the server
+// name in the TLS ClientHello. An error is returned if the client did not
+// request the "acme-tls/1" application protocol or if there is no challenge
+// certificate for the server name.
+func (r *Responder) GetChallengeCertificate(hello *tls.ClientHelloInfo) (
+	*tls.Certificate, error) {
+	return r.getChallengeCertificate(hello)
+}
+
+// Respond will create a challenge certificate for the domain specified by key,
+// using the key authorisation specified by value.
+func (r *Responder) Respond(key, value string) error {
+	return r.respond(key, value)
+}
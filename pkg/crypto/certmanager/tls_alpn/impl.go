@@ -0,0 +1,146 @@
+package tls_alpn
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"errors"
+	"fmt"
+	"math/big"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Cloud-Foundations/golib/pkg/log"
+)
+
+// idPeAcmeIdentifier is the OID for the acmeIdentifier X.509 extension.
+var idPeAcmeIdentifier = asn1.ObjectIdentifier{1, 3, 6, 1, 5, 5, 7, 1, 31}
+
+func makeChallengeCertificate(domain, keyAuthorisation string) (
+	*tls.Certificate, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	digest := sha256.Sum256([]byte(keyAuthorisation))
+	extensionValue, err := asn1.Marshal(digest[:])
+	if err != nil {
+		return nil, err
+	}
+	serialNumber, err := rand.Int(rand.Reader, big.NewInt(1<<62))
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	template := &x509.Certificate{
+		SerialNumber: serialNumber,
+		Subject:      pkix.Name{CommonName: "ACME tls-alpn-01 challenge"},
+		NotBefore:    now.Add(-time.Hour),
+		NotAfter:     now.Add(time.Hour * 24),
+		DNSNames:     []string{domain},
+		ExtraExtensions: []pkix.Extension{
+			{
+				Id:       idPeAcmeIdentifier,
+				Critical: true,
+				Value:    extensionValue,
+			},
+		},
+	}
+	certDER, err := x509.CreateCertificate(rand.Reader, template, template,
+		key.Public(), key)
+	if err != nil {
+		return nil, err
+	}
+	return &tls.Certificate{
+		Certificate: [][]byte{certDER},
+		PrivateKey:  key,
+	}, nil
+}
+
+func newResponder(logger log.DebugLogger) (*Responder, error) {
+	return &Responder{
+		logger:       logger,
+		certificates: make(map[string]*tls.Certificate),
+	}, nil
+}
+
+func newServer(portNum uint16, logger log.DebugLogger) (*Responder, error) {
+	responder, err := newResponder(logger)
+	if err != nil {
+		return nil, err
+	}
+	listener, err := tls.Listen("tcp",
+		":"+strconv.FormatInt(int64(portNum), 10),
+		&tls.Config{
+			GetCertificate: responder.getChallengeCertificate,
+			NextProtos:     []string{ProtocolName},
+		})
+	if err != nil {
+		return nil, err
+	}
+	go responder.serve(listener)
+	return responder, nil
+}
+
+func (r *Responder) cleanup() {
+	r.rwMutex.Lock()
+	r.certificates = make(map[string]*tls.Certificate)
+	r.rwMutex.Unlock()
+}
+
+func (r *Responder) getChallengeCertificate(hello *tls.ClientHelloInfo) (
+	*tls.Certificate, error) {
+	if len(hello.SupportedProtos) != 1 ||
+		hello.SupportedProtos[0] != ProtocolName {
+		return nil, errors.New("not an ACME tls-alpn-01 challenge")
+	}
+	domain := strings.ToLower(strings.TrimSuffix(hello.ServerName, "."))
+	r.rwMutex.RLock()
+	certificate := r.certificates[domain]
+	r.rwMutex.RUnlock()
+	if certificate == nil {
+		r.logger.Debugf(0, "no challenge certificate for: %s\n", domain)
+		return nil, fmt.Errorf("no challenge certificate for: %s", domain)
+	}
+	r.logger.Debugf(1, "serving challenge certificate for: %s\n", domain)
+	return certificate, nil
+}
+
+func (r *Responder) respond(key, value string) error {
+	domain := strings.ToLower(strings.TrimSuffix(key, "."))
+	certificate, err := makeChallengeCertificate(domain, value)
+	if err != nil {
+		return err
+	}
+	r.logger.Debugf(1, "publishing tls-alpn-01 certificate for: %s\n", domain)
+	r.rwMutex.Lock()
+	defer r.rwMutex.Unlock()
+	r.certificates[domain] = certificate
+	return nil
+}
+
+// serve will complete the TLS handshake for each connection and then close
+// the connection, since no data are exchanged for a tls-alpn-01 challenge.
+func (r *Responder) serve(listener net.Listener) {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			r.logger.Println(err)
+			return
+		}
+		go func(conn net.Conn) {
+			defer conn.Close()
+			conn.SetDeadline(time.Now().Add(time.Second * 10))
+			if err := conn.(*tls.Conn).Handshake(); err != nil {
+				r.logger.Debugf(1, "%s: %s\n", conn.RemoteAddr(), err)
+			}
+		}(conn)
+	}
+}
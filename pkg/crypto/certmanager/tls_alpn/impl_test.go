@@ -0,0 +1,79 @@
+package tls_alpn
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/asn1"
+	"testing"
+
+	"github.com/Cloud-Foundations/golib/pkg/log/testlogger"
+)
+
+func TestChallengeCertificate(t *testing.T) {
+	responder, err := New(testlogger.New(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	const keyAuthorisation = "token.thumbprint"
+	if err := responder.Respond("Example.COM", keyAuthorisation); err != nil {
+		t.Fatal(err)
+	}
+	_, err = responder.GetChallengeCertificate(&tls.ClientHelloInfo{
+		ServerName:      "example.com",
+		SupportedProtos: []string{"h2", "http/1.1"},
+	})
+	if err == nil {
+		t.Fatal("expected failure for non-ACME ClientHello")
+	}
+	_, err = responder.GetChallengeCertificate(&tls.ClientHelloInfo{
+		ServerName:      "other.example.com",
+		SupportedProtos: []string{ProtocolName},
+	})
+	if err == nil {
+		t.Fatal("expected failure for unknown server name")
+	}
+	listener, err := tls.Listen("tcp", "localhost:", &tls.Config{
+		GetCertificate: responder.GetChallengeCertificate,
+		NextProtos:     []string{ProtocolName},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go responder.serve(listener)
+	conn, err := tls.Dial("tcp", listener.Addr().String(), &tls.Config{
+		InsecureSkipVerify: true,
+		NextProtos:         []string{ProtocolName},
+		ServerName:         "example.com",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	state := conn.ConnectionState()
+	if state.NegotiatedProtocol != ProtocolName {
+		t.Fatalf("negotiated protocol: \"%s\"", state.NegotiatedProtocol)
+	}
+	leaf := state.PeerCertificates[0]
+	if len(leaf.DNSNames) != 1 || leaf.DNSNames[0] != "example.com" {
+		t.Fatalf("unexpected DNS names: %v", leaf.DNSNames)
+	}
+	expected := sha256.Sum256([]byte(keyAuthorisation))
+	for _, extension := range leaf.Extensions {
+		if !extension.Id.Equal(idPeAcmeIdentifier) {
+			continue
+		}
+		if !extension.Critical {
+			t.Fatal("acmeIdentifier extension not critical")
+		}
+		var digest []byte
+		if _, err := asn1.Unmarshal(extension.Value, &digest); err != nil {
+			t.Fatal(err)
+		}
+		if string(digest) != string(expected[:]) {
+			t.Fatal("acmeIdentifier digest mismatch")
+		}
+		return
+	}
+	t.Fatal("no acmeIdentifier extension")
+}